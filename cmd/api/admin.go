@@ -0,0 +1,102 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"sync/atomic"
+
+	"github.com/cedrickchee/skel/internal/jsonlog"
+	"github.com/cedrickchee/skel/internal/validator"
+)
+
+// adminRoutes returns the handler for the admin listener (-admin-addr). It
+// serves things that are useful to operators but must never be public: the
+// expvar metrics, the pprof profiles, a readiness probe (which, unlike the
+// public one, includes the errors from failing checks) and a way to change
+// the log level without restarting. There's no authentication, so the admin
+// address should only be reachable from the machine itself or a private
+// network.
+//
+// We use a http.ServeMux rather than httprouter here, because the pprof
+// handlers expect to serve everything under /debug/pprof/ themselves.
+func (app *application) adminRoutes() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	mux.HandleFunc("/readyz", app.readyzHandler(true))
+	mux.HandleFunc("/log-level", app.logLevelHandler)
+
+	return app.recoverPanic(mux)
+}
+
+// setReady marks the application as ready, or not ready, to serve requests.
+func (app *application) setReady(ready bool) {
+	var v int32
+	if ready {
+		v = 1
+	}
+	atomic.StoreInt32(&app.ready, v)
+}
+
+// isReady reports whether the application is ready to serve requests.
+func (app *application) isReady() bool {
+	return atomic.LoadInt32(&app.ready) == 1
+}
+
+// logLevelHandler shows the logger's minimum level for GET requests, and
+// changes it for PUT requests with a body like {"level": "error"}.
+func (app *application) logLevelHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var input struct {
+			Level string `json:"level"`
+		}
+
+		err := app.readJSON(w, r, &input)
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+
+		level, err := jsonlog.ParseLevel(input.Level)
+		if err != nil {
+			v := validator.New()
+			v.AddError("level", "must be one of INFO, ERROR, FATAL or OFF")
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		// Log the change while the lower of the two levels is in effect, so
+		// that it's recorded unless INFO entries are off both before and
+		// after.
+		props := map[string]string{
+			"from": app.logger.Level().String(),
+			"to":   level.String(),
+		}
+		if level < app.logger.Level() {
+			app.logger.SetLevel(level)
+			app.loggerFor(r.Context()).PrintInfo("log level changed", props)
+		} else {
+			app.loggerFor(r.Context()).PrintInfo("log level changed", props)
+			app.logger.SetLevel(level)
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		app.methodNotAllowedResponse(w, r)
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"level": app.logger.Level().String()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/cedrickchee/skel/internal/jsonlog"
+)
+
+func TestAdminRoutes(t *testing.T) {
+	app := newTestApplication(t)
+
+	ts := newTestServer(t, app.adminRoutes())
+	defer ts.Close()
+
+	for _, path := range []string{"/debug/vars", "/debug/pprof/", "/debug/pprof/goroutine?debug=1"} {
+		code, _, _ := ts.get(t, path)
+		if code != http.StatusOK {
+			t.Errorf("%s: want %d; got %d", path, http.StatusOK, code)
+		}
+	}
+
+	// The public router doesn't serve any of them.
+	public := newTestServer(t, app.routes())
+	defer public.Close()
+
+	for _, path := range []string{"/debug/vars", "/debug/pprof/"} {
+		code, _, _ := public.get(t, path)
+		if code != http.StatusNotFound {
+			t.Errorf("%s: want %d; got %d", path, http.StatusNotFound, code)
+		}
+	}
+}
+
+func TestReadyHandler(t *testing.T) {
+	app := newTestApplication(t)
+
+	ts := newTestServer(t, app.adminRoutes())
+	defer ts.Close()
+
+	for _, tt := range []struct {
+		ready bool
+		want  int
+	}{
+		{false, http.StatusServiceUnavailable},
+		{true, http.StatusOK},
+		{false, http.StatusServiceUnavailable},
+	} {
+		app.setReady(tt.ready)
+
+		code, _, _ := ts.get(t, "/readyz")
+		if code != tt.want {
+			t.Errorf("ready %v: want %d; got %d", tt.ready, tt.want, code)
+		}
+	}
+}
+
+func TestLogLevelHandler(t *testing.T) {
+	app := newTestApplication(t)
+
+	ts := newTestServer(t, app.adminRoutes())
+	defer ts.Close()
+
+	tests := []struct {
+		method string
+		body   string
+		want   int
+		level  jsonlog.Level
+	}{
+		{http.MethodGet, "", http.StatusOK, jsonlog.LevelInfo},
+		{http.MethodPut, `{"level": "error"}`, http.StatusOK, jsonlog.LevelError},
+		{http.MethodPut, `{"level": "debug"}`, http.StatusUnprocessableEntity, jsonlog.LevelError},
+		{http.MethodPut, `{"level": 1}`, http.StatusBadRequest, jsonlog.LevelError},
+		{http.MethodPut, `{"level": "INFO"}`, http.StatusOK, jsonlog.LevelInfo},
+		{http.MethodDelete, "", http.StatusMethodNotAllowed, jsonlog.LevelInfo},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, ts.URL+"/log-level", strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rs, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		code := rs.StatusCode
+		b, _ := ioutil.ReadAll(rs.Body)
+		rs.Body.Close()
+
+		if code != tt.want {
+			t.Errorf("%s %s: want %d; got %d: %s", tt.method, tt.body, tt.want, code, b)
+		}
+		if got := app.logger.Level(); got != tt.level {
+			t.Errorf("%s %s: want level %s; got %s", tt.method, tt.body, tt.level, got)
+		}
+		if code == http.StatusOK && !strings.Contains(string(b), tt.level.String()) {
+			t.Errorf("%s %s: want level in response; got %s", tt.method, tt.body, b)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/cedrickchee/skel/internal/data"
+)
+
+// authorizeOwner checks whether the user making the request may act on a
+// resource owned by the user with the given ID. It's called by handlers once
+// they've loaded the resource, because the owner isn't known to the
+// requirePermission() middleware.
+//
+// The policy is:
+//
+//   - A user with the permission code (like "movies:write") may act on the
+//     resources they own.
+//   - A user with the permission code followed by ":any" (like
+//     "movies:write:any") may act on every resource, including those with no
+//     owner.
+//
+// Service clients never own anything, so they need the ":any" permission.
+func (app *application) authorizeOwner(r *http.Request, code string, ownerID int64) (bool, error) {
+	if client, ok := app.contextGetPrincipal(r).(*data.ServiceClient); ok {
+		return client.Permissions.Include(code + ":any"), nil
+	}
+
+	user := app.contextGetUser(r)
+
+	if user.IsAnonymous() {
+		return false, nil
+	}
+
+	permissions, err := app.getPermissions(r.Context(), user)
+	if err != nil {
+		return false, err
+	}
+
+	if permissions.Include(code + ":any") {
+		return true, nil
+	}
+
+	// An ownerID of 0 means the resource has no owner, and we must never treat
+	// that as a match.
+	return ownerID != 0 && ownerID == user.ID && permissions.Include(code), nil
+}
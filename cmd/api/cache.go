@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/cedrickchee/skel/internal/data"
+)
+
+// Publish the cache hit and miss counts. These are package-level because
+// expvar panics if the same name is registered twice, and we may create more
+// than one authCache (in tests, for example).
+var authCacheMetrics = expvar.NewMap("auth_cache")
+
+// authCache is an in-process cache of authenticated users and their
+// permissions, keyed by user ID. It saves the authenticate() and
+// requirePermission() middleware from going to the database on every request.
+//
+// Entries expire after a fixed TTL, but anything which changes a user or their
+// permissions should call invalidate() (or purge() if the change may affect
+// many users) so that the change takes effect immediately.
+type authCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[int64]*authCacheEntry
+	// tokens maps the SHA-256 hash of an authentication token to the user it
+	// belongs to. We never keep the plaintext tokens in memory.
+	tokens map[[sha256.Size]byte]authCacheToken
+	// generation is incremented every time an entry is invalidated. Callers
+	// read it before loading data from the database, and the data is only
+	// cached if the generation hasn't changed in the meantime. Otherwise a
+	// slow request could put data back in the cache which was loaded before
+	// the invalidation.
+	generation uint64
+	lastSweep  time.Time
+}
+
+// authCacheToken is a cached authentication token. The token's own expiry is
+// kept with it, since the user's entry can outlive the token.
+type authCacheToken struct {
+	userID int64
+	expiry time.Time
+}
+
+type authCacheEntry struct {
+	user        *data.User
+	permissions data.Permissions
+	tokens      [][sha256.Size]byte
+	expires     time.Time
+}
+
+// newAuthCache returns a new authCache. A TTL of zero or less disables the
+// cache, so that every lookup is a miss.
+func newAuthCache(ttl time.Duration) *authCache {
+	return &authCache{
+		ttl:     ttl,
+		now:     time.Now,
+		entries: make(map[int64]*authCacheEntry),
+		tokens:  make(map[[sha256.Size]byte]authCacheToken),
+	}
+}
+
+// version returns the current cache generation. See the generation field for
+// how this is used.
+func (c *authCache) version() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.generation
+}
+
+// lookup returns the unexpired entry for a user, recording a hit or a miss.
+// The caller must hold the mutex.
+func (c *authCache) lookup(userID int64) (*authCacheEntry, bool) {
+	entry, ok := c.entries[userID]
+	if ok && c.now().After(entry.expires) {
+		c.remove(userID)
+		ok = false
+	}
+
+	if !ok {
+		authCacheMetrics.Add("misses", 1)
+		return nil, false
+	}
+
+	authCacheMetrics.Add("hits", 1)
+	return entry, true
+}
+
+// entry returns the entry for a user, creating it if it doesn't exist. The
+// caller must hold the mutex.
+func (c *authCache) entry(userID int64) *authCacheEntry {
+	now := c.now()
+
+	// Every so often, sweep out all of the expired entries so that users who
+	// stop making requests don't stay in memory forever.
+	if now.Sub(c.lastSweep) > c.ttl {
+		for id, entry := range c.entries {
+			if now.After(entry.expires) {
+				c.remove(id)
+			}
+		}
+		c.lastSweep = now
+	}
+
+	entry, ok := c.entries[userID]
+	if !ok || now.After(entry.expires) {
+		c.remove(userID)
+		entry = &authCacheEntry{expires: now.Add(c.ttl)}
+		c.entries[userID] = entry
+	}
+
+	return entry
+}
+
+// remove deletes the entry for a user along with all of its token mappings.
+// The caller must hold the mutex.
+func (c *authCache) remove(userID int64) {
+	entry, ok := c.entries[userID]
+	if !ok {
+		return
+	}
+
+	for _, hash := range entry.tokens {
+		delete(c.tokens, hash)
+	}
+	delete(c.entries, userID)
+}
+
+// userForToken returns the cached user for an authentication token. A token
+// which has expired is a miss, even if the user's entry hasn't, so that it's
+// refused in the same way as it would be by the database.
+func (c *authCache) userForToken(token string) (*data.User, bool) {
+	if c.ttl <= 0 {
+		return nil, false
+	}
+
+	hash := sha256.Sum256([]byte(token))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached, ok := c.tokens[hash]
+	if ok && !c.now().Before(cached.expiry) {
+		delete(c.tokens, hash)
+		ok = false
+	}
+	if !ok {
+		authCacheMetrics.Add("misses", 1)
+		return nil, false
+	}
+
+	entry, ok := c.lookup(cached.userID)
+	if !ok || entry.user == nil {
+		return nil, false
+	}
+
+	return entry.user, true
+}
+
+// setUser caches the user for an authentication token which expires at
+// expiry, unless the cache has been invalidated since generation was read.
+func (c *authCache) setUser(token string, user *data.User, expiry time.Time, generation uint64) {
+	if c.ttl <= 0 {
+		return
+	}
+
+	hash := sha256.Sum256([]byte(token))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+
+	entry := c.entry(user.ID)
+	entry.user = user
+	if _, ok := c.tokens[hash]; !ok {
+		entry.tokens = append(entry.tokens, hash)
+	}
+	c.tokens[hash] = authCacheToken{userID: user.ID, expiry: expiry}
+}
+
+// permissions returns the cached permissions for a user.
+func (c *authCache) permissions(userID int64) (data.Permissions, bool) {
+	if c.ttl <= 0 {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.lookup(userID)
+	if !ok || entry.permissions == nil {
+		return nil, false
+	}
+
+	return entry.permissions, true
+}
+
+// setPermissions caches the permissions for a user, unless the cache has been
+// invalidated since generation was read.
+func (c *authCache) setPermissions(userID int64, permissions data.Permissions, generation uint64) {
+	if c.ttl <= 0 {
+		return
+	}
+
+	// Store an empty (rather than nil) slice for users with no permissions,
+	// so that we can tell them apart from users whose permissions haven't
+	// been loaded yet.
+	if permissions == nil {
+		permissions = data.Permissions{}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+
+	c.entry(userID).permissions = permissions
+}
+
+// invalidate removes everything cached for a user. Call this whenever the
+// user's record or permissions change.
+func (c *authCache) invalidate(userID int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	c.remove(userID)
+}
+
+// purge removes everything from the cache. Call this when a change may affect
+// many users at once, such as deleting a role.
+func (c *authCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	c.entries = make(map[int64]*authCacheEntry)
+	c.tokens = make(map[[sha256.Size]byte]authCacheToken)
+}
+
+// getPermissions returns the permissions for the user making the request,
+// from the cache if possible and from the database otherwise.
+func (app *application) getPermissions(ctx context.Context, user *data.User) (data.Permissions, error) {
+	permissions, ok := app.cache.permissions(user.ID)
+	if ok {
+		return permissions, nil
+	}
+
+	generation := app.cache.version()
+
+	permissions, err := app.models.Permissions.GetAllForUser(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	app.cache.setPermissions(user.ID, permissions, generation)
+
+	return permissions, nil
+}
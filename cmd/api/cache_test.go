@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cedrickchee/skel/internal/data"
+)
+
+func TestAuthCache(t *testing.T) {
+	now := time.Now()
+
+	cache := newAuthCache(time.Minute)
+	cache.now = func() time.Time { return now }
+
+	user := &data.User{ID: 1, Email: "john@example.com"}
+	token := "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU"
+
+	cache.setUser(token, user, now.Add(time.Hour), cache.version())
+	cache.setPermissions(user.ID, data.Permissions{"movies:read"}, cache.version())
+
+	t.Run("Hit", func(t *testing.T) {
+		got, ok := cache.userForToken(token)
+		if !ok || got != user {
+			t.Fatalf("want cached user; got %v, %v", got, ok)
+		}
+
+		permissions, ok := cache.permissions(user.ID)
+		if !ok || !permissions.Include("movies:read") {
+			t.Fatalf("want cached permissions; got %v, %v", permissions, ok)
+		}
+	})
+
+	t.Run("Unknown token", func(t *testing.T) {
+		if _, ok := cache.userForToken("GBQTA6P3BDRPZVQZAFR2NPMWLU"); ok {
+			t.Fatal("want miss for unknown token")
+		}
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		now = now.Add(2 * time.Minute)
+		defer func() { now = now.Add(-2 * time.Minute) }()
+
+		if _, ok := cache.userForToken(token); ok {
+			t.Fatal("want miss for expired entry")
+		}
+	})
+
+	t.Run("Expired token", func(t *testing.T) {
+		// The token expires long before the user's entry does, and must stop
+		// working when it does.
+		short := "MFRGGZDFMZTWQ2LKNNWG23TPOA"
+		cache.setUser(token, user, now.Add(time.Hour), cache.version())
+		cache.setUser(short, user, now.Add(10*time.Second), cache.version())
+
+		if _, ok := cache.userForToken(short); !ok {
+			t.Fatal("want hit before the token expires")
+		}
+
+		now = now.Add(10 * time.Second)
+		defer func() { now = now.Add(-10 * time.Second) }()
+
+		if _, ok := cache.userForToken(short); ok {
+			t.Fatal("want miss for expired token")
+		}
+		if _, ok := cache.userForToken(token); !ok {
+			t.Fatal("want hit for the user's other token")
+		}
+	})
+
+	t.Run("Stale write", func(t *testing.T) {
+		// Simulate a request which read the generation, then had its
+		// permissions revoked while it was loading them from the database.
+		generation := cache.version()
+		cache.invalidate(user.ID)
+		cache.setPermissions(user.ID, data.Permissions{"movies:read"}, generation)
+
+		if _, ok := cache.permissions(user.ID); ok {
+			t.Fatal("want stale permissions to be discarded")
+		}
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		disabled := newAuthCache(0)
+		disabled.setUser(token, user, now.Add(time.Hour), disabled.version())
+
+		if _, ok := disabled.userForToken(token); ok {
+			t.Fatal("want miss when cache is disabled")
+		}
+	})
+}
+
+// stubPermissionModel is a PermissionModel whose permissions can be changed
+// during a test. It also counts how many times it has been queried.
+type stubPermissionModel struct {
+	mu          sync.Mutex
+	permissions map[int64]data.Permissions
+	calls       int
+}
+
+func (m *stubPermissionModel) GetAllForUser(ctx context.Context, userID int64) (data.Permissions, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.calls++
+	return m.permissions[userID], nil
+}
+
+func (m *stubPermissionModel) AddForUser(ctx context.Context, userID int64, codes ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.permissions[userID] = append(m.permissions[userID], codes...)
+	return nil
+}
+
+func (m *stubPermissionModel) revoke(userID int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.permissions[userID] = nil
+}
+
+func TestPermissionRevokedWithLiveToken(t *testing.T) {
+	app := newTestApplication(t)
+
+	permissions := &stubPermissionModel{permissions: map[int64]data.Permissions{
+		1: {"movies:read"},
+		3: {"movies:read", "roles:read", "roles:write"},
+	}}
+	app.models.Permissions = permissions
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	userToken := newTestToken(t, app, "john@example.com")
+	adminToken := newTestToken(t, app, "jane@example.com")
+
+	// The first request loads the permissions from the model, and the second
+	// should be served from the cache.
+	for i := 0; i < 2; i++ {
+		code, _, _ := ts.authenticatedGet(t, userToken, "/v1/movies/1")
+		if code != http.StatusOK {
+			t.Fatalf("want %d; got %d", http.StatusOK, code)
+		}
+	}
+	if permissions.calls != 1 {
+		t.Fatalf("want permissions to be loaded once; got %d", permissions.calls)
+	}
+
+	// Revoke the user's permissions in the "database". Until the cache is
+	// invalidated, the user can still use their token as before.
+	permissions.revoke(1)
+
+	code, _, _ := ts.authenticatedGet(t, userToken, "/v1/movies/1")
+	if code != http.StatusOK {
+		t.Fatalf("want %d before invalidation; got %d", http.StatusOK, code)
+	}
+
+	// Removing the role through the API invalidates the user's cache entry, so
+	// their very next request must be refused even though the token is still
+	// live.
+	code, _, _ = ts.authenticatedRequest(t, adminToken, http.MethodDelete, "/v1/roles/viewer/users/1", nil)
+	if code != http.StatusOK {
+		t.Fatalf("want %d removing role; got %d", http.StatusOK, code)
+	}
+
+	code, _, _ = ts.authenticatedGet(t, userToken, "/v1/movies/1")
+	if code != http.StatusForbidden {
+		t.Fatalf("want %d after revocation; got %d", http.StatusForbidden, code)
+	}
+}
+
+/*
+Run:
+
+$ go test -v -run "^Test(AuthCache|PermissionRevokedWithLiveToken)$" github.com/cedrickchee/skel/cmd/api
+*/
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies is the list of networks containing the reverse proxies (like
+// Caddy or a cloud load balancer) which we trust to tell us the client's IP
+// address in the X-Forwarded-For and X-Real-IP headers.
+type trustedProxies []*net.IPNet
+
+// parseTrustedProxies parses a space separated list of IP addresses and CIDR
+// ranges, like "10.0.0.0/8 127.0.0.1".
+func parseTrustedProxies(val string) (trustedProxies, error) {
+	var proxies trustedProxies
+
+	for _, field := range strings.Fields(val) {
+		// Treat a bare IP address as a network containing just that address.
+		if !strings.Contains(field, "/") {
+			ip := net.ParseIP(field)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", field)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", field)
+		}
+		proxies = append(proxies, network)
+	}
+
+	return proxies, nil
+}
+
+// contains reports whether ip is one of the trusted proxies.
+func (p trustedProxies) contains(ip net.IP) bool {
+	for _, network := range p {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP works out the IP address of the client that made the request.
+//
+// The forwarding headers are trivial to forge, so we only believe them when
+// the request came directly from a trusted proxy. Each proxy appends the
+// address it received the request from to X-Forwarded-For, so we walk the
+// list from right to left, skipping over our own proxies, and the first
+// address that isn't one of them is the client. Anything to the left of that
+// was supplied by the client and can't be trusted.
+func (p trustedProxies) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	peer := net.ParseIP(host)
+	if peer == nil || !p.contains(peer) {
+		return host
+	}
+
+	// Headers may be repeated, in which case they are read in order as if
+	// they were a single comma-separated list.
+	var hops []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(value, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+
+	if len(hops) == 0 {
+		if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+			return ip.String()
+		}
+		return peer.String()
+	}
+
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hops[i])
+		if ip == nil {
+			// If we find garbage, the best we can do is the last address
+			// that a trusted proxy gave us.
+			break
+		}
+
+		client = ip
+		if !p.contains(ip) {
+			break
+		}
+	}
+
+	return client.String()
+}
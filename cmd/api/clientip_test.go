@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	proxies, err := parseTrustedProxies("127.0.0.1 10.0.0.0/8  ::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(proxies) != 3 {
+		t.Fatalf("want 3 proxies; got %d", len(proxies))
+	}
+	if got := proxies[0].String(); got != "127.0.0.1/32" {
+		t.Errorf("want 127.0.0.1/32; got %s", got)
+	}
+	if got := proxies[2].String(); got != "::1/128" {
+		t.Errorf("want ::1/128; got %s", got)
+	}
+
+	for _, val := range []string{"localhost", "10.0.0.0/33", "10.0.0"} {
+		if _, err := parseTrustedProxies(val); err == nil {
+			t.Errorf("want error for %q", val)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/8 192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        []string
+		xRealIP    string
+		want       string
+	}{
+		{"No proxy", "203.0.113.7:1234", nil, "", "203.0.113.7"},
+		{"Untrusted peer spoofing", "203.0.113.7:1234", []string{"1.2.3.4"}, "5.6.7.8", "203.0.113.7"},
+		{"Trusted peer", "10.0.0.1:1234", []string{"203.0.113.7"}, "", "203.0.113.7"},
+		{"Trusted peer without headers", "10.0.0.1:1234", nil, "", "10.0.0.1"},
+		{"Client prepends address", "10.0.0.1:1234", []string{"1.2.3.4, 203.0.113.7"}, "", "203.0.113.7"},
+		{"Chain of proxies", "10.0.0.1:1234", []string{"1.2.3.4, 203.0.113.7, 192.168.1.1", "10.1.2.3"}, "", "203.0.113.7"},
+		{"Only proxies", "10.0.0.1:1234", []string{"10.0.0.2, 10.0.0.3"}, "", "10.0.0.2"},
+		{"Garbage", "10.0.0.1:1234", []string{"1.2.3.4, garbage, 10.0.0.2"}, "", "10.0.0.2"},
+		{"IPv6", "10.0.0.1:1234", []string{" 2001:db8::1 "}, "", "2001:db8::1"},
+		{"X-Real-IP", "192.168.1.1:1234", nil, "203.0.113.7", "203.0.113.7"},
+		{"Invalid X-Real-IP", "192.168.1.1:1234", nil, "garbage", "192.168.1.1"},
+		{"X-Forwarded-For wins", "192.168.1.1:1234", []string{"203.0.113.7"}, "1.2.3.4", "203.0.113.7"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if tt.xRealIP != "" {
+				r.Header.Set("X-Real-IP", tt.xRealIP)
+			}
+
+			if got := proxies.clientIP(r); got != tt.want {
+				t.Errorf("want %s; got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+// TestRateLimitClientIP checks that clients can't get a fresh bucket by
+// sending a different X-Forwarded-For header with each request, unless they
+// come through a trusted proxy.
+func TestRateLimitClientIP(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.limiter.enabled = true
+	app.config.limiter.rps = 0.001
+	app.config.limiter.burst = 1
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	get := func(xff string) int {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/v1/healthcheck", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Forwarded-For", xff)
+
+		rs, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rs.Body.Close()
+
+		return rs.StatusCode
+	}
+
+	// The test server isn't a trusted proxy, so the header is ignored.
+	if code := get("1.1.1.1"); code != http.StatusOK {
+		t.Fatalf("want %d; got %d", http.StatusOK, code)
+	}
+	if code := get("2.2.2.2"); code != http.StatusTooManyRequests {
+		t.Fatalf("want %d; got %d", http.StatusTooManyRequests, code)
+	}
+
+	// Once it is, each forwarded address has a bucket of its own.
+	app.config.trustedProxies, _ = parseTrustedProxies("127.0.0.1 ::1")
+
+	if code := get("3.3.3.3"); code != http.StatusOK {
+		t.Fatalf("want %d; got %d", http.StatusOK, code)
+	}
+	if code := get("3.3.3.3"); code != http.StatusTooManyRequests {
+		t.Fatalf("want %d; got %d", http.StatusTooManyRequests, code)
+	}
+}
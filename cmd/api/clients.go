@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/cedrickchee/skel/internal/data"
+	"github.com/cedrickchee/skel/internal/validator"
+)
+
+// createClientHandler registers a new service client with the given
+// permissions. The client can't do anything until an API key has been created
+// for it with createClientKeyHandler.
+func (app *application) createClientHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name        string   `json:"name"`
+		Permissions []string `json:"permissions"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	client := &data.ServiceClient{
+		Name:        input.Name,
+		Permissions: input.Permissions,
+	}
+
+	v := validator.New()
+
+	if data.ValidateServiceClient(v, client); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Clients.Insert(r.Context(), client)
+	if err != nil {
+		var cErr *data.ConstraintError
+		switch {
+		case errors.Is(err, data.ErrDuplicateClient):
+			v.AddError("name", "a client with this name already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrUnknownPermission):
+			v.AddError("permissions", "must only contain existing permission codes")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.As(err, &cErr):
+			app.constraintViolationResponse(w, r, cErr)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/clients/%d", client.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"client": client}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createClientKeyHandler issues a new API key for a service client. The
+// plaintext key is only included in this response, so the caller must store
+// it straight away.
+func (app *application) createClientKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	key, err := app.models.Clients.NewKey(r.Context(), id)
+	if err != nil {
+		var cErr *data.ConstraintError
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.As(err, &cErr):
+			app.constraintViolationResponse(w, r, cErr)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"api_key": key}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteClientKeyHandler revokes one of a service client's API keys, given its
+// prefix.
+func (app *application) deleteClientKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Clients.DeleteKey(r.Context(), id, app.readStringParam(r, "prefix"))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "API key successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// mockAPIKey is the plaintext API key of the mock "ingest" service client,
+// which has the movies:read and movies:write permissions.
+const mockAPIKey = "skel_AAAQEAYE_AAAQEAYEAUDAOCAJBIFQYDIOB4IBCEQT"
+
+func TestAPIKeyAuthentication(t *testing.T) {
+	app := newTestApplication(t)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	userToken := newTestToken(t, app, "john@example.com")
+
+	tests := []struct {
+		name     string
+		method   string
+		urlPath  string
+		headers  map[string]string
+		wantCode int
+	}{
+		{
+			name:     "X-API-Key header",
+			method:   http.MethodGet,
+			urlPath:  "/v1/movies/1",
+			headers:  map[string]string{"X-API-Key": mockAPIKey},
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "ApiKey scheme",
+			method:   http.MethodGet,
+			urlPath:  "/v1/movies/1",
+			headers:  map[string]string{"Authorization": "ApiKey " + mockAPIKey},
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "Unknown key",
+			method:   http.MethodGet,
+			urlPath:  "/v1/movies/1",
+			headers:  map[string]string{"X-API-Key": "skel_AAAQEAYE_BBBQEAYEAUDAOCAJBIFQYDIOB4IBCEQT"},
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "Malformed key",
+			method:   http.MethodGet,
+			urlPath:  "/v1/movies/1",
+			headers:  map[string]string{"X-API-Key": "not-a-key"},
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:    "Key and token",
+			method:  http.MethodGet,
+			urlPath: "/v1/movies/1",
+			headers: map[string]string{
+				"X-API-Key":     mockAPIKey,
+				"Authorization": "Bearer " + userToken.Plaintext,
+			},
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "Missing permission",
+			method:   http.MethodGet,
+			urlPath:  "/v1/roles",
+			headers:  map[string]string{"X-API-Key": mockAPIKey},
+			wantCode: http.StatusForbidden,
+		},
+		{
+			// The client has movies:write but not movies:write:any, and it
+			// can't own the movie, so it mustn't be allowed to change it.
+			name:     "Movie owned by a user",
+			method:   http.MethodDelete,
+			urlPath:  "/v1/movies/1",
+			headers:  map[string]string{"X-API-Key": mockAPIKey},
+			wantCode: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, ts.URL+tt.urlPath, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+
+			rs, err := ts.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rs.Body.Close()
+
+			if rs.StatusCode != tt.wantCode {
+				t.Errorf("want %d; got %d", tt.wantCode, rs.StatusCode)
+			}
+		})
+	}
+}
+
+func TestCreateClientHandler(t *testing.T) {
+	app := newTestApplication(t)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	tests := []struct {
+		name     string
+		email    string
+		body     string
+		wantCode int
+	}{
+		{"Valid", "jane@example.com", `{"name": "importer", "permissions": ["movies:write"]}`, http.StatusCreated},
+		{"Duplicate name", "jane@example.com", `{"name": "ingest", "permissions": []}`, http.StatusUnprocessableEntity},
+		{"Missing permissions", "jane@example.com", `{"name": "importer"}`, http.StatusUnprocessableEntity},
+		{"Not an admin", "ed@example.com", `{"name": "importer", "permissions": []}`, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := newTestToken(t, app, tt.email)
+
+			code, _, _ := ts.authenticatedRequest(t, token, http.MethodPost, "/v1/clients", strings.NewReader(tt.body))
+			if code != tt.wantCode {
+				t.Errorf("want %d; got %d", tt.wantCode, code)
+			}
+		})
+	}
+}
+
+func TestClientKeyHandlers(t *testing.T) {
+	app := newTestApplication(t)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	token := newTestToken(t, app, "jane@example.com")
+
+	t.Run("Create", func(t *testing.T) {
+		code, _, body := ts.authenticatedRequest(t, token, http.MethodPost, "/v1/clients/1/keys", nil)
+		if code != http.StatusCreated {
+			t.Fatalf("want %d; got %d", http.StatusCreated, code)
+		}
+
+		var got struct {
+			APIKey struct {
+				Prefix string `json:"prefix"`
+				Key    string `json:"key"`
+			} `json:"api_key"`
+		}
+		err := json.NewDecoder(body).Decode(&got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(got.APIKey.Key, "skel_"+got.APIKey.Prefix+"_") {
+			t.Errorf("want key to start with its prefix; got %q", got.APIKey.Key)
+		}
+	})
+
+	t.Run("Create for unknown client", func(t *testing.T) {
+		code, _, _ := ts.authenticatedRequest(t, token, http.MethodPost, "/v1/clients/99/keys", nil)
+		if code != http.StatusNotFound {
+			t.Errorf("want %d; got %d", http.StatusNotFound, code)
+		}
+	})
+
+	t.Run("Revoke", func(t *testing.T) {
+		code, _, _ := ts.authenticatedRequest(t, token, http.MethodDelete, "/v1/clients/1/keys/AAAQEAYE", nil)
+		if code != http.StatusOK {
+			t.Errorf("want %d; got %d", http.StatusOK, code)
+		}
+	})
+
+	t.Run("Revoke unknown key", func(t *testing.T) {
+		code, _, _ := ts.authenticatedRequest(t, token, http.MethodDelete, "/v1/clients/1/keys/ZZZZZZZZ", nil)
+		if code != http.StatusNotFound {
+			t.Errorf("want %d; got %d", http.StatusNotFound, code)
+		}
+	})
+}
+
+/*
+Run:
+
+$ go test -v -run "^Test(APIKeyAuthentication|CreateClientHandler|ClientKeyHandlers)$" github.com/cedrickchee/skel/cmd/api
+*/
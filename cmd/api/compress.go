@@ -0,0 +1,316 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/felixge/httpsnoop"
+)
+
+// compress compresses response bodies with gzip or deflate, whichever the
+// client prefers according to its Accept-Encoding header. Small responses
+// aren't worth compressing, so the body is buffered until it reaches
+// -compress-min-size bytes, and only then do we decide whether to compress
+// it. Responses whose content type is already compressed (like images) are
+// sent as they are.
+//
+// The response writer is wrapped with httpsnoop.Wrap(), like the metrics()
+// middleware does, so that it still supports the same optional interfaces
+// (http.Flusher, http.Hijacker and so on) as the writer it wraps.
+func (app *application) compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.config.compress.enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Whether or not we compress this response, a different
+		// Accept-Encoding header could have changed the answer, so caches
+		// need to know.
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{
+			w:        w,
+			encoding: encoding,
+			minSize:  app.config.compress.minSize,
+		}
+		defer cw.close()
+
+		next.ServeHTTP(cw.wrap(), r)
+	})
+}
+
+// negotiateEncoding returns "gzip" or "deflate", whichever the Accept-Encoding
+// header value gives the higher quality value, or "" if it accepts neither.
+// Ties go to gzip, which is the more widely supported of the two.
+func negotiateEncoding(accept string) string {
+	q := map[string]float64{}
+
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		if coding == "" {
+			continue
+		}
+
+		quality := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				v, err := strconv.ParseFloat(param[2:], 64)
+				if err == nil {
+					quality = v
+				}
+			}
+		}
+
+		q[coding] = quality
+	}
+
+	// "*" stands for any coding that isn't listed explicitly.
+	for _, coding := range []string{"gzip", "deflate"} {
+		if _, ok := q[coding]; !ok {
+			if v, ok := q["*"]; ok {
+				q[coding] = v
+			}
+		}
+	}
+
+	switch {
+	case q["gzip"] > 0 && q["gzip"] >= q["deflate"]:
+		return "gzip"
+	case q["deflate"] > 0:
+		return "deflate"
+	default:
+		return ""
+	}
+}
+
+// incompressibleTypes are the content types which are already compressed, so
+// compressing them again would only waste CPU. A type matches if it starts
+// with one of these.
+var incompressibleTypes = []string{
+	"image/",
+	"video/",
+	"audio/",
+	"font/woff",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/x-bzip2",
+	"application/x-7z-compressed",
+	"application/x-rar-compressed",
+	"application/zstd",
+}
+
+// compressible reports whether a response with the given Content-Type is
+// worth compressing. SVG images are text, so they are the exception to the
+// rule for "image/".
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = contentType
+	}
+
+	if mediaType == "image/svg+xml" {
+		return true
+	}
+
+	for _, prefix := range incompressibleTypes {
+		if strings.HasPrefix(mediaType, prefix) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// The gzip and zlib writers allocate a lot of memory, so we reuse them. Note
+// that the HTTP "deflate" coding is the zlib format (RFC 9110, section
+// 8.4.1.2), not a raw DEFLATE stream, which is what compress/flate writes.
+var (
+	gzipWriters = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+	zlibWriters = sync.Pool{New: func() interface{} { return zlib.NewWriter(nil) }}
+)
+
+// compressWriter buffers the start of a response body until it knows whether
+// to compress it, and then compresses the rest on the fly.
+type compressWriter struct {
+	w        http.ResponseWriter
+	encoding string
+	minSize  int
+
+	status  int
+	buf     []byte
+	decided bool
+	// zw is the gzip or zlib writer, if we decided to compress.
+	zw interface {
+		io.WriteCloser
+		Flush() error
+		Reset(io.Writer)
+	}
+}
+
+// wrap returns the http.ResponseWriter to pass to the next handler.
+func (cw *compressWriter) wrap() http.ResponseWriter {
+	return httpsnoop.Wrap(cw.w, httpsnoop.Hooks{
+		WriteHeader: func(httpsnoop.WriteHeaderFunc) httpsnoop.WriteHeaderFunc {
+			return cw.writeHeader
+		},
+		Write: func(httpsnoop.WriteFunc) httpsnoop.WriteFunc {
+			return cw.write
+		},
+		Flush: func(httpsnoop.FlushFunc) httpsnoop.FlushFunc {
+			return cw.flush
+		},
+		// Don't let io.Copy() use the underlying writer's ReadFrom() method,
+		// which would bypass the compression.
+		ReadFrom: func(httpsnoop.ReadFromFunc) httpsnoop.ReadFromFunc {
+			return func(src io.Reader) (int64, error) {
+				return io.Copy(writerFunc(cw.write), src)
+			}
+		},
+	})
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(b []byte) (int, error) { return f(b) }
+
+// writeHeader records the status code, but doesn't send it until we've
+// decided whether to compress, because compressing changes the headers.
+func (cw *compressWriter) writeHeader(code int) {
+	if cw.status != 0 {
+		return
+	}
+	cw.status = code
+
+	// Responses with these codes don't have a body, so there's nothing to
+	// decide.
+	if code == http.StatusNoContent || code == http.StatusNotModified || code < 200 {
+		cw.decide(false)
+	}
+}
+
+func (cw *compressWriter) write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.writeHeader(http.StatusOK)
+	}
+
+	if !cw.decided {
+		cw.buf = append(cw.buf, b...)
+		if len(cw.buf) >= cw.minSize {
+			err := cw.decide(true)
+			if err != nil {
+				return 0, err
+			}
+		}
+		return len(b), nil
+	}
+
+	if cw.zw != nil {
+		return cw.zw.Write(b)
+	}
+	return cw.w.Write(b)
+}
+
+// decide sends the headers, compressing the response if it's allowed to and
+// is worth it, and then writes out anything that has been buffered.
+func (cw *compressWriter) decide(allowed bool) error {
+	cw.decided = true
+
+	h := cw.w.Header()
+
+	if h.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+
+	if allowed && len(cw.buf) >= cw.minSize && h.Get("Content-Encoding") == "" && compressible(h.Get("Content-Type")) {
+		h.Set("Content-Encoding", cw.encoding)
+		h.Del("Content-Length")
+
+		switch cw.encoding {
+		case "gzip":
+			gw := gzipWriters.Get().(*gzip.Writer)
+			gw.Reset(cw.w)
+			cw.zw = gw
+		case "deflate":
+			zw := zlibWriters.Get().(*zlib.Writer)
+			zw.Reset(cw.w)
+			cw.zw = zw
+		}
+	}
+
+	if cw.status != 0 {
+		cw.w.WriteHeader(cw.status)
+	}
+
+	if len(cw.buf) == 0 {
+		return nil
+	}
+
+	var err error
+	if cw.zw != nil {
+		_, err = cw.zw.Write(cw.buf)
+	} else {
+		_, err = cw.w.Write(cw.buf)
+	}
+	cw.buf = nil
+
+	return err
+}
+
+// flush sends whatever has been written so far. If we haven't decided whether
+// to compress yet, we have to decide now, based on what we have.
+func (cw *compressWriter) flush() {
+	if !cw.decided && cw.status != 0 {
+		cw.decide(true)
+	}
+	if cw.zw != nil {
+		cw.zw.Flush()
+	}
+	if f, ok := cw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// close finishes the response once the handler has returned: it sends a
+// short response that never reached the minimum size, or writes the end of
+// the compressed stream.
+func (cw *compressWriter) close() {
+	if !cw.decided {
+		if cw.status == 0 {
+			// The handler didn't write anything, so leave it to net/http to
+			// send the default response.
+			return
+		}
+		cw.decide(false)
+	}
+
+	if cw.zw == nil {
+		return
+	}
+
+	cw.zw.Close()
+
+	switch zw := cw.zw.(type) {
+	case *gzip.Writer:
+		gzipWriters.Put(zw)
+	case *zlib.Writer:
+		zlibWriters.Put(zw)
+	}
+	cw.zw = nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"deflate", "deflate"},
+		{"gzip, deflate, br", "gzip"},
+		{"deflate, gzip", "gzip"},
+		{"gzip;q=0.5, deflate", "deflate"},
+		{"gzip;q=0, deflate;q=0", ""},
+		{"GZIP", "gzip"},
+		{"br", ""},
+		{"*", "gzip"},
+		{"*;q=0.1, gzip;q=0", "deflate"},
+		{"identity", ""},
+	}
+
+	for _, tt := range tests {
+		if got := negotiateEncoding(tt.accept); got != tt.want {
+			t.Errorf("negotiateEncoding(%q) = %q; want %q", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.compress.enabled = true
+	app.config.compress.minSize = 100
+
+	large := strings.Repeat(`{"title": "Moana"}`, 100)
+
+	tests := []struct {
+		name         string
+		method       string
+		accept       string
+		contentType  string
+		body         string
+		wantEncoding string
+	}{
+		{"gzip", http.MethodGet, "gzip, deflate", "application/json", large, "gzip"},
+		{"deflate", http.MethodGet, "deflate", "application/json", large, "deflate"},
+		{"Not accepted", http.MethodGet, "gzip;q=0", "application/json", large, ""},
+		{"No header", http.MethodGet, "", "application/json", large, ""},
+		{"Below minimum size", http.MethodGet, "gzip", "application/json", `{"title": "Moana"}`, ""},
+		{"Already compressed", http.MethodGet, "gzip", "image/png", large, ""},
+		{"SVG", http.MethodGet, "gzip", "image/svg+xml", large, "gzip"},
+		{"HEAD", http.MethodHead, "gzip", "application/json", large, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.Header().Set("Content-Length", "999")
+				w.WriteHeader(http.StatusTeapot)
+				// Write in small pieces, so that the body crosses the minimum
+				// size part way through.
+				for i := 0; i < len(tt.body); i += 50 {
+					end := i + 50
+					if end > len(tt.body) {
+						end = len(tt.body)
+					}
+					w.Write([]byte(tt.body[i:end]))
+				}
+			})
+
+			rr := httptest.NewRecorder()
+			r := httptest.NewRequest(tt.method, "/", nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept-Encoding", tt.accept)
+			}
+
+			app.compress(next).ServeHTTP(rr, r)
+
+			rs := rr.Result()
+
+			if rs.StatusCode != http.StatusTeapot {
+				t.Errorf("want status %d; got %d", http.StatusTeapot, rs.StatusCode)
+			}
+			if got := rs.Header.Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Fatalf("want Content-Encoding %q; got %q", tt.wantEncoding, got)
+			}
+			if got := rs.Header.Values("Vary"); len(got) != 1 || got[0] != "Accept-Encoding" {
+				t.Errorf("want Vary [Accept-Encoding]; got %q", got)
+			}
+
+			var body io.Reader = rs.Body
+			switch tt.wantEncoding {
+			case "gzip":
+				zr, err := gzip.NewReader(rs.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = zr
+			case "deflate":
+				zr, err := zlib.NewReader(rs.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = zr
+			}
+
+			if tt.wantEncoding != "" && rs.Header.Get("Content-Length") != "" {
+				t.Errorf("want no Content-Length; got %q", rs.Header.Get("Content-Length"))
+			}
+
+			b, err := ioutil.ReadAll(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.body {
+				t.Errorf("body was changed: got %d bytes; want %d", len(b), len(tt.body))
+			}
+		})
+	}
+}
+
+func TestCompressDisabled(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.compress.enabled = false
+
+	large := strings.Repeat(`{"title": "Moana"}`, 100)
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(large))
+	})
+
+	rr := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+
+	app.compress(next).ServeHTTP(rr, r)
+
+	if got := rr.Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("want no Content-Encoding; got %q", got)
+	}
+	// The response is the same whatever the Accept-Encoding header says, so
+	// it mustn't split caches on it.
+	if got := rr.Header().Values("Vary"); len(got) != 0 {
+		t.Errorf("want no Vary; got %q", got)
+	}
+	if rr.Body.String() != large {
+		t.Errorf("body was changed: got %d bytes; want %d", rr.Body.Len(), len(large))
+	}
+}
+
+func TestCompressNoContent(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.compress.enabled = true
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	rr := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+
+	app.compress(next).ServeHTTP(rr, r)
+
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("want status %d; got %d", http.StatusNoContent, rr.Code)
+	}
+	if got := rr.Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("want no Content-Encoding; got %q", got)
+	}
+	if rr.Body.Len() != 0 {
+		t.Errorf("want empty body; got %q", rr.Body)
+	}
+}
+
+// TestCompressRoutes checks the middleware in place, with the CORS and
+// authentication middleware adding their own Vary headers and the metrics
+// middleware wrapping it.
+func TestCompressRoutes(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.compress.enabled = true
+	app.config.compress.minSize = 10
+	app.config.cors.policy.Origins = []string{"https://example.com"}
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	jane := newTestToken(t, app, "jane@example.com")
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/v1/movies/1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+jane.Plaintext)
+	req.Header.Set("Origin", "https://example.com")
+	// Setting the header ourselves stops the client from decompressing the
+	// response behind our back.
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	rs, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Body.Close()
+
+	if rs.StatusCode != http.StatusOK {
+		t.Fatalf("want %d; got %d", http.StatusOK, rs.StatusCode)
+	}
+	if got := rs.Header.Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("want Content-Encoding gzip; got %q", got)
+	}
+
+	vary := strings.Join(rs.Header.Values("Vary"), ", ")
+	for _, want := range []string{"Accept-Encoding", "Origin", "Authorization"} {
+		if !strings.Contains(vary, want) {
+			t.Errorf("want %q in Vary; got %q", want, vary)
+		}
+	}
+
+	zr, err := gzip.NewReader(rs.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(b, []byte(`"movie"`)) {
+		t.Errorf("unexpected body %q", b)
+	}
+
+	// The metrics middleware still sees the status code.
+	code, _, body := ts.authenticatedGet(t, jane, "/metrics")
+	if code != http.StatusOK {
+		t.Fatalf("want %d; got %d", http.StatusOK, code)
+	}
+	b, err = ioutil.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `http_requests_total{method="GET",route="/v1/movies/:id",status="200"} 1`
+	if !strings.Contains(string(b), want+"\n") {
+		t.Errorf("want %q in metrics:\n%s", want, b)
+	}
+}
@@ -13,17 +13,46 @@ import (
 // information.
 type contextKey string
 
-// Convert the string "user" to a contextKey type and assign it to the
-// userContextKey constant. We'll use this constant as the key for getting and
-// setting user information in the request context.
-const userContextKey = contextKey("user")
+// Convert the string "principal" to a contextKey type and assign it to the
+// principalContextKey constant. We'll use this constant as the key for getting
+// and setting the principal (the user or service client making the request)
+// in the request context.
+const principalContextKey = contextKey("principal")
+
+// routeMatchContextKey is the key for the routeMatch which the metrics()
+// middleware uses to find out which route handled the request.
+const routeMatchContextKey = contextKey("routeMatch")
+
+// clientIPContextKey is the key for the client's IP address, which the realIP()
+// middleware works out once for each request.
+const clientIPContextKey = contextKey("clientIP")
+
+// contextSetPrincipal method returns a new copy of the request with the
+// provided principal added to the context. The principal is also given to the
+// data package, so that the movie model can send their reads to the primary
+// database just after they've changed something.
+func (app *application) contextSetPrincipal(r *http.Request, principal data.Principal) *http.Request {
+	ctx := context.WithValue(r.Context(), principalContextKey, principal)
+	ctx = data.ContextWithPrincipal(ctx, principal)
+	return r.WithContext(ctx)
+}
+
+// contextGetPrincipal method retrieves the principal from the request context.
+// Like contextGetUser(), it panics if there isn't one, because the
+// authenticate() middleware always sets it.
+func (app *application) contextGetPrincipal(r *http.Request) data.Principal {
+	principal, ok := r.Context().Value(principalContextKey).(data.Principal)
+	if !ok {
+		panic("missing principal value in request context")
+	}
+
+	return principal
+}
 
 // contextSetUser method returns a new copy of the request with the provided
-// User struct added to the context. Note that we use our userContextKey
-// constant as the key.
+// User struct added to the context as the principal.
 func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
-	ctx := context.WithValue(r.Context(), userContextKey, user)
-	return r.WithContext(ctx)
+	return app.contextSetPrincipal(r, user)
 }
 
 // contextGetUser method retrieves the User struct from the request context. The
@@ -31,11 +60,60 @@ func (app *application) contextSetUser(r *http.Request, user *data.User) *http.R
 // User struct value in the context, and if it doesn't exist it will firmly be
 // an 'unexpected' error. As we discussed earlier in the book, it's OK to panic
 // in those circumstances.
+//
+// If the request was made by a service client rather than a user, this
+// returns the AnonymousUser, so that handlers which only care about users
+// never mistake a client for one.
 func (app *application) contextGetUser(r *http.Request) *data.User {
-	user, ok := r.Context().Value(userContextKey).(*data.User)
+	switch principal := app.contextGetPrincipal(r).(type) {
+	case *data.User:
+		return principal
+	default:
+		return data.AnonymousUser
+	}
+}
+
+// contextSetClientIP method returns a new copy of the request with the
+// provided client IP address added to the context.
+func (app *application) contextSetClientIP(r *http.Request, ip string) *http.Request {
+	ctx := context.WithValue(r.Context(), clientIPContextKey, ip)
+	return r.WithContext(ctx)
+}
+
+// clientIP returns the IP address of the client that made the request. It
+// doesn't panic if the realIP() middleware hasn't run, but falls back to
+// working the address out from the request itself.
+func (app *application) clientIP(r *http.Request) string {
+	ip, ok := r.Context().Value(clientIPContextKey).(string)
 	if !ok {
-		panic("missing user value in request context")
+		return app.config.trustedProxies.clientIP(r)
 	}
 
-	return user
+	return ip
+}
+
+// routeMatch records the pattern of the route which handled a request, like
+// "/v1/movies/:id". It's a pointer in the context, rather than a value, so
+// that the route's handler can fill it in for middleware further out to read.
+type routeMatch struct {
+	pattern string
+}
+
+// contextSetRouteMatch method returns a new copy of the request with the
+// provided routeMatch added to the context.
+func (app *application) contextSetRouteMatch(r *http.Request, match *routeMatch) *http.Request {
+	ctx := context.WithValue(r.Context(), routeMatchContextKey, match)
+	return r.WithContext(ctx)
+}
+
+// route wraps a route's handler so that it records the route's pattern in the
+// request's routeMatch, if there is one.
+func (app *application) route(pattern string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if match, ok := r.Context().Value(routeMatchContextKey).(*routeMatch); ok {
+			match.pattern = pattern
+		}
+
+		next(w, r)
+	}
 }
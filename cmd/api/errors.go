@@ -1,17 +1,21 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+
+	"github.com/cedrickchee/skel/internal/data"
 )
 
 // The logError() method is a generic helper for logging an error message. Later
 // we'll upgrade this to use structured logging, and record additional
 // information about the request including the HTTP method and URL.
 func (app *application) logError(r *http.Request, err error) {
-	app.logger.PrintError(err, map[string]string{
+	app.loggerFor(r.Context()).PrintError(err, map[string]string{
 		"request_method": r.Method,
 		"request_url":    r.URL.String(),
+		"ip_addr":        app.clientIP(r),
 	})
 }
 
@@ -79,6 +83,35 @@ func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Requ
 	app.errorResponse(w, r, http.StatusConflict, message)
 }
 
+// constraintViolationResponse reports a change which the database refused
+// because it would break one of its constraints. A unique violation means the
+// request clashes with a record which already exists, so it gets a 409
+// Conflict. Any other violation means something in the request is wrong, so
+// it gets a 422 Unprocessable Entity. When we know which field was at fault,
+// the message is keyed by it, like a failed validation.
+func (app *application) constraintViolationResponse(w http.ResponseWriter, r *http.Request, err *data.ConstraintError) {
+	status := http.StatusUnprocessableEntity
+	if errors.Is(err, data.ErrUniqueViolation) {
+		status = http.StatusConflict
+	}
+
+	if err.Field == "" {
+		// There's nothing the client can do about a constraint we haven't
+		// described, so log it for us to look into.
+		app.logError(r, err)
+		message := "unable to save the record because it conflicts with existing data"
+		app.errorResponse(w, r, status, message)
+		return
+	}
+
+	app.errorResponse(w, r, status, map[string]string{err.Field: err.Message})
+}
+
+func (app *application) roleInUseResponse(w http.ResponseWriter, r *http.Request) {
+	message := "unable to delete the role because other roles inherit from it"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
 func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
 	message := "rate limit exceeded"
 	app.errorResponse(w, r, http.StatusTooManyRequests, message)
@@ -99,6 +132,13 @@ func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
 }
 
+func (app *application) invalidAPIKeyResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", "ApiKey")
+
+	message := "invalid or missing API key"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
 func (app *application) authenticationRequiredResponse(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("WWW-Authenticate", "Bearer")
 
@@ -115,3 +155,13 @@ func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Requ
 	message := "your user account doesn't have the necessary permissions to access this resource"
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
+
+func (app *application) oidcLoginFailedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "unable to sign in with the identity provider"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+func (app *application) unverifiedEmailResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the identity provider has not verified your email address"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
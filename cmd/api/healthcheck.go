@@ -1,11 +1,19 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cedrickchee/skel/internal/data"
 )
 
 // Declare a handler which writes a well-formed JSON response with information
-// about the application status, operating environment and version.
+// about the application status, operating environment and version. It doesn't
+// check any of the application's dependencies; use /v1/healthz and /v1/readyz
+// for probes.
 func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Request) {
 	// Declare an envelope map containing the data for the response. Notice that
 	// the way we've constructed this means the environment and version data
@@ -25,3 +33,136 @@ func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Reques
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// healthzHandler is the liveness probe. It only says that the process is up
+// and able to serve HTTP requests, and deliberately doesn't check the
+// database or anything else, so that an orchestrator doesn't restart every
+// instance of the API because of a problem which restarting won't fix.
+func (app *application) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.writeJSON(w, http.StatusOK, envelope{"status": "alive"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readinessTimeout is how long the readiness checks have to complete, in
+// total.
+const readinessTimeout = 2 * time.Second
+
+// readinessCheck is one of the dependencies that must be working for the
+// application to be ready to serve requests.
+type readinessCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// checkResult is the outcome of a readinessCheck, as reported by the
+// readiness probe.
+type checkResult struct {
+	Status  string `json:"status"`
+	Latency string `json:"latency"`
+	Error   string `json:"error,omitempty"`
+}
+
+// readinessChecks returns the checks that the readiness probe runs.
+func (app *application) readinessChecks() []readinessCheck {
+	checks := []readinessCheck{
+		{"database", app.models.Health.Ping},
+		{"migrations", app.checkMigrations},
+	}
+
+	if app.config.smtp.healthCheck {
+		checks = append(checks, readinessCheck{"smtp", app.mailer.Ping})
+	}
+
+	return checks
+}
+
+// checkMigrations checks that the database schema is at least at the version
+// that this build expects, and that no migration failed part way through. A
+// newer schema is fine, because during a rolling deployment the old instances
+// keep running against the schema that the new ones have migrated.
+func (app *application) checkMigrations(ctx context.Context) error {
+	version, dirty, err := app.models.Health.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case dirty:
+		return fmt.Errorf("migration %d is dirty", version)
+	case version < data.SchemaVersion:
+		return fmt.Errorf("schema is at version %d, want %d", version, data.SchemaVersion)
+	}
+
+	return nil
+}
+
+// readyzHandler returns the readiness probe, which a load balancer uses to
+// decide whether to send requests to this instance. It runs every readiness
+// check concurrently and responds with 200 OK if they all pass, or 503
+// Service Unavailable if any fail, along with each check's status and
+// latency. It also fails as soon as a graceful shutdown begins, so that the
+// load balancer stops sending new requests while the in-flight ones finish.
+//
+// The error messages from failed checks can give away details of our
+// infrastructure, so they're only included in the response if verbose is
+// true, as it is on the admin listener. They're always logged.
+func (app *application) readyzHandler(verbose bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !app.isReady() {
+			app.errorResponse(w, r, http.StatusServiceUnavailable, "the server is shutting down")
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+		defer cancel()
+
+		checks := app.readinessChecks()
+		errs := make([]error, len(checks))
+		results := make(map[string]checkResult, len(checks))
+
+		var (
+			wg sync.WaitGroup
+			mu sync.Mutex
+		)
+
+		for i, c := range checks {
+			wg.Add(1)
+			go func(i int, c readinessCheck) {
+				defer wg.Done()
+
+				start := time.Now()
+				errs[i] = c.check(ctx)
+				res := checkResult{Status: "ok", Latency: time.Since(start).String()}
+
+				if errs[i] != nil {
+					res.Status = "failing"
+					if verbose {
+						res.Error = errs[i].Error()
+					}
+				}
+
+				mu.Lock()
+				results[c.name] = res
+				mu.Unlock()
+			}(i, c)
+		}
+		wg.Wait()
+
+		status, code := "ready", http.StatusOK
+		for i, err := range errs {
+			if err != nil {
+				status, code = "unavailable", http.StatusServiceUnavailable
+				app.loggerFor(r.Context()).PrintError(err, map[string]string{
+					"check": checks[i].name,
+				})
+			}
+		}
+
+		err := app.writeJSON(w, code, envelope{"status": status, "checks": results}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+	}
+}
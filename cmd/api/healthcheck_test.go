@@ -2,8 +2,11 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"testing"
+
+	"github.com/cedrickchee/skel/internal/data"
 )
 
 func TestHealthcheckHandler(t *testing.T) {
@@ -41,8 +44,98 @@ func TestHealthcheckHandler(t *testing.T) {
 	}
 }
 
+func TestHealthzHandler(t *testing.T) {
+	app := newTestApplication(t)
+	app.models.Health = data.MockHealthModel{PingErr: errors.New("connection refused")}
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	// Liveness doesn't depend on the database.
+	code, _, _ := ts.get(t, "/v1/healthz")
+	if code != http.StatusOK {
+		t.Errorf("want %d; got %d", http.StatusOK, code)
+	}
+}
+
+func TestReadyzHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		health   data.MockHealthModel
+		notReady bool
+		want     int
+		failing  string
+	}{
+		{"Ready", data.MockHealthModel{Version: data.SchemaVersion}, false, http.StatusOK, ""},
+		{"Newer schema", data.MockHealthModel{Version: data.SchemaVersion + 1}, false, http.StatusOK, ""},
+		{"Database down", data.MockHealthModel{PingErr: errors.New("connection refused")}, false, http.StatusServiceUnavailable, "database"},
+		{"Pending migrations", data.MockHealthModel{Version: data.SchemaVersion - 1}, false, http.StatusServiceUnavailable, "migrations"},
+		{"Dirty migration", data.MockHealthModel{Version: data.SchemaVersion, Dirty: true}, false, http.StatusServiceUnavailable, "migrations"},
+		{"Shutting down", data.MockHealthModel{Version: data.SchemaVersion}, true, http.StatusServiceUnavailable, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.models.Health = tt.health
+			app.setReady(!tt.notReady)
+
+			ts := newTestServer(t, app.routes())
+			defer ts.Close()
+
+			admin := newTestServer(t, app.adminRoutes())
+			defer admin.Close()
+
+			for _, srv := range []struct {
+				ts      *testServer
+				path    string
+				verbose bool
+			}{
+				{ts, "/v1/readyz", false},
+				{admin, "/readyz", true},
+			} {
+				code, _, body := srv.ts.get(t, srv.path)
+				if code != tt.want {
+					t.Fatalf("%s: want %d; got %d", srv.path, tt.want, code)
+				}
+
+				var got struct {
+					Checks map[string]checkResult `json:"checks"`
+				}
+				err := json.NewDecoder(body).Decode(&got)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if tt.notReady {
+					continue
+				}
+
+				for _, name := range []string{"database", "migrations"} {
+					res, ok := got.Checks[name]
+					if !ok || res.Latency == "" {
+						t.Errorf("%s: want %s check with latency; got %+v", srv.path, name, got.Checks)
+					}
+
+					want := "ok"
+					if name == tt.failing || (tt.failing == "database" && name == "migrations") {
+						want = "failing"
+					}
+					if res.Status != want {
+						t.Errorf("%s: want %s check %s; got %s", srv.path, name, want, res.Status)
+					}
+					if (res.Error != "") != (want == "failing" && srv.verbose) {
+						t.Errorf("%s: unexpected error %q for %s check", srv.path, res.Error, name)
+					}
+				}
+			}
+		})
+	}
+}
+
 /*
 Run:
 
 $ go test -v -run ^TestHealthcheckHandler$ github.com/cedrickchee/skel/cmd/api
+$ go test -v -run ^TestReadyzHandler$ github.com/cedrickchee/skel/cmd/api
 */
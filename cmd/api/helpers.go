@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,6 +11,8 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/cedrickchee/skel/internal/jsonlog"
+	"github.com/cedrickchee/skel/internal/tracing"
 	"github.com/cedrickchee/skel/internal/validator"
 	"github.com/julienschmidt/httprouter"
 )
@@ -37,6 +40,14 @@ func (app *application) readIDParam(r *http.Request) (int64, error) {
 	return id, nil
 }
 
+// Retrieve a named string URL parameter from the current request context, such
+// as the 'name' parameter in /v1/roles/:name.
+func (app *application) readStringParam(r *http.Request, name string) string {
+	params := httprouter.ParamsFromContext(r.Context())
+
+	return params.ByName(name)
+}
+
 type envelope map[string]interface{}
 
 // Define a writeJSON() helper for sending responses. This takes the destination
@@ -233,27 +244,13 @@ func (app *application) readInt(qs url.Values, key string,
 	return i
 }
 
-// background is a helper function that accepts an arbitrary function as a
-// parameter.
-func (app *application) background(fn func()) {
-	// Increment the WaitGroup counter.
-	app.wg.Add(1)
-
-	// Launch a background goroutine.
-	go func() {
-		// Use defer to decrement the WaitGroup counter before the goroutine
-		// returns.
-		defer app.wg.Done()
-
-		// Run a deferred function which uses recover() to catch any panic, and
-		// log an error message instead of terminating the application.
-		defer func() {
-			if err := recover(); err != nil {
-				app.logger.PrintError(fmt.Errorf("%s", err), nil)
-			}
-		}()
+// loggerFor returns a logger which adds the request ID and trace IDs carried
+// by ctx, if there are any, to every log entry.
+func (app *application) loggerFor(ctx context.Context) *jsonlog.Logger {
+	tc, ok := tracing.FromContext(ctx)
+	if !ok {
+		return app.logger
+	}
 
-		// Execute the arbitrary function that we passed as the parameter.
-		fn()
-	}()
+	return app.logger.With(tc.Properties())
 }
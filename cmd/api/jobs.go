@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+
+	"github.com/cedrickchee/skel/internal/data"
+	"github.com/cedrickchee/skel/internal/jobs"
+	"github.com/cedrickchee/skel/internal/tracing"
+)
+
+// The kinds of background job that the application runs.
+const (
+	jobSendEmail = "send_email"
+)
+
+// sendEmailPayload is the payload of a send_email job.
+type sendEmailPayload struct {
+	Recipient string                 `json:"recipient"`
+	Template  string                 `json:"template"`
+	Data      map[string]interface{} `json:"data"`
+}
+
+// registerJobHandlers tells the job queue which handler runs each kind of job.
+func (app *application) registerJobHandlers() {
+	app.jobs.Handle(jobSendEmail, app.sendEmailJob)
+}
+
+// enqueueJob queues a job to run in the background. When ctx comes from
+// Models.Transaction(), the job is queued in the same transaction as the
+// changes which caused it, so that it's only queued if they are saved, and is
+// never lost if they are. In other words, the jobs table is our transactional
+// outbox. The job also carries the request ID and trace from ctx, so that its
+// log entries can be traced back to the request.
+func (app *application) enqueueJob(ctx context.Context, kind string, payload interface{}) error {
+	job, err := data.NewJob(kind, payload)
+	if err != nil {
+		return err
+	}
+
+	if tc, ok := tracing.FromContext(ctx); ok {
+		job.RequestID = tc.RequestID
+		job.Traceparent = tc.Traceparent()
+	}
+
+	return app.models.WithTx(ctx).Jobs.Enqueue(ctx, job)
+}
+
+// enqueueEmail queues a send_email job. Note that the template data is stored
+// in the jobs table until the email has been sent, which includes the
+// plaintext of any token in it. It's deleted once the email is sent, or
+// cleared if the job is given up on, so the token only sits in the table
+// while it's waiting to go out; but until then, the jobs table needs the same
+// care as the tokens table.
+func (app *application) enqueueEmail(ctx context.Context, recipient, templateFile string, data map[string]interface{}) error {
+	return app.enqueueJob(ctx, jobSendEmail, sendEmailPayload{
+		Recipient: recipient,
+		Template:  templateFile,
+		Data:      data,
+	})
+}
+
+// sendEmailJob sends an email queued by enqueueEmail().
+func (app *application) sendEmailJob(ctx context.Context, job *data.Job) error {
+	var payload sendEmailPayload
+
+	// Decode numbers as json.Number rather than float64, so that a large ID
+	// isn't rendered in the email like 1.234567e+06.
+	dec := json.NewDecoder(bytes.NewReader(job.Payload))
+	dec.UseNumber()
+
+	err := dec.Decode(&payload)
+	if err != nil {
+		return jobs.Permanent(err)
+	}
+
+	return app.mailer.Send(payload.Recipient, payload.Template, payload.Data)
+}
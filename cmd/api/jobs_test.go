@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/cedrickchee/skel/internal/data"
+	"github.com/cedrickchee/skel/internal/jobs"
+)
+
+// recordingJobModel is a mock job model which remembers the jobs queued.
+type recordingJobModel struct {
+	data.MockJobModel
+	queued *[]*data.Job
+}
+
+func (m recordingJobModel) Enqueue(ctx context.Context, job *data.Job) error {
+	*m.queued = append(*m.queued, job)
+	return m.MockJobModel.Enqueue(ctx, job)
+}
+
+func TestRegisterUserQueuesEmail(t *testing.T) {
+	app := newTestApplication(t)
+
+	var queued []*data.Job
+	app.models.Jobs = recordingJobModel{queued: &queued}
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	body := `{"name": "Alice", "email": "alice@example.com", "password": "pa55word1234"}`
+
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/v1/users", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Request-ID", "abc-123")
+
+	rs, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.Body.Close()
+
+	if rs.StatusCode != http.StatusAccepted {
+		t.Fatalf("want %d; got %d", http.StatusAccepted, rs.StatusCode)
+	}
+
+	if len(queued) != 1 {
+		t.Fatalf("want 1 job queued; got %d", len(queued))
+	}
+
+	job := queued[0]
+	if job.Kind != jobSendEmail {
+		t.Errorf("want kind %q; got %q", jobSendEmail, job.Kind)
+	}
+	if job.RequestID != "abc-123" || job.Traceparent == "" {
+		t.Errorf("want job to carry the request's trace; got %q and %q", job.RequestID, job.Traceparent)
+	}
+	for _, want := range []string{`"recipient":"alice@example.com"`, `"template":"user_welcome.tmpl"`, `"userID":2`} {
+		if !strings.Contains(string(job.Payload), want) {
+			t.Errorf("want %s in payload %s", want, job.Payload)
+		}
+	}
+
+	// A duplicate email address fails validation, and queues nothing.
+	queued = nil
+	code, _, _ := ts.authenticatedRequest(t, newTestToken(t, app, "john@example.com"), http.MethodPost, "/v1/users",
+		strings.NewReader(`{"name": "John", "email": "john@example.com", "password": "pa55word1234"}`))
+	if code != http.StatusUnprocessableEntity {
+		t.Errorf("want %d; got %d", http.StatusUnprocessableEntity, code)
+	}
+	if len(queued) != 0 {
+		t.Errorf("want no jobs queued; got %d", len(queued))
+	}
+}
+
+func TestSendEmailJobInvalidPayload(t *testing.T) {
+	app := newTestApplication(t)
+
+	// A payload which can't be decoded will never work, so there's no point
+	// retrying it.
+	err := app.sendEmailJob(context.Background(), &data.Job{Kind: jobSendEmail, Payload: []byte(`{"recipient": 1}`)})
+	if !jobs.IsPermanent(err) {
+		t.Fatalf("want a permanent error; got %v", err)
+	}
+}
@@ -3,18 +3,24 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"expvar"
 	"flag"
 	"fmt"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 
+	"github.com/cedrickchee/skel/internal/cors"
 	"github.com/cedrickchee/skel/internal/data"
+	"github.com/cedrickchee/skel/internal/jobs"
 	"github.com/cedrickchee/skel/internal/jsonlog"
 	"github.com/cedrickchee/skel/internal/mailer"
+	"github.com/cedrickchee/skel/internal/metrics"
+	"github.com/cedrickchee/skel/internal/oidc"
+	"github.com/cedrickchee/skel/internal/ratelimit"
 
 	// Import the pq driver so that it can register itself with the database/sql
 	// package. Note that we alias this import to the blank identifier, to stop
@@ -42,13 +48,40 @@ var (
 type config struct {
 	port int
 	env  string
+	// shutdownDelay is how long to keep serving requests after failing the
+	// readiness probe, before starting the graceful shutdown.
+	shutdownDelay time.Duration
+	// adminAddr is the address of the admin listener, which serves expvar,
+	// pprof and other operational endpoints. It's disabled if empty.
+	adminAddr string
 	// Hold the configuration settings for the database connection pool, which
 	// we will read in from a command-line flag.
 	db struct {
+		// driver is either "postgres", or "memory" to keep everything in
+		// memory instead, for demos without a database.
+		driver       string
 		dsn          string
 		maxOpenConns int
 		maxIdleConns int
 		maxIdleTime  string
+		// queryTimeout is how long a model waits for a query. A query is
+		// also abandoned if the request it's for is cancelled first.
+		queryTimeout time.Duration
+		// replicaDSNs are the read replicas which serve the movie listings.
+		// A user's reads stick to the primary for replicaStickiness after
+		// they write something, and the replicas are health checked every
+		// replicaCheckInterval.
+		replicaDSNs          []string
+		replicaStickiness    time.Duration
+		replicaCheckInterval time.Duration
+		// migrateOnStart applies any pending migrations before the server
+		// starts.
+		migrateOnStart bool
+		// Queries which take longer than slowQueryThreshold are logged, with
+		// their plan if slowQueryExplain is set. A zero threshold turns the
+		// log off.
+		slowQueryThreshold time.Duration
+		slowQueryExplain   bool
 	}
 	// Struct contains fields for the requests-per-second and burst values, and
 	// a boolean field which we can use to enable/disable rate limiting
@@ -57,6 +90,13 @@ type config struct {
 		rps     float64
 		burst   int
 		enabled bool
+		// backend is where the token buckets are kept: "memory" or
+		// "postgres".
+		backend string
+		// policies are the per-route limits loaded from the file given by
+		// -limiter-policies. Requests which match none of them use rps and
+		// burst.
+		policies []*ratelimit.Policy
 	}
 	// Hold the SMTP server settings.
 	smtp struct {
@@ -65,10 +105,55 @@ type config struct {
 		username string
 		password string
 		sender   string
+		// healthCheck makes the readiness probe check that the SMTP server
+		// is reachable.
+		healthCheck bool
 	}
-	// Hold the Cross-Origin Resource Sharing (CORS) policies.
+	// Hold the Cross-Origin Resource Sharing (CORS) policies. The default
+	// policy comes from the -cors-* flags, and routes can override it in the
+	// file given by -cors-config.
 	cors struct {
-		trustedOrigins []string
+		policy cors.Policy
+		routes []*cors.Policy
+	}
+	// Hold the names of the roles which are assigned to every newly
+	// registered user.
+	roles struct {
+		defaults []string
+	}
+	// Hold the time-to-live for cached users and permissions. A zero value
+	// disables the cache.
+	authCache struct {
+		ttl time.Duration
+	}
+	// Hold the path to the file which configures the OpenID Connect identity
+	// providers that users can sign in with.
+	oidc struct {
+		configFile string
+	}
+	// Hold the networks of the reverse proxies whose X-Forwarded-For and
+	// X-Real-IP headers we believe. Requests from anywhere else are taken at
+	// face value.
+	trustedProxies trustedProxies
+	// Hold the settings for compressing responses. Bodies smaller than
+	// minSize bytes are sent uncompressed, because the saving wouldn't be
+	// worth the CPU time or the gzip header.
+	compress struct {
+		enabled bool
+		minSize int
+	}
+	// Hold the settings for the background job workers. drainTimeout is how
+	// long to keep running queued jobs when shutting down.
+	jobs struct {
+		workers      int
+		pollInterval time.Duration
+		drainTimeout time.Duration
+	}
+	// Hold the settings for the sweeper which deletes expired tokens. A zero
+	// sweepInterval disables it.
+	tokens struct {
+		sweepInterval  time.Duration
+		sweepBatchSize int
 	}
 }
 
@@ -77,11 +162,25 @@ type config struct {
 // config struct and a logger, but it will grow to include a lot more as our
 // build progresses.
 type application struct {
-	config config
-	logger *jsonlog.Logger
-	models data.Models
-	mailer mailer.Mailer
-	wg     sync.WaitGroup
+	// ready is 1 while the server is accepting requests. Use setReady() and
+	// isReady() rather than accessing it directly.
+	ready int32
+
+	config  config
+	logger  *jsonlog.Logger
+	models  data.Models
+	mailer  mailer.Mailer
+	cache   *authCache
+	oidc    map[string]*oidc.Provider
+	limiter ratelimit.Limiter
+	// registry holds the metrics served at /metrics.
+	registry *metrics.Registry
+	// jobs runs the background jobs queued with enqueueJob(). It's nil in
+	// tests, where jobs are only queued.
+	jobs *jobs.Queue
+	// sweeper deletes expired tokens. It's nil if it's disabled, and in
+	// tests.
+	sweeper *tokenSweeper
 }
 
 func main() {
@@ -93,11 +192,14 @@ func main() {
 	// 'development' if no corresponding flags are provided.
 	flag.IntVar(&cfg.port, "port", 4000, "API server port")
 	flag.StringVar(&cfg.env, "env", "development", "Environment (development|staging|production)")
+	flag.DurationVar(&cfg.shutdownDelay, "shutdown-delay", 0, "How long to keep serving after failing the readiness probe when shutting down")
+	flag.StringVar(&cfg.adminAddr, "admin-addr", "localhost:4001", "Admin server address, for expvar, pprof and runtime settings (empty to disable)")
 
 	// Read the DSN value from the db-dsn command-line flag into the config
 	// struct. Use the empty string "" as the default value for the db-dsn
 	// command-line flag, rather than os.Getenv("SKEL_DB_DSN") like we were
 	// previously.
+	flag.StringVar(&cfg.db.driver, "db-driver", "postgres", "Database driver (postgres|memory)")
 	flag.StringVar(&cfg.db.dsn, "db-dsn", "", "PostgreSQL DSN")
 
 	// Read the connection pool settings from command-line flags into the config
@@ -105,6 +207,20 @@ func main() {
 	flag.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", 25, "PostgreSQL max open connections")
 	flag.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", 25, "PostgreSQL max idle connections")
 	flag.StringVar(&cfg.db.maxIdleTime, "db-max-idle-time", "15m", "PostgreSQL max idle time")
+	flag.DurationVar(&cfg.db.queryTimeout, "db-query-timeout", data.DefaultTimeout, "PostgreSQL query timeout")
+
+	// The -db-replica-dsn flag can be given once for each read replica. We
+	// can't split a single value on whitespace like -cors-trusted-origins,
+	// because key=value DSNs have spaces in them.
+	flag.Func("db-replica-dsn", "PostgreSQL read replica DSN (may be repeated)", func(val string) error {
+		cfg.db.replicaDSNs = append(cfg.db.replicaDSNs, val)
+		return nil
+	})
+	flag.DurationVar(&cfg.db.replicaStickiness, "db-replica-stickiness", data.DefaultStickiness, "How long a user's reads go to the primary after they write")
+	flag.DurationVar(&cfg.db.replicaCheckInterval, "db-replica-check-interval", 5*time.Second, "How often to health check the read replicas")
+	flag.BoolVar(&cfg.db.migrateOnStart, "migrate-on-start", false, "Apply pending database migrations before starting the server")
+	flag.DurationVar(&cfg.db.slowQueryThreshold, "db-slow-query-threshold", 200*time.Millisecond, "Log queries which take longer than this (0 disables)")
+	flag.BoolVar(&cfg.db.slowQueryExplain, "db-slow-query-explain", false, "Log the EXPLAIN plan of slow queries (development only)")
 
 	// Command line flags to read the rate limiter setting values into the
 	// config struct. Notice that we use true as the default for the "enabled"
@@ -112,6 +228,8 @@ func main() {
 	flag.Float64Var(&cfg.limiter.rps, "limiter-rps", 2, "Rate limiter maximum requests per second")
 	flag.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
 	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
+	flag.StringVar(&cfg.limiter.backend, "limiter-backend", "memory", "Rate limiter backend (memory|postgres)")
+	limiterPolicies := flag.String("limiter-policies", "", "Path to the per-route rate limit policies file (JSON)")
 
 	// Read the SMTP server configuration settings into the config struct, using
 	// the Mailtrap settings as the default values.
@@ -120,6 +238,7 @@ func main() {
 	flag.StringVar(&cfg.smtp.username, "smtp-username", "b3754c2b680c33", "SMTP username")
 	flag.StringVar(&cfg.smtp.password, "smtp-password", "bd6fa5aaa2bd2f", "SMTP password")
 	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "Skel <no-reply@example.com>", "SMTP sender")
+	flag.BoolVar(&cfg.smtp.healthCheck, "smtp-health-check", false, "Check that the SMTP server is reachable in the readiness probe")
 
 	// Use the flag.Func() function to process the -cors-trusted-origins command
 	// line flag. In this we use the strings.Fields() function to split the flag
@@ -128,10 +247,58 @@ func main() {
 	// Importantly, if the -cors-trusted-origins flag is not present, contains
 	// the empty string, or contains only whitespace, then strings.Fields() will
 	// return an empty []string slice.
+	// Origins may have a wildcard subdomain, like "https://*.example.com".
 	flag.Func("cors-trusted-origins", "Trusted CORS origins (space separated)", func(val string) error {
-		cfg.cors.trustedOrigins = strings.Fields(val)
+		cfg.cors.policy.Origins = strings.Fields(val)
+		return nil
+	})
+
+	// The rest of the default CORS policy. The rate limit headers are exposed
+	// by default, so that browser clients can see how close they are to the
+	// limit, and so is the request ID, so that they can report it.
+	cfg.cors.policy.AllowedMethods = cors.DefaultAllowedMethods
+	cfg.cors.policy.AllowedHeaders = cors.DefaultAllowedHeaders
+	cfg.cors.policy.ExposedHeaders = []string{"RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "Retry-After", "X-Request-ID"}
+	flag.BoolVar(&cfg.cors.policy.AllowCredentials, "cors-allow-credentials", false, "Allow credentialed CORS requests")
+	flag.DurationVar(&cfg.cors.policy.MaxAge, "cors-max-age", 0, "How long browsers may cache CORS preflight responses")
+	flag.Func("cors-exposed-headers", `Response headers exposed to CORS requests (space separated) (default "RateLimit-Limit RateLimit-Remaining RateLimit-Reset Retry-After X-Request-ID")`, func(val string) error {
+		cfg.cors.policy.ExposedHeaders = strings.Fields(val)
 		return nil
 	})
+	corsConfig := flag.String("cors-config", "", "Path to the per-route CORS policies file (JSON)")
+
+	// Process the -default-roles command line flag in the same way. New users
+	// are only given the "viewer" role unless told otherwise.
+	cfg.roles.defaults = []string{"viewer"}
+	flag.Func("default-roles", `Roles assigned to new users (space separated) (default "viewer")`, func(val string) error {
+		cfg.roles.defaults = strings.Fields(val)
+		return nil
+	})
+
+	// Process the -trusted-proxies command line flag. Bare IP addresses are
+	// accepted as well as CIDR ranges, so "127.0.0.1 10.0.0.0/8" is fine.
+	flag.Func("trusted-proxies", "Trusted reverse proxy addresses or CIDR ranges (space separated)", func(val string) error {
+		proxies, err := parseTrustedProxies(val)
+		if err != nil {
+			return err
+		}
+		cfg.trustedProxies = proxies
+		return nil
+	})
+
+	flag.IntVar(&cfg.jobs.workers, "jobs-workers", 2, "Number of background jobs to run at once")
+	flag.DurationVar(&cfg.jobs.pollInterval, "jobs-poll-interval", time.Second, "How often idle job workers check for new jobs")
+	flag.DurationVar(&cfg.jobs.drainTimeout, "jobs-drain-timeout", 15*time.Second, "How long to keep running queued jobs when shutting down")
+
+	flag.DurationVar(&cfg.tokens.sweepInterval, "tokens-sweep-interval", 10*time.Minute, "How often to delete expired tokens (0 to disable)")
+	flag.IntVar(&cfg.tokens.sweepBatchSize, "tokens-sweep-batch-size", 1000, "Maximum number of expired tokens to delete in one statement (at least 1)")
+
+	flag.BoolVar(&cfg.compress.enabled, "compress-enabled", true, "Compress responses with gzip or deflate when the client accepts it")
+	flag.IntVar(&cfg.compress.minSize, "compress-min-size", 1024, "Minimum response size in bytes to compress")
+
+	flag.DurationVar(&cfg.authCache.ttl, "auth-cache-ttl", time.Minute, "How long to cache authenticated users and their permissions (0 to disable)")
+
+	flag.StringVar(&cfg.oidc.configFile, "oidc-config", "", "Path to the OpenID Connect providers file (JSON)")
 
 	displayVersion := flag.Bool("version", false, "Display version and exit")
 
@@ -150,24 +317,127 @@ func main() {
 	// the INFO severity level to the standard out stream.
 	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo)
 
-	// Call the openDB() helper function (see below) to create the connection
-	// pool, passing in the config struct. If this returns an error, we log it
-	// and exit the application immediately.
-	db, err := openDB(cfg)
+	// Load the OpenID Connect identity providers, if any have been configured.
+	// An unreadable or invalid file is fatal, since it almost certainly means
+	// a typo in the deployment.
+	var providers map[string]*oidc.Provider
+	if cfg.oidc.configFile != "" {
+		var err error
+		providers, err = oidc.LoadConfig(cfg.oidc.configFile, nil)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+	}
+
+	// Load the per-route rate limit policies, if there are any.
+	if *limiterPolicies != "" {
+		var err error
+		cfg.limiter.policies, err = ratelimit.LoadPolicies(*limiterPolicies)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		// The middleware has buckets of its own under these names.
+		for _, p := range cfg.limiter.policies {
+			if p.Name == "default" || p.Name == authFailuresPolicy {
+				logger.PrintFatal(fmt.Errorf("-limiter-policies: the name %q is reserved", p.Name), nil)
+			}
+		}
+	}
+
+	// Check the default CORS policy, and load the per-route overrides on top
+	// of it.
+	err := cfg.cors.policy.Validate()
 	if err != nil {
-		// Use the PrintFatal() method to write a log entry containing the error
-		// at the FATAL level and exit. We have no additional properties to
-		// include in the log entry, so we pass nil as the second parameter.
 		logger.PrintFatal(err, nil)
 	}
+	if *corsConfig != "" {
+		cfg.cors.routes, err = cors.LoadRoutes(*corsConfig, cfg.cors.policy)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+	}
 
-	// Defer a call to db.Close() so that the connection pool is closed before
-	// the main() function exits.
-	defer db.Close()
+	// The sweeper deletes a batch at a time until a batch comes back less
+	// than full, so a batch size below one would never finish (or fail on a
+	// negative LIMIT).
+	if cfg.tokens.sweepBatchSize < 1 {
+		logger.PrintFatal(errors.New("-tokens-sweep-batch-size must be at least 1"), nil)
+	}
+
+	// Slow query plans can contain values from the queries, like email
+	// addresses, so they're only logged in development.
+	if cfg.db.slowQueryExplain && cfg.env != "development" {
+		logger.PrintFatal(errors.New("-db-slow-query-explain is only allowed with -env=development"), nil)
+	}
 
-	// Also log a message to say that the connection pool has been successfully
-	// established.
-	logger.PrintInfo("database connection pool established", nil)
+	// With the memory driver there's no database, and db stays nil. Nothing
+	// else can use a database either, so we refuse the settings which need
+	// one rather than quietly ignoring them.
+	var db *sql.DB
+	switch cfg.db.driver {
+	case "postgres":
+		// Call the openDB() helper function (see below) to create the
+		// connection pool, passing in the config struct. If this returns an
+		// error, we log it and exit the application immediately.
+		db, err = openDB(cfg)
+		if err != nil {
+			// Use the PrintFatal() method to write a log entry containing
+			// the error at the FATAL level and exit. We have no additional
+			// properties to include in the log entry, so we pass nil as the
+			// second parameter.
+			logger.PrintFatal(err, nil)
+		}
+
+		// Defer a call to db.Close() so that the connection pool is closed
+		// before the main() function exits.
+		defer db.Close()
+
+		// Also log a message to say that the connection pool has been
+		// successfully established.
+		logger.PrintInfo("database connection pool established", nil)
+	case "memory":
+		switch {
+		case cfg.db.slowQueryExplain:
+			logger.PrintFatal(errors.New("-db-slow-query-explain needs -db-driver=postgres"), nil)
+		case len(cfg.db.replicaDSNs) > 0:
+			logger.PrintFatal(errors.New("read replicas need -db-driver=postgres"), nil)
+		case cfg.limiter.backend == "postgres":
+			logger.PrintFatal(errors.New("-limiter-backend=postgres needs -db-driver=postgres"), nil)
+		case cfg.db.migrateOnStart:
+			logger.PrintFatal(errors.New("-migrate-on-start needs -db-driver=postgres"), nil)
+		}
+
+		logger.PrintInfo("using in-memory models, which are lost when the server stops", nil)
+	default:
+		logger.PrintFatal(fmt.Errorf("unknown database driver %q", cfg.db.driver), nil)
+	}
+
+	// `api migrate ...` runs the migrations, rather than the server. Note that
+	// the flags, like -db-dsn, come before the subcommand.
+	switch flag.Arg(0) {
+	case "":
+	case "migrate":
+		if db == nil {
+			logger.PrintFatal(errors.New("migrate needs -db-driver=postgres"), nil)
+		}
+		err = runMigrate(context.Background(), db, logger, os.Stdout, flag.Args()[1:])
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		return
+	default:
+		logger.PrintFatal(fmt.Errorf("unknown command %q", flag.Arg(0)), nil)
+	}
+
+	// Bring the database up to date before anything uses it, if we've been
+	// asked to. Each instance takes its turn, and those after the first find
+	// nothing left to do.
+	if cfg.db.migrateOnStart {
+		err = runMigrate(context.Background(), db, logger, os.Stdout, []string{"up"})
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+	}
 
 	// Publish a new 'version' variable in the expvar handler containing our
 	// application version number.
@@ -178,26 +448,137 @@ func main() {
 		return runtime.NumGoroutine()
 	}))
 
+	// Open a connection pool for each read replica. They're checked in the
+	// same way as the primary at startup, so a typo in a DSN is caught
+	// straight away, but a replica which goes down later on is only ejected
+	// until it comes back.
+	var replicas *data.ReplicaSet
+	if len(cfg.db.replicaDSNs) > 0 {
+		var pools []*sql.DB
+		for _, dsn := range cfg.db.replicaDSNs {
+			pool, err := openPool(cfg, dsn)
+			if err != nil {
+				logger.PrintFatal(err, nil)
+			}
+			pools = append(pools, pool)
+		}
+
+		replicas = data.NewReplicaSet(pools, cfg.db.replicaStickiness)
+		defer replicas.Close()
+
+		go func() {
+			ticker := time.NewTicker(cfg.db.replicaCheckInterval)
+			defer ticker.Stop()
+
+			for range ticker.C {
+				replicas.Check(context.Background(), 2*time.Second)
+			}
+		}()
+
+		logger.PrintInfo("database read replicas established", map[string]string{
+			"replicas": strconv.Itoa(len(pools)),
+		})
+	}
+
 	// Publish the database connection pool statistics.
-	expvar.Publish("database", expvar.Func(func() interface{} {
-		return db.Stats()
-	}))
+	if db != nil {
+		expvar.Publish("database", expvar.Func(func() interface{} {
+			return db.Stats()
+		}))
+	}
+
+	// And the statistics of each read replica's pool, along with whether
+	// it's healthy and how many reads it has served.
+	if replicas != nil {
+		expvar.Publish("database_replicas", expvar.Func(func() interface{} {
+			return replicas.Stats()
+		}))
+	}
 
 	// Publish the current Unix timestamp.
 	expvar.Publish("timestamp", expvar.Func(func() interface{} {
 		return time.Now().Unix()
 	}))
 
+	// Choose where to keep the rate limiter's token buckets. The Postgres
+	// backend shares them between every instance of the API.
+	var limiter ratelimit.Limiter
+	switch cfg.limiter.backend {
+	case "memory":
+		limiter = ratelimit.NewMemory()
+	case "postgres":
+		pg := ratelimit.NewPostgres(db)
+		pg.Start(time.Minute)
+		defer pg.Stop(context.Background())
+		limiter = pg
+	default:
+		logger.PrintFatal(fmt.Errorf("unknown rate limiter backend %q", cfg.limiter.backend), nil)
+	}
+
+	// The query metrics go in the same registry as the rest, so it's created
+	// before the models.
+	registry := metrics.NewRegistry()
+
+	models := data.NewMemoryModels()
+	if db != nil {
+		ins := data.NewInstrumentation(registry, logger, cfg.db.slowQueryThreshold)
+		if cfg.db.slowQueryExplain {
+			ins.ExplainDB = db
+		}
+		models = data.NewModels(db, cfg.db.queryTimeout, replicas, ins)
+	}
+
+	// Make sure the -default-roles exist. AddForUser() would refuse them
+	// anyway, but then every registration would fail rather than the server
+	// failing to start.
+	for _, name := range cfg.roles.defaults {
+		_, err := models.Roles.Get(context.Background(), name)
+		if err != nil {
+			if errors.Is(err, data.ErrRecordNotFound) {
+				err = fmt.Errorf("-default-roles: unknown role %q", name)
+			}
+			logger.PrintFatal(err, nil)
+		}
+	}
+
 	// Declare an instance of the application struct, containing the config
 	// struct and the logger.
 	app := &application{
 		config: cfg,
 		logger: logger,
-		// Initialize a Models struct, passing in the connection pool as a
-		// parameter.
-		models: data.NewModels(db),
+		models: models,
 		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username,
 			cfg.smtp.password, cfg.smtp.sender),
+		cache:    newAuthCache(cfg.authCache.ttl),
+		oidc:     providers,
+		limiter:  limiter,
+		registry: registry,
+	}
+	app.jobs = jobs.New(app.models.Jobs, logger, jobs.Config{
+		Workers:      cfg.jobs.workers,
+		PollInterval: cfg.jobs.pollInterval,
+	})
+
+	// Publish the same runtime and database figures as expvar does for
+	// Prometheus, along with the number of jobs running in the background.
+	registerMetrics(app.registry, db)
+	app.registry.NewGaugeFunc("background_jobs_in_flight", "Number of queued jobs being run by this instance.", func() float64 {
+		return float64(app.jobs.Running())
+	})
+
+	// Start the workers which run the jobs from the queue, like sending
+	// emails. They're stopped in serve() when the server shuts down.
+	app.registerJobHandlers()
+	app.jobs.Start()
+
+	// Start deleting expired tokens, and count how many have gone. Every
+	// instance runs a sweeper, but only one of them deletes at a time.
+	if cfg.tokens.sweepInterval > 0 {
+		app.sweeper = newTokenSweeper(app.models.Tokens, logger, cfg.tokens.sweepInterval, cfg.tokens.sweepBatchSize)
+		app.registry.NewCounterFunc("tokens_expired_deleted_total", "Total number of expired tokens deleted.", func() float64 {
+			return float64(app.sweeper.Deleted())
+		})
+		app.sweeper.Start()
 	}
 
 	// Start the HTTP server.
@@ -209,9 +590,15 @@ func main() {
 
 // The openDB() function returns a sql.DB connection pool.
 func openDB(cfg config) (*sql.DB, error) {
-	// Use sql.Open() to create an empty connection pool, using the DSN from the
-	// config struct.
-	db, err := sql.Open("postgres", cfg.db.dsn)
+	return openPool(cfg, cfg.db.dsn)
+}
+
+// openPool returns a sql.DB connection pool for dsn, with the pool settings
+// from cfg. It's used for the primary database and for each read replica.
+func openPool(cfg config, dsn string) (*sql.DB, error) {
+	// Use sql.Open() to create an empty connection pool, using the DSN we
+	// were given.
+	db, err := sql.Open("postgres", dsn)
 	if err != nil {
 		return nil, err
 	}
@@ -251,3 +638,39 @@ func openDB(cfg config) (*sql.DB, error) {
 	// Return the sql.DB connection pool.
 	return db, nil
 }
+
+// registerMetrics registers gauges and counters for the number of goroutines
+// and the database connection pool statistics from db.Stats(). There are no
+// database figures if db is nil.
+func registerMetrics(registry *metrics.Registry, db *sql.DB) {
+	registry.NewGaugeFunc("go_goroutines", "Number of goroutines that currently exist.", func() float64 {
+		return float64(runtime.NumGoroutine())
+	})
+
+	if db == nil {
+		return
+	}
+
+	stats := func(fn func(s sql.DBStats) float64) func() float64 {
+		return func() float64 { return fn(db.Stats()) }
+	}
+
+	registry.NewGaugeFunc("db_max_open_connections", "Maximum number of open connections to the database.",
+		stats(func(s sql.DBStats) float64 { return float64(s.MaxOpenConnections) }))
+	registry.NewGaugeFunc("db_open_connections", "Number of established connections, both in use and idle.",
+		stats(func(s sql.DBStats) float64 { return float64(s.OpenConnections) }))
+	registry.NewGaugeFunc("db_in_use_connections", "Number of connections currently in use.",
+		stats(func(s sql.DBStats) float64 { return float64(s.InUse) }))
+	registry.NewGaugeFunc("db_idle_connections", "Number of idle connections.",
+		stats(func(s sql.DBStats) float64 { return float64(s.Idle) }))
+	registry.NewCounterFunc("db_wait_count_total", "Total number of connections waited for.",
+		stats(func(s sql.DBStats) float64 { return float64(s.WaitCount) }))
+	registry.NewCounterFunc("db_wait_duration_seconds_total", "Total time blocked waiting for a new connection.",
+		stats(func(s sql.DBStats) float64 { return s.WaitDuration.Seconds() }))
+	registry.NewCounterFunc("db_max_idle_closed_total", "Total number of connections closed due to SetMaxIdleConns.",
+		stats(func(s sql.DBStats) float64 { return float64(s.MaxIdleClosed) }))
+	registry.NewCounterFunc("db_max_idle_time_closed_total", "Total number of connections closed due to SetConnMaxIdleTime.",
+		stats(func(s sql.DBStats) float64 { return float64(s.MaxIdleTimeClosed) }))
+	registry.NewCounterFunc("db_max_lifetime_closed_total", "Total number of connections closed due to SetConnMaxLifetime.",
+		stats(func(s sql.DBStats) float64 { return float64(s.MaxLifetimeClosed) }))
+}
@@ -7,14 +7,15 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
+	"github.com/cedrickchee/skel/internal/cors"
 	"github.com/cedrickchee/skel/internal/data"
+	"github.com/cedrickchee/skel/internal/metrics"
+	"github.com/cedrickchee/skel/internal/ratelimit"
+	"github.com/cedrickchee/skel/internal/tracing"
 	"github.com/cedrickchee/skel/internal/validator"
 	"github.com/felixge/httpsnoop"
-	"github.com/tomasen/realip"
-	"golang.org/x/time/rate"
 )
 
 func (app *application) recoverPanic(next http.Handler) http.Handler {
@@ -43,116 +44,180 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 	})
 }
 
-// rateLimit is an IP-based rate limiter.
-// Unlike a a global rate limiter, it’s generally more common to want a separate
-// rate limiter for each client, so that one bad client making too many requests
-// doesn’t affect all the others.
+// rateLimit limits the rate of requests from each client, so that one bad
+// client making too many requests doesn't affect all the others.
 //
-// Using this pattern for rate-limiting will only work if your API application
-// is running on a single-machine. If your infrastructure is distributed, with
-// your application running on multiple servers behind a load balancer, then
-// you'll need to use an alternative approach.
+// Each request is matched against the policies from the -limiter-policies
+// file, in order, and the first one that matches decides the rate and what
+// the client's bucket is keyed by: their IP address, user, API key or any of
+// these. Requests which don't match any policy fall back to the default
+// -limiter-rps and -limiter-burst, keyed by IP address.
+//
+// Because policies can be keyed by user, this middleware must run after
+// authenticate(). That leaves authenticate() to limit requests with bad
+// credentials itself, with checkAuthFailures() and chargeAuthFailure().
+//
+// The buckets themselves live in app.limiter. With the in-memory backend this
+// only works if the API is running on a single machine. If it's distributed,
+// with the application running on multiple servers behind a load balancer,
+// use the Postgres backend (-limiter-backend=postgres) so that all of the
+// servers share the same buckets.
 func (app *application) rateLimit(next http.Handler) http.Handler {
-	// Define a client struct to hold the rate limiter and last seen time for
-	// each client.
-	type client struct {
-		limiter  *rate.Limiter
-		lastSeen time.Time
+	defaultPolicy := &ratelimit.Policy{
+		Name: "default",
+		Key:  ratelimit.KeyIP,
+		Limit: ratelimit.Limit{
+			Rate:  app.config.limiter.rps,
+			Burst: app.config.limiter.burst,
+		},
 	}
 
-	// Declare a mutex and a map to hold the clients' IP addresses and rate
-	// limiters.
-	var (
-		mu sync.Mutex
-		// An in-memory map of rate limiters, using the IP address for each
-		// client as the map key.
-		// The map values are pointers to a client struct.
-		clients = make(map[string]*client)
-	)
-
-	// Launch a background goroutine which removes old entries from the clients
-	// map once every minute.
-	go func() {
-		for {
-			time.Sleep(time.Minute)
-
-			// Lock the mutex to prevent any rate limiter checks from happening
-			// while the cleanup is taking place.
-			mu.Lock()
-
-			// Loop through all clients. If they haven't been seen within the
-			// last three minutes, delete the corresponding entry from the map.
-			for ip, client := range clients {
-				if time.Since(client.lastSeen) > 3*time.Minute {
-					delete(clients, ip)
-				}
-			}
-
-			// Importantly, unlock the mutex when the cleanup is complete.
-			mu.Unlock()
-		}
-	}()
-
-	// The function we are returning is a closure, which 'closes over' the
-	// clients variable.
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Only carry out the check if rate limiting is enabled.
 		if app.config.limiter.enabled {
-			// Get the client's real IP address from the request.
-			ip := realip.FromRequest(r)
-
-			// Because we’ll potentially have multiple goroutines accessing the map
-			// concurrently, we’ll need to protect access to the map by using a
-			// mutex to prevent race conditions.
-			//
-			// Lock the mutex to prevent this code from being executed concurrently.
-			mu.Lock()
-
-			// Check to see if the IP address already exists in the map. If it
-			// doesn't, then initialize a new rate limiter and add the IP address
-			// and limiter to the map.
-			if _, found := clients[ip]; !found {
-				// Create and add a new client struct to the map if it doesn't
-				// already exist.
-				clients[ip] = &client{
-					// The rate limiter allows an average of 2 requests per second,
-					// with a maximum of 4 requests in a single "burst".
-					limiter: rate.NewLimiter(rate.Limit(app.config.limiter.rps), app.config.limiter.burst),
+			policy := defaultPolicy
+			for _, p := range app.config.limiter.policies {
+				if p.Matches(r.Method, r.URL.Path) {
+					policy = p
+					break
 				}
 			}
 
-			// Update the last seen time for the client.
-			clients[ip].lastSeen = time.Now()
+			// Prefix the key with the policy name, so that every policy has
+			// its own set of buckets.
+			key := policy.Name + "|" + app.rateLimitKey(r, policy.Key)
 
-			// Call the Allow() method on the rate limiter for the current IP
-			// address to see if the request is permitted, and if it's not, then
-			// unlock the mutex and call the rateLimitExceededResponse() helper to
-			// return a 429 Too Many Requests response.
-			//
-			// Whenever we call the Allow() method on the rate limiter exactly one
-			// token will be consumed from the bucket. If there are no tokens left
-			// in the bucket, then Allow() will return `false` and that acts as the
-			// trigger for us send the client a `429 Too Many Requests` response.
+			// Take a token from the client's bucket. If there are no tokens
+			// left, send the client a 429 Too Many Requests response.
 			//
-			// It’s also important to note that the code behind the Allow() method
-			// is protected by a mutex and is safe for concurrent use.
-			if !clients[ip].limiter.Allow() {
-				mu.Unlock()
-				app.rateLimitExceededResponse(w, r)
-				return
+			// If the limiter itself fails (for example, because the database
+			// is unavailable) we log the error and let the request through.
+			// Refusing every request would turn a problem with the limiter
+			// into an outage of the whole API.
+			res, err := app.limiter.Allow(r.Context(), key, policy.Limit)
+			if err != nil {
+				app.logError(r, err)
+			} else {
+				setRateLimitHeaders(w, res)
+
+				if !res.Allowed {
+					app.rateLimitExceededResponse(w, r)
+					return
+				}
 			}
-
-			// Very importantly, unlock the mutex before calling the next handler in
-			// the chain. Notice that we DON'T use defer to unlock the mutex, as
-			// that would mean that the mutex isn't unlocked until all the handlers
-			// downstream of this middleware have also returned.
-			mu.Unlock()
 		}
 
 		next.ServeHTTP(w, r)
 	})
 }
 
+// setRateLimitHeaders tells the client about the state of their bucket, using
+// the RateLimit header fields from the IETF draft
+// (https://datatracker.ietf.org/doc/draft-ietf-httpapi-ratelimit-headers/),
+// so that they can slow down before they're refused rather than after.
+//
+// With a token bucket, RateLimit-Limit is the size of the burst and
+// RateLimit-Reset is the number of seconds until the bucket is full again.
+// When the request is refused, Retry-After says how many seconds it will be
+// until the next request is allowed. All of the times are rounded up to whole
+// seconds, so a client which waits that long is never refused.
+func setRateLimitHeaders(w http.ResponseWriter, res ratelimit.Result) {
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(res.Reset)))
+
+	if !res.Allowed {
+		retryAfter := ceilSeconds(res.RetryAfter)
+		if retryAfter < 1 {
+			retryAfter = 1
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	}
+}
+
+// authFailuresPolicy names the buckets which failed authentications are
+// charged to. They're keyed by IP address, and have the default -limiter-rps
+// and -limiter-burst.
+const authFailuresPolicy = "auth-failures"
+
+// checkAuthFailures is called by authenticate() before it looks up the
+// credentials which came with a request. If the client's IP address has run
+// out of failed authentications, it sends a 429 Too Many Requests response
+// and returns false, so that a flood of bad tokens or keys can't get past the
+// rate limiter and cost a query each. Successful authentications aren't
+// charged, so they're only held up by a client which has also been failing.
+func (app *application) checkAuthFailures(w http.ResponseWriter, r *http.Request) bool {
+	if !app.config.limiter.enabled {
+		return true
+	}
+
+	res, err := app.limiter.Peek(r.Context(), app.authFailuresKey(r), app.authFailuresLimit())
+	if err != nil {
+		// As in rateLimit(), a broken limiter lets the request through.
+		app.logError(r, err)
+		return true
+	}
+	if !res.Allowed {
+		setRateLimitHeaders(w, res)
+		app.rateLimitExceededResponse(w, r)
+		return false
+	}
+
+	return true
+}
+
+// chargeAuthFailure takes a token from the client's failed authentications
+// bucket, after authenticate() has refused their credentials.
+func (app *application) chargeAuthFailure(r *http.Request) {
+	if !app.config.limiter.enabled {
+		return
+	}
+
+	_, err := app.limiter.Allow(r.Context(), app.authFailuresKey(r), app.authFailuresLimit())
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
+func (app *application) authFailuresKey(r *http.Request) string {
+	return authFailuresPolicy + "|ip:" + app.clientIP(r)
+}
+
+func (app *application) authFailuresLimit() ratelimit.Limit {
+	return ratelimit.Limit{Rate: app.config.limiter.rps, Burst: app.config.limiter.burst}
+}
+
+// ceilSeconds returns a duration in whole seconds, rounded up.
+func ceilSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
+// rateLimitKey returns the identity that a rate limit policy's buckets are
+// keyed by for this request. If the request doesn't come from the kind of
+// principal that the policy asks for, the client's IP address is used instead.
+func (app *application) rateLimitKey(r *http.Request, key string) string {
+	principal := app.contextGetPrincipal(r)
+
+	switch key {
+	case ratelimit.KeyUser:
+		if user, ok := principal.(*data.User); ok && !user.IsAnonymous() {
+			return principal.PrincipalID()
+		}
+	case ratelimit.KeyAPIKey:
+		// Service clients are keyed by client rather than by the individual
+		// key, so that rotating a key doesn't give the client a fresh bucket.
+		if _, ok := principal.(*data.ServiceClient); ok {
+			return principal.PrincipalID()
+		}
+	case ratelimit.KeyPrincipal:
+		if !principal.IsAnonymous() {
+			return principal.PrincipalID()
+		}
+	}
+
+	return "ip:" + app.clientIP(r)
+}
+
 // authenticate checks the authentication token to authenticate users, so the
 // app knows which user a request is coming from.
 func (app *application) authenticate(next http.Handler) http.Handler {
@@ -161,11 +226,67 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		// to any caches that the response may vary based on the value of the
 		// Authorization header in the request.
 		w.Header().Add("Vary", "Authorization")
+		w.Header().Add("Vary", "X-API-Key")
 
 		// Retrieve the value of the Authorization header from the request. This
 		// will return the empty string "" if there is no such header found.
 		authorizationHeader := r.Header.Get("Authorization")
 
+		// Service clients authenticate with an API key instead of a token,
+		// sent either in the X-API-Key header or as 'Authorization: ApiKey
+		// <key>'. A request must not carry both a key and a token, since we
+		// wouldn't know which of them it meant to use.
+		apiKey := r.Header.Get("X-API-Key")
+		if strings.HasPrefix(authorizationHeader, "ApiKey ") && apiKey == "" {
+			apiKey = strings.TrimPrefix(authorizationHeader, "ApiKey ")
+			authorizationHeader = ""
+		}
+
+		// Requests with credentials are refused straight away if the client
+		// has been sending bad ones, and charged if theirs are bad too.
+		if apiKey != "" || authorizationHeader != "" {
+			if !app.checkAuthFailures(w, r) {
+				return
+			}
+		}
+		invalidAPIKey := func() {
+			app.chargeAuthFailure(r)
+			app.invalidAPIKeyResponse(w, r)
+		}
+		invalidToken := func() {
+			app.chargeAuthFailure(r)
+			app.invalidAuthenticationTokenResponse(w, r)
+		}
+
+		if apiKey != "" {
+			if authorizationHeader != "" {
+				invalidAPIKey()
+				return
+			}
+
+			v := validator.New()
+
+			if data.ValidateAPIKeyPlaintext(v, apiKey); !v.Valid() {
+				invalidAPIKey()
+				return
+			}
+
+			client, err := app.models.Clients.GetForKey(r.Context(), apiKey)
+			if err != nil {
+				switch {
+				case errors.Is(err, data.ErrRecordNotFound):
+					invalidAPIKey()
+				default:
+					app.serverErrorResponse(w, r, err)
+				}
+				return
+			}
+
+			r = app.contextSetPrincipal(r, client)
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		// If there is no Authorization header found, use the contextSetUser()
 		// helper that we just made to add the AnonymousUser to the request
 		// context. Then we call the next handler in the chain and return
@@ -183,7 +304,7 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		// invalidAuthenticationTokenResponse() helper.
 		headerParts := strings.Split(authorizationHeader, " ")
 		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
-			app.invalidAuthenticationTokenResponse(w, r)
+			invalidToken()
 			return
 		}
 
@@ -198,23 +319,33 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		// rather than the failedValidationResponse() helper that we'd normally
 		// use.
 		if data.ValidateTokenPlaintext(v, token); !v.Valid() {
-			app.invalidAuthenticationTokenResponse(w, r)
+			invalidToken()
 			return
 		}
 
-		// Retrieve the details of the user associated with the authentication
+		// Look for the user in the cache first. If they aren't there, then
+		// retrieve the details of the user associated with the authentication
 		// token, again calling the invalidAuthenticationTokenResponse() helper
 		// if no matching record was found. IMPORTANT: Notice that we are using
 		// ScopeAuthentication as the first parameter here.
-		user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
-		if err != nil {
-			switch {
-			case errors.Is(err, data.ErrRecordNotFound):
-				app.invalidAuthenticationTokenResponse(w, r)
-			default:
-				app.serverErrorResponse(w, r, err)
+		user, ok := app.cache.userForToken(token)
+		if !ok {
+			generation := app.cache.version()
+
+			var expiry time.Time
+			var err error
+			user, expiry, err = app.models.Users.GetForToken(r.Context(), data.ScopeAuthentication, token)
+			if err != nil {
+				switch {
+				case errors.Is(err, data.ErrRecordNotFound):
+					invalidToken()
+				default:
+					app.serverErrorResponse(w, r, err)
+				}
+				return
 			}
-			return
+
+			app.cache.setUser(token, user, expiry, generation)
 		}
 
 		// Call the contextSetUser() helper to add the user information to the
@@ -293,12 +424,12 @@ func (app *application) requirePermission(code string, next http.HandlerFunc) ht
 	// Note that the first parameter for this middleware function is the
 	// permission code that we require the user to have.
 
-	fn := func(w http.ResponseWriter, r *http.Request) {
+	userFn := func(w http.ResponseWriter, r *http.Request) {
 		// Retrieve the user from the request context.
 		user := app.contextGetUser(r)
 
 		// Get the slice of permissions for the user.
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		permissions, err := app.getPermissions(r.Context(), user)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
@@ -316,21 +447,39 @@ func (app *application) requirePermission(code string, next http.HandlerFunc) ht
 		next.ServeHTTP(w, r)
 	}
 
-	// Wrap this with the requireActivatedUser() middleware before returning it.
+	// Wrap this with the requireActivatedUser() middleware.
 	//
 	// It means that when we use the requirePermission() middleware we'll
 	// actually be carrying out three checks which together ensure that the
 	// request is from an authenticated (non-anonymous), activated user, who has
 	// a specific permission.
-	return app.requireActivatedUser(fn)
+	userChecks := app.requireActivatedUser(userFn)
+
+	// Service clients don't have an activated flag, and their permissions are
+	// granted directly rather than through roles, so they are checked
+	// separately. GetForKey() already loaded the permissions in authenticate().
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, ok := app.contextGetPrincipal(r).(*data.ServiceClient)
+		if !ok {
+			userChecks(w, r)
+			return
+		}
+
+		if !client.Permissions.Include(code) {
+			app.notPermittedResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
 }
 
-// enableCORS check if the value of the request Origin header is an exact,
-// case-sensitive, match for one of our trusted origins. If there is a match,
-// then we should set an "Access-Control-Allow-Origin" response header which
+// enableCORS checks if the value of the request Origin header matches one of
+// the trusted origins in the CORS policy for the requested route. If there is
+// a match, then we set an "Access-Control-Allow-Origin" response header which
 // reflects (or echoes) back the value of the request's Origin header.
-// Otherwise, we should allow the request to proceed as normal without setting
-// that response header.
+// Otherwise, we allow the request to proceed as normal without setting that
+// response header, and the browser won't let the page read the response.
 // It also intercepts and responds to any preflight requests.
 // The purpose of this preflight request is to determine whether the real
 // cross-origin request will be permitted or not.
@@ -353,39 +502,50 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 		// Get the value of the request's Origin header.
 		origin := r.Header.Get("Origin")
 
-		// Only run this if there's an Origin request header present AND at
-		// least one trusted origin is configured.
-		if origin != "" && len(app.config.cors.trustedOrigins) != 0 {
-			// Loop through the list of trusted origins, checking to see if the
-			// request origin exactly matches one of them.
-			for i := range app.config.cors.trustedOrigins {
-				if origin == app.config.cors.trustedOrigins[i] {
-					// If there is a match, then set a
-					// 'Access-Control-Allow-Origin' response header with the
-					// request origin as the value.
-					w.Header().Set("Access-Control-Allow-Origin", origin)
-
-					// **** Identify it's a preflight cross-origin request ****
-					// Check if the request has the HTTP method OPTIONS and
-					// contains the "Access-Control-Request-Method" header. If
-					// it does, then we treat it as a preflight request.
-					if r.Method == http.MethodOptions &&
-						r.Header.Get("Access-Control-Request-Method") != "" {
-						// ***** Response with some special headers *****
-						// Set the necessary preflight response headers to let
-						// the browser know whether or not it's OK for the real
-						// request to proceed.
-						w.Header().Set("Access-Control-Allow-Methods",
-							"OPTIONS, PUT, PATCH, DELETE")
-						w.Header().Set("Access-Control-Allow-Headers",
-							"Authorization, Content-Type")
-
-						// Write the headers along with a 200 OK status and
-						// return from the middleware with no further action.
-						w.WriteHeader(http.StatusOK)
-						return
-					}
+		// Only run this if there's an Origin request header present AND the
+		// route's policy trusts it. A policy with no origins never does.
+		policy := app.corsPolicy(r)
+		if origin != "" && policy.AllowsOrigin(origin) {
+			// Echo the origin back rather than sending "*", even if every
+			// origin is trusted, because browsers refuse "*" for credentialed
+			// requests.
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+
+			if policy.AllowCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+
+			// **** Identify it's a preflight cross-origin request ****
+			// Check if the request has the HTTP method OPTIONS and contains
+			// the "Access-Control-Request-Method" header. If it does, then we
+			// treat it as a preflight request.
+			if r.Method == http.MethodOptions &&
+				r.Header.Get("Access-Control-Request-Method") != "" {
+				// ***** Response with some special headers *****
+				// Set the necessary preflight response headers to let the
+				// browser know whether or not it's OK for the real request to
+				// proceed, and for how long it may remember the answer.
+				w.Header().Set("Access-Control-Allow-Methods",
+					strings.Join(policy.AllowedMethods, ", "))
+				w.Header().Set("Access-Control-Allow-Headers",
+					strings.Join(policy.AllowedHeaders, ", "))
+
+				if policy.MaxAge > 0 {
+					w.Header().Set("Access-Control-Max-Age",
+						strconv.Itoa(int(policy.MaxAge/time.Second)))
 				}
+
+				// Write the headers along with a 200 OK status and return
+				// from the middleware with no further action.
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+
+			// Let scripts read the headers that they wouldn't otherwise be
+			// able to see, like the rate limit headers.
+			if len(policy.ExposedHeaders) != 0 {
+				w.Header().Set("Access-Control-Expose-Headers",
+					strings.Join(policy.ExposedHeaders, ", "))
 			}
 		}
 
@@ -394,14 +554,38 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 	})
 }
 
-// metrics records custom request-level metrics for our application.
+// corsPolicy returns the CORS policy for the request's route: the first of
+// the -cors-config routes whose pattern matches, or the default policy.
+func (app *application) corsPolicy(r *http.Request) *cors.Policy {
+	for _, p := range app.config.cors.routes {
+		if p.Matches(r.URL.Path) {
+			return p
+		}
+	}
+
+	return &app.config.cors.policy
+}
+
+// The expvar variables for the metrics() middleware. These are package-level
+// variables because expvar only lets each name be published once per process.
+var (
+	totalRequestsReceived           = expvar.NewInt("total_requests_received")
+	totalResponsesSent              = expvar.NewInt("total_responses_sent")
+	totalProcessingTimeMicroseconds = expvar.NewInt("total_processing_time_μs")
+	totalResponseSentByStatus       = expvar.NewMap("total_responses_sent_by_status")
+)
+
+// metrics records custom request-level metrics for our application. As well as
+// the expvar totals, it counts requests and records their latency in
+// app.registry for the Prometheus /metrics endpoint, labelled by method, route
+// pattern and status code.
 func (app *application) metrics(next http.Handler) http.Handler {
-	// Initialize the new expvar variables when the middleware chain is first
+	// Register the Prometheus metrics when the middleware chain is first
 	// built.
-	totalRequestsReceived := expvar.NewInt("total_requests_received")
-	totalResponsesSent := expvar.NewInt("total_responses_sent")
-	totalProcessingTimeMicroseconds := expvar.NewInt("total_processing_time_μs")
-	totalResponseSentByStatus := expvar.NewMap("total_responses_sent_by_status")
+	requests := app.registry.NewCounterVec("http_requests_total",
+		"Total number of HTTP requests.", "method", "route", "status")
+	duration := app.registry.NewHistogramVec("http_request_duration_seconds",
+		"HTTP request latency in seconds.", metrics.DefBuckets, "method", "route", "status")
 
 	// The following code will be run for every request.
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -431,7 +615,14 @@ func (app *application) metrics(next http.Handler) http.Handler {
 		// Call the httpsnoop.CaptureMetrics() function, passing in the next
 		// handler in the chain along with the existing http.ResponseWriter and
 		// http.Request. This returns the metrics struct.
-		metrics := httpsnoop.CaptureMetrics(next, w, r)
+		//
+		// The route pattern is only known once the router has matched the
+		// request, so put an empty routeMatch in the context for the handler
+		// to fill in.
+		match := &routeMatch{}
+		r = app.contextSetRouteMatch(r, match)
+
+		m := httpsnoop.CaptureMetrics(next, w, r)
 
 		// On the way back up the middleware chain, increment the number of
 		// responses sent by 1.
@@ -439,26 +630,76 @@ func (app *application) metrics(next http.Handler) http.Handler {
 
 		// Get the request processing time in microseconds from httpsnoop and
 		// increment the cumulative processing time.
-		totalProcessingTimeMicroseconds.Add(metrics.Duration.Microseconds())
+		totalProcessingTimeMicroseconds.Add(m.Duration.Microseconds())
 
 		// Use the Add() method to increment the count for the given status code
 		// by 1. Note that the expvar map is string-keyed, so we need to use the
 		// strconv.Itoa() function to convert the status code (which is an
 		// integer) to a string.
-		totalResponseSentByStatus.Add(strconv.Itoa(metrics.Code), 1)
+		totalResponseSentByStatus.Add(strconv.Itoa(m.Code), 1)
+
+		// Label by route pattern rather than by path, so that /v1/movies/1
+		// and /v1/movies/2 are counted together, and junk paths from scanners
+		// can't create an unbounded number of series. Requests which never
+		// reached a route handler (404s, and requests turned away by earlier
+		// middleware such as the rate limiter) are counted as "unmatched".
+		route, method := match.pattern, r.Method
+		if route == "" {
+			route, method = "unmatched", "other"
+		}
+		status := strconv.Itoa(m.Code)
+
+		requests.Inc(method, route, status)
+		duration.Observe(m.Duration.Seconds(), method, route, status)
+	})
+}
+
+// traceRequest gives every request a request ID and a place in a distributed
+// trace. A valid X-Request-ID header from the client is used as the request
+// ID, and a valid W3C traceparent header makes this request part of the
+// caller's trace; otherwise new ones are generated. Both are stored in the
+// request context, so that every log entry for the request can include them,
+// and sent back in the response headers so that the client can quote them
+// when something goes wrong.
+func (app *application) traceRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tc := tracing.New(r.Header.Get("X-Request-ID"), r.Header.Get("traceparent"))
+
+		w.Header().Set("X-Request-ID", tc.RequestID)
+		w.Header().Set("traceparent", tc.Traceparent())
+
+		r = r.WithContext(tracing.NewContext(r.Context(), tc))
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// realIP works out the client's IP address and stores it in the request
+// context, so that the rate limiter and the logs all agree on who the client
+// is. The X-Forwarded-For and X-Real-IP headers are only honoured when the
+// request comes directly from one of the -trusted-proxies; otherwise anyone
+// could dodge the rate limiter by sending a different address each time.
+func (app *application) realIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = app.contextSetClientIP(r, app.config.trustedProxies.clientIP(r))
+
+		next.ServeHTTP(w, r)
 	})
 }
 
 // logRequest logs HTTP requests. Specifically, we're using the logger to record
 // the IP address of the user, and which URL and method are being requested.
+// The remote_addr is the address of the direct peer, which is the proxy when
+// we're running behind one.
 func (app *application) logRequest(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Log a "request" message.
-		app.logger.PrintInfo("request", map[string]string{
-			"ip_addr":  r.RemoteAddr,
-			"protocol": r.Proto,
-			"method":   r.Method,
-			"path":     r.URL.RequestURI(),
+		app.loggerFor(r.Context()).PrintInfo("request", map[string]string{
+			"ip_addr":     app.clientIP(r),
+			"remote_addr": r.RemoteAddr,
+			"protocol":    r.Proto,
+			"method":      r.Method,
+			"path":        r.URL.RequestURI(),
 		})
 
 		next.ServeHTTP(w, r)
@@ -3,12 +3,21 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/cedrickchee/skel/internal/cors"
+	"github.com/cedrickchee/skel/internal/data"
 	"github.com/cedrickchee/skel/internal/jsonlog"
+	"github.com/cedrickchee/skel/internal/ratelimit"
 )
 
 // Initialize a new jsonlog.Logger.
@@ -74,3 +83,427 @@ Run:
 
 $ go test -v -run ^TestLogRequest$ github.com/cedrickchee/skel/cmd/api
 */
+
+func TestRateLimitPolicies(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.limiter.enabled = true
+	app.config.limiter.rps = 100
+	app.config.limiter.burst = 100
+	app.config.limiter.policies = []*ratelimit.Policy{
+		{
+			Name:    "login",
+			Method:  http.MethodPost,
+			Pattern: "/v1/tokens/authentication",
+			Key:     ratelimit.KeyIP,
+			Limit:   ratelimit.Limit{Rate: 5.0 / 60, Burst: 2},
+		},
+		{
+			Name:    "movies",
+			Pattern: "/v1/movies/:id",
+			Key:     ratelimit.KeyUser,
+			Limit:   ratelimit.Limit{Rate: 0.001, Burst: 1},
+		},
+	}
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	t.Run("Per IP", func(t *testing.T) {
+		body := `{"email": "nobody@example.com", "password": "pa55word"}`
+
+		for i, want := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests} {
+			rs, err := ts.Client().Post(ts.URL+"/v1/tokens/authentication", "application/json", strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			rs.Body.Close()
+
+			if rs.StatusCode != want {
+				t.Fatalf("request %d: want %d; got %d", i+1, want, rs.StatusCode)
+			}
+		}
+
+		// Other routes are limited by the default policy, so they're
+		// unaffected.
+		code, _, _ := ts.get(t, "/v1/healthcheck")
+		if code != http.StatusOK {
+			t.Errorf("want %d; got %d", http.StatusOK, code)
+		}
+	})
+
+	t.Run("Per user", func(t *testing.T) {
+		john := newTestToken(t, app, "john@example.com")
+		jane := newTestToken(t, app, "jane@example.com")
+
+		// Every request comes from the same IP address, but each user has a
+		// bucket of their own.
+		for _, tt := range []struct {
+			token *data.Token
+			want  int
+		}{
+			{john, http.StatusOK},
+			{john, http.StatusTooManyRequests},
+			{jane, http.StatusOK},
+		} {
+			code, _, _ := ts.authenticatedGet(t, tt.token, "/v1/movies/1")
+			if code != tt.want {
+				t.Fatalf("want %d; got %d", tt.want, code)
+			}
+		}
+	})
+}
+
+// countingUserModel is a MockUserModel which counts the token lookups.
+type countingUserModel struct {
+	data.MockUserModel
+	lookups int64
+}
+
+func (m *countingUserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*data.User, time.Time, error) {
+	atomic.AddInt64(&m.lookups, 1)
+	return m.MockUserModel.GetForToken(ctx, tokenScope, tokenPlaintext)
+}
+
+func TestRateLimitFailedAuthentication(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.limiter.enabled = true
+	app.config.limiter.rps = 0.001
+	app.config.limiter.burst = 2
+	// The movies are limited per user, generously, so only the failed
+	// authentications can run out.
+	app.config.limiter.policies = []*ratelimit.Policy{
+		{
+			Name:    "movies",
+			Pattern: "/v1/movies/:id",
+			Key:     ratelimit.KeyUser,
+			Limit:   ratelimit.Limit{Rate: 100, Burst: 100},
+		},
+	}
+	app.cache = newAuthCache(0)
+
+	users := &countingUserModel{}
+	app.models.Users = users
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	// Successful authentications aren't charged.
+	john := newTestToken(t, app, "john@example.com")
+	for i := 0; i < 3; i++ {
+		code, _, _ := ts.authenticatedGet(t, john, "/v1/movies/1")
+		if code != http.StatusOK {
+			t.Fatalf("want %d; got %d", http.StatusOK, code)
+		}
+	}
+
+	unknown := &data.Token{Plaintext: "ABCDEFGHIJKLMNOPQRSTUVWXYZ"}
+	for i, want := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests} {
+		code, _, _ := ts.authenticatedGet(t, unknown, "/v1/movies/1")
+		if code != want {
+			t.Fatalf("request %d: want %d; got %d", i+1, want, code)
+		}
+	}
+
+	// Once the client has run out, bad credentials are refused before they're
+	// looked up, whether they're tokens or API keys.
+	if got := atomic.LoadInt64(&users.lookups); got != 5 {
+		t.Errorf("want 5 token lookups; got %d", got)
+	}
+
+	rq, err := http.NewRequest(http.MethodGet, ts.URL+"/v1/movies/1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rq.Header.Set("X-API-Key", "skel_nope")
+	rs, err := ts.Client().Do(rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.Body.Close()
+	if rs.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("want %d for an API key; got %d", http.StatusTooManyRequests, rs.StatusCode)
+	}
+
+	// Requests without credentials have their own buckets.
+	code, _, _ := ts.get(t, "/v1/healthcheck")
+	if code != http.StatusOK {
+		t.Errorf("want %d; got %d", http.StatusOK, code)
+	}
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.limiter.enabled = true
+	// One request every 30 seconds, with a burst of 2.
+	app.config.limiter.rps = 1.0 / 30
+	app.config.limiter.burst = 2
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	tests := []struct {
+		wantCode       int
+		wantRemaining  string
+		wantReset      string
+		wantRetryAfter string
+	}{
+		{http.StatusOK, "1", "30", ""},
+		{http.StatusOK, "0", "60", ""},
+		{http.StatusTooManyRequests, "0", "60", "30"},
+	}
+
+	for i, tt := range tests {
+		code, header, _ := ts.get(t, "/v1/healthcheck")
+
+		if code != tt.wantCode {
+			t.Fatalf("request %d: want %d; got %d", i+1, tt.wantCode, code)
+		}
+
+		// The bucket refills a little between requests, so allow the times
+		// to be a second out.
+		want := map[string][]string{
+			"RateLimit-Limit":     {"2"},
+			"RateLimit-Remaining": {tt.wantRemaining},
+			"RateLimit-Reset":     {tt.wantReset, decrement(tt.wantReset)},
+			"Retry-After":         {tt.wantRetryAfter, decrement(tt.wantRetryAfter)},
+		}
+		for name, values := range want {
+			got := header.Get(name)
+			if got != values[0] && got != values[1] {
+				t.Errorf("request %d: want %s %q; got %q", i+1, name, values[0], got)
+			}
+		}
+	}
+}
+
+// decrement returns the integer in s minus one, or s itself if it isn't an
+// integer.
+func decrement(s string) string {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return s
+	}
+	return strconv.Itoa(n - 1)
+}
+
+func TestEnableCORS(t *testing.T) {
+	app := newTestApplication(t)
+	app.config.cors.policy = cors.Policy{
+		Origins:        []string{"https://*.example.com"},
+		AllowedMethods: cors.DefaultAllowedMethods,
+		AllowedHeaders: cors.DefaultAllowedHeaders,
+		ExposedHeaders: []string{"RateLimit-Remaining"},
+	}
+	app.config.cors.routes = []*cors.Policy{
+		{
+			Pattern:          "/v1/movies/:id",
+			Origins:          []string{"https://app.example.com"},
+			AllowCredentials: true,
+			AllowedMethods:   []string{"PATCH", "DELETE"},
+			AllowedHeaders:   cors.DefaultAllowedHeaders,
+			ExposedHeaders:   []string{"ETag", "Link"},
+			MaxAge:           10 * time.Minute,
+		},
+	}
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	do := func(t *testing.T, method, path, origin string) (int, http.Header) {
+		t.Helper()
+
+		req, err := http.NewRequest(method, ts.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Origin", origin)
+		if method == http.MethodOptions {
+			req.Header.Set("Access-Control-Request-Method", http.MethodDelete)
+		}
+
+		rs, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rs.Body.Close()
+
+		return rs.StatusCode, rs.Header
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		origin string
+		want   map[string]string
+	}{
+		{
+			name:   "Wildcard origin",
+			method: http.MethodGet,
+			path:   "/v1/healthcheck",
+			origin: "https://www.example.com",
+			want: map[string]string{
+				"Access-Control-Allow-Origin":      "https://www.example.com",
+				"Access-Control-Allow-Credentials": "",
+				"Access-Control-Expose-Headers":    "RateLimit-Remaining",
+			},
+		},
+		{
+			name:   "Untrusted origin",
+			method: http.MethodGet,
+			path:   "/v1/healthcheck",
+			origin: "https://example.com",
+			want: map[string]string{
+				"Access-Control-Allow-Origin":   "",
+				"Access-Control-Expose-Headers": "",
+			},
+		},
+		{
+			name:   "Default preflight",
+			method: http.MethodOptions,
+			path:   "/v1/movies",
+			origin: "https://www.example.com",
+			want: map[string]string{
+				"Access-Control-Allow-Origin":  "https://www.example.com",
+				"Access-Control-Allow-Methods": "OPTIONS, PUT, PATCH, DELETE",
+				"Access-Control-Allow-Headers": "Authorization, Content-Type",
+				"Access-Control-Max-Age":       "",
+			},
+		},
+		{
+			name:   "Route preflight",
+			method: http.MethodOptions,
+			path:   "/v1/movies/1",
+			origin: "https://app.example.com",
+			want: map[string]string{
+				"Access-Control-Allow-Origin":      "https://app.example.com",
+				"Access-Control-Allow-Credentials": "true",
+				"Access-Control-Allow-Methods":     "PATCH, DELETE",
+				"Access-Control-Max-Age":           "600",
+			},
+		},
+		{
+			name:   "Route exposed headers",
+			method: http.MethodGet,
+			path:   "/v1/movies/1",
+			origin: "https://app.example.com",
+			want: map[string]string{
+				"Access-Control-Allow-Credentials": "true",
+				"Access-Control-Expose-Headers":    "ETag, Link",
+			},
+		},
+		{
+			name:   "Route overrides origins",
+			method: http.MethodGet,
+			path:   "/v1/movies/1",
+			origin: "https://www.example.com",
+			want: map[string]string{
+				"Access-Control-Allow-Origin": "",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, header := do(t, tt.method, tt.path, tt.origin)
+
+			if tt.method == http.MethodOptions && tt.want["Access-Control-Allow-Origin"] != "" && code != http.StatusOK {
+				t.Errorf("want %d; got %d", http.StatusOK, code)
+			}
+
+			for name, want := range tt.want {
+				if got := header.Get(name); got != want {
+					t.Errorf("want %s %q; got %q", name, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestTraceRequest(t *testing.T) {
+	app := newTestApplication(t)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	t.Run("From headers", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/v1/movies/1", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Request-ID", "abc-123")
+		req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+		rs, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rs.Body.Close()
+
+		if got := rs.Header.Get("X-Request-ID"); got != "abc-123" {
+			t.Errorf("want X-Request-ID %q; got %q", "abc-123", got)
+		}
+		if got := rs.Header.Get("traceparent"); !strings.HasPrefix(got, "00-4bf92f3577b34da6a3ce929d0e0e4736-") || strings.Contains(got, "00f067aa0ba902b7") {
+			t.Errorf("want traceparent for a new span in the same trace; got %q", got)
+		}
+	})
+
+	t.Run("Generated", func(t *testing.T) {
+		code, header, _ := ts.get(t, "/v1/healthcheck")
+		if code != http.StatusOK {
+			t.Fatalf("want %d; got %d", http.StatusOK, code)
+		}
+
+		if len(header.Get("X-Request-ID")) != 32 || header.Get("traceparent") == "" {
+			t.Errorf("want generated IDs; got %q and %q", header.Get("X-Request-ID"), header.Get("traceparent"))
+		}
+	})
+}
+
+func TestMetrics(t *testing.T) {
+	app := newTestApplication(t)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	john := newTestToken(t, app, "john@example.com")
+	jane := newTestToken(t, app, "jane@example.com")
+
+	ts.authenticatedGet(t, john, "/v1/movies/1")
+	ts.authenticatedGet(t, john, "/v1/movies/1")
+	ts.get(t, "/v1/movies/2")
+	ts.get(t, "/no/such/path")
+
+	// Only principals with the metrics:read permission can see the metrics.
+	if code, _, _ := ts.get(t, "/metrics"); code != http.StatusUnauthorized {
+		t.Errorf("want %d; got %d", http.StatusUnauthorized, code)
+	}
+	if code, _, _ := ts.authenticatedGet(t, john, "/metrics"); code != http.StatusForbidden {
+		t.Errorf("want %d; got %d", http.StatusForbidden, code)
+	}
+
+	code, header, body := ts.authenticatedGet(t, jane, "/metrics")
+	if code != http.StatusOK {
+		t.Fatalf("want %d; got %d", http.StatusOK, code)
+	}
+	if ct := header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("unexpected Content-Type %q", ct)
+	}
+
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		`http_requests_total{method="GET",route="/v1/movies/:id",status="200"} 2`,
+		`http_requests_total{method="GET",route="/v1/movies/:id",status="401"} 1`,
+		`http_requests_total{method="other",route="unmatched",status="404"} 1`,
+		`http_requests_total{method="GET",route="/metrics",status="403"} 1`,
+		`http_request_duration_seconds_count{method="GET",route="/v1/movies/:id",status="200"} 2`,
+	} {
+		if !strings.Contains(string(b), want+"\n") {
+			t.Errorf("want %q in metrics:\n%s", want, b)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/cedrickchee/skel/internal/jsonlog"
+	"github.com/cedrickchee/skel/internal/migrate"
+	"github.com/cedrickchee/skel/migrations"
+)
+
+// migrateUsage describes the migrate subcommand.
+const migrateUsage = `usage: api [flags] migrate <command>
+
+commands:
+  up         apply all pending migrations
+  down [N]   roll back the last N migrations (default 1)
+  goto V     migrate up or down to version V (0 rolls back everything)
+  force V    mark the database as clean at version V, after fixing a failed
+             migration by hand (0 means no migrations applied)
+  status     show the database version and which migrations are applied`
+
+// errMigrateUsage is returned by runMigrate() when its arguments are wrong.
+var errMigrateUsage = errors.New(migrateUsage)
+
+// runMigrate runs the migrate subcommand: `api migrate up|down|goto|force|status`.
+// The migrations are embedded in the binary, so nothing needs to be shipped
+// alongside it, and status is written to out.
+func runMigrate(ctx context.Context, db *sql.DB, logger *jsonlog.Logger, out io.Writer, args []string) error {
+	m, err := migrate.New(db, migrations.FS, logger)
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		return errMigrateUsage
+	}
+
+	// Read the version or count argument, for the commands which take one.
+	arg := func(def int64) (int64, error) {
+		switch len(args) {
+		case 1:
+			if def < 0 {
+				return 0, errMigrateUsage
+			}
+			return def, nil
+		case 2:
+			n, err := strconv.ParseInt(args[1], 10, 64)
+			if err != nil || n < 0 {
+				return 0, errMigrateUsage
+			}
+			return n, nil
+		default:
+			return 0, errMigrateUsage
+		}
+	}
+
+	// Version 0 on the command line means no migrations at all.
+	version := func(v int64) int64 {
+		if v == 0 {
+			return migrate.NilVersion
+		}
+		return v
+	}
+
+	switch args[0] {
+	case "up":
+		if len(args) != 1 {
+			return errMigrateUsage
+		}
+		return m.Up(ctx)
+	case "down":
+		n, err := arg(1)
+		if err != nil || n == 0 {
+			return errMigrateUsage
+		}
+		return m.Down(ctx, int(n))
+	case "goto":
+		v, err := arg(-1)
+		if err != nil {
+			return err
+		}
+		return m.Goto(ctx, version(v))
+	case "force":
+		v, err := arg(-1)
+		if err != nil {
+			return err
+		}
+		return m.Force(ctx, version(v))
+	case "status":
+		if len(args) != 1 {
+			return errMigrateUsage
+		}
+		return migrateStatus(ctx, m, out)
+	default:
+		return errMigrateUsage
+	}
+}
+
+// migrateStatus writes the database's version, and each migration with
+// whether it has been applied.
+func migrateStatus(ctx context.Context, m *migrate.Migrator, out io.Writer) error {
+	current, dirty, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case current == migrate.NilVersion && !dirty:
+		fmt.Fprintln(out, "version: none")
+	case dirty:
+		fmt.Fprintf(out, "version: %d (dirty)\n", current)
+	default:
+		fmt.Fprintf(out, "version: %d\n", current)
+	}
+
+	for _, migration := range m.Migrations() {
+		state := "pending"
+		if current != migrate.NilVersion && migration.Version <= current {
+			state = "applied"
+		}
+		fmt.Fprintf(out, "%06d %-8s %s\n", migration.Version, state, migration.Name)
+	}
+
+	return nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestRunMigrateUsage(t *testing.T) {
+	// None of these get as far as the database, so there doesn't need to be
+	// one.
+	tests := [][]string{
+		{},
+		{"sideways"},
+		{"up", "3"},
+		{"down", "0"},
+		{"down", "x"},
+		{"goto"},
+		{"goto", "-1"},
+		{"force"},
+		{"status", "now"},
+	}
+
+	for _, args := range tests {
+		err := runMigrate(context.Background(), nil, nil, &bytes.Buffer{}, args)
+		if !errors.Is(err, errMigrateUsage) {
+			t.Errorf("runMigrate(%q): want usage error; got %v", args, err)
+		}
+	}
+}
@@ -42,6 +42,8 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 		Year:    input.Year,
 		Runtime: input.Runtime,
 		Genres:  input.Genres,
+		// Record the user creating the movie as its owner.
+		CreatedBy: app.contextGetUser(r).ID,
 	}
 
 	// Initialize a new Validator instance.
@@ -57,9 +59,17 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 	// Call the Insert() method on our movies model, passing in a pointer to the
 	// validated movie struct. This will create a record in the database and
 	// update the movie struct with the system-generated information.
-	err = app.models.Movies.Insert(movie)
+	err = app.models.Movies.Insert(r.Context(), movie)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		// The database's constraints back up ValidateMovie(), so a
+		// ConstraintError is the client's fault rather than ours.
+		var cErr *data.ConstraintError
+		switch {
+		case errors.As(err, &cErr):
+			app.constraintViolationResponse(w, r, cErr)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
@@ -95,7 +105,7 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 	// need to use the errors.Is() function to check if it returns a
 	// data.ErrRecordNotFound error, in which case we send a 404 Not Found
 	// response to the client.
-	movie, err := app.models.Movies.Get(id)
+	movie, err := app.models.Movies.Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -123,7 +133,7 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 
 	// Fetch the existing movie record from the database, sending a 404 Not
 	// Found response to the client if we couldn't find a matching record.
-	movie, err := app.models.Movies.Get(id)
+	movie, err := app.models.Movies.Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -134,6 +144,19 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	// Check that the user is allowed to change this particular movie. The
+	// requirePermission() middleware has already checked for "movies:write",
+	// but that only covers the movies the user owns.
+	ok, err := app.authorizeOwner(r, "movies:write", movie.CreatedBy)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !ok {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
 	// Declare an input struct to hold the expected data from the client.
 	// Note that all the fields have the zero-value nil.
 	var input struct {
@@ -187,11 +210,14 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 
 	// Pass the updated movie record to our new Update() method. Intercept any
 	// ErrEditConflict error and call the new editConflictResponse() helper.
-	err = app.models.Movies.Update(movie)
+	err = app.models.Movies.Update(r.Context(), movie)
 	if err != nil {
+		var cErr *data.ConstraintError
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
 			app.editConflictResponse(w, r)
+		case errors.As(err, &cErr):
+			app.constraintViolationResponse(w, r, cErr)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
@@ -213,9 +239,32 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	// Fetch the movie so that we know who owns it, and check that the user is
+	// allowed to delete it.
+	movie, err := app.models.Movies.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	ok, err := app.authorizeOwner(r, "movies:write", movie.CreatedBy)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !ok {
+		app.notPermittedResponse(w, r)
+		return
+	}
+
 	// Delete the movie from the database, sending a 404 Not Found response to
 	// the client if there isn't a matching record.
-	err = app.models.Movies.Delete(id)
+	err = app.models.Movies.Delete(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -278,7 +327,7 @@ func (app *application) listMovieHandler(w http.ResponseWriter, r *http.Request)
 
 	// Call the GetAll() method to retrieve the movies, passing in the various
 	// filter parameters.
-	movies, metadata, err := app.models.Movies.GetAll(input.Title, input.Genres,
+	movies, metadata, err := app.models.Movies.GetAll(r.Context(), input.Title, input.Genres,
 		input.Filters)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
+	"strings"
 	"testing"
 	"time"
 
@@ -38,11 +40,11 @@ func TestShowMovieHandler(t *testing.T) {
 		{"Trailing slash", "/v1/movies/1/", http.StatusMovedPermanently, "", ""},
 	}
 
-	user, err := app.models.Users.GetByEmail("john@example.com")
+	user, err := app.models.Users.GetByEmail(context.Background(), "john@example.com")
 	if err != nil {
 		t.Fatal(err)
 	}
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	token, err := app.models.Tokens.New(context.Background(), user.ID, 24*time.Hour, data.ScopeAuthentication)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -82,8 +84,235 @@ func TestShowMovieHandler(t *testing.T) {
 	}
 }
 
+func TestUpdateMovieHandler(t *testing.T) {
+	app := newTestApplication(t)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	// The mock movie with ID 1 is owned by john@example.com. Ed is an editor
+	// who doesn't own it, and Jane is an admin with "movies:write:any".
+	tests := []struct {
+		name     string
+		email    string
+		urlPath  string
+		wantCode int
+	}{
+		{"Owner", "john@example.com", "/v1/movies/1", http.StatusOK},
+		{"Editor not owner", "ed@example.com", "/v1/movies/1", http.StatusForbidden},
+		{"Admin", "jane@example.com", "/v1/movies/1", http.StatusOK},
+		{"Non-existent ID", "jane@example.com", "/v1/movies/2", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := newTestToken(t, app, tt.email)
+			body := strings.NewReader(`{"title": "Casablanca"}`)
+
+			code, _, _ := ts.authenticatedRequest(t, token, http.MethodPatch, tt.urlPath, body)
+			if code != tt.wantCode {
+				t.Errorf("want %d; got %d", tt.wantCode, code)
+			}
+		})
+	}
+}
+
+func TestDeleteMovieHandler(t *testing.T) {
+	app := newTestApplication(t)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	tests := []struct {
+		name     string
+		email    string
+		urlPath  string
+		wantCode int
+	}{
+		{"Owner", "john@example.com", "/v1/movies/1", http.StatusOK},
+		{"Editor not owner", "ed@example.com", "/v1/movies/1", http.StatusForbidden},
+		{"Admin", "jane@example.com", "/v1/movies/1", http.StatusOK},
+		{"Non-existent ID", "john@example.com", "/v1/movies/2", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := newTestToken(t, app, tt.email)
+
+			code, _, _ := ts.authenticatedRequest(t, token, http.MethodDelete, tt.urlPath, nil)
+			if code != tt.wantCode {
+				t.Errorf("want %d; got %d", tt.wantCode, code)
+			}
+		})
+	}
+}
+
+// constraintMovieModel is a mock movie model whose Insert() fails with err,
+// as if the database had refused the movie.
+type constraintMovieModel struct {
+	data.MockMovieModel
+	err error
+}
+
+func (m constraintMovieModel) Insert(ctx context.Context, movie *data.Movie) error {
+	return m.err
+}
+
+func TestCreateMovieHandlerConstraintViolation(t *testing.T) {
+	tests := []struct {
+		name        string
+		err         *data.ConstraintError
+		wantCode    int
+		wantMessage interface{}
+	}{
+		{
+			name:        "Check",
+			err:         &data.ConstraintError{Kind: data.ErrCheckViolation, Constraint: "movies_year_check", Field: "year", Message: "must be between 1888 and the current year"},
+			wantCode:    http.StatusUnprocessableEntity,
+			wantMessage: map[string]interface{}{"year": "must be between 1888 and the current year"},
+		},
+		{
+			name:        "Unique",
+			err:         &data.ConstraintError{Kind: data.ErrUniqueViolation, Constraint: "movies_title_key", Field: "title", Message: "a movie with this title already exists"},
+			wantCode:    http.StatusConflict,
+			wantMessage: map[string]interface{}{"title": "a movie with this title already exists"},
+		},
+		{
+			name:        "Unknown constraint",
+			err:         &data.ConstraintError{Kind: data.ErrForeignKeyViolation, Constraint: "movies_studio_fkey"},
+			wantCode:    http.StatusUnprocessableEntity,
+			wantMessage: "unable to save the record because it conflicts with existing data",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.models.Movies = constraintMovieModel{err: tt.err}
+
+			ts := newTestServer(t, app.routes())
+			defer ts.Close()
+
+			token := newTestToken(t, app, "ed@example.com")
+			body := strings.NewReader(`{"title": "Moana", "year": 2016, "runtime": "107 mins", "genres": ["animation"]}`)
+
+			code, _, rs := ts.authenticatedRequest(t, token, http.MethodPost, "/v1/movies", body)
+			defer rs.Close()
+
+			if code != tt.wantCode {
+				t.Errorf("want %d; got %d", tt.wantCode, code)
+			}
+
+			var got struct {
+				Error interface{} `json:"error"`
+			}
+			err := json.NewDecoder(rs).Decode(&got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEqual(t, got.Error, tt.wantMessage)
+		})
+	}
+}
+
+func TestListMovieHandler(t *testing.T) {
+	app := newMemoryTestApplication(t)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	// An activated editor, who can both create and list movies.
+	ctx := context.Background()
+	user := &data.User{Name: "Ed", Email: "ed@example.com", Activated: true}
+	err := user.Password.Set("pa55word")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = app.models.Users.Insert(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = app.models.Roles.AddForUser(ctx, user.ID, "editor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := newTestToken(t, app, user.Email)
+
+	for _, movie := range []string{
+		`{"title": "Moana", "year": 2016, "runtime": "107 mins", "genres": ["animation", "adventure"]}`,
+		`{"title": "Black Panther", "year": 2018, "runtime": "134 mins", "genres": ["action", "adventure"]}`,
+		`{"title": "The Breakfast Club", "year": 1985, "runtime": "97 mins", "genres": ["comedy", "drama"]}`,
+	} {
+		code, _, _ := ts.authenticatedRequest(t, token, http.MethodPost, "/v1/movies", strings.NewReader(movie))
+		if code != http.StatusCreated {
+			t.Fatalf("want %d creating a movie; got %d", http.StatusCreated, code)
+		}
+	}
+
+	tests := []struct {
+		name         string
+		urlPath      string
+		wantTitles   []string
+		wantMetadata data.Metadata
+	}{
+		{
+			name:         "All",
+			urlPath:      "/v1/movies",
+			wantTitles:   []string{"Moana", "Black Panther", "The Breakfast Club"},
+			wantMetadata: data.Metadata{CurrentPage: 1, PageSize: 20, FirstPage: 1, LastPage: 1, TotalRecords: 3},
+		},
+		{
+			name:         "Genre and sort",
+			urlPath:      "/v1/movies?genres=adventure&sort=-year",
+			wantTitles:   []string{"Black Panther", "Moana"},
+			wantMetadata: data.Metadata{CurrentPage: 1, PageSize: 20, FirstPage: 1, LastPage: 1, TotalRecords: 2},
+		},
+		{
+			name:         "Title and page",
+			urlPath:      "/v1/movies?title=the+club&page=1&page_size=1",
+			wantTitles:   []string{"The Breakfast Club"},
+			wantMetadata: data.Metadata{CurrentPage: 1, PageSize: 1, FirstPage: 1, LastPage: 1, TotalRecords: 1},
+		},
+		{
+			name:         "Past the last page",
+			urlPath:      "/v1/movies?sort=runtime&page=4&page_size=1",
+			wantTitles:   nil,
+			wantMetadata: data.Metadata{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _, body := ts.authenticatedGet(t, token, tt.urlPath)
+			defer body.Close()
+
+			if code != http.StatusOK {
+				t.Fatalf("want %d; got %d", http.StatusOK, code)
+			}
+
+			var got struct {
+				Metadata data.Metadata `json:"metadata"`
+				Movies   []data.Movie  `json:"movies"`
+			}
+			err := json.NewDecoder(body).Decode(&got)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var titles []string
+			for _, movie := range got.Movies {
+				titles = append(titles, movie.Title)
+			}
+
+			assertEqual(t, titles, tt.wantTitles)
+			assertEqual(t, got.Metadata, tt.wantMetadata)
+		})
+	}
+}
+
 /*
 Run:
 
 $ go test -v -run ^TestShowMovieHandler$ github.com/cedrickchee/skel/cmd/api
+$ go test -v -run "^Test(Update|Delete|List)MovieHandler$" github.com/cedrickchee/skel/cmd/api
 */
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cedrickchee/skel/internal/data"
+	"github.com/cedrickchee/skel/internal/oidc"
+	"github.com/cedrickchee/skel/internal/validator"
+)
+
+// oidcCookieName is the name of the cookie which carries the state, nonce and
+// PKCE code verifier from the start of an OpenID Connect login to the callback.
+const oidcCookieName = "oidc_login"
+
+// oidcLogin is the data stored in the oidcCookieName cookie.
+type oidcLogin struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+}
+
+// oidcProvider returns the identity provider named in the URL, or sends a 404
+// Not Found response and returns false if there isn't one.
+func (app *application) oidcProvider(w http.ResponseWriter, r *http.Request) (string, *oidc.Provider, bool) {
+	name := app.readStringParam(r, "provider")
+
+	provider, ok := app.oidc[name]
+	if !ok {
+		app.notFoundResponse(w, r)
+		return "", nil, false
+	}
+
+	return name, provider, true
+}
+
+// oidcStartHandler begins an OpenID Connect login by redirecting the user to
+// the identity provider.
+//
+// Rather than keeping pending logins on the server, we generate a random
+// state, nonce and PKCE code verifier and store them in a short-lived HttpOnly
+// cookie. When the provider sends the user back to the callback, the state in
+// the URL must match the one in the cookie, which proves that the login was
+// started by the same browser (and not by an attacker trying to log the user
+// in to the attacker's account).
+func (app *application) oidcStartHandler(w http.ResponseWriter, r *http.Request) {
+	name, provider, ok := app.oidcProvider(w, r)
+	if !ok {
+		return
+	}
+
+	var login oidcLogin
+
+	for _, s := range []*string{&login.State, &login.Nonce, &login.Verifier} {
+		var err error
+		*s, err = oidc.RandomString()
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	authURL, err := provider.AuthCodeURL(r.Context(), login.State, login.Nonce, oidc.Challenge(login.Verifier))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	js, err := json.Marshal(login)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:  oidcCookieName,
+		Value: base64.RawURLEncoding.EncodeToString(js),
+		// Only send the cookie to this provider's callback.
+		Path:     "/v1/auth/oidc/" + name + "/",
+		MaxAge:   int((10 * time.Minute).Seconds()),
+		HttpOnly: true,
+		Secure:   app.config.env != "development" && app.config.env != "test",
+		// The callback is reached by a top-level redirect from the provider's
+		// site, so the cookie can't be SameSite=Strict.
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// oidcCallbackHandler completes an OpenID Connect login. It exchanges the
+// authorization code for an ID token, verifies the token, finds or creates the
+// matching user and then issues them an authentication token, exactly as if
+// they had logged in with their password.
+func (app *application) oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	name, provider, ok := app.oidcProvider(w, r)
+	if !ok {
+		return
+	}
+
+	// Whatever happens, the cookie can't be used again.
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookieName,
+		Value:    "",
+		Path:     "/v1/auth/oidc/" + name + "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+
+	qs := r.URL.Query()
+
+	// The provider sends the user back with an error parameter if they
+	// refused consent, or if something else went wrong at its end.
+	if qs.Get("error") != "" {
+		app.logError(r, errors.New("oidc: provider returned error: "+qs.Get("error")+" "+qs.Get("error_description")))
+		app.oidcLoginFailedResponse(w, r)
+		return
+	}
+
+	login, err := readOIDCCookie(r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	state := qs.Get("state")
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(login.State)) != 1 {
+		app.badRequestResponse(w, r, errors.New("login state does not match"))
+		return
+	}
+
+	rawIDToken, err := provider.Exchange(r.Context(), qs.Get("code"), login.Verifier)
+	if err != nil {
+		app.logError(r, err)
+		app.oidcLoginFailedResponse(w, r)
+		return
+	}
+
+	claims, err := provider.Verify(r.Context(), rawIDToken, login.Nonce)
+	if err != nil {
+		app.logError(r, err)
+		app.oidcLoginFailedResponse(w, r)
+		return
+	}
+
+	// We link accounts by email address, so we must only trust addresses
+	// which the provider has verified. Otherwise anybody could sign up with
+	// the provider using somebody else's address and take over their account.
+	if claims.Email == "" || !bool(claims.EmailVerified) {
+		app.unverifiedEmailResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+
+	user, err := app.oidcUser(r.Context(), v, claims)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	token, err := app.models.Tokens.New(r.Context(), user.ID, 24*time.Hour, data.ScopeAuthentication)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// oidcUser returns the user with the verified email address from the ID token
+// claims, activating them if necessary. If there is no such user, a new,
+// activated user is created with the default roles. If the claims don't make a
+// valid user, the errors are added to v and the returned user is nil.
+func (app *application) oidcUser(ctx context.Context, v *validator.Validator, claims *oidc.Claims) (*data.User, error) {
+	user, err := app.models.Users.GetByEmail(ctx, claims.Email)
+
+	switch {
+	case err == nil:
+		// The provider has verified that the user owns the email address,
+		// which is all that the activation email would have done.
+		if !user.Activated {
+			err = app.activateOIDCUser(ctx, user)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return user, nil
+
+	case !errors.Is(err, data.ErrRecordNotFound):
+		return nil, err
+	}
+
+	name := claims.Name
+	if name == "" {
+		name = strings.SplitN(claims.Email, "@", 2)[0]
+	}
+
+	user = &data.User{
+		Name:      name,
+		Email:     claims.Email,
+		Activated: true,
+	}
+
+	// The user will always log in through the provider, but every user must
+	// have a password, so give them a random one. They can still choose their
+	// own later with the password reset flow.
+	password, err := oidc.RandomString()
+	if err != nil {
+		return nil, err
+	}
+
+	err = user.Password.Set(password)
+	if err != nil {
+		return nil, err
+	}
+
+	if data.ValidateUser(v, user); !v.Valid() {
+		return nil, nil
+	}
+
+	// Create the user and give them their roles in one transaction, so that
+	// a failure can't leave behind a user without any.
+	err = app.models.Transaction(ctx, func(ctx context.Context, tx data.Models) error {
+		err := tx.Users.Insert(ctx, user)
+		if err != nil {
+			return err
+		}
+
+		if len(app.config.roles.defaults) > 0 {
+			return tx.Roles.AddForUser(ctx, user.ID, app.config.roles.defaults...)
+		}
+
+		return nil
+	})
+	if err != nil {
+		// If the same user logged in twice at the same time, the other
+		// request may have just created them. The transaction has been
+		// rolled back by now, so we look them up outside of it.
+		if errors.Is(err, data.ErrDuplicateEmail) {
+			return app.models.Users.GetByEmail(ctx, claims.Email)
+		}
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// activateOIDCUser activates an existing user who has just proven, through an
+// identity provider, that they own the email address. Nothing proves that
+// whoever registered the account did: somebody could have signed up with the
+// address first, waiting for its owner to sign in. So the password they chose
+// is replaced with a random one, and any tokens issued for the account are
+// deleted, in one transaction. The owner can set a password of their own with
+// the password reset flow.
+func (app *application) activateOIDCUser(ctx context.Context, user *data.User) error {
+	password, err := oidc.RandomString()
+	if err != nil {
+		return err
+	}
+
+	err = user.Password.Set(password)
+	if err != nil {
+		return err
+	}
+	user.Activated = true
+
+	err = app.models.Transaction(ctx, func(ctx context.Context, tx data.Models) error {
+		err := tx.Users.Update(ctx, user)
+		if err != nil {
+			return err
+		}
+
+		for _, scope := range []string{data.ScopeAuthentication, data.ScopeActivation, data.ScopePasswordReset} {
+			err = tx.Tokens.DeleteAllForUser(ctx, scope, user.ID)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	app.cache.invalidate(user.ID)
+
+	return nil
+}
+
+// readOIDCCookie decodes the login data from the oidcCookieName cookie.
+func readOIDCCookie(r *http.Request) (*oidcLogin, error) {
+	cookie, err := r.Cookie(oidcCookieName)
+	if err != nil {
+		return nil, errors.New("login has expired or was not started from this browser")
+	}
+
+	js, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil {
+		return nil, errors.New("malformed login cookie")
+	}
+
+	var login oidcLogin
+
+	err = json.Unmarshal(js, &login)
+	if err != nil || login.State == "" || login.Nonce == "" || login.Verifier == "" {
+		return nil, errors.New("malformed login cookie")
+	}
+
+	return &login, nil
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cedrickchee/skel/internal/data"
+	"github.com/cedrickchee/skel/internal/oidc"
+	"github.com/cedrickchee/skel/internal/oidc/oidctest"
+)
+
+// oidcLoginRedirect starts a login on the test server and follows the redirect
+// to the fake identity provider, which logs the user in straight away. It
+// returns the callback URL that the provider sent the user back to.
+func oidcLoginRedirect(t *testing.T, ts *testServer, idp *oidctest.Server) *url.URL {
+	t.Helper()
+
+	code, header, _ := ts.get(t, "/v1/auth/oidc/test/start")
+	if code != http.StatusFound {
+		t.Fatalf("want %d from start; got %d", http.StatusFound, code)
+	}
+
+	client := idp.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+
+	res, err := client.Get(header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusFound {
+		t.Fatalf("want %d from provider; got %d", http.StatusFound, res.StatusCode)
+	}
+
+	callback, err := url.Parse(res.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return callback
+}
+
+func TestOIDCLogin(t *testing.T) {
+	idp := oidctest.NewServer("skel", "s3cret")
+	defer idp.Close()
+
+	app := newTestApplication(t)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	app.oidc = map[string]*oidc.Provider{
+		"test": oidc.NewProvider(oidc.ProviderConfig{
+			Issuer:       idp.URL,
+			ClientID:     "skel",
+			ClientSecret: "s3cret",
+			RedirectURL:  ts.URL + "/v1/auth/oidc/test/callback",
+		}, idp.Client()),
+	}
+
+	tests := []struct {
+		name     string
+		claims   map[string]interface{}
+		tamper   func(callback *url.URL)
+		wantCode int
+	}{
+		{
+			name:     "Existing user",
+			claims:   map[string]interface{}{"sub": "1", "email": "john@example.com", "email_verified": true},
+			wantCode: http.StatusCreated,
+		},
+		{
+			name:     "New user",
+			claims:   map[string]interface{}{"sub": "2", "email": "new@example.com", "email_verified": true, "name": "New User"},
+			wantCode: http.StatusCreated,
+		},
+		{
+			name:     "Unverified email",
+			claims:   map[string]interface{}{"sub": "3", "email": "jane@example.com", "email_verified": false},
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:   "State mismatch",
+			claims: map[string]interface{}{"sub": "1", "email": "john@example.com", "email_verified": true},
+			tamper: func(callback *url.URL) {
+				qs := callback.Query()
+				qs.Set("state", "forged")
+				callback.RawQuery = qs.Encode()
+			},
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:   "Bad code",
+			claims: map[string]interface{}{"sub": "1", "email": "john@example.com", "email_verified": true},
+			tamper: func(callback *url.URL) {
+				qs := callback.Query()
+				qs.Set("code", "forged")
+				callback.RawQuery = qs.Encode()
+			},
+			wantCode: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp.SetClaims(tt.claims)
+
+			callback := oidcLoginRedirect(t, ts, idp)
+			if tt.tamper != nil {
+				tt.tamper(callback)
+			}
+
+			code, _, body := ts.get(t, callback.RequestURI())
+			defer body.Close()
+
+			if code != tt.wantCode {
+				t.Fatalf("want %d; got %d", tt.wantCode, code)
+			}
+
+			if code == http.StatusCreated {
+				var res struct {
+					AuthenticationToken struct {
+						Token string `json:"token"`
+					} `json:"authentication_token"`
+				}
+
+				err := json.NewDecoder(body).Decode(&res)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if res.AuthenticationToken.Token == "" {
+					t.Error("want an authentication token in the response")
+				}
+			}
+		})
+	}
+
+	t.Run("Unknown provider", func(t *testing.T) {
+		code, _, _ := ts.get(t, "/v1/auth/oidc/nope/start")
+		if code != http.StatusNotFound {
+			t.Errorf("want %d; got %d", http.StatusNotFound, code)
+		}
+	})
+
+	t.Run("Missing cookie", func(t *testing.T) {
+		idp.SetClaims(map[string]interface{}{"sub": "1", "email": "john@example.com", "email_verified": true})
+
+		callback := oidcLoginRedirect(t, ts, idp)
+
+		// A different browser, without the cookie set by the start endpoint,
+		// must not be able to complete the login.
+		res, err := http.Get(ts.URL + callback.RequestURI())
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("want %d; got %d", http.StatusBadRequest, res.StatusCode)
+		}
+	})
+
+	t.Run("Start sets cookie", func(t *testing.T) {
+		_, header, _ := ts.get(t, "/v1/auth/oidc/test/start")
+
+		cookie := header.Get("Set-Cookie")
+		for _, want := range []string{oidcCookieName + "=", "HttpOnly", "Path=/v1/auth/oidc/test/", "SameSite=Lax"} {
+			if !strings.Contains(cookie, want) {
+				t.Errorf("want Set-Cookie to contain %q; got %q", want, cookie)
+			}
+		}
+	})
+}
+
+// An account registered with somebody else's email address must not survive
+// the owner signing in through a provider: the password chosen at
+// registration, and the tokens issued for the account, stop working.
+func TestOIDCLoginUnactivatedUser(t *testing.T) {
+	idp := oidctest.NewServer("skel", "s3cret")
+	defer idp.Close()
+
+	app := newMemoryTestApplication(t)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	app.oidc = map[string]*oidc.Provider{
+		"test": oidc.NewProvider(oidc.ProviderConfig{
+			Issuer:       idp.URL,
+			ClientID:     "skel",
+			ClientSecret: "s3cret",
+			RedirectURL:  ts.URL + "/v1/auth/oidc/test/callback",
+		}, idp.Client()),
+	}
+
+	ctx := context.Background()
+	squatter := &data.User{Name: "Mallory", Email: "victim@example.com"}
+	err := squatter.Password.Set("pa55word")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = app.models.Users.Insert(ctx, squatter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := app.models.Tokens.New(ctx, squatter.ID, time.Hour, data.ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idp.SetClaims(map[string]interface{}{"sub": "4", "email": "victim@example.com", "email_verified": true})
+
+	callback := oidcLoginRedirect(t, ts, idp)
+	code, _, _ := ts.get(t, callback.RequestURI())
+	if code != http.StatusCreated {
+		t.Fatalf("want %d; got %d", http.StatusCreated, code)
+	}
+
+	user, err := app.models.Users.GetByEmail(ctx, "victim@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.Activated {
+		t.Error("want the user to be activated")
+	}
+
+	res, err := http.Post(ts.URL+"/v1/tokens/authentication", "application/json",
+		strings.NewReader(`{"email": "victim@example.com", "password": "pa55word"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("want %d logging in with the old password; got %d", http.StatusUnauthorized, res.StatusCode)
+	}
+
+	code, _, _ = ts.authenticatedGet(t, token, "/v1/movies")
+	if code != http.StatusUnauthorized {
+		t.Errorf("want %d with the old token; got %d", http.StatusUnauthorized, code)
+	}
+}
+
+/*
+Run:
+
+$ go test -v -run "^TestOIDCLogin(UnactivatedUser)?$" github.com/cedrickchee/skel/cmd/api
+*/
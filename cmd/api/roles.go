@@ -0,0 +1,284 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/cedrickchee/skel/internal/data"
+	"github.com/cedrickchee/skel/internal/validator"
+)
+
+// listRolesHandler returns every role, along with the permission codes that it
+// grants and the name of the role it inherits from.
+func (app *application) listRolesHandler(w http.ResponseWriter, r *http.Request) {
+	roles, err := app.models.Roles.GetAll(r.Context())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"roles": roles}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createRoleHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name        string   `json:"name"`
+		Parent      string   `json:"parent"`
+		Permissions []string `json:"permissions"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	role := &data.Role{
+		Name:        input.Name,
+		Parent:      input.Parent,
+		Permissions: input.Permissions,
+	}
+
+	v := validator.New()
+
+	if data.ValidateRole(v, role); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// If a parent role was given, make sure that it actually exists. Otherwise
+	// the new role would silently be created without a parent.
+	if role.Parent != "" {
+		_, err = app.models.Roles.Get(r.Context(), role.Parent)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				v.AddError("parent", "no matching role found")
+				app.failedValidationResponse(w, r, v.Errors)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+	}
+
+	err = app.models.Roles.Insert(r.Context(), role)
+	if err != nil {
+		var cErr *data.ConstraintError
+		switch {
+		case errors.Is(err, data.ErrDuplicateRole):
+			v.AddError("name", "a role with this name already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrUnknownPermission):
+			v.AddError("permissions", "must only contain existing permission codes")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.As(err, &cErr):
+			app.constraintViolationResponse(w, r, cErr)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/roles/%s", role.Name))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"role": role}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateRoleHandler changes the parent and permissions of an existing role.
+// The name can't be changed, since it's what users and other roles refer to.
+// Fields which aren't in the request are left as they are, and "parent": ""
+// removes the parent.
+func (app *application) updateRoleHandler(w http.ResponseWriter, r *http.Request) {
+	role, err := app.models.Roles.Get(r.Context(), app.readStringParam(r, "name"))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var input struct {
+		Parent      *string  `json:"parent"`
+		Permissions []string `json:"permissions"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if input.Parent != nil {
+		role.Parent = *input.Parent
+	}
+	if input.Permissions != nil {
+		role.Permissions = input.Permissions
+	}
+
+	v := validator.New()
+
+	if data.ValidateRole(v, role); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// As in createRoleHandler(), a parent which doesn't exist would otherwise
+	// be quietly dropped.
+	if role.Parent != "" {
+		_, err = app.models.Roles.Get(r.Context(), role.Parent)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				v.AddError("parent", "no matching role found")
+				app.failedValidationResponse(w, r, v.Errors)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+	}
+
+	err = app.models.Roles.Update(r.Context(), role)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrRoleCycle):
+			v.AddError("parent", "must not inherit from the role")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrUnknownPermission):
+			v.AddError("permissions", "must only contain existing permission codes")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Like deleting a role, this may change the permissions of any number of
+	// users.
+	app.cache.purge()
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"role": role}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteRoleHandler(w http.ResponseWriter, r *http.Request) {
+	name := app.readStringParam(r, "name")
+
+	err := app.models.Roles.Delete(r.Context(), name)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrRoleInUse):
+			app.roleInUseResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Deleting a role may change the permissions of any number of users, so
+	// empty the whole cache.
+	app.cache.purge()
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "role successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// addUserRoleHandler assigns the role in the URL to the user with the given ID.
+func (app *application) addUserRoleHandler(w http.ResponseWriter, r *http.Request) {
+	role, userID, ok := app.readUserRoleParams(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.models.Roles.AddForUser(r.Context(), userID, role.Name)
+	if err != nil {
+		var cErr *data.ConstraintError
+		switch {
+		// The role was looked up above, so it can only be unknown if it
+		// has been deleted since.
+		case errors.Is(err, data.ErrRecordNotFound), errors.Is(err, data.ErrUnknownRole):
+			app.notFoundResponse(w, r)
+		case errors.As(err, &cErr):
+			app.constraintViolationResponse(w, r, cErr)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.cache.invalidate(userID)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "role successfully assigned"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// removeUserRoleHandler unassigns the role in the URL from the user with the
+// given ID.
+func (app *application) removeUserRoleHandler(w http.ResponseWriter, r *http.Request) {
+	role, userID, ok := app.readUserRoleParams(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.models.Roles.RemoveForUser(r.Context(), userID, role.Name)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Make sure the user loses the role's permissions straight away, even if
+	// they have a cached entry from an earlier request.
+	app.cache.invalidate(userID)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "role successfully removed"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readUserRoleParams reads the role name and user ID from a
+// /v1/roles/:name/users/:id URL and looks up the role. If anything goes wrong
+// it sends the appropriate error response itself and returns false, so the
+// calling handler only needs to return.
+func (app *application) readUserRoleParams(w http.ResponseWriter, r *http.Request) (*data.Role, int64, bool) {
+	userID, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, 0, false
+	}
+
+	role, err := app.models.Roles.Get(r.Context(), app.readStringParam(r, "name"))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, 0, false
+	}
+
+	return role, userID, true
+}
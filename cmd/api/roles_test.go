@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/cedrickchee/skel/internal/data"
+)
+
+func TestListRolesHandler(t *testing.T) {
+	app := newTestApplication(t)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	tests := []struct {
+		name      string
+		email     string
+		wantCode  int
+		wantRoles int
+	}{
+		{"Admin", "jane@example.com", http.StatusOK, 3},
+		{"Missing permission", "john@example.com", http.StatusForbidden, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := newTestToken(t, app, tt.email)
+
+			code, _, body := ts.authenticatedGet(t, token, "/v1/roles")
+			if code != tt.wantCode {
+				t.Fatalf("want %d; got %d", tt.wantCode, code)
+			}
+
+			if code == http.StatusOK {
+				var got struct {
+					Roles []struct {
+						Name   string `json:"name"`
+						Parent string `json:"parent"`
+					} `json:"roles"`
+				}
+				err := json.NewDecoder(body).Decode(&got)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(got.Roles) != tt.wantRoles {
+					t.Errorf("want %d roles; got %d", tt.wantRoles, len(got.Roles))
+				}
+			}
+		})
+	}
+}
+
+func TestCreateRoleHandler(t *testing.T) {
+	app := newTestApplication(t)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	token := newTestToken(t, app, "jane@example.com")
+
+	tests := []struct {
+		name      string
+		body      string
+		wantCode  int
+		wantField string
+	}{
+		{"Valid", `{"name": "critic", "parent": "viewer", "permissions": []}`, http.StatusCreated, ""},
+		{"Duplicate name", `{"name": "viewer", "permissions": []}`, http.StatusUnprocessableEntity, "name"},
+		{"Unknown parent", `{"name": "critic", "parent": "nobody", "permissions": []}`, http.StatusUnprocessableEntity, "parent"},
+		{"Invalid name", `{"name": "Critic!", "permissions": []}`, http.StatusUnprocessableEntity, "name"},
+		{"Duplicate permissions", `{"name": "critic", "permissions": ["movies:read", "movies:read"]}`, http.StatusUnprocessableEntity, "permissions"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _, body := ts.authenticatedRequest(t, token, http.MethodPost, "/v1/roles", strings.NewReader(tt.body))
+			if code != tt.wantCode {
+				t.Fatalf("want %d; got %d", tt.wantCode, code)
+			}
+
+			if tt.wantField != "" {
+				var got struct {
+					Error map[string]string `json:"error"`
+				}
+				err := json.NewDecoder(body).Decode(&got)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, ok := got.Error[tt.wantField]; !ok {
+					t.Errorf("want error for field %q; got %v", tt.wantField, got.Error)
+				}
+			}
+		})
+	}
+}
+
+func TestUpdateRoleHandler(t *testing.T) {
+	app := newMemoryTestApplication(t)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	ctx := context.Background()
+	admin := &data.User{Name: "Ada", Email: "ada@example.com", Activated: true}
+	err := app.models.Users.Insert(ctx, admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = app.models.Roles.AddForUser(ctx, admin.ID, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := newTestToken(t, app, admin.Email)
+
+	tests := []struct {
+		name      string
+		urlPath   string
+		body      string
+		wantCode  int
+		wantField string
+	}{
+		{"Permissions", "/v1/roles/viewer", `{"permissions": ["movies:read", "metrics:read"]}`, http.StatusOK, ""},
+		{"Cycle", "/v1/roles/viewer", `{"parent": "admin"}`, http.StatusUnprocessableEntity, "parent"},
+		{"Remove parent", "/v1/roles/editor", `{"parent": ""}`, http.StatusOK, ""},
+		{"Own parent", "/v1/roles/viewer", `{"parent": "viewer"}`, http.StatusUnprocessableEntity, "parent"},
+		{"Unknown parent", "/v1/roles/viewer", `{"parent": "nobody"}`, http.StatusUnprocessableEntity, "parent"},
+		{"Unknown permission", "/v1/roles/viewer", `{"permissions": ["no:such:permission"]}`, http.StatusUnprocessableEntity, "permissions"},
+		{"Non-existent role", "/v1/roles/nobody", `{"permissions": []}`, http.StatusNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _, body := ts.authenticatedRequest(t, token, http.MethodPatch, tt.urlPath, strings.NewReader(tt.body))
+			if code != tt.wantCode {
+				t.Fatalf("want %d; got %d", tt.wantCode, code)
+			}
+
+			if tt.wantField != "" {
+				var got struct {
+					Error map[string]string `json:"error"`
+				}
+				err := json.NewDecoder(body).Decode(&got)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, ok := got.Error[tt.wantField]; !ok {
+					t.Errorf("want error for field %q; got %v", tt.wantField, got.Error)
+				}
+			}
+		})
+	}
+
+	// Only the successful updates were kept: editor no longer inherits from
+	// viewer, and viewer has the new permissions.
+	editor, err := app.models.Roles.Get(ctx, "editor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	viewer, err := app.models.Roles.Get(ctx, "viewer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, editor.Parent, "")
+	assertEqual(t, viewer.Parent, "")
+	assertEqual(t, viewer.Permissions, data.Permissions{"metrics:read", "movies:read"})
+}
+
+func TestDeleteRoleHandler(t *testing.T) {
+	app := newTestApplication(t)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	token := newTestToken(t, app, "jane@example.com")
+
+	tests := []struct {
+		name     string
+		urlPath  string
+		wantCode int
+	}{
+		{"Leaf role", "/v1/roles/admin", http.StatusOK},
+		{"Inherited role", "/v1/roles/viewer", http.StatusConflict},
+		{"Non-existent role", "/v1/roles/nobody", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _, _ := ts.authenticatedRequest(t, token, http.MethodDelete, tt.urlPath, nil)
+			if code != tt.wantCode {
+				t.Errorf("want %d; got %d", tt.wantCode, code)
+			}
+		})
+	}
+}
+
+func TestAddUserRoleHandler(t *testing.T) {
+	app := newTestApplication(t)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	token := newTestToken(t, app, "jane@example.com")
+
+	tests := []struct {
+		name     string
+		urlPath  string
+		wantCode int
+	}{
+		{"Valid", "/v1/roles/editor/users/1", http.StatusOK},
+		{"Non-existent role", "/v1/roles/nobody/users/1", http.StatusNotFound},
+		{"Invalid user ID", "/v1/roles/editor/users/abc", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _, _ := ts.authenticatedRequest(t, token, http.MethodPut, tt.urlPath, nil)
+			if code != tt.wantCode {
+				t.Errorf("want %d; got %d", tt.wantCode, code)
+			}
+		})
+	}
+}
+
+/*
+Run:
+
+$ go test -v -run Role github.com/cedrickchee/skel/cmd/api
+*/
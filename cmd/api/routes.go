@@ -1,7 +1,6 @@
 package main
 
 import (
-	"expvar"
 	"net/http"
 
 	"github.com/julienschmidt/httprouter"
@@ -21,33 +20,66 @@ func (app *application) routes() http.Handler {
 	// responses.
 	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
 
+	// handle registers a handler with the router, wrapped so that the
+	// metrics can be labelled with the route's pattern.
+	handle := func(method, pattern string, handler http.HandlerFunc) {
+		router.HandlerFunc(method, pattern, app.route(pattern, handler))
+	}
+
 	// Register the relevant methods, URL patterns and handler functions for our
-	// endpoints using the HandlerFunc() method. Note that http.MethodGet and
+	// endpoints using the handle() function. Note that http.MethodGet and
 	// http.MethodPost are constants which equate to the strings 'GET' and
 	// 'POST' respectively.
-	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
+	handle(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
+	handle(http.MethodGet, "/v1/healthz", app.healthzHandler)
+	handle(http.MethodGet, "/v1/readyz", app.readyzHandler(false))
+
+	handle(http.MethodGet, "/v1/movies", app.requirePermission("movies:read", app.listMovieHandler))
+	handle(http.MethodPost, "/v1/movies", app.requirePermission("movies:write", app.createMovieHandler))
+	handle(http.MethodGet, "/v1/movies/:id", app.requirePermission("movies:read", app.showMovieHandler))
+	handle(http.MethodPatch, "/v1/movies/:id", app.requirePermission("movies:write", app.updateMovieHandler))
+	handle(http.MethodDelete, "/v1/movies/:id", app.requirePermission("movies:write", app.deleteMovieHandler))
+
+	handle(http.MethodPost, "/v1/users", app.registerUserHandler)
+	handle(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
+	handle(http.MethodPut, "/v1/users/password", app.updateUserPasswordHandler)
+
+	handle(http.MethodGet, "/v1/roles", app.requirePermission("roles:read", app.listRolesHandler))
+	handle(http.MethodPost, "/v1/roles", app.requirePermission("roles:write", app.createRoleHandler))
+	handle(http.MethodPatch, "/v1/roles/:name", app.requirePermission("roles:write", app.updateRoleHandler))
+	handle(http.MethodDelete, "/v1/roles/:name", app.requirePermission("roles:write", app.deleteRoleHandler))
+	handle(http.MethodPut, "/v1/roles/:name/users/:id", app.requirePermission("roles:write", app.addUserRoleHandler))
+	handle(http.MethodDelete, "/v1/roles/:name/users/:id", app.requirePermission("roles:write", app.removeUserRoleHandler))
 
-	router.HandlerFunc(http.MethodGet, "/v1/movies", app.requirePermission("movies:read", app.listMovieHandler))
-	router.HandlerFunc(http.MethodPost, "/v1/movies", app.requirePermission("movies:write", app.createMovieHandler))
-	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.requirePermission("movies:read", app.showMovieHandler))
-	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.requirePermission("movies:write", app.updateMovieHandler))
-	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.requirePermission("movies:write", app.deleteMovieHandler))
+	handle(http.MethodPost, "/v1/clients", app.requirePermission("clients:write", app.createClientHandler))
+	handle(http.MethodPost, "/v1/clients/:id/keys", app.requirePermission("clients:write", app.createClientKeyHandler))
+	handle(http.MethodDelete, "/v1/clients/:id/keys/:prefix", app.requirePermission("clients:write", app.deleteClientKeyHandler))
 
-	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
-	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
-	router.HandlerFunc(http.MethodPut, "/v1/users/password", app.updateUserPasswordHandler)
+	handle(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+	handle(http.MethodPost, "/v1/tokens/activation", app.createActivationTokenHandler)
+	handle(http.MethodPost, "/v1/tokens/password-reset", app.createPasswordResetTokenHandler)
 
-	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
-	router.HandlerFunc(http.MethodPost, "/v1/tokens/activation", app.createActivationTokenHandler)
-	router.HandlerFunc(http.MethodPost, "/v1/tokens/password-reset", app.createPasswordResetTokenHandler)
+	handle(http.MethodGet, "/v1/auth/oidc/:provider/start", app.oidcStartHandler)
+	handle(http.MethodGet, "/v1/auth/oidc/:provider/callback", app.oidcCallbackHandler)
 
-	router.Handler(http.MethodGet, "/debug/vars", expvar.Handler())
+	// Serve the metrics in the Prometheus text format. They give away a fair
+	// bit about the application, so only principals with the metrics:read
+	// permission (like a service client for the Prometheus server) can scrape
+	// them.
+	handle(http.MethodGet, "/metrics", app.requirePermission("metrics:read", app.registry.Handler().ServeHTTP))
 
 	// Wrap the router with the middlewares. This will ensure that the
 	// middleware runs for every one of our API endpoints.
-	var wrappedRouter = app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router))))
+	// Note that rateLimit() comes after authenticate(), so that policies can
+	// limit each user separately. authenticate() limits failed
+	// authentications by IP address itself.
+	// compress() goes inside metrics(), so that the metrics still see the
+	// status code that the handler wrote.
+	var wrappedRouter = app.metrics(app.compress(app.recoverPanic(app.enableCORS(app.authenticate(app.rateLimit(router))))))
 	if app.config.env != "test" {
-		wrappedRouter = app.logRequest(app.metrics(wrappedRouter))
+		wrappedRouter = app.logRequest(wrappedRouter)
 	}
-	return wrappedRouter
+	// traceRequest() and realIP() go outermost, so that every other
+	// middleware sees the same request ID and client IP address.
+	return app.traceRequest(app.realIP(wrappedRouter))
 }
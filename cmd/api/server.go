@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -29,6 +30,39 @@ func (app *application) serve() error {
 		WriteTimeout: 30 * time.Second,
 	}
 
+	// Start the admin server, if it's enabled. We listen before starting the
+	// main server, so that a mistake in -admin-addr is reported straight away
+	// rather than just logged. The admin server doesn't get a write timeout,
+	// because a CPU profile or trace can take longer than that to collect.
+	var adminSrv *http.Server
+	if app.config.adminAddr != "" {
+		adminSrv = &http.Server{
+			Addr:        app.config.adminAddr,
+			Handler:     app.adminRoutes(),
+			ErrorLog:    log.New(app.logger, "", 0),
+			IdleTimeout: time.Minute,
+			ReadTimeout: 10 * time.Second,
+		}
+
+		ln, err := net.Listen("tcp", adminSrv.Addr)
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			app.logger.PrintInfo("starting admin server", map[string]string{
+				"addr": adminSrv.Addr,
+			})
+
+			err := adminSrv.Serve(ln)
+			if !errors.Is(err, http.ErrServerClosed) {
+				app.logger.PrintError(err, map[string]string{
+					"addr": adminSrv.Addr,
+				})
+			}
+		}()
+	}
+
 	// *************************************************************************
 	// Gracefully shutdown the running server
 	// *************************************************************************
@@ -62,6 +96,19 @@ func (app *application) serve() error {
 			"signal": s.String(),
 		})
 
+		// Report that we're not ready any more, so that load balancers stop
+		// sending us new requests. Then, if there's a shutdown delay, keep
+		// serving for that long, because it takes a load balancer a few
+		// probes to notice, and any requests it sends us in the meantime
+		// would be refused once Shutdown() closes the listener.
+		app.setReady(false)
+		if app.config.shutdownDelay > 0 {
+			app.logger.PrintInfo("draining connections", map[string]string{
+				"delay": app.config.shutdownDelay.String(),
+			})
+			time.Sleep(app.config.shutdownDelay)
+		}
+
 		// Create a context with a 5-second timeout.
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
@@ -76,23 +123,49 @@ func (app *application) serve() error {
 		// Importantly, the Shutdown() method does not wait for any background
 		// tasks to complete, nor does it close hijacked long-lived connections
 		// like WebSockets.
-		err := srv.Shutdown(ctx)
-		if err != nil {
-			shutdownError <- err
+		//
+		// The admin server is shut down at the same time, and any error from
+		// it is only reported if the main server shut down cleanly. Either
+		// way, we hold on to the error until the background tasks below have
+		// finished: serve() returns as soon as it receives it, and the jobs
+		// and the sweeper must be stopped even when the shutdown wasn't clean.
+		shutdownErr := srv.Shutdown(ctx)
+		if adminSrv != nil {
+			adminErr := adminSrv.Shutdown(ctx)
+			if shutdownErr == nil {
+				shutdownErr = adminErr
+			}
 		}
 
-		// Log a message to say that we're waiting for any background goroutines
-		// to complete their tasks.
+		// Log a message to say that we're waiting for the job queue and the
+		// token sweeper to finish.
 		app.logger.PrintInfo("completing background tasks", map[string]string{
 			"addr": srv.Addr,
 		})
 
-		// Call Wait() to block until our WaitGroup counter is zero --
-		// essentially blocking until the background goroutines have finished.
-		// Then we return nil on the shutdownError channel, to indicate that the
-		// shutdown completed without any issues.
-		app.wg.Wait()
-		shutdownError <- nil
+		// Drain the job queue, so that the emails for the last requests we
+		// served are sent before we exit. Anything still queued when the
+		// drain timeout runs out stays in the database, and is run by the
+		// next instance to start. So running out of time isn't a failed
+		// shutdown, and we only log it.
+		drainCtx, drainCancel := context.WithTimeout(context.Background(), app.config.jobs.drainTimeout)
+		defer drainCancel()
+
+		err := app.jobs.Shutdown(drainCtx)
+		if err != nil {
+			app.logger.PrintError(fmt.Errorf("draining job queue: %w", err), nil)
+		}
+
+		// Stop the token sweeper. Any expired tokens it didn't get to are
+		// deleted by the next sweep, here or on another instance.
+		err = app.sweeper.Stop(drainCtx)
+		if err != nil {
+			app.logger.PrintError(fmt.Errorf("stopping token sweeper: %w", err), nil)
+		}
+
+		// Then we send the result of the shutdown on the shutdownError
+		// channel, which is nil if it completed without any issues.
+		shutdownError <- shutdownErr
 	}()
 
 	// Log a "starting server" message.
@@ -103,11 +176,16 @@ func (app *application) serve() error {
 
 	// Start the HTTP server.
 	//
+	// Strictly speaking we aren't ready until ListenAndServe() has opened its
+	// listener, but requests which arrive in the meantime just queue up until
+	// it has.
+	//
 	// Calling Shutdown() on our server will cause ListenAndServe() to
 	// immediately return a http.ErrServerClosed error. So if we see this error,
 	// it is actually a good thing and an indication that the graceful shutdown
 	// has started. So we check specifically for this, only returning the error
 	// if it is NOT http.ErrServerClosed.
+	app.setReady(true)
 	err := srv.ListenAndServe()
 	if !errors.Is(err, http.ErrServerClosed) {
 		return err
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/cedrickchee/skel/internal/jsonlog"
+)
+
+// expiredTokens is the part of data.TokenModel which the sweeper uses.
+type expiredTokens interface {
+	DeleteExpired(ctx context.Context, limit int) (int64, error)
+}
+
+// tokenSweeper deletes expired tokens every interval, so that the tokens
+// table doesn't keep growing. Each sweep deletes them in batches of batchSize,
+// until a batch comes back less than full.
+type tokenSweeper struct {
+	// deleted is the total number of tokens deleted. It's the first field so
+	// that it's 64-bit aligned for the atomic functions, even on 32-bit
+	// platforms.
+	deleted int64
+
+	tokens    expiredTokens
+	logger    *jsonlog.Logger
+	interval  time.Duration
+	batchSize int
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// newTokenSweeper returns a sweeper for tokens. Call Start() to set it going.
+func newTokenSweeper(tokens expiredTokens, logger *jsonlog.Logger, interval time.Duration, batchSize int) *tokenSweeper {
+	return &tokenSweeper{
+		tokens:    tokens,
+		logger:    logger,
+		interval:  interval,
+		batchSize: batchSize,
+	}
+}
+
+// Start sweeps straight away, and then every interval, until Stop() is
+// called.
+func (s *tokenSweeper) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.done = make(chan struct{})
+
+	go func() {
+		defer close(s.done)
+
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			s.sweep(ctx)
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the sweeper, abandoning any sweep in progress (the batch it's
+// deleting is rolled back), and waits for it to finish or for ctx to be done.
+// It's safe to call on a nil or unstarted sweeper.
+func (s *tokenSweeper) Stop(ctx context.Context) error {
+	if s == nil || s.cancel == nil {
+		return nil
+	}
+
+	s.cancel()
+
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Deleted returns the total number of tokens deleted.
+func (s *tokenSweeper) Deleted() int64 {
+	return atomic.LoadInt64(&s.deleted)
+}
+
+// sweep deletes expired tokens a batch at a time, until there are none left
+// or ctx is cancelled. Errors are logged, and the next sweep tries again.
+func (s *tokenSweeper) sweep(ctx context.Context) {
+	var total int64
+
+	for ctx.Err() == nil {
+		n, err := s.tokens.DeleteExpired(ctx, s.batchSize)
+		if err != nil {
+			if ctx.Err() == nil {
+				s.logger.PrintError(err, map[string]string{"task": "token sweeper"})
+			}
+			break
+		}
+
+		total += n
+		atomic.AddInt64(&s.deleted, n)
+
+		if n < int64(s.batchSize) {
+			break
+		}
+	}
+
+	if total > 0 {
+		s.logger.PrintInfo("deleted expired tokens", map[string]string{
+			"deleted": strconv.FormatInt(total, 10),
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cedrickchee/skel/internal/jsonlog"
+)
+
+// fakeExpiredTokens hands out batches from a fixed number of expired tokens.
+type fakeExpiredTokens struct {
+	mu      sync.Mutex
+	expired int64
+	calls   int
+	err     error
+}
+
+func (f *fakeExpiredTokens) DeleteExpired(ctx context.Context, limit int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls++
+	if f.err != nil {
+		return 0, f.err
+	}
+
+	n := f.expired
+	if n > int64(limit) {
+		n = int64(limit)
+	}
+	f.expired -= n
+
+	return n, nil
+}
+
+func TestTokenSweeperSweep(t *testing.T) {
+	var logs bytes.Buffer
+
+	tokens := &fakeExpiredTokens{expired: 25}
+	s := newTokenSweeper(tokens, jsonlog.New(&logs, jsonlog.LevelInfo), time.Hour, 10)
+
+	// A sweep keeps going until a batch comes back less than full: 10, 10
+	// and then 5.
+	s.sweep(context.Background())
+
+	if tokens.calls != 3 {
+		t.Errorf("want 3 batches; got %d", tokens.calls)
+	}
+	if s.Deleted() != 25 {
+		t.Errorf("want 25 deleted; got %d", s.Deleted())
+	}
+	if !strings.Contains(logs.String(), `"deleted":"25"`) {
+		t.Errorf("want the deleted count in the logs:\n%s", logs.String())
+	}
+
+	// Errors are logged, and don't stop the next sweep.
+	logs.Reset()
+	tokens.err = errors.New("connection refused")
+	s.sweep(context.Background())
+
+	if !strings.Contains(logs.String(), "connection refused") {
+		t.Errorf("want the error in the logs:\n%s", logs.String())
+	}
+}
+
+func TestTokenSweeperStartStop(t *testing.T) {
+	tokens := &fakeExpiredTokens{expired: 3}
+	s := newTokenSweeper(tokens, jsonlog.New(&bytes.Buffer{}, jsonlog.LevelInfo), time.Millisecond, 10)
+
+	s.Start()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Deleted() < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := s.Stop(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Deleted() != 3 {
+		t.Errorf("want 3 deleted; got %d", s.Deleted())
+	}
+
+	// Stopping a sweeper which was never started, or doesn't exist, is fine.
+	var none *tokenSweeper
+	if err := none.Stop(ctx); err != nil {
+		t.Errorf("want nil; got %v", err)
+	}
+}
@@ -3,6 +3,7 @@
 package main
 
 import (
+	"context"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -10,9 +11,12 @@ import (
 	"net/http/httptest"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/cedrickchee/skel/internal/data"
 	"github.com/cedrickchee/skel/internal/jsonlog"
+	"github.com/cedrickchee/skel/internal/metrics"
+	"github.com/cedrickchee/skel/internal/ratelimit"
 )
 
 // Create a newTestApplication helper which returns an instance of our
@@ -25,11 +29,23 @@ func newTestApplication(t *testing.T) *application {
 		config: config{
 			env: "test",
 		},
-		logger: logger,
-		models: data.NewMockModels(),
+		logger:   logger,
+		models:   data.NewMockModels(),
+		cache:    newAuthCache(time.Minute),
+		limiter:  ratelimit.NewMemory(),
+		registry: metrics.NewRegistry(),
 	}
 }
 
+// newMemoryTestApplication returns an application like newTestApplication,
+// but with the in-memory models, for tests which need the models to behave
+// like the real ones. They start out with no users or movies.
+func newMemoryTestApplication(t *testing.T) *application {
+	app := newTestApplication(t)
+	app.models = data.NewMemoryModels()
+	return app
+}
+
 // Define a custom testServer type which anonymously embeds a httptest.Server
 // instance.
 type testServer struct {
@@ -96,6 +112,43 @@ func (ts *testServer) authenticatedGet(t *testing.T, token *data.Token, urlPath
 	return rs.StatusCode, rs.Header, rs.Body
 }
 
+// authenticatedRequest method makes a request with the given method, url path,
+// body and auth token on the test server, and returns the response status
+// code, headers and body.
+func (ts *testServer) authenticatedRequest(t *testing.T, token *data.Token, method, urlPath string, body io.Reader) (int, http.Header, io.ReadCloser) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, ts.URL+urlPath, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token.Plaintext)
+
+	rs, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rs.StatusCode, rs.Header, rs.Body
+}
+
+// newTestToken returns an authentication token for the mock user with the
+// given email address.
+func newTestToken(t *testing.T, app *application, email string) *data.Token {
+	t.Helper()
+
+	user, err := app.models.Users.GetByEmail(context.Background(), email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := app.models.Tokens.New(context.Background(), user.ID, 24*time.Hour, data.ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
 // Test assertion functions
 
 func assertEqual(t *testing.T, a, b interface{}) {
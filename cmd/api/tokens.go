@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"net/http"
 	"time"
@@ -38,7 +39,7 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	// Lookup the user record based on the email address. If no matching user
 	// was found, then we call the app.invalidCredentialsResponse() helper to
 	// send a 401 Unauthorized response to the client.
-	user, err := app.models.Users.GetByEmail(input.Email)
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -65,7 +66,7 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 
 	// Otherwise, if the password is correct, we generate a new token with a
 	// 24-hour expiry time and the scope 'authentication'.
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	token, err := app.models.Tokens.New(r.Context(), user.ID, 24*time.Hour, data.ScopeAuthentication)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -102,7 +103,7 @@ func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r
 
 	// Try to retrieve the corresponding user record for the email address. If
 	// it can't be found, return an error message to the client.
-	user, err := app.models.Users.GetByEmail(input.Email)
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -122,28 +123,27 @@ func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r
 	}
 
 	// Otherwise, create a new password reset token with a 45-minute expiry
-	// time.
-	token, err := app.models.Tokens.New(user.ID, 45*time.Minute, data.ScopePasswordReset)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
-	}
+	// time, and queue the email containing it in the same transaction.
+	err = app.models.Transaction(r.Context(), func(ctx context.Context, tx data.Models) error {
+		token, err := tx.Tokens.New(ctx, user.ID, 45*time.Minute, data.ScopePasswordReset)
+		if err != nil {
+			return err
+		}
 
-	// Email the user with their password reset token.
-	app.background(func() {
-		data := map[string]interface{}{
+		emailData := map[string]interface{}{
 			"passwordResetToken": token.Plaintext,
 		}
 
 		// Since email addresses MAY be case sensitive, notice that we are
-		// sending this email using the address stored in our database for the
-		// user --- not to the input.Email address provided by the client in
-		// this request.
-		err = app.mailer.Send(user.Email, "token_password_reset.tmpl", data)
-		if err != nil {
-			app.logger.PrintError(err, nil)
-		}
+		// sending this email using the address stored in our database for
+		// the user --- not to the input.Email address provided by the client
+		// in this request.
+		return app.enqueueEmail(ctx, user.Email, "token_password_reset.tmpl", emailData)
 	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
 
 	// Send a 202 Accepted response and confirmation message to the client.
 	env := envelope{
@@ -177,7 +177,7 @@ func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *h
 
 	// Try to retrieve the corresponding user record for the email address. If
 	// it can't be found, return an error message to the client.
-	user, err := app.models.Users.GetByEmail(input.Email)
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -196,28 +196,28 @@ func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *h
 		return
 	}
 
-	// Otherwise, create a new activation token.
-	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
-	}
+	// Otherwise, create a new activation token, and queue the email
+	// containing it in the same transaction.
+	err = app.models.Transaction(r.Context(), func(ctx context.Context, tx data.Models) error {
+		token, err := tx.Tokens.New(ctx, user.ID, 3*24*time.Hour, data.ScopeActivation)
+		if err != nil {
+			return err
+		}
 
-	// Email the user with their additional activation token.
-	app.background(func() {
-		data := map[string]interface{}{
+		emailData := map[string]interface{}{
 			"activationToken": token.Plaintext,
 		}
 
 		// Since email addresses MAY be case sensitive, notice that we are
-		// sending this email using the address stored in our database for the
-		// user --- not to the input.Email address provided by the client in
-		// this request.
-		err = app.mailer.Send(user.Email, "token_activation.tmpl", data)
-		if err != nil {
-			app.logger.PrintError(err, nil)
-		}
+		// sending this email using the address stored in our database for
+		// the user --- not to the input.Email address provided by the client
+		// in this request.
+		return app.enqueueEmail(ctx, user.Email, "token_activation.tmpl", emailData)
 	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
 
 	// Send a 202 Accepted response and confirmation message to the client.
 	env := envelope{
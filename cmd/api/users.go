@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"net/http"
 	"time"
@@ -53,8 +54,45 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	// Insert the user data into the database.
-	err = app.models.Users.Insert(user)
+	// Insert the user, give them their roles, create their activation token
+	// and queue their welcome email all in one transaction. Either all of it
+	// happens or none of it does, so we never end up with a user who can't
+	// activate their account because their email was lost.
+	err = app.models.Transaction(r.Context(), func(ctx context.Context, tx data.Models) error {
+		err := tx.Users.Insert(ctx, user)
+		if err != nil {
+			return err
+		}
+
+		// Assign the configured default roles (by default just "viewer") to
+		// the new user.
+		if len(app.config.roles.defaults) > 0 {
+			err = tx.Roles.AddForUser(ctx, user.ID, app.config.roles.defaults...)
+			if err != nil {
+				return err
+			}
+		}
+
+		// After the user record has been created in the database, generate a
+		// new activation token for the user.
+		token, err := tx.Tokens.New(ctx, user.ID, 3*24*time.Hour, data.ScopeActivation)
+		if err != nil {
+			return err
+		}
+
+		// As there are now multiple pieces of data that we want to pass to
+		// our email templates, we create a map to act as a 'holding
+		// structure' for the data. This contains the plaintext version of the
+		// activation token for the user, along with their ID.
+		emailData := map[string]interface{}{
+			"activationToken": token.Plaintext,
+			"userID":          user.ID,
+		}
+
+		// Queue the welcome email. A job worker sends it, and tries again
+		// later if the SMTP server can't be reached.
+		return app.enqueueEmail(ctx, user.Email, "user_welcome.tmpl", emailData)
+	})
 	if err != nil {
 		switch {
 		// If we get a ErrDuplicateEmail error, use the v.AddError() method to
@@ -69,43 +107,6 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	// Add the "movies:read" permission for the new user.
-	err = app.models.Permissions.AddForUser(user.ID, "movies:read")
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
-	}
-
-	// After the user record has been created in the database, generate a new
-	// activation token for the user.
-	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
-	}
-
-	// Use the background helper to execute an anonymous function that sends the
-	// welcome email.
-	app.background(func() {
-		// As there are now multiple pieces of data that we want to pass to our
-		// email templates, we create a map to act as a 'holding structure' for
-		// the data. This contains the plaintext version of the activation token
-		// for the user, along with their ID.
-		data := map[string]interface{}{
-			"activationToken": token.Plaintext,
-			"userID":          user.ID,
-		}
-
-		// Send the welcome email, passing in the map above as dynamic data.
-		err = app.mailer.Send(user.Email, "user_welcome.tmpl", data)
-		if err != nil {
-			// Importantly, if there is an error sending the email then we use
-			// the app.logger.PrintError() helper to manage it, instead of the
-			// app.serverErrorResponse() helper like before.
-			app.logger.PrintError(err, nil)
-		}
-	})
-
 	// Write a JSON response containing the user data along with a 202 Accepted
 	// status code. This status code indicates that the request has been
 	// accepted for processing, but the processing has not been completed.
@@ -138,7 +139,7 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 	// Retrieve the details of the user associated with the token using the
 	// GetForToken() method. If no matching record is found, then we let the
 	// client know that the token they provided is not valid.
-	user, err := app.models.Users.GetForToken(data.ScopeActivation, input.TokenPlaintext)
+	user, _, err := app.models.Users.GetForToken(r.Context(), data.ScopeActivation, input.TokenPlaintext)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -154,8 +155,18 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 	user.Activated = true
 
 	// Save the updated user record in our database, checking for any edit
-	// conflicts in the same way that we did for our movie records.
-	err = app.models.Users.Update(user)
+	// conflicts in the same way that we did for our movie records. If that
+	// goes well, we delete all activation tokens for the user. Both happen
+	// in one transaction, so a token can't outlive the activation it was
+	// used for.
+	err = app.models.Transaction(r.Context(), func(ctx context.Context, tx data.Models) error {
+		err := tx.Users.Update(ctx, user)
+		if err != nil {
+			return err
+		}
+
+		return tx.Tokens.DeleteAllForUser(ctx, data.ScopeActivation, user.ID)
+	})
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
@@ -166,13 +177,8 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	// If everything went successfully, then we delete all activation tokens for
-	// the user.
-	err = app.models.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
-	}
+	// The user's cached record (if any) still says they aren't activated.
+	app.cache.invalidate(user.ID)
 
 	// Send the updated user details to the client in a JSON response.
 	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
@@ -208,7 +214,7 @@ func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http
 
 	// Retrieve the details of the user associated with the password reset
 	// token, returning an error message if no matching record was found.
-	user, err := app.models.Users.GetForToken(data.ScopePasswordReset, input.TokenPlaintext)
+	user, _, err := app.models.Users.GetForToken(r.Context(), data.ScopePasswordReset, input.TokenPlaintext)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -228,8 +234,16 @@ func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http
 	}
 
 	// Save the updated user record in our database, checking for any edit
-	// conflicts as normal.
-	err = app.models.Users.Update(user)
+	// conflicts as normal, and delete all password reset tokens for the user
+	// in the same transaction, so that the token can't be used twice.
+	err = app.models.Transaction(r.Context(), func(ctx context.Context, tx data.Models) error {
+		err := tx.Users.Update(ctx, user)
+		if err != nil {
+			return err
+		}
+
+		return tx.Tokens.DeleteAllForUser(ctx, data.ScopePasswordReset, user.ID)
+	})
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
@@ -240,13 +254,7 @@ func (app *application) updateUserPasswordHandler(w http.ResponseWriter, r *http
 		return
 	}
 
-	// If everything was successful, then delete all password reset tokens for
-	// the user.
-	err = app.models.Tokens.DeleteAllForUser(data.ScopePasswordReset, user.ID)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
-	}
+	app.cache.invalidate(user.ID)
 
 	// Send the user a confirmation message.
 	env := envelope{
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+)
+
+// A string constant containing the HTML for the webpage. The JavaScript makes
+// a credentialed request (one which includes cookies) to our GET
+// /v1/healthcheck endpoint. The browser only lets the page read the response
+// if the API replies with "Access-Control-Allow-Credentials: true", so this
+// fails unless the API was started with -cors-allow-credentials.
+const html = `
+<!DOCTYPE html>
+<html lang='en'>
+<head>
+    <meta charset='UTF-8'>
+</head>
+<body>
+    <h1>Credentialed CORS</h1>
+    <div id='output'></div>
+    <script>
+        document.addEventListener('DOMContentLoaded', function() {
+            fetch('http://localhost:4000/v1/healthcheck', {
+                credentials: 'include'
+            }).then(
+                function (response) {
+                    response.text().then(function (text) {
+                        document.getElementById('output').innerHTML = text;
+                    });
+                },
+                function(err) {
+                    document.getElementById('output').innerHTML = err;
+                }
+            );
+        });
+    </script>
+</body>
+</html>`
+
+func main() {
+	addr := flag.String("addr", ":9000", "Server address")
+	flag.Parse()
+
+	log.Printf("starting server on %s", *addr)
+
+	err := http.ListenAndServe(*addr, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(html))
+	}))
+	log.Fatal(err)
+}
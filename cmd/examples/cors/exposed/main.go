@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+)
+
+// A string constant containing the HTML for the webpage. The JavaScript calls
+// our GET /v1/healthcheck endpoint and lists every response header that the
+// page is allowed to read. Browsers hide all but a few simple headers from
+// cross-origin scripts, so the RateLimit-* headers only appear in the list
+// when the API exposes them (which it does by default, see
+// -cors-exposed-headers).
+const html = `
+<!DOCTYPE html>
+<html lang='en'>
+<head>
+    <meta charset='UTF-8'>
+</head>
+<body>
+    <h1>Exposed Headers CORS</h1>
+    <ul id='output'></ul>
+    <script>
+        document.addEventListener('DOMContentLoaded', function() {
+            fetch('http://localhost:4000/v1/healthcheck').then(
+                function (response) {
+                    var output = document.getElementById('output');
+                    response.headers.forEach(function (value, name) {
+                        var item = document.createElement('li');
+                        item.textContent = name + ': ' + value;
+                        output.appendChild(item);
+                    });
+                },
+                function(err) {
+                    document.getElementById('output').innerHTML = err;
+                }
+            );
+        });
+    </script>
+</body>
+</html>`
+
+func main() {
+	addr := flag.String("addr", ":9000", "Server address")
+	flag.Parse()
+
+	log.Printf("starting server on %s", *addr)
+
+	err := http.ListenAndServe(*addr, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(html))
+	}))
+	log.Fatal(err)
+}
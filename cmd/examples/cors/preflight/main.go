@@ -10,6 +10,12 @@ import (
 // of a <h1> header tag, and some JavaScript which calls our POST
 // /v1/tokens/authentication endpoint and writes the response body to inside the
 // <div id='output'></div> tag.
+//
+// The "Content-Type: application/json" header makes this a non-simple request,
+// so the browser sends a preflight request first. Click the button to send the
+// request again: if the API was started with -cors-max-age, the browser's
+// network tab shows that it reuses the cached preflight result instead of
+// sending another OPTIONS request, until the max age has passed.
 const html = `
 <!DOCTYPE html>
 <html lang="en">
@@ -18,9 +24,10 @@ const html = `
 </head>
 <body>
     <h1>Preflight CORS</h1>
+    <button id="again">Send again</button>
     <div id="output"></div>
     <script>
-        document.addEventListener("DOMContentLoaded", function() {
+        function send() {
             fetch("http://localhost:4000/v1/tokens/authentication", {
                 method: "POST",
                 headers: {
@@ -40,6 +47,11 @@ const html = `
                     document.getElementById("output").innerHTML = err;
                 }
             );
+        }
+
+        document.addEventListener("DOMContentLoaded", function() {
+            send();
+            document.getElementById("again").addEventListener("click", send);
         });
     </script>
 </body>
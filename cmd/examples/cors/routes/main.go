@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+)
+
+// A string constant containing the HTML for the webpage. The JavaScript calls
+// two endpoints, GET /v1/healthcheck and GET /v1/movies/1, and shows the status
+// and the readable response headers of each, or the error if the browser
+// blocked it.
+//
+// Start the API with the per-route policies in cors.json, and no trusted
+// origins of its own:
+//
+//	$ go run ./cmd/api -cors-config=./cmd/examples/cors/routes/cors.json
+//
+// The default policy trusts no origins, so the healthcheck is blocked. The
+// route for /v1/movies/:id has a policy of its own, which trusts this page and
+// only exposes X-Request-ID, so the movie request gets through (with a 401,
+// since it isn't authenticated) but the RateLimit-* headers are hidden.
+const html = `
+<!DOCTYPE html>
+<html lang='en'>
+<head>
+    <meta charset='UTF-8'>
+</head>
+<body>
+    <h1>Per-Route CORS</h1>
+    <h2>GET /v1/healthcheck</h2>
+    <ul id='healthcheck'></ul>
+    <h2>GET /v1/movies/1</h2>
+    <ul id='movie'></ul>
+    <script>
+        function show(id, url) {
+            var output = document.getElementById(id);
+
+            function add(text) {
+                var item = document.createElement('li');
+                item.textContent = text;
+                output.appendChild(item);
+            }
+
+            fetch(url).then(
+                function (response) {
+                    add('status: ' + response.status);
+                    response.headers.forEach(function (value, name) {
+                        add(name + ': ' + value);
+                    });
+                },
+                function(err) {
+                    add(err);
+                }
+            );
+        }
+
+        document.addEventListener('DOMContentLoaded', function() {
+            show('healthcheck', 'http://localhost:4000/v1/healthcheck');
+            show('movie', 'http://localhost:4000/v1/movies/1');
+        });
+    </script>
+</body>
+</html>`
+
+func main() {
+	addr := flag.String("addr", ":9000", "Server address")
+	flag.Parse()
+
+	log.Printf("starting server on %s", *addr)
+
+	err := http.ListenAndServe(*addr, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(html))
+	}))
+	log.Fatal(err)
+}
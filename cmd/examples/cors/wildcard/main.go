@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+)
+
+// A string constant containing the HTML for the webpage. The JavaScript shows
+// the page's own origin, then calls our GET /v1/healthcheck endpoint and
+// writes the response body (or the error, if the browser blocked it) below.
+//
+// Start the API with a wildcard origin:
+//
+//	$ go run ./cmd/api -cors-trusted-origins='http://*.localhost:9000'
+//
+// Then open http://app.localhost:9000 and http://admin.localhost:9000
+// (browsers resolve *.localhost to the loopback address): both are allowed.
+// http://localhost:9000 is blocked, because the wildcard needs a subdomain to
+// match.
+const html = `
+<!DOCTYPE html>
+<html lang='en'>
+<head>
+    <meta charset='UTF-8'>
+</head>
+<body>
+    <h1>Wildcard Origin CORS</h1>
+    <p>Origin: <code id='origin'></code></p>
+    <div id='output'></div>
+    <script>
+        document.addEventListener('DOMContentLoaded', function() {
+            document.getElementById('origin').textContent = window.location.origin;
+
+            fetch('http://localhost:4000/v1/healthcheck').then(
+                function (response) {
+                    response.text().then(function (text) {
+                        document.getElementById('output').innerHTML = text;
+                    });
+                },
+                function(err) {
+                    document.getElementById('output').innerHTML = err;
+                }
+            );
+        });
+    </script>
+</body>
+</html>`
+
+func main() {
+	addr := flag.String("addr", ":9000", "Server address")
+	flag.Parse()
+
+	log.Printf("starting server on %s", *addr)
+
+	err := http.ListenAndServe(*addr, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(html))
+	}))
+	log.Fatal(err)
+}
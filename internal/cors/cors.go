@@ -0,0 +1,247 @@
+// Package cors holds the Cross-Origin Resource Sharing (CORS) policies which
+// decide which web pages on other origins may call the API from a browser, and
+// what they're allowed to do when they do.
+package cors
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cedrickchee/skel/internal/route"
+)
+
+// DefaultAllowedMethods and DefaultAllowedHeaders are what a preflight
+// response allows unless a policy says otherwise. GET, HEAD and POST never
+// need to be listed, because they are always allowed.
+var (
+	DefaultAllowedMethods = []string{"OPTIONS", "PUT", "PATCH", "DELETE"}
+	DefaultAllowedHeaders = []string{"Authorization", "Content-Type"}
+)
+
+// Policy is a set of CORS rules.
+type Policy struct {
+	// Pattern is the route pattern which the policy applies to, like
+	// "/v1/movies/:id" (see route.Match). It is empty for the default policy,
+	// which applies to every route.
+	Pattern string
+	// Origins are the trusted origins. Each is either an exact origin like
+	// "https://example.com", an origin with a wildcard subdomain like
+	// "https://*.example.com", or "*" to trust every origin.
+	Origins []string
+	// AllowCredentials lets the browser send cookies and read the response
+	// for credentialed requests.
+	AllowCredentials bool
+	// AllowedMethods and AllowedHeaders are sent in response to preflight
+	// requests.
+	AllowedMethods []string
+	AllowedHeaders []string
+	// ExposedHeaders are the response headers which scripts are allowed to
+	// read, in addition to the handful of simple ones that browsers always
+	// expose.
+	ExposedHeaders []string
+	// MaxAge is how long browsers may cache the result of a preflight
+	// request. Zero means that the Access-Control-Max-Age header isn't sent,
+	// so the browser's default (5 seconds) applies.
+	MaxAge time.Duration
+}
+
+// Validate checks that the policy's origins are well formed and that its
+// settings make sense together.
+func (p *Policy) Validate() error {
+	for _, origin := range p.Origins {
+		if err := validateOrigin(origin); err != nil {
+			return err
+		}
+
+		// Trusting every origin with the user's cookies would let any web
+		// page on the internet act on their behalf.
+		if origin == "*" && p.AllowCredentials {
+			return errors.New(`cors: the "*" origin can't be used when credentials are allowed`)
+		}
+	}
+
+	if p.MaxAge < 0 {
+		return errors.New("cors: max age must not be negative")
+	}
+
+	return nil
+}
+
+// validateOrigin checks that an origin pattern is "*", or a scheme and host
+// with an optional port and nothing else. A wildcard is only allowed in place
+// of the subdomain, like "https://*.example.com".
+func validateOrigin(origin string) error {
+	if origin == "*" {
+		return nil
+	}
+
+	// Replace the wildcard with a valid label, so that the rest can be
+	// checked by the URL parser.
+	check := origin
+	if strings.Contains(origin, "*") {
+		if strings.Count(origin, "*") != 1 || !strings.Contains(origin, "://*.") {
+			return fmt.Errorf("cors: invalid origin %q: a wildcard can only replace the subdomain", origin)
+		}
+		check = strings.Replace(origin, "*.", "x.", 1)
+	}
+
+	u, err := url.Parse(check)
+	if err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return fmt.Errorf("cors: invalid origin %q: must be like https://example.com", origin)
+	}
+
+	return nil
+}
+
+// Matches reports whether the policy applies to the given URL path.
+func (p *Policy) Matches(path string) bool {
+	return p.Pattern == "" || route.Match(p.Pattern, path)
+}
+
+// AllowsOrigin reports whether the value of a request's Origin header is one
+// of the policy's trusted origins.
+func (p *Policy) AllowsOrigin(origin string) bool {
+	// Scheme and host names are case-insensitive, so compare them in lower
+	// case.
+	origin = strings.ToLower(origin)
+
+	for _, pattern := range p.Origins {
+		if matchOrigin(strings.ToLower(pattern), origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchOrigin matches an origin against a pattern from Policy.Origins.
+func matchOrigin(pattern, origin string) bool {
+	if pattern == "*" {
+		return true
+	}
+
+	i := strings.Index(pattern, "*.")
+	if i < 0 {
+		return pattern == origin
+	}
+
+	// For "https://*.example.com", the origin must start with "https://" and
+	// end with ".example.com", and there must be at least one label in
+	// between. Checking for the dot means that "https://example.com" and
+	// "https://badexample.com" don't match.
+	prefix, suffix := pattern[:i], pattern[i+1:]
+	if len(origin) <= len(prefix)+len(suffix) || !strings.HasPrefix(origin, prefix) || !strings.HasSuffix(origin, suffix) {
+		return false
+	}
+
+	subdomain := origin[len(prefix) : len(origin)-len(suffix)]
+	return !strings.ContainsAny(subdomain, "/:@?#")
+}
+
+// routeConfig is a per-route policy as written in the config file. Every
+// setting is optional, and the ones which are missing are taken from the
+// default policy, so a route only needs to say how it differs.
+type routeConfig struct {
+	Pattern          string   `json:"pattern"`
+	Origins          []string `json:"origins"`
+	AllowCredentials *bool    `json:"allow_credentials"`
+	AllowedMethods   []string `json:"allowed_methods"`
+	AllowedHeaders   []string `json:"allowed_headers"`
+	ExposedHeaders   []string `json:"exposed_headers"`
+	MaxAge           *string  `json:"max_age"`
+}
+
+// LoadRoutes reads per-route policies from a JSON file in the format:
+//
+//	{
+//		"routes": [
+//			{
+//				"pattern": "/v1/movies/:id",
+//				"origins": ["https://*.example.com"],
+//				"allow_credentials": true,
+//				"exposed_headers": ["ETag", "Link"],
+//				"max_age": "10m"
+//			}
+//		]
+//	}
+//
+// Each route starts as a copy of defaults with the settings from the file
+// applied on top. An empty "origins" list turns CORS off for the route. The
+// policies are returned in the same order as in the file, which is the order
+// in which they should be matched.
+func LoadRoutes(path string, defaults Policy) ([]*Policy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var cfg struct {
+		Routes []routeConfig `json:"routes"`
+	}
+
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+
+	err = dec.Decode(&cfg)
+	if err != nil {
+		return nil, fmt.Errorf("cors: parsing %s: %w", path, err)
+	}
+
+	policies := make([]*Policy, len(cfg.Routes))
+	for i, rc := range cfg.Routes {
+		policies[i], err = rc.policy(defaults)
+		if err != nil {
+			return nil, fmt.Errorf("cors: route %d in %s: %w", i+1, path, err)
+		}
+	}
+
+	return policies, nil
+}
+
+// policy applies the route's settings on top of the defaults.
+func (rc routeConfig) policy(defaults Policy) (*Policy, error) {
+	if !strings.HasPrefix(rc.Pattern, "/") {
+		return nil, errors.New("pattern must start with /")
+	}
+
+	p := defaults
+	p.Pattern = rc.Pattern
+
+	// A nil slice means that the setting was missing from the file, while
+	// an empty one means it was set to [].
+	if rc.Origins != nil {
+		p.Origins = rc.Origins
+	}
+	if rc.AllowCredentials != nil {
+		p.AllowCredentials = *rc.AllowCredentials
+	}
+	if rc.AllowedMethods != nil {
+		p.AllowedMethods = rc.AllowedMethods
+	}
+	if rc.AllowedHeaders != nil {
+		p.AllowedHeaders = rc.AllowedHeaders
+	}
+	if rc.ExposedHeaders != nil {
+		p.ExposedHeaders = rc.ExposedHeaders
+	}
+	if rc.MaxAge != nil {
+		d, err := time.ParseDuration(*rc.MaxAge)
+		if err != nil {
+			return nil, fmt.Errorf("invalid max_age %q", *rc.MaxAge)
+		}
+		p.MaxAge = d
+	}
+
+	err := p.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
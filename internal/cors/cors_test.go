@@ -0,0 +1,135 @@
+package cors
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAllowsOrigin(t *testing.T) {
+	p := &Policy{Origins: []string{"http://localhost:9000", "https://*.example.com", "https://*.example.org:8443"}}
+
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"http://localhost:9000", true},
+		{"HTTP://LOCALHOST:9000", true},
+		{"http://localhost:9001", false},
+		{"https://localhost:9000", false},
+		{"https://app.example.com", true},
+		{"https://a.b.example.com", true},
+		{"https://example.com", false},
+		{"https://badexample.com", false},
+		{"http://app.example.com", false},
+		{"https://app.example.com:8080", false},
+		{"https://app.example.com.evil.com", false},
+		{"https://evil.com/.example.com", false},
+		{"https://app.example.org:8443", true},
+		{"https://app.example.org", false},
+		{"null", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.origin, func(t *testing.T) {
+			if got := p.AllowsOrigin(tt.origin); got != tt.want {
+				t.Errorf("want %v; got %v", tt.want, got)
+			}
+		})
+	}
+
+	if (&Policy{}).AllowsOrigin("https://example.com") {
+		t.Error("want a policy without origins to trust nothing")
+	}
+	if !(&Policy{Origins: []string{"*"}}).AllowsOrigin("https://example.com") {
+		t.Error(`want "*" to trust every origin`)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, origin := range []string{"*", "https://example.com", "http://localhost:9000", "https://*.example.com"} {
+		if err := (&Policy{Origins: []string{origin}}).Validate(); err != nil {
+			t.Errorf("%s: %v", origin, err)
+		}
+	}
+
+	for name, p := range map[string]*Policy{
+		"Path":                 {Origins: []string{"https://example.com/"}},
+		"No scheme":            {Origins: []string{"example.com"}},
+		"Wildcard in the host": {Origins: []string{"https://app*.example.com"}},
+		"Two wildcards":        {Origins: []string{"https://*.*.example.com"}},
+		"Any with credentials": {Origins: []string{"*"}, AllowCredentials: true},
+		"Negative max age":     {MaxAge: -time.Second},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if err := p.Validate(); err == nil {
+				t.Error("want error")
+			}
+		})
+	}
+}
+
+func TestLoadRoutes(t *testing.T) {
+	write := func(t *testing.T, contents string) string {
+		t.Helper()
+
+		path := filepath.Join(t.TempDir(), "cors.json")
+		err := ioutil.WriteFile(path, []byte(contents), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	defaults := Policy{
+		Origins:        []string{"https://example.com"},
+		AllowedMethods: DefaultAllowedMethods,
+		ExposedHeaders: []string{"Retry-After"},
+	}
+
+	t.Run("Valid", func(t *testing.T) {
+		path := write(t, `{"routes": [
+			{"pattern": "/v1/movies/:id", "origins": ["https://*.example.com"], "allow_credentials": true, "exposed_headers": ["ETag", "Link"], "max_age": "10m"},
+			{"pattern": "/v1/users/*path", "origins": []}
+		]}`)
+
+		routes, err := LoadRoutes(path, defaults)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(routes) != 2 {
+			t.Fatalf("want 2 routes; got %d", len(routes))
+		}
+
+		movie := routes[0]
+		if !movie.AllowsOrigin("https://app.example.com") || !movie.AllowCredentials || movie.MaxAge != 10*time.Minute {
+			t.Errorf("unexpected policy %+v", movie)
+		}
+		if len(movie.ExposedHeaders) != 2 || len(movie.AllowedMethods) != len(DefaultAllowedMethods) {
+			t.Errorf("unexpected policy %+v", movie)
+		}
+		if !movie.Matches("/v1/movies/1") || movie.Matches("/v1/movies") {
+			t.Error("unexpected route matching")
+		}
+
+		users := routes[1]
+		if users.AllowsOrigin("https://example.com") || len(users.ExposedHeaders) != 1 {
+			t.Errorf("unexpected policy %+v", users)
+		}
+	})
+
+	for name, contents := range map[string]string{
+		"Bad pattern":   `{"routes": [{"pattern": "v1"}]}`,
+		"Bad origin":    `{"routes": [{"pattern": "/", "origins": ["example.com"]}]}`,
+		"Bad max age":   `{"routes": [{"pattern": "/", "max_age": "10"}]}`,
+		"Unknown field": `{"routes": [{"pattern": "/", "orgins": []}]}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := LoadRoutes(write(t, contents), defaults)
+			if err == nil {
+				t.Error("want error")
+			}
+		})
+	}
+}
@@ -0,0 +1,390 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cedrickchee/skel/internal/validator"
+	"github.com/lib/pq"
+)
+
+var (
+	ErrDuplicateClient = errors.New("duplicate client")
+)
+
+// Principal is whoever is making a request: either a human User, or a
+// ServiceClient authenticating with an API key.
+type Principal interface {
+	// IsAnonymous reports whether the request is unauthenticated.
+	IsAnonymous() bool
+	// PrincipalID returns an identifier which is unique across all kinds of
+	// principal, like "user:1" or "client:1".
+	PrincipalID() string
+}
+
+// PrincipalID returns the user's identifier as a Principal.
+func (u *User) PrincipalID() string {
+	if u.IsAnonymous() {
+		return "anonymous"
+	}
+	return fmt.Sprintf("user:%d", u.ID)
+}
+
+// ServiceClient is a machine-to-machine client, like one of our ingestion
+// services. Clients have their own permission grants, separate from users and
+// roles, and authenticate with API keys instead of passwords.
+type ServiceClient struct {
+	ID          int64       `json:"id"`
+	CreatedAt   time.Time   `json:"created_at"`
+	Name        string      `json:"name"`
+	Permissions Permissions `json:"permissions"`
+}
+
+// IsAnonymous always returns false, since a ServiceClient can only be obtained
+// with a valid API key.
+func (c *ServiceClient) IsAnonymous() bool {
+	return false
+}
+
+// PrincipalID returns the client's identifier as a Principal.
+func (c *ServiceClient) PrincipalID() string {
+	return fmt.Sprintf("client:%d", c.ID)
+}
+
+func ValidateServiceClient(v *validator.Validator, client *ServiceClient) {
+	v.Check(client.Name != "", "name", "must be provided")
+	v.Check(len(client.Name) <= 100, "name", "must not be more than 100 bytes long")
+	v.Check(validator.Matches(client.Name, RoleRX), "name", "must only contain lowercase letters, digits, hyphens and underscores")
+
+	v.Check(client.Permissions != nil, "permissions", "must be provided")
+	v.Check(validator.Unique(client.Permissions), "permissions", "must not contain duplicate values")
+}
+
+// apiKeyPrefix is the fixed start of every API key. It makes keys easy to
+// recognize, both for people and for secret scanners.
+const apiKeyPrefix = "skel_"
+
+// APIKey holds the data for an API key. A key looks like:
+//
+//	skel_AAAQEAYE_AAAQEAYEAUDAOCAJBIFQYDIOB4IBCEQT
+//
+// The first random part is the key's prefix, which is stored in plain text and
+// used to look the key up. The whole key is only stored as a SHA-256 hash, and
+// the plaintext is only ever shown once, when the key is created.
+type APIKey struct {
+	ID        int64     `json:"id"`
+	ClientID  int64     `json:"-"`
+	Prefix    string    `json:"prefix"`
+	Plaintext string    `json:"key,omitempty"`
+	Hash      []byte    `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// generateAPIKey creates a new random API key for a client.
+func generateAPIKey(clientID int64) (*APIKey, error) {
+	// 5 random bytes give an 8 character prefix, and 20 random bytes give a
+	// 32 character (160-bit) secret.
+	randomBytes := make([]byte, 25)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+
+	key := &APIKey{
+		ClientID: clientID,
+		Prefix:   encoding.EncodeToString(randomBytes[:5]),
+	}
+	key.Plaintext = apiKeyPrefix + key.Prefix + "_" + encoding.EncodeToString(randomBytes[5:])
+
+	hash := sha256.Sum256([]byte(key.Plaintext))
+	key.Hash = hash[:]
+
+	return key, nil
+}
+
+// ValidateAPIKeyPlaintext checks that the plaintext API key has the right
+// shape.
+func ValidateAPIKeyPlaintext(v *validator.Validator, keyPlaintext string) {
+	v.Check(keyPlaintext != "", "key", "must be provided")
+	v.Check(len(keyPlaintext) == 46 && strings.HasPrefix(keyPlaintext, apiKeyPrefix) && keyPlaintext[13] == '_',
+		"key", "must be a valid API key")
+}
+
+// ClientModel struct type which wraps a sql.DB connection pool.
+type ClientModel struct {
+	DB      DBTX
+	Timeout time.Duration
+}
+
+// Insert adds a new service client, along with the permission codes that it is
+// granted, in a single transaction.
+func (m ClientModel) Insert(ctx context.Context, client *ServiceClient) error {
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	tx, err := beginTx(ctx, m.DB)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		-- name: clients.insert
+		INSERT INTO service_clients (name)
+		VALUES ($1)
+		RETURNING id, created_at`
+
+	err = tx.QueryRowContext(ctx, query, client.Name).Scan(&client.ID, &client.CreatedAt)
+	if err != nil {
+		switch {
+		case violates(err, "service_clients_name_key"):
+			return ErrDuplicateClient
+		default:
+			return translateError(err)
+		}
+	}
+
+	query = `
+		-- name: clients.insert_permissions
+		INSERT INTO service_clients_permissions
+		SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`
+
+	result, err := tx.ExecContext(ctx, query, client.ID, pq.Array(client.Permissions))
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected != int64(len(client.Permissions)) {
+		return ErrUnknownPermission
+	}
+
+	return tx.Commit()
+}
+
+// Get returns a specific service client by ID, along with its permissions.
+func (m ClientModel) Get(ctx context.Context, id int64) (*ServiceClient, error) {
+	query := `
+		-- name: clients.get
+		SELECT service_clients.id, service_clients.created_at, service_clients.name,
+			COALESCE(array_agg(permissions.code ORDER BY permissions.code) FILTER (WHERE permissions.code IS NOT NULL), '{}')
+		FROM service_clients
+		LEFT JOIN service_clients_permissions ON service_clients_permissions.client_id = service_clients.id
+		LEFT JOIN permissions ON permissions.id = service_clients_permissions.permission_id
+		WHERE service_clients.id = $1
+		GROUP BY service_clients.id`
+
+	var client ServiceClient
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(&client.ID, &client.CreatedAt, &client.Name, pq.Array(&client.Permissions))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &client, nil
+}
+
+// NewKey creates and stores a new API key for a service client. The returned
+// key is the only place that the plaintext is available.
+func (m ClientModel) NewKey(ctx context.Context, clientID int64) (*APIKey, error) {
+	key, err := generateAPIKey(clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		-- name: clients.new_key
+		INSERT INTO api_keys (client_id, prefix, hash)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at`
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	err = m.DB.QueryRowContext(ctx, query, key.ClientID, key.Prefix, key.Hash).Scan(&key.ID, &key.CreatedAt)
+	if err != nil {
+		switch {
+		case violates(err, "api_keys_client_id_fkey"):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, translateError(err)
+		}
+	}
+
+	return key, nil
+}
+
+// DeleteKey revokes the API key with the given prefix. The key must belong to
+// the given client.
+func (m ClientModel) DeleteKey(ctx context.Context, clientID int64, prefix string) error {
+	query := `
+		-- name: clients.delete_key
+		DELETE FROM api_keys
+		WHERE client_id = $1 AND prefix = $2`
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, clientID, prefix)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// GetForKey returns the service client that a plaintext API key belongs to,
+// along with the client's permissions. The key should already have been
+// checked with ValidateAPIKeyPlaintext().
+func (m ClientModel) GetForKey(ctx context.Context, keyPlaintext string) (*ServiceClient, error) {
+	if len(keyPlaintext) < len(apiKeyPrefix)+8 {
+		return nil, ErrRecordNotFound
+	}
+
+	// Look the key up by its prefix, which is indexed, and then compare the
+	// hashes in constant time.
+	prefix := keyPlaintext[len(apiKeyPrefix) : len(apiKeyPrefix)+8]
+	keyHash := sha256.Sum256([]byte(keyPlaintext))
+
+	query := `
+		-- name: clients.get_for_key
+		SELECT service_clients.id, service_clients.created_at, service_clients.name, api_keys.hash,
+			COALESCE(array_agg(permissions.code ORDER BY permissions.code) FILTER (WHERE permissions.code IS NOT NULL), '{}')
+		FROM api_keys
+		INNER JOIN service_clients ON service_clients.id = api_keys.client_id
+		LEFT JOIN service_clients_permissions ON service_clients_permissions.client_id = service_clients.id
+		LEFT JOIN permissions ON permissions.id = service_clients_permissions.permission_id
+		WHERE api_keys.prefix = $1
+		GROUP BY service_clients.id, api_keys.hash`
+
+	var client ServiceClient
+	var hash []byte
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, prefix).Scan(&client.ID, &client.CreatedAt, &client.Name, &hash, pq.Array(&client.Permissions))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if subtle.ConstantTimeCompare(hash, keyHash[:]) != 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	return &client, nil
+}
+
+// Mock models
+
+var mockClient = &ServiceClient{
+	ID:          1,
+	CreatedAt:   time.Now(),
+	Name:        "ingest",
+	Permissions: Permissions{"movies:read", "movies:write"},
+}
+
+// mockAPIKey is the API key for the mockClient. The key prefix is AAAQEAYE.
+var mockAPIKey = func() *APIKey {
+	plaintext := "skel_AAAQEAYE_AAAQEAYEAUDAOCAJBIFQYDIOB4IBCEQT"
+	hash := sha256.Sum256([]byte(plaintext))
+
+	return &APIKey{
+		ID:        1,
+		ClientID:  mockClient.ID,
+		Prefix:    "AAAQEAYE",
+		Plaintext: plaintext,
+		Hash:      hash[:],
+		CreatedAt: time.Now(),
+	}
+}()
+
+type MockClientModel struct{}
+
+// Insert inserts a new service client. Note that it must not have the same
+// name as the mockClient.
+func (m MockClientModel) Insert(ctx context.Context, client *ServiceClient) error {
+	if client.Name == mockClient.Name {
+		return ErrDuplicateClient
+	}
+
+	client.ID = 2
+	client.CreatedAt = time.Now()
+
+	return nil
+}
+
+// Get gets the mockClient.
+func (m MockClientModel) Get(ctx context.Context, id int64) (*ServiceClient, error) {
+	if id != mockClient.ID {
+		return nil, ErrRecordNotFound
+	}
+
+	return mockClient, nil
+}
+
+// NewKey returns the mockAPIKey for the mockClient.
+func (m MockClientModel) NewKey(ctx context.Context, clientID int64) (*APIKey, error) {
+	if clientID != mockClient.ID {
+		return nil, ErrRecordNotFound
+	}
+
+	key := *mockAPIKey
+	return &key, nil
+}
+
+// DeleteKey revokes the mockAPIKey.
+func (m MockClientModel) DeleteKey(ctx context.Context, clientID int64, prefix string) error {
+	if clientID != mockClient.ID || prefix != mockAPIKey.Prefix {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// GetForKey returns the mockClient for the mockAPIKey.
+func (m MockClientModel) GetForKey(ctx context.Context, keyPlaintext string) (*ServiceClient, error) {
+	keyHash := sha256.Sum256([]byte(keyPlaintext))
+
+	if !bytes.Equal(keyHash[:], mockAPIKey.Hash) {
+		return nil, ErrRecordNotFound
+	}
+
+	return mockClient, nil
+}
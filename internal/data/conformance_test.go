@@ -0,0 +1,729 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cedrickchee/skel/internal/metrics"
+	"github.com/cedrickchee/skel/internal/testdb"
+)
+
+// The conformance tests check that every implementation of Models behaves
+// the same way, so that handler tests and demos which use the memory models
+// can be trusted to tell us how the API behaves against PostgreSQL. They only
+// use the models themselves to set up and check their data.
+
+func TestMemoryModelsConformance(t *testing.T) {
+	testModelsConformance(t, func(t *testing.T) Models {
+		return NewMemoryModels()
+	})
+}
+
+func TestPostgresModelsConformance(t *testing.T) {
+	testModelsConformance(t, func(t *testing.T) Models {
+		// Instrumented, as they are in the server, so that the wrapper is
+		// run through every query too.
+		ins := NewInstrumentation(metrics.NewRegistry(), nil, 0)
+		return NewModels(testdb.New(t), 0, nil, ins)
+	})
+}
+
+// testModelsConformance runs every conformance test, each against a fresh,
+// empty set of models from newModels.
+func testModelsConformance(t *testing.T, newModels func(t *testing.T) Models) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, m Models)
+	}{
+		{"Movies", testMoviesConformance},
+		{"MoviesGetAll", testMoviesGetAllConformance},
+		{"Users", testUsersConformance},
+		{"Tokens", testTokensConformance},
+		{"Permissions", testPermissionsConformance},
+		{"Roles", testRolesConformance},
+		{"Clients", testClientsConformance},
+		{"Jobs", testJobsConformance},
+		{"Transaction", testTransactionConformance},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			tt.test(t, newModels(t))
+		})
+	}
+}
+
+// insertUser adds a user with the given email, and returns them.
+func insertUser(t *testing.T, m Models, email string) *User {
+	t.Helper()
+
+	user := &User{Name: "Test", Email: email, Password: password{hash: []byte("not a real hash")}}
+
+	err := m.Users.Insert(context.Background(), user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// assertConstraintError checks that err is a ConstraintError of the given
+// kind, for the given constraint and field.
+func assertConstraintError(t *testing.T, err error, kind error, constraint, field string) {
+	t.Helper()
+
+	var cErr *ConstraintError
+	if !errors.As(err, &cErr) {
+		t.Errorf("want a ConstraintError for %s; got %v", constraint, err)
+		return
+	}
+	if !errors.Is(err, kind) || cErr.Constraint != constraint || cErr.Field != field {
+		t.Errorf("want %v of %s on field %q; got %v of %s on field %q", kind, constraint, field, cErr.Kind, cErr.Constraint, cErr.Field)
+	}
+}
+
+func testMoviesConformance(t *testing.T, m Models) {
+	ctx := context.Background()
+
+	movie := &Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation", "adventure"}}
+	err := m.Movies.Insert(ctx, movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if movie.ID != 1 || movie.Version != 1 || movie.CreatedAt.IsZero() {
+		t.Errorf("want ID 1, version 1 and a creation time; got %+v", movie)
+	}
+
+	// The table's constraints are reported as ConstraintErrors, which say
+	// which field was wrong.
+	err = m.Movies.Insert(ctx, &Movie{Title: "Too Early", Year: 1800, Runtime: 1, Genres: []string{"drama"}})
+	assertConstraintError(t, err, ErrCheckViolation, "movies_year_check", "year")
+	err = m.Movies.Insert(ctx, &Movie{Title: "Orphan", Year: 2000, Runtime: 1, Genres: []string{"drama"}, CreatedBy: 99})
+	assertConstraintError(t, err, ErrForeignKeyViolation, "movies_created_by_fkey", "created_by")
+
+	for _, id := range []int64{0, 99} {
+		_, err = m.Movies.Get(ctx, id)
+		if !errors.Is(err, ErrRecordNotFound) {
+			t.Errorf("Get(%d): want %v; got %v", id, ErrRecordNotFound, err)
+		}
+	}
+
+	got, err := m.Movies.Get(ctx, movie.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := *got
+
+	// Changing what we got back mustn't change what's stored.
+	got.Runtime = 113
+	got.Genres[0] = "musical"
+
+	again, err := m.Movies.Get(ctx, movie.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Runtime != 107 || again.Genres[0] != "animation" {
+		t.Errorf("want the stored movie unchanged; got %+v", again)
+	}
+
+	got.Genres = []string{"a", "b", "c", "d", "e", "f"}
+	err = m.Movies.Update(ctx, got)
+	assertConstraintError(t, err, ErrCheckViolation, "genres_length_check", "genres")
+
+	got.Genres = []string{"musical"}
+	err = m.Movies.Update(ctx, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != 2 {
+		t.Errorf("want version 2; got %d", got.Version)
+	}
+
+	err = m.Movies.Update(ctx, &stale)
+	if !errors.Is(err, ErrEditConflict) {
+		t.Errorf("want %v updating a stale copy; got %v", ErrEditConflict, err)
+	}
+
+	err = m.Movies.Delete(ctx, movie.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Movies.Delete(ctx, movie.ID)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("want %v deleting twice; got %v", ErrRecordNotFound, err)
+	}
+	err = m.Movies.Update(ctx, got)
+	if !errors.Is(err, ErrEditConflict) {
+		t.Errorf("want %v updating a deleted movie; got %v", ErrEditConflict, err)
+	}
+}
+
+func testMoviesGetAllConformance(t *testing.T, m Models) {
+	ctx := context.Background()
+
+	for _, movie := range []*Movie{
+		{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation", "adventure"}},
+		{Title: "Black Panther", Year: 2018, Runtime: 134, Genres: []string{"action", "adventure"}},
+		{Title: "The Breakfast Club", Year: 1985, Runtime: 97, Genres: []string{"comedy", "drama"}},
+		{Title: "The Club", Year: 2015, Runtime: 97, Genres: []string{"drama"}},
+	} {
+		err := m.Movies.Insert(ctx, movie)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	safelist := []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
+
+	tests := []struct {
+		name         string
+		title        string
+		genres       []string
+		filters      Filters
+		wantIDs      []int64
+		wantMetadata Metadata
+	}{
+		{
+			name:         "All",
+			filters:      Filters{Page: 1, PageSize: 20, Sort: "-id", SortSafelist: safelist},
+			wantIDs:      []int64{4, 3, 2, 1},
+			wantMetadata: Metadata{CurrentPage: 1, PageSize: 20, FirstPage: 1, LastPage: 1, TotalRecords: 4},
+		},
+		{
+			name:         "Title words in any order and case",
+			title:        "CLUB the",
+			filters:      Filters{Page: 1, PageSize: 20, Sort: "id", SortSafelist: safelist},
+			wantIDs:      []int64{3, 4},
+			wantMetadata: Metadata{CurrentPage: 1, PageSize: 20, FirstPage: 1, LastPage: 1, TotalRecords: 2},
+		},
+		{
+			name:         "Title needs every word",
+			title:        "breakfast club",
+			filters:      Filters{Page: 1, PageSize: 20, Sort: "id", SortSafelist: safelist},
+			wantIDs:      []int64{3},
+			wantMetadata: Metadata{CurrentPage: 1, PageSize: 20, FirstPage: 1, LastPage: 1, TotalRecords: 1},
+		},
+		{
+			name:         "Genres",
+			genres:       []string{"drama", "comedy"},
+			filters:      Filters{Page: 1, PageSize: 20, Sort: "id", SortSafelist: safelist},
+			wantIDs:      []int64{3},
+			wantMetadata: Metadata{CurrentPage: 1, PageSize: 20, FirstPage: 1, LastPage: 1, TotalRecords: 1},
+		},
+		{
+			name:         "Ties broken by ascending ID",
+			filters:      Filters{Page: 1, PageSize: 20, Sort: "-runtime", SortSafelist: safelist},
+			wantIDs:      []int64{2, 1, 3, 4},
+			wantMetadata: Metadata{CurrentPage: 1, PageSize: 20, FirstPage: 1, LastPage: 1, TotalRecords: 4},
+		},
+		{
+			name:         "Sort by title",
+			filters:      Filters{Page: 1, PageSize: 20, Sort: "title", SortSafelist: safelist},
+			wantIDs:      []int64{2, 1, 3, 4},
+			wantMetadata: Metadata{CurrentPage: 1, PageSize: 20, FirstPage: 1, LastPage: 1, TotalRecords: 4},
+		},
+		{
+			name:         "Page",
+			filters:      Filters{Page: 2, PageSize: 3, Sort: "year", SortSafelist: safelist},
+			wantIDs:      []int64{2},
+			wantMetadata: Metadata{CurrentPage: 2, PageSize: 3, FirstPage: 1, LastPage: 2, TotalRecords: 4},
+		},
+		{
+			name:         "Past the last page",
+			filters:      Filters{Page: 3, PageSize: 3, Sort: "year", SortSafelist: safelist},
+			wantIDs:      nil,
+			wantMetadata: Metadata{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			genres := tt.genres
+			if genres == nil {
+				genres = []string{}
+			}
+
+			movies, metadata, err := m.Movies.GetAll(ctx, tt.title, genres, tt.filters)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var ids []int64
+			for _, movie := range movies {
+				ids = append(ids, movie.ID)
+			}
+
+			if !reflect.DeepEqual(ids, tt.wantIDs) {
+				t.Errorf("want IDs %v; got %v", tt.wantIDs, ids)
+			}
+			if metadata != tt.wantMetadata {
+				t.Errorf("want metadata %+v; got %+v", tt.wantMetadata, metadata)
+			}
+		})
+	}
+}
+
+func testUsersConformance(t *testing.T, m Models) {
+	ctx := context.Background()
+
+	alice := insertUser(t, m, "alice@example.com")
+	if alice.ID != 1 || alice.Version != 1 || alice.CreatedAt.IsZero() {
+		t.Errorf("want ID 1, version 1 and a creation time; got %+v", alice)
+	}
+	bob := insertUser(t, m, "bob@example.com")
+
+	// Emails are unique, whatever their case.
+	err := m.Users.Insert(ctx, &User{Name: "Alice", Email: "ALICE@example.com", Password: password{hash: []byte("x")}})
+	if !errors.Is(err, ErrDuplicateEmail) {
+		t.Errorf("want %v; got %v", ErrDuplicateEmail, err)
+	}
+
+	got, err := m.Users.GetByEmail(ctx, "Alice@Example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != alice.ID || !reflect.DeepEqual(got.Password.hash, alice.Password.hash) {
+		t.Errorf("want %+v; got %+v", alice, got)
+	}
+
+	_, err = m.Users.GetByEmail(ctx, "nobody@example.com")
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("want %v; got %v", ErrRecordNotFound, err)
+	}
+
+	bob.Email = "alice@example.com"
+	err = m.Users.Update(ctx, bob)
+	if !errors.Is(err, ErrDuplicateEmail) {
+		t.Errorf("want %v; got %v", ErrDuplicateEmail, err)
+	}
+
+	stale := *got
+	got.Activated = true
+	err = m.Users.Update(ctx, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != 2 {
+		t.Errorf("want version 2; got %d", got.Version)
+	}
+
+	err = m.Users.Update(ctx, &stale)
+	if !errors.Is(err, ErrEditConflict) {
+		t.Errorf("want %v; got %v", ErrEditConflict, err)
+	}
+}
+
+func testTokensConformance(t *testing.T, m Models) {
+	ctx := context.Background()
+
+	alice := insertUser(t, m, "alice@example.com")
+
+	activation, err := m.Tokens.New(ctx, alice.ID, time.Hour, ScopeActivation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := m.Tokens.New(ctx, alice.ID, -time.Hour, ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		scope     string
+		plaintext string
+		wantError error
+	}{
+		{name: "Valid", scope: ScopeActivation, plaintext: activation.Plaintext},
+		{name: "Wrong scope", scope: ScopeAuthentication, plaintext: activation.Plaintext, wantError: ErrRecordNotFound},
+		{name: "Expired", scope: ScopeAuthentication, plaintext: expired.Plaintext, wantError: ErrRecordNotFound},
+		{name: "Unknown", scope: ScopeActivation, plaintext: "ABCDEFGHIJKLMNOPQRSTUVWXYZ", wantError: ErrRecordNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, expiry, err := m.Users.GetForToken(ctx, tt.scope, tt.plaintext)
+			if !errors.Is(err, tt.wantError) {
+				t.Fatalf("want %v; got %v", tt.wantError, err)
+			}
+			if err == nil && user.ID != alice.ID {
+				t.Errorf("want user %d; got %d", alice.ID, user.ID)
+			}
+			// PostgreSQL only stores whole seconds.
+			if d := expiry.Sub(activation.Expiry); err == nil && (d < -time.Second || d > time.Second) {
+				t.Errorf("want expiry %v; got %v", activation.Expiry, expiry)
+			}
+		})
+	}
+
+	err = m.Tokens.Insert(ctx, activation)
+	assertConstraintError(t, err, ErrUniqueViolation, "tokens_pkey", "")
+	_, err = m.Tokens.New(ctx, 99, time.Hour, ScopeActivation)
+	assertConstraintError(t, err, ErrForeignKeyViolation, "tokens_user_id_fkey", "")
+
+	n, err := m.Tokens.DeleteExpired(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("want 1 expired token deleted; got %d", n)
+	}
+
+	err = m.Tokens.DeleteAllForUser(ctx, ScopeActivation, alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = m.Users.GetForToken(ctx, ScopeActivation, activation.Plaintext)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("want %v after deleting the user's tokens; got %v", ErrRecordNotFound, err)
+	}
+}
+
+func testPermissionsConformance(t *testing.T, m Models) {
+	ctx := context.Background()
+
+	alice := insertUser(t, m, "alice@example.com")
+
+	permissionsFor := func(userID int64) Permissions {
+		t.Helper()
+
+		permissions, err := m.Permissions.GetAllForUser(ctx, userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(permissions)
+		return permissions
+	}
+
+	if got := permissionsFor(alice.ID); got != nil {
+		t.Errorf("want no permissions; got %v", got)
+	}
+
+	// A name which isn't a role stops any of them being assigned.
+	err := m.Roles.AddForUser(ctx, alice.ID, "editor", "no-such-role")
+	if !errors.Is(err, ErrUnknownRole) {
+		t.Errorf("want %v; got %v", ErrUnknownRole, err)
+	}
+	if got := permissionsFor(alice.ID); got != nil {
+		t.Errorf("want no permissions; got %v", got)
+	}
+
+	// Editors inherit from viewers. Assigning a role twice is fine.
+	for i := 0; i < 2; i++ {
+		err = m.Roles.AddForUser(ctx, alice.ID, "editor", "editor")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = m.Permissions.AddForUser(ctx, alice.ID, "movies:read", "metrics:read", "no:such:permission")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := Permissions{"metrics:read", "movies:read", "movies:write"}
+	if got := permissionsFor(alice.ID); !reflect.DeepEqual(got, want) {
+		t.Errorf("want %v; got %v", want, got)
+	}
+
+	err = m.Roles.RemoveForUser(ctx, alice.ID, "editor")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want = Permissions{"metrics:read", "movies:read"}
+	if got := permissionsFor(alice.ID); !reflect.DeepEqual(got, want) {
+		t.Errorf("want %v; got %v", want, got)
+	}
+
+	err = m.Permissions.AddForUser(ctx, 99, "movies:read")
+	assertConstraintError(t, err, ErrForeignKeyViolation, "users_permissions_user_id_fkey", "")
+}
+
+func testRolesConformance(t *testing.T, m Models) {
+	ctx := context.Background()
+
+	roles, err := m.Roles.GetAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, role := range roles {
+		names = append(names, role.Name)
+	}
+	if want := []string{"viewer", "editor", "admin"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("want the roles from the migrations, %v; got %v", want, names)
+	}
+
+	critic := &Role{Name: "critic", Parent: "viewer", Permissions: Permissions{"metrics:read"}}
+	err = m.Roles.Insert(ctx, critic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := m.Roles.Get(ctx, "critic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != critic.ID || got.Parent != "viewer" || !reflect.DeepEqual(got.Permissions, critic.Permissions) {
+		t.Errorf("want %+v; got %+v", critic, got)
+	}
+
+	err = m.Roles.Insert(ctx, &Role{Name: "critic", Permissions: Permissions{}})
+	if !errors.Is(err, ErrDuplicateRole) {
+		t.Errorf("want %v; got %v", ErrDuplicateRole, err)
+	}
+	err = m.Roles.Insert(ctx, &Role{Name: "reviewer", Permissions: Permissions{"no:such:permission"}})
+	if !errors.Is(err, ErrUnknownPermission) {
+		t.Errorf("want %v; got %v", ErrUnknownPermission, err)
+	}
+
+	err = m.Roles.Delete(ctx, "viewer")
+	if !errors.Is(err, ErrRoleInUse) {
+		t.Errorf("want %v deleting a parent; got %v", ErrRoleInUse, err)
+	}
+
+	// Update replaces the parent and the permissions.
+	update := &Role{ID: critic.ID, Parent: "editor", Permissions: Permissions{"movies:write:any"}}
+	err = m.Roles.Update(ctx, update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = m.Roles.Get(ctx, "critic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if update.Name != "critic" || got.Parent != "editor" || !reflect.DeepEqual(got.Permissions, update.Permissions) {
+		t.Errorf("want %+v; got %+v", update, got)
+	}
+
+	viewer, err := m.Roles.Get(ctx, "viewer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Roles.Update(ctx, &Role{ID: viewer.ID, Parent: "critic", Permissions: viewer.Permissions})
+	if !errors.Is(err, ErrRoleCycle) {
+		t.Errorf("want %v; got %v", ErrRoleCycle, err)
+	}
+	err = m.Roles.Update(ctx, &Role{ID: critic.ID, Permissions: Permissions{"no:such:permission"}})
+	if !errors.Is(err, ErrUnknownPermission) {
+		t.Errorf("want %v; got %v", ErrUnknownPermission, err)
+	}
+	err = m.Roles.Update(ctx, &Role{ID: 99, Permissions: Permissions{}})
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("want %v; got %v", ErrRecordNotFound, err)
+	}
+
+	// A refused update changes nothing.
+	got, err = m.Roles.Get(ctx, "critic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Parent != "editor" || !reflect.DeepEqual(got.Permissions, update.Permissions) {
+		t.Errorf("want %+v unchanged; got %+v", update, got)
+	}
+
+	err = m.Roles.Delete(ctx, "critic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = m.Roles.Get(ctx, "critic")
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("want %v; got %v", ErrRecordNotFound, err)
+	}
+}
+
+func testClientsConformance(t *testing.T, m Models) {
+	ctx := context.Background()
+
+	client := &ServiceClient{Name: "indexer", Permissions: Permissions{"movies:read"}}
+	err := m.Clients.Insert(ctx, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.Clients.Insert(ctx, &ServiceClient{Name: "indexer", Permissions: Permissions{}})
+	if !errors.Is(err, ErrDuplicateClient) {
+		t.Errorf("want %v; got %v", ErrDuplicateClient, err)
+	}
+	err = m.Clients.Insert(ctx, &ServiceClient{Name: "other", Permissions: Permissions{"no:such:permission"}})
+	if !errors.Is(err, ErrUnknownPermission) {
+		t.Errorf("want %v; got %v", ErrUnknownPermission, err)
+	}
+
+	key, err := m.Clients.NewKey(ctx, client.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = m.Clients.NewKey(ctx, 99)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("want %v; got %v", ErrRecordNotFound, err)
+	}
+
+	got, err := m.Clients.GetForKey(ctx, key.Plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != client.ID || !reflect.DeepEqual(got.Permissions, client.Permissions) {
+		t.Errorf("want %+v; got %+v", client, got)
+	}
+
+	err = m.Clients.DeleteKey(ctx, client.ID, key.Prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = m.Clients.GetForKey(ctx, key.Plaintext)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("want %v for a deleted key; got %v", ErrRecordNotFound, err)
+	}
+}
+
+func testJobsConformance(t *testing.T, m Models) {
+	ctx := context.Background()
+
+	_, err := m.Jobs.Claim(ctx, time.Minute)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Fatalf("want %v with no jobs; got %v", ErrRecordNotFound, err)
+	}
+
+	job, err := NewJob("test", map[string]int{"n": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Jobs.Enqueue(ctx, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claimed, err := m.Jobs.Claim(ctx, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claimed.ID != job.ID || claimed.Attempts != 1 {
+		t.Errorf("want job %d on attempt 1; got %+v", job.ID, claimed)
+	}
+
+	// It's leased, so nobody else can claim it.
+	_, err = m.Jobs.Claim(ctx, time.Minute)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("want %v while the job is leased; got %v", ErrRecordNotFound, err)
+	}
+
+	err = m.Jobs.Retry(ctx, claimed, time.Now().Add(-time.Second), "failed")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first claim is stale now.
+	err = m.Jobs.Complete(ctx, claimed)
+	if !errors.Is(err, ErrEditConflict) {
+		t.Errorf("want %v completing a stale claim; got %v", ErrEditConflict, err)
+	}
+
+	claimed, err = m.Jobs.Claim(ctx, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claimed.Attempts != 2 || claimed.LastError != "failed" {
+		t.Errorf("want attempt 2 after a failure; got %+v", claimed)
+	}
+
+	err = m.Jobs.Complete(ctx, claimed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A buried job is never claimed again.
+	job, err = NewJob("test", map[string]int{"n": 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Jobs.Enqueue(ctx, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claimed, err = m.Jobs.Claim(ctx, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Jobs.Bury(ctx, claimed, "failed for good")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = m.Jobs.Claim(ctx, time.Minute)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("want %v after burying the only job; got %v", ErrRecordNotFound, err)
+	}
+}
+
+func testTransactionConformance(t *testing.T, m Models) {
+	ctx := context.Background()
+	errBoom := errors.New("boom")
+
+	// register creates a user, their activation token and the job which
+	// emails it to them, in one transaction, and then returns fnErr.
+	register := func(email string, fnErr error) (token *Token, err error) {
+		err = m.Transaction(ctx, func(ctx context.Context, tx Models) error {
+			user := &User{Name: "Test", Email: email, Password: password{hash: []byte("not a real hash")}}
+			err := tx.Users.Insert(ctx, user)
+			if err != nil {
+				return err
+			}
+
+			token, err = tx.Tokens.New(ctx, user.ID, time.Hour, ScopeActivation)
+			if err != nil {
+				return err
+			}
+
+			job, err := NewJob("send_email", map[string]string{"recipient": email})
+			if err != nil {
+				return err
+			}
+			err = tx.Jobs.Enqueue(ctx, job)
+			if err != nil {
+				return err
+			}
+
+			return fnErr
+		})
+		return token, err
+	}
+
+	// A failure part way through leaves nothing behind.
+	token, err := register("rollback@example.com", errBoom)
+	if !errors.Is(err, errBoom) {
+		t.Fatalf("want %v; got %v", errBoom, err)
+	}
+
+	_, err = m.Users.GetByEmail(ctx, "rollback@example.com")
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("want the user to be rolled back; got %v", err)
+	}
+	_, _, err = m.Users.GetForToken(ctx, ScopeActivation, token.Plaintext)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("want the token to be rolled back; got %v", err)
+	}
+	_, err = m.Jobs.Claim(ctx, time.Minute)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("want the job to be rolled back; got %v", err)
+	}
+
+	// Success keeps all of it.
+	token, err = register("commit@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, _, err := m.Users.GetForToken(ctx, ScopeActivation, token.Plaintext)
+	if err != nil || user.Email != "commit@example.com" {
+		t.Errorf("want the user and their token to be committed; got %v, %v", user, err)
+	}
+	job, err := m.Jobs.Claim(ctx, time.Minute)
+	if err != nil || !strings.Contains(string(job.Payload), "commit@example.com") {
+		t.Errorf("want the job to be committed; got %v, %v", job, err)
+	}
+}
@@ -0,0 +1,81 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"testing"
+	"time"
+)
+
+// blockingDriver is a database/sql driver whose queries never finish, and
+// only return once their context is done. It lets us check that the models
+// give up on a query when they should, without a real database.
+type blockingDriver struct{}
+
+func (blockingDriver) Open(name string) (driver.Conn, error) {
+	return blockingConn{}, nil
+}
+
+type blockingConn struct{}
+
+func (blockingConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+func (blockingConn) Close() error              { return nil }
+func (blockingConn) Begin() (driver.Tx, error) { return nil, errors.New("not supported") }
+
+func (blockingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (blockingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func init() {
+	sql.Register("blocking", blockingDriver{})
+}
+
+func TestModelContext(t *testing.T) {
+	db, err := sql.Open("blocking", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	t.Run("Cancelled", func(t *testing.T) {
+		m := NewModels(db, time.Minute, nil, nil)
+
+		// Cancel the context part way through the query, like net/http does
+		// when the client goes away.
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(20*time.Millisecond, cancel)
+
+		start := time.Now()
+		_, err := m.Movies.Get(ctx, 1)
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("want %v; got %v", context.Canceled, err)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("query took %s to abort", elapsed)
+		}
+
+		err = m.Tokens.DeleteAllForUser(ctx, ScopeActivation, 1)
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("want %v; got %v", context.Canceled, err)
+		}
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		m := NewModels(db, 20*time.Millisecond, nil, nil)
+
+		_, err := m.Users.GetByEmail(context.Background(), "alice@example.com")
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("want %v; got %v", context.DeadlineExceeded, err)
+		}
+	})
+}
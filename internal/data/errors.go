@@ -0,0 +1,115 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// The kinds of constraint violation which a ConstraintError can be. Use
+// errors.Is() to check for them, whichever constraint was violated.
+var (
+	ErrUniqueViolation     = errors.New("unique violation")
+	ErrCheckViolation      = errors.New("check violation")
+	ErrForeignKeyViolation = errors.New("foreign key violation")
+)
+
+// ConstraintError reports that the database refused a change because it
+// would have violated one of the constraints on a table. Models return it for
+// violations which they don't have a more specific error for, like a movie
+// from before 1888, so that handlers can tell the client what was wrong
+// instead of sending a 500.
+type ConstraintError struct {
+	// Kind is ErrUniqueViolation, ErrCheckViolation or
+	// ErrForeignKeyViolation.
+	Kind error
+	// Constraint is the name of the constraint, like "movies_year_check".
+	Constraint string
+	// Field and Message describe the violation in the same way as a
+	// validator.Validator error, when the constraint is one we know about.
+	// Otherwise they're empty.
+	Field   string
+	Message string
+	// Err is the error from the database driver, if there was one.
+	Err error
+}
+
+func (e *ConstraintError) Error() string {
+	if e.Err != nil {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s of constraint %q", e.Kind, e.Constraint)
+}
+
+// Is makes errors.Is(err, ErrCheckViolation) and the like work.
+func (e *ConstraintError) Is(target error) bool {
+	return target == e.Kind
+}
+
+func (e *ConstraintError) Unwrap() error {
+	return e.Err
+}
+
+// constraintFields maps the constraints which a client can violate to the
+// input field and message to report. The messages match those from the
+// Validate functions, where there is one, because a ConstraintError usually
+// means that something got past them.
+var constraintFields = map[string]struct{ field, message string }{
+	"movies_year_check":        {"year", "must be between 1888 and the current year"},
+	"movies_runtime_check":     {"runtime", "must be a positive integer"},
+	"genres_length_check":      {"genres", "must contain between 1 and 5 genres"},
+	"movies_created_by_fkey":   {"created_by", "must be an existing user"},
+	"users_email_key":          {"email", "a user with this email address already exists"},
+	"roles_name_key":           {"name", "a role with this name already exists"},
+	"service_clients_name_key": {"name", "a client with this name already exists"},
+}
+
+// pqConstraintKinds maps the SQLSTATE codes for constraint violations to the
+// kind of ConstraintError.
+var pqConstraintKinds = map[pq.ErrorCode]error{
+	"23505": ErrUniqueViolation,     // unique_violation
+	"23514": ErrCheckViolation,      // check_violation
+	"23503": ErrForeignKeyViolation, // foreign_key_violation
+}
+
+// newConstraintError returns a ConstraintError for a violation of the named
+// constraint, with the field and message for it filled in.
+func newConstraintError(kind error, constraint string, err error) *ConstraintError {
+	f := constraintFields[constraint]
+
+	return &ConstraintError{
+		Kind:       kind,
+		Constraint: constraint,
+		Field:      f.field,
+		Message:    f.message,
+		Err:        err,
+	}
+}
+
+// translateError turns a constraint violation reported by PostgreSQL into a
+// ConstraintError. Any other error is returned unchanged. We look at the
+// error's SQLSTATE code and constraint name, rather than its text, which
+// depends on the server's version and locale.
+func translateError(err error) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return err
+	}
+
+	kind, ok := pqConstraintKinds[pqErr.Code]
+	if !ok {
+		return err
+	}
+
+	return newConstraintError(kind, pqErr.Constraint, err)
+}
+
+// violates reports whether err is a violation of the named constraint.
+func violates(err error, constraint string) bool {
+	var cErr *ConstraintError
+	if errors.As(translateError(err), &cErr) {
+		return cErr.Constraint == constraint
+	}
+	return false
+}
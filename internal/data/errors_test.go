@@ -0,0 +1,101 @@
+package data
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestTranslateError(t *testing.T) {
+	tests := []struct {
+		name           string
+		err            error
+		wantKind       error
+		wantConstraint string
+		wantField      string
+	}{
+		{
+			name:           "Check",
+			err:            &pq.Error{Code: "23514", Constraint: "movies_year_check"},
+			wantKind:       ErrCheckViolation,
+			wantConstraint: "movies_year_check",
+			wantField:      "year",
+		},
+		{
+			name:           "Unique",
+			err:            &pq.Error{Code: "23505", Constraint: "users_email_key"},
+			wantKind:       ErrUniqueViolation,
+			wantConstraint: "users_email_key",
+			wantField:      "email",
+		},
+		{
+			name:           "Foreign key",
+			err:            &pq.Error{Code: "23503", Constraint: "tokens_user_id_fkey"},
+			wantKind:       ErrForeignKeyViolation,
+			wantConstraint: "tokens_user_id_fkey",
+		},
+		{
+			name:           "Wrapped",
+			err:            fmt.Errorf("inserting movie: %w", &pq.Error{Code: "23514", Constraint: "genres_length_check"}),
+			wantKind:       ErrCheckViolation,
+			wantConstraint: "genres_length_check",
+			wantField:      "genres",
+		},
+		// Other errors, from PostgreSQL or not, are left alone.
+		{name: "Not a constraint", err: &pq.Error{Code: "42P01"}},
+		{name: "Not from PostgreSQL", err: sql.ErrNoRows},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := translateError(tt.err)
+
+			var cErr *ConstraintError
+			if !errors.As(err, &cErr) {
+				if tt.wantKind != nil {
+					t.Fatalf("want a ConstraintError; got %#v", err)
+				}
+				if err != tt.err {
+					t.Errorf("want %v unchanged; got %v", tt.err, err)
+				}
+				return
+			}
+
+			if !errors.Is(err, tt.wantKind) {
+				t.Errorf("want %v; got %v", tt.wantKind, cErr.Kind)
+			}
+			if cErr.Constraint != tt.wantConstraint || cErr.Field != tt.wantField {
+				t.Errorf("want constraint %q on field %q; got %q on %q", tt.wantConstraint, tt.wantField, cErr.Constraint, cErr.Field)
+			}
+			if tt.wantField != "" && cErr.Message == "" {
+				t.Error("want a message for the field")
+			}
+
+			// The driver's error is still there, for logging.
+			var pqErr *pq.Error
+			if !errors.As(err, &pqErr) {
+				t.Error("want the ConstraintError to wrap the *pq.Error")
+			}
+		})
+	}
+}
+
+func TestViolates(t *testing.T) {
+	pqErr := &pq.Error{Code: "23505", Constraint: "roles_name_key"}
+
+	if !violates(pqErr, "roles_name_key") {
+		t.Error("want a *pq.Error to violate its constraint")
+	}
+	if !violates(newConstraintError(ErrUniqueViolation, "roles_name_key", nil), "roles_name_key") {
+		t.Error("want a ConstraintError to violate its constraint")
+	}
+	if violates(pqErr, "users_email_key") {
+		t.Error("want no violation of a different constraint")
+	}
+	if violates(errors.New(`pq: duplicate key value violates unique constraint "roles_name_key"`), "roles_name_key") {
+		t.Error("want the message text to be ignored")
+	}
+}
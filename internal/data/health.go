@@ -0,0 +1,91 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/cedrickchee/skel/internal/migrate"
+	"github.com/cedrickchee/skel/migrations"
+)
+
+// SchemaVersion is the version of the newest of the embedded migrations, which
+// is the version of the database schema that this build of the application
+// expects. It's read from the migrations themselves, so that it can't fall
+// behind them.
+var SchemaVersion = latestSchemaVersion()
+
+// latestSchemaVersion returns the version of the newest embedded migration.
+// The files are compiled in, so if they can't be loaded the build itself is
+// broken, and we panic in the same way as regexp.MustCompile().
+func latestSchemaVersion() int64 {
+	all, err := migrate.Load(migrations.FS)
+	if err != nil {
+		panic(err)
+	}
+	if len(all) == 0 {
+		return migrate.NilVersion
+	}
+
+	return all[len(all)-1].Version
+}
+
+// HealthModel struct type wraps a sql.DB connection pool, and is used by the
+// readiness checks to find out whether the database is usable.
+type HealthModel struct {
+	DB *sql.DB
+}
+
+// Ping checks that a connection to the database can be made.
+func (m HealthModel) Ping(ctx context.Context) error {
+	return m.DB.PingContext(ctx)
+}
+
+// SchemaVersion returns the version of the last migration applied to the
+// database, and whether that migration failed part way through (in which case
+// golang-migrate marks it as dirty).
+func (m HealthModel) SchemaVersion(ctx context.Context) (int64, bool, error) {
+	query := `
+		SELECT version, dirty
+		FROM schema_migrations
+		LIMIT 1`
+
+	var version int64
+	var dirty bool
+
+	err := m.DB.QueryRowContext(ctx, query).Scan(&version, &dirty)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, false, nil
+		default:
+			return 0, false, err
+		}
+	}
+
+	return version, dirty, nil
+}
+
+// Mock models
+
+// MockHealthModel reports a healthy database at the expected schema version,
+// unless its fields say otherwise.
+type MockHealthModel struct {
+	PingErr error
+	Version int64
+	Dirty   bool
+}
+
+// Ping returns the mock's PingErr.
+func (m MockHealthModel) Ping(ctx context.Context) error {
+	return m.PingErr
+}
+
+// SchemaVersion returns the mock's Version and Dirty, or an error if PingErr
+// is set.
+func (m MockHealthModel) SchemaVersion(ctx context.Context) (int64, bool, error) {
+	if m.PingErr != nil {
+		return 0, false, m.PingErr
+	}
+	return m.Version, m.Dirty, nil
+}
@@ -0,0 +1,37 @@
+package data
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestSchemaVersion checks that SchemaVersion is the version of the newest
+// file in the migrations directory, which would catch a migration that wasn't
+// embedded.
+func TestSchemaVersion(t *testing.T) {
+	files, err := ioutil.ReadDir("../../migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var latest int64
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".up.sql") {
+			continue
+		}
+
+		version, err := strconv.ParseInt(strings.SplitN(f.Name(), "_", 2)[0], 10, 64)
+		if err != nil {
+			t.Fatalf("unexpected migration file name %q", f.Name())
+		}
+		if version > latest {
+			latest = version
+		}
+	}
+
+	if latest != SchemaVersion {
+		t.Errorf("want SchemaVersion to be %d, the version of the newest migration; got %d", latest, SchemaVersion)
+	}
+}
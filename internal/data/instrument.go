@@ -0,0 +1,203 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/cedrickchee/skel/internal/jsonlog"
+	"github.com/cedrickchee/skel/internal/metrics"
+	"github.com/cedrickchee/skel/internal/tracing"
+)
+
+// unnamedQuery is the name recorded for a query without a name comment.
+const unnamedQuery = "unnamed"
+
+// queryName returns the name of a query, which the models give in a comment
+// on its first line, like "-- name: movies.get". Because the name is part of
+// the SQL, it also shows up in PostgreSQL's own logs and pg_stat_activity.
+func queryName(query string) string {
+	query = strings.TrimSpace(query)
+	if !strings.HasPrefix(query, "-- name:") {
+		return unnamedQuery
+	}
+
+	line := query[len("-- name:"):]
+	if i := strings.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+
+	name := strings.TrimSpace(line)
+	if name == "" {
+		return unnamedQuery
+	}
+	return name
+}
+
+// Instrumentation measures the queries which the models run: how long each
+// named query takes, and how often it fails, are recorded in a metrics
+// registry, and queries which take longer than SlowThreshold are logged,
+// along with the ID of the request they were for.
+type Instrumentation struct {
+	durations *metrics.HistogramVec
+	errors    *metrics.CounterVec
+
+	logger *jsonlog.Logger
+	// SlowThreshold is how long a query can take before it's logged. Zero
+	// turns the log off.
+	SlowThreshold time.Duration
+	// ExplainDB, if it isn't nil, is used to run EXPLAIN on each slow query,
+	// and the plan is added to the log entry. It's meant for development: it
+	// costs an extra round trip for every slow query, and plans can contain
+	// values from the query.
+	ExplainDB *sql.DB
+}
+
+// NewInstrumentation registers the query metrics in registry, and returns an
+// Instrumentation which records them and logs slow queries to logger.
+func NewInstrumentation(registry *metrics.Registry, logger *jsonlog.Logger, slowThreshold time.Duration) *Instrumentation {
+	return &Instrumentation{
+		durations: registry.NewHistogramVec("db_query_duration_seconds",
+			"Database query latency in seconds.", metrics.DefBuckets, "query"),
+		errors: registry.NewCounterVec("db_query_errors_total",
+			"Total number of database queries which returned an error.", "query"),
+		logger:        logger,
+		SlowThreshold: slowThreshold,
+	}
+}
+
+// Wrap returns db with every query it runs measured. It returns db itself if
+// ins is nil, or if db is already instrumented.
+func (ins *Instrumentation) Wrap(db DBTX) DBTX {
+	if ins == nil {
+		return db
+	}
+	if _, ok := db.(instrumentedDB); ok {
+		return db
+	}
+
+	return instrumentedDB{DBTX: db, ins: ins}
+}
+
+// observe records a query which took d and returned err.
+func (ins *Instrumentation) observe(ctx context.Context, query string, args []interface{}, d time.Duration, err error) {
+	name := queryName(query)
+
+	ins.durations.Observe(d.Seconds(), name)
+	if err != nil {
+		ins.errors.Inc(name)
+	}
+
+	if ins.SlowThreshold <= 0 || d < ins.SlowThreshold || ins.logger == nil {
+		return
+	}
+
+	props := map[string]string{
+		"query":    name,
+		"duration": d.String(),
+	}
+	if tc, ok := tracing.FromContext(ctx); ok {
+		for k, v := range tc.Properties() {
+			props[k] = v
+		}
+	}
+	if err != nil {
+		props["error"] = err.Error()
+	}
+	if ins.ExplainDB != nil {
+		plan, err := ins.explain(query, args)
+		if err != nil {
+			props["explain_error"] = err.Error()
+		} else {
+			props["plan"] = plan
+		}
+	}
+
+	ins.logger.PrintInfo("slow query", props)
+}
+
+// explain returns PostgreSQL's plan for query. Plain EXPLAIN doesn't run the
+// query, so it's safe for statements which change data. It runs on its own
+// connection from ExplainDB, rather than in the query's transaction, so that
+// an error can't abort the transaction; and with a context of its own, since
+// the query's may be about to expire.
+func (ins *Instrumentation) explain(query string, args []interface{}) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	rows, err := ins.ExplainDB.QueryContext(ctx, "EXPLAIN "+query, args...)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	var lines []string
+	for rows.Next() {
+		var line string
+		err := rows.Scan(&line)
+		if err != nil {
+			return "", err
+		}
+		lines = append(lines, line)
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
+
+// instrumentedDB is a DBTX which measures every query it runs.
+type instrumentedDB struct {
+	DBTX
+	ins *Instrumentation
+}
+
+func (db instrumentedDB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	start := time.Now()
+	result, err := db.DBTX.ExecContext(ctx, query, args...)
+	db.ins.observe(ctx, query, args, time.Since(start), err)
+
+	return result, err
+}
+
+// QueryContext only measures the time until the first rows are ready, not
+// the time spent reading them.
+func (db instrumentedDB) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	start := time.Now()
+	rows, err := db.DBTX.QueryContext(ctx, query, args...)
+	db.ins.observe(ctx, query, args, time.Since(start), err)
+
+	return rows, err
+}
+
+// QueryRowContext counts an error if the query fails, but not if it just
+// finds no rows, since sql.ErrNoRows only turns up in Scan().
+func (db instrumentedDB) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	start := time.Now()
+	row := db.DBTX.QueryRowContext(ctx, query, args...)
+	db.ins.observe(ctx, query, args, time.Since(start), row.Err())
+
+	return row
+}
+
+// begin starts a transaction on the wrapped DBTX with beginTx(), and returns
+// it instrumented in the same way.
+func (db instrumentedDB) begin(ctx context.Context) (txn, error) {
+	tx, err := beginTx(ctx, db.DBTX)
+	if err != nil {
+		return nil, err
+	}
+
+	return instrumentedTx{instrumentedDB: instrumentedDB{DBTX: tx, ins: db.ins}, tx: tx}, nil
+}
+
+// instrumentedTx is a transaction whose queries are measured.
+type instrumentedTx struct {
+	instrumentedDB
+	tx txn
+}
+
+func (t instrumentedTx) Commit() error   { return t.tx.Commit() }
+func (t instrumentedTx) Rollback() error { return t.tx.Rollback() }
@@ -0,0 +1,218 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cedrickchee/skel/internal/jsonlog"
+	"github.com/cedrickchee/skel/internal/metrics"
+	"github.com/cedrickchee/skel/internal/tracing"
+)
+
+// scriptedDriver is a database/sql driver whose queries do what they say:
+// one containing "slow" takes 20ms, one containing "fail" fails, and EXPLAIN
+// returns a one line plan. Anything else succeeds with no rows.
+type scriptedDriver struct{}
+
+// scriptedBegins counts the transactions begun with the scripted driver.
+var scriptedBegins int64
+
+func (scriptedDriver) Open(name string) (driver.Conn, error) {
+	return scriptedConn{}, nil
+}
+
+type scriptedConn struct{}
+
+func (scriptedConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+func (scriptedConn) Close() error { return nil }
+func (scriptedConn) Begin() (driver.Tx, error) {
+	atomic.AddInt64(&scriptedBegins, 1)
+	return scriptedConn{}, nil
+}
+func (scriptedConn) Commit() error   { return nil }
+func (scriptedConn) Rollback() error { return nil }
+
+func (scriptedConn) run(query string) error {
+	if strings.Contains(query, "slow") {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if strings.Contains(query, "fail") {
+		return errors.New("query failed")
+	}
+	return nil
+}
+
+func (c scriptedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if strings.HasPrefix(query, "EXPLAIN ") {
+		return &scriptedRows{lines: []string{"Seq Scan on movies"}}, nil
+	}
+	if err := c.run(query); err != nil {
+		return nil, err
+	}
+	return &scriptedRows{}, nil
+}
+
+func (c scriptedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if err := c.run(query); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(1), nil
+}
+
+type scriptedRows struct {
+	lines []string
+}
+
+func (r *scriptedRows) Columns() []string { return []string{"QUERY PLAN"} }
+func (r *scriptedRows) Close() error      { return nil }
+func (r *scriptedRows) Next(dest []driver.Value) error {
+	if len(r.lines) == 0 {
+		return io.EOF
+	}
+	dest[0], r.lines = r.lines[0], r.lines[1:]
+	return nil
+}
+
+func init() {
+	sql.Register("scripted", scriptedDriver{})
+}
+
+func TestQueryName(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"\n\t\t-- name: movies.get\n\t\tSELECT 1", "movies.get"},
+		{"-- name:  tokens.sweep_lock \nSELECT 1", "tokens.sweep_lock"},
+		{"SELECT 1", unnamedQuery},
+		{"-- name:\nSELECT 1", unnamedQuery},
+		{"-- just a comment\nSELECT 1", unnamedQuery},
+	}
+
+	for _, tt := range tests {
+		if got := queryName(tt.query); got != tt.want {
+			t.Errorf("queryName(%q): want %q; got %q", tt.query, tt.want, got)
+		}
+	}
+}
+
+func TestInstrumentation(t *testing.T) {
+	db, err := sql.Open("scripted", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var logs bytes.Buffer
+	registry := metrics.NewRegistry()
+
+	ins := NewInstrumentation(registry, jsonlog.New(&logs, jsonlog.LevelInfo), 10*time.Millisecond)
+	ins.ExplainDB = db
+	idb := ins.Wrap(db)
+
+	if ins.Wrap(idb) != idb {
+		t.Error("want Wrap() to leave an instrumented DBTX alone")
+	}
+
+	tc := tracing.New("0123456789abcdef0123456789abcdef", "")
+	ctx := tracing.NewContext(context.Background(), tc)
+
+	_, err = idb.ExecContext(ctx, "-- name: fast.exec\nUPDATE movies SET title = 'x'")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Finding no rows isn't an error, as far as the metrics go.
+	var n int
+	err = idb.QueryRowContext(ctx, "-- name: slow.get\nSELECT slow").Scan(&n)
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("want %v; got %v", sql.ErrNoRows, err)
+	}
+
+	_, err = idb.QueryContext(ctx, "-- name: broken\nSELECT fail")
+	if err == nil {
+		t.Fatal("want an error")
+	}
+
+	var out bytes.Buffer
+	_, err = registry.WriteTo(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		`db_query_duration_seconds_count{query="fast.exec"} 1`,
+		`db_query_duration_seconds_count{query="slow.get"} 1`,
+		`db_query_duration_seconds_count{query="broken"} 1`,
+		`db_query_errors_total{query="broken"} 1`,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("want metrics to contain %q; got:\n%s", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), `db_query_errors_total{query="slow.get"}`) {
+		t.Error("want no error counted for a query which found no rows")
+	}
+
+	// Only the slow query is logged, with its plan and the request ID.
+	entries := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	if len(entries) != 1 {
+		t.Fatalf("want 1 log entry; got %d:\n%s", len(entries), logs.String())
+	}
+	for _, want := range []string{`"slow query"`, `"query":"slow.get"`, `"request_id":"` + tc.RequestID + `"`, `"plan":"Seq Scan on movies"`} {
+		if !strings.Contains(entries[0], want) {
+			t.Errorf("want the log entry to contain %s; got %s", want, entries[0])
+		}
+	}
+}
+
+func TestInstrumentationTransaction(t *testing.T) {
+	db, err := sql.Open("scripted", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	registry := metrics.NewRegistry()
+	ins := NewInstrumentation(registry, nil, 0)
+
+	// beginTx() still starts a real transaction when the pool is wrapped,
+	// and the queries in it are measured.
+	before := atomic.LoadInt64(&scriptedBegins)
+
+	tx, err := beginTx(context.Background(), ins.Wrap(db))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tx.(nestedTx); ok || atomic.LoadInt64(&scriptedBegins) != before+1 {
+		t.Fatal("want a new transaction")
+	}
+
+	_, err = tx.ExecContext(context.Background(), "-- name: in.tx\nUPDATE movies SET title = 'x'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	_, err = registry.WriteTo(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `db_query_duration_seconds_count{query="in.tx"} 1`; !strings.Contains(out.String(), want) {
+		t.Errorf("want metrics to contain %q; got:\n%s", want, out.String())
+	}
+}
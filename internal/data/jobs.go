@@ -0,0 +1,215 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// DefaultMaxAttempts is how many times a job is tried before it's given up
+// on, unless the job says otherwise.
+const DefaultMaxAttempts = 5
+
+// Job is a unit of background work, like sending an email, which is stored in
+// the database until it has been done.
+type Job struct {
+	ID int64
+	// Kind decides which handler runs the job, and Payload is the handler's
+	// input, as JSON.
+	Kind    string
+	Payload json.RawMessage
+	// Attempts is the number of times the job has been claimed, including
+	// the current one.
+	Attempts    int
+	MaxAttempts int
+	// RunAt is the earliest time at which the job may run.
+	RunAt     time.Time
+	LastError string
+	// RequestID and Traceparent identify the request which queued the job,
+	// so that the job's log entries can be traced back to it.
+	RequestID   string
+	Traceparent string
+	CreatedAt   time.Time
+}
+
+// NewJob returns a job of the given kind, with payload encoded as JSON, which
+// is ready to be queued to run straight away.
+func NewJob(kind string, payload interface{}) (*Job, error) {
+	js, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Job{
+		Kind:        kind,
+		Payload:     js,
+		MaxAttempts: DefaultMaxAttempts,
+		RunAt:       time.Now(),
+	}, nil
+}
+
+// JobModel struct type wraps a sql.DB connection pool, or a transaction, so
+// that jobs can be queued along with the changes which caused them.
+type JobModel struct {
+	DB      DBTX
+	Timeout time.Duration
+}
+
+// Enqueue adds a job to the queue.
+func (m JobModel) Enqueue(ctx context.Context, job *Job) error {
+	query := `
+		-- name: jobs.enqueue
+		INSERT INTO jobs (kind, payload, max_attempts, run_at, request_id, traceparent)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at`
+
+	args := []interface{}{job.Kind, []byte(job.Payload), job.MaxAttempts, job.RunAt, job.RequestID, job.Traceparent}
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&job.ID, &job.CreatedAt)
+}
+
+// Claim takes the job which has been due the longest and marks it as running
+// for the length of the lease. A job whose lease has run out, because the
+// worker which claimed it died, can be claimed again. It returns
+// ErrRecordNotFound if there are no jobs due.
+//
+// FOR UPDATE SKIP LOCKED means that workers claiming jobs at the same time
+// each get a different one, instead of queueing up behind the first.
+func (m JobModel) Claim(ctx context.Context, lease time.Duration) (*Job, error) {
+	query := `
+		-- name: jobs.claim
+		UPDATE jobs
+		SET status = 'running', attempts = attempts + 1, locked_until = NOW() + $1 * interval '1 millisecond'
+		WHERE id = (
+			SELECT id FROM jobs
+			WHERE (status = 'pending' AND run_at <= NOW())
+			OR (status = 'running' AND locked_until <= NOW())
+			ORDER BY run_at
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, kind, payload, attempts, max_attempts, run_at, last_error, request_id, traceparent, created_at`
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	var job Job
+	var payload []byte
+
+	err := m.DB.QueryRowContext(ctx, query, lease.Milliseconds()).Scan(
+		&job.ID,
+		&job.Kind,
+		&payload,
+		&job.Attempts,
+		&job.MaxAttempts,
+		&job.RunAt,
+		&job.LastError,
+		&job.RequestID,
+		&job.Traceparent,
+		&job.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	job.Payload = payload
+
+	return &job, nil
+}
+
+// Complete deletes a job which has been done.
+//
+// This and the other methods which finish a claim only change the job if it
+// hasn't been claimed again since, which would mean that our lease ran out
+// and another worker has taken over. In that case they return
+// ErrEditConflict.
+func (m JobModel) Complete(ctx context.Context, job *Job) error {
+	query := `
+		-- name: jobs.complete
+		DELETE FROM jobs
+		WHERE id = $1 AND attempts = $2 AND status = 'running'`
+
+	return m.finish(ctx, query, job.ID, job.Attempts)
+}
+
+// Retry puts a failed job back in the queue to run again at runAt.
+func (m JobModel) Retry(ctx context.Context, job *Job, runAt time.Time, lastError string) error {
+	query := `
+		-- name: jobs.retry
+		UPDATE jobs
+		SET status = 'pending', run_at = $3, locked_until = NULL, last_error = $4
+		WHERE id = $1 AND attempts = $2 AND status = 'running'`
+
+	return m.finish(ctx, query, job.ID, job.Attempts, runAt, lastError)
+}
+
+// Bury marks a job as dead, so that it's never run again but stays in the
+// table for someone to look at. The payload is cleared, because it can hold
+// secrets, like the plaintext of a token in an email, which would otherwise be
+// kept forever. The kind, error and request ID are enough to look into why
+// the job failed.
+func (m JobModel) Bury(ctx context.Context, job *Job, lastError string) error {
+	query := `
+		-- name: jobs.bury
+		UPDATE jobs
+		SET status = 'dead', payload = '{}', locked_until = NULL, last_error = $3
+		WHERE id = $1 AND attempts = $2 AND status = 'running'`
+
+	return m.finish(ctx, query, job.ID, job.Attempts, lastError)
+}
+
+func (m JobModel) finish(ctx context.Context, query string, args ...interface{}) error {
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+
+	return nil
+}
+
+// Mocking models
+
+// MockJobModel accepts jobs but never has any to run.
+type MockJobModel struct{}
+
+func (m MockJobModel) Enqueue(ctx context.Context, job *Job) error {
+	job.ID = 1
+	job.CreatedAt = time.Now()
+	return nil
+}
+
+func (m MockJobModel) Claim(ctx context.Context, lease time.Duration) (*Job, error) {
+	return nil, ErrRecordNotFound
+}
+
+func (m MockJobModel) Complete(ctx context.Context, job *Job) error {
+	return nil
+}
+
+func (m MockJobModel) Retry(ctx context.Context, job *Job, runAt time.Time, lastError string) error {
+	return nil
+}
+
+func (m MockJobModel) Bury(ctx context.Context, job *Job, lastError string) error {
+	return nil
+}
@@ -0,0 +1,71 @@
+package data
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cedrickchee/skel/internal/testdb"
+)
+
+// buryJob queues a job with a secret in its payload, claims it and buries it.
+func buryJob(t *testing.T, m Models) *Job {
+	t.Helper()
+	ctx := context.Background()
+
+	job, err := NewJob("send_email", map[string]string{"activationToken": "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Jobs.Enqueue(ctx, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claimed, err := m.Jobs.Claim(ctx, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Jobs.Bury(ctx, claimed, "mail server said no")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return claimed
+}
+
+// A dead job stays in the table forever, so burying it must clear its payload,
+// which may hold a plaintext token.
+func TestJobModelBury(t *testing.T) {
+	t.Parallel()
+
+	db := testdb.New(t)
+	job := buryJob(t, Models{Jobs: JobModel{DB: db}})
+
+	var status, payload, lastError string
+	err := db.QueryRow("SELECT status, payload, last_error FROM jobs WHERE id = $1", job.ID).Scan(&status, &payload, &lastError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != "dead" || lastError != "mail server said no" {
+		t.Errorf("want a dead job with its error; got %q and %q", status, lastError)
+	}
+	if payload != "{}" {
+		t.Errorf("want the payload cleared; got %s", payload)
+	}
+}
+
+func TestMemoryJobModelBury(t *testing.T) {
+	t.Parallel()
+
+	m := NewMemoryModels()
+	job := buryJob(t, m)
+
+	stored := m.Jobs.(memoryJobModel).db.jobs[job.ID]
+	if stored.status != "dead" || stored.LastError != "mail server said no" {
+		t.Errorf("want a dead job with its error; got %q and %q", stored.status, stored.LastError)
+	}
+	if string(stored.Payload) != "{}" {
+		t.Errorf("want the payload cleared; got %s", stored.Payload)
+	}
+}
@@ -0,0 +1,1043 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// NewMemoryModels returns models which keep everything in memory, for demos
+// and tests which need more than the canned mocks. Unlike the mocks, they
+// behave like the PostgreSQL models: IDs and versions are assigned, edit
+// conflicts and duplicate emails are detected, tokens expire, permissions come
+// from roles, and movie listings are filtered, sorted and paginated. They
+// start out with the permissions and roles that the migrations create, and no
+// users or movies.
+//
+// Transaction() rolls back by putting back a copy of the tables taken when it
+// started. Nothing else can use the models until it finishes, so transactions
+// are serialized rather than run side by side. Data is lost when the process
+// exits.
+func NewMemoryModels() Models {
+	db := newMemoryDB()
+
+	return Models{
+		Movies:      memoryMovieModel{db},
+		Users:       memoryUserModel{db},
+		Tokens:      memoryTokenModel{db},
+		Permissions: memoryPermissionModel{db},
+		Roles:       memoryRoleModel{db},
+		Clients:     memoryClientModel{db},
+		Jobs:        memoryJobModel{db},
+		Health:      MockHealthModel{Version: SchemaVersion},
+		memory:      db,
+	}
+}
+
+// memoryDB holds the tables for the memory models. Every method of every
+// model holds mu for as long as it runs, so each one is atomic. tx is held
+// for the whole of a transaction, and every method which isn't part of the
+// transaction waits for it, so that nobody else sees the transaction's
+// changes before it commits, or changes the tables under it. Use lock() to
+// take them.
+type memoryDB struct {
+	mu sync.Mutex
+	tx sync.Mutex
+
+	memoryTables
+}
+
+// memoryTables are the tables themselves, which a transaction copies so that
+// it can roll back.
+type memoryTables struct {
+	// nextID holds the last ID used for each table, like a bigserial
+	// sequence.
+	nextID map[string]int64
+
+	movies map[int64]*Movie
+	users  map[int64]*User
+	// tokens is keyed by string(hash).
+	tokens map[string]*Token
+	// permissions holds the permission codes which exist.
+	permissions      map[string]bool
+	usersPermissions map[int64]map[string]bool
+	// roles is keyed by name, and usersRoles holds the names of each user's
+	// roles.
+	roles      map[string]*Role
+	usersRoles map[int64]map[string]bool
+	clients    map[int64]*ServiceClient
+	// apiKeys is keyed by prefix.
+	apiKeys map[string]*APIKey
+	jobs    map[int64]*memoryJob
+}
+
+// memoryJob is a Job along with the columns which the Job struct doesn't
+// have.
+type memoryJob struct {
+	Job
+	status      string
+	lockedUntil time.Time
+}
+
+func newMemoryDB() *memoryDB {
+	db := &memoryDB{memoryTables: memoryTables{
+		nextID:           make(map[string]int64),
+		movies:           make(map[int64]*Movie),
+		users:            make(map[int64]*User),
+		tokens:           make(map[string]*Token),
+		permissions:      make(map[string]bool),
+		usersPermissions: make(map[int64]map[string]bool),
+		roles:            make(map[string]*Role),
+		usersRoles:       make(map[int64]map[string]bool),
+		clients:          make(map[int64]*ServiceClient),
+		apiKeys:          make(map[string]*APIKey),
+		jobs:             make(map[int64]*memoryJob),
+	}}
+
+	// The permissions and roles created by the migrations.
+	for _, code := range []string{"movies:read", "movies:write", "roles:read", "roles:write", "movies:write:any", "clients:write", "metrics:read"} {
+		db.permissions[code] = true
+	}
+	for _, role := range mockRoles {
+		r := cloneRole(role)
+		r.ID = db.next("roles")
+		sort.Strings(r.Permissions)
+		db.roles[r.Name] = r
+	}
+
+	return db
+}
+
+// memoryTxKey is the context key for the memoryDB whose transaction the
+// context is part of.
+type memoryTxKey struct{}
+
+// lock locks the tables for a model method called with ctx, and returns the
+// function which unlocks them. Inside a transaction (that is, with the ctx
+// which Transaction() passed to its function) the transaction lock is already
+// held, so only mu is taken.
+func (db *memoryDB) lock(ctx context.Context) func() {
+	if ctx.Value(memoryTxKey{}) == db {
+		db.mu.Lock()
+		return db.mu.Unlock
+	}
+
+	db.tx.Lock()
+	db.mu.Lock()
+	return func() {
+		db.mu.Unlock()
+		db.tx.Unlock()
+	}
+}
+
+// transaction runs fn for Models.Transaction(). The tables are copied before
+// fn is called, and put back if it returns an error or panics. The IDs handed
+// out in the meantime aren't reused, just as a PostgreSQL sequence isn't
+// rolled back.
+func (db *memoryDB) transaction(ctx context.Context, m Models, fn func(ctx context.Context, tx Models) error) error {
+	if ctx.Value(memoryTxKey{}) == db {
+		return fn(ctx, m)
+	}
+
+	db.tx.Lock()
+	defer db.tx.Unlock()
+
+	db.mu.Lock()
+	saved := db.memoryTables.clone()
+	db.mu.Unlock()
+
+	committed := false
+	defer func() {
+		if !committed {
+			db.mu.Lock()
+			saved.nextID = db.nextID
+			db.memoryTables = saved
+			db.mu.Unlock()
+		}
+	}()
+
+	err := fn(context.WithValue(ctx, memoryTxKey{}, db), m)
+	if err != nil {
+		return err
+	}
+
+	committed = true
+	return nil
+}
+
+// clone returns a deep copy of the tables.
+func (t *memoryTables) clone() memoryTables {
+	c := memoryTables{
+		nextID:           make(map[string]int64, len(t.nextID)),
+		movies:           make(map[int64]*Movie, len(t.movies)),
+		users:            make(map[int64]*User, len(t.users)),
+		tokens:           make(map[string]*Token, len(t.tokens)),
+		permissions:      make(map[string]bool, len(t.permissions)),
+		usersPermissions: make(map[int64]map[string]bool, len(t.usersPermissions)),
+		roles:            make(map[string]*Role, len(t.roles)),
+		usersRoles:       make(map[int64]map[string]bool, len(t.usersRoles)),
+		clients:          make(map[int64]*ServiceClient, len(t.clients)),
+		apiKeys:          make(map[string]*APIKey, len(t.apiKeys)),
+		jobs:             make(map[int64]*memoryJob, len(t.jobs)),
+	}
+
+	for table, id := range t.nextID {
+		c.nextID[table] = id
+	}
+	for id, movie := range t.movies {
+		c.movies[id] = cloneMovie(movie)
+	}
+	for id, user := range t.users {
+		c.users[id] = cloneUser(user)
+	}
+	for hash, token := range t.tokens {
+		tc := *token
+		c.tokens[hash] = &tc
+	}
+	for code := range t.permissions {
+		c.permissions[code] = true
+	}
+	for userID, codes := range t.usersPermissions {
+		c.usersPermissions[userID] = cloneSet(codes)
+	}
+	for name, role := range t.roles {
+		c.roles[name] = cloneRole(role)
+	}
+	for userID, names := range t.usersRoles {
+		c.usersRoles[userID] = cloneSet(names)
+	}
+	for id, client := range t.clients {
+		c.clients[id] = cloneClient(client)
+	}
+	for prefix, key := range t.apiKeys {
+		kc := *key
+		c.apiKeys[prefix] = &kc
+	}
+	for id, job := range t.jobs {
+		jc := *job
+		jc.Payload = append([]byte(nil), job.Payload...)
+		c.jobs[id] = &jc
+	}
+
+	return c
+}
+
+func cloneSet(set map[string]bool) map[string]bool {
+	c := make(map[string]bool, len(set))
+	for k, v := range set {
+		c[k] = v
+	}
+	return c
+}
+
+// next returns the next ID for table.
+func (db *memoryDB) next(table string) int64 {
+	db.nextID[table]++
+	return db.nextID[table]
+}
+
+// nowSeconds returns the current time to the second, because that's all the
+// timestamp(0) columns keep.
+func nowSeconds() time.Time {
+	return time.Now().Truncate(time.Second)
+}
+
+func cloneMovie(movie *Movie) *Movie {
+	m := *movie
+	m.Genres = append([]string(nil), movie.Genres...)
+	return &m
+}
+
+func cloneUser(user *User) *User {
+	u := *user
+	u.Password.plaintext = nil
+	return &u
+}
+
+func cloneRole(role *Role) *Role {
+	r := *role
+	r.Permissions = append(Permissions{}, role.Permissions...)
+	return &r
+}
+
+func cloneClient(client *ServiceClient) *ServiceClient {
+	c := *client
+	c.Permissions = append(Permissions{}, client.Permissions...)
+	return &c
+}
+
+// knownPermissions reports whether every one of codes exists, and returns
+// them sorted.
+func (db *memoryDB) knownPermissions(codes []string) (Permissions, bool) {
+	sorted := Permissions{}
+	for _, code := range codes {
+		if !db.permissions[code] {
+			return nil, false
+		}
+		sorted = append(sorted, code)
+	}
+	sort.Strings(sorted)
+
+	return sorted, true
+}
+
+// memoryMovieModel is the memory version of MovieModel.
+type memoryMovieModel struct {
+	db *memoryDB
+}
+
+func (m memoryMovieModel) Insert(ctx context.Context, movie *Movie) error {
+	defer m.db.lock(ctx)()
+
+	if err := checkMovie(movie); err != nil {
+		return err
+	}
+	if movie.CreatedBy != 0 && m.db.users[movie.CreatedBy] == nil {
+		return newConstraintError(ErrForeignKeyViolation, "movies_created_by_fkey", nil)
+	}
+
+	movie.ID = m.db.next("movies")
+	movie.CreatedAt = nowSeconds()
+	movie.Version = 1
+
+	m.db.movies[movie.ID] = cloneMovie(movie)
+
+	return nil
+}
+
+// checkMovie returns a ConstraintError if movie violates one of the movies
+// table's CHECK constraints. They're checked in order of name, as PostgreSQL
+// does. Note that an empty list of genres passes genres_length_check, because
+// array_length() is NULL for an empty array; only ValidateMovie() stops it.
+func checkMovie(movie *Movie) error {
+	switch {
+	case len(movie.Genres) > 5:
+		return newConstraintError(ErrCheckViolation, "genres_length_check", nil)
+	case movie.Runtime < 0:
+		return newConstraintError(ErrCheckViolation, "movies_runtime_check", nil)
+	case movie.Year < 1888 || int(movie.Year) > time.Now().Year():
+		return newConstraintError(ErrCheckViolation, "movies_year_check", nil)
+	}
+	return nil
+}
+
+func (m memoryMovieModel) Get(ctx context.Context, id int64) (*Movie, error) {
+	defer m.db.lock(ctx)()
+
+	movie, ok := m.db.movies[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	return cloneMovie(movie), nil
+}
+
+func (m memoryMovieModel) Update(ctx context.Context, movie *Movie) error {
+	defer m.db.lock(ctx)()
+
+	if err := checkMovie(movie); err != nil {
+		return err
+	}
+
+	stored, ok := m.db.movies[movie.ID]
+	if !ok || stored.Version != movie.Version {
+		return ErrEditConflict
+	}
+
+	movie.Version++
+
+	updated := cloneMovie(movie)
+	// Update() only changes these columns, whatever else is in movie.
+	updated.CreatedAt = stored.CreatedAt
+	updated.CreatedBy = stored.CreatedBy
+	m.db.movies[movie.ID] = updated
+
+	return nil
+}
+
+func (m memoryMovieModel) Delete(ctx context.Context, id int64) error {
+	defer m.db.lock(ctx)()
+
+	if _, ok := m.db.movies[id]; !ok {
+		return ErrRecordNotFound
+	}
+
+	delete(m.db.movies, id)
+
+	return nil
+}
+
+// GetAll filters, sorts and paginates the movies in the same way as the SQL
+// query. The title is matched like PostgreSQL's 'simple' full-text search
+// configuration: every word in it must be one of the words in the movie's
+// title, ignoring case.
+func (m memoryMovieModel) GetAll(ctx context.Context, title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
+	defer m.db.lock(ctx)()
+
+	column, desc := filters.sortColumn(), filters.sortDirection() == "DESC"
+
+	var matches []*Movie
+	for _, movie := range m.db.movies {
+		if title != "" && !containsWords(movie.Title, title) {
+			continue
+		}
+		if !containsAll(movie.Genres, genres) {
+			continue
+		}
+		matches = append(matches, movie)
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		a, b := matches[i], matches[j]
+
+		var cmp int
+		switch column {
+		case "title":
+			cmp = strings.Compare(a.Title, b.Title)
+		case "year":
+			cmp = compareInt(int64(a.Year), int64(b.Year))
+		case "runtime":
+			cmp = compareInt(int64(a.Runtime), int64(b.Runtime))
+		}
+		if desc {
+			cmp = -cmp
+		}
+		// Like the SQL query, the ID is always the tie-breaker, in
+		// ascending order, unless it's the sort column itself.
+		if cmp == 0 {
+			cmp = compareInt(a.ID, b.ID)
+			if column == "id" && desc {
+				cmp = -cmp
+			}
+		}
+
+		return cmp < 0
+	})
+
+	movies := []*Movie{}
+	for i := filters.offset(); i < len(matches) && len(movies) < filters.limit(); i++ {
+		movies = append(movies, cloneMovie(matches[i]))
+	}
+
+	if len(movies) == 0 {
+		return movies, Metadata{}, nil
+	}
+
+	return movies, calculateMetadata(len(matches), filters.Page, filters.PageSize), nil
+}
+
+func compareInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// words splits s into lowercase words, like the 'simple' text search
+// configuration does.
+func words(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// containsWords reports whether every word in query is also in text.
+func containsWords(text, query string) bool {
+	want := words(query)
+	if len(want) == 0 {
+		return false
+	}
+
+	return containsAll(words(text), want)
+}
+
+// containsAll reports whether every one of want is in have, like the @>
+// operator on arrays.
+func containsAll(have, want []string) bool {
+	for _, w := range want {
+		found := false
+		for _, h := range have {
+			if h == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// memoryUserModel is the memory version of UserModel. Emails are compared
+// without regard to case, like the citext column.
+type memoryUserModel struct {
+	db *memoryDB
+}
+
+// emailTaken reports whether a user other than id has the given email.
+func (db *memoryDB) emailTaken(email string, id int64) bool {
+	for _, user := range db.users {
+		if user.ID != id && strings.EqualFold(user.Email, email) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m memoryUserModel) Insert(ctx context.Context, user *User) error {
+	defer m.db.lock(ctx)()
+
+	if m.db.emailTaken(user.Email, 0) {
+		return ErrDuplicateEmail
+	}
+
+	user.ID = m.db.next("users")
+	user.CreatedAt = nowSeconds()
+	user.Version = 1
+
+	m.db.users[user.ID] = cloneUser(user)
+
+	return nil
+}
+
+func (m memoryUserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
+	defer m.db.lock(ctx)()
+
+	for _, user := range m.db.users {
+		if strings.EqualFold(user.Email, email) {
+			return cloneUser(user), nil
+		}
+	}
+
+	return nil, ErrRecordNotFound
+}
+
+func (m memoryUserModel) Update(ctx context.Context, user *User) error {
+	defer m.db.lock(ctx)()
+
+	if m.db.emailTaken(user.Email, user.ID) {
+		return ErrDuplicateEmail
+	}
+
+	stored, ok := m.db.users[user.ID]
+	if !ok || stored.Version != user.Version {
+		return ErrEditConflict
+	}
+
+	user.Version++
+
+	updated := cloneUser(user)
+	updated.CreatedAt = stored.CreatedAt
+	m.db.users[user.ID] = updated
+
+	return nil
+}
+
+func (m memoryUserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, time.Time, error) {
+	defer m.db.lock(ctx)()
+
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	token, ok := m.db.tokens[string(tokenHash[:])]
+	if !ok || token.Scope != tokenScope || !token.Expiry.After(time.Now()) {
+		return nil, time.Time{}, ErrRecordNotFound
+	}
+
+	user, ok := m.db.users[token.UserID]
+	if !ok {
+		return nil, time.Time{}, ErrRecordNotFound
+	}
+
+	return cloneUser(user), token.Expiry, nil
+}
+
+// memoryTokenModel is the memory version of TokenModel.
+type memoryTokenModel struct {
+	db *memoryDB
+}
+
+func (m memoryTokenModel) New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error) {
+	token, err := generateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.Insert(ctx, token)
+	return token, err
+}
+
+func (m memoryTokenModel) Insert(ctx context.Context, token *Token) error {
+	defer m.db.lock(ctx)()
+
+	if _, ok := m.db.tokens[string(token.Hash)]; ok {
+		return newConstraintError(ErrUniqueViolation, "tokens_pkey", nil)
+	}
+	if _, ok := m.db.users[token.UserID]; !ok {
+		return newConstraintError(ErrForeignKeyViolation, "tokens_user_id_fkey", nil)
+	}
+
+	stored := *token
+	stored.Plaintext = ""
+	m.db.tokens[string(token.Hash)] = &stored
+
+	return nil
+}
+
+func (m memoryTokenModel) DeleteAllForUser(ctx context.Context, scope string, userID int64) error {
+	defer m.db.lock(ctx)()
+
+	for hash, token := range m.db.tokens {
+		if token.Scope == scope && token.UserID == userID {
+			delete(m.db.tokens, hash)
+		}
+	}
+
+	return nil
+}
+
+// DeleteExpired doesn't need an advisory lock, like the PostgreSQL version
+// takes, since only this process can see the tokens.
+func (m memoryTokenModel) DeleteExpired(ctx context.Context, limit int) (int64, error) {
+	defer m.db.lock(ctx)()
+
+	var deleted int64
+	for hash, token := range m.db.tokens {
+		if deleted >= int64(limit) {
+			break
+		}
+		if token.Expiry.Before(time.Now()) {
+			delete(m.db.tokens, hash)
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
+
+// memoryPermissionModel is the memory version of PermissionModel.
+type memoryPermissionModel struct {
+	db *memoryDB
+}
+
+// GetAllForUser returns the user's permissions in alphabetical order. The
+// PostgreSQL model returns them in no particular order.
+func (m memoryPermissionModel) GetAllForUser(ctx context.Context, userID int64) (Permissions, error) {
+	defer m.db.lock(ctx)()
+
+	codes := make(map[string]bool)
+	for code := range m.db.usersPermissions[userID] {
+		codes[code] = true
+	}
+
+	// Walk up from each of the user's roles to the top of the hierarchy.
+	for name := range m.db.usersRoles[userID] {
+		for role := m.db.roles[name]; role != nil; role = m.db.roles[role.Parent] {
+			for _, code := range role.Permissions {
+				codes[code] = true
+			}
+			if role.Parent == "" {
+				break
+			}
+		}
+	}
+
+	var permissions Permissions
+	for code := range codes {
+		permissions = append(permissions, code)
+	}
+	sort.Strings(permissions)
+
+	return permissions, nil
+}
+
+// AddForUser grants the permissions to the user. Codes which don't exist are
+// ignored, but granting a permission the user already has directly is an
+// error, as it is in PostgreSQL.
+func (m memoryPermissionModel) AddForUser(ctx context.Context, userID int64, codes ...string) error {
+	defer m.db.lock(ctx)()
+
+	granted := m.db.usersPermissions[userID]
+	for _, code := range codes {
+		if granted[code] {
+			return newConstraintError(ErrUniqueViolation, "users_permissions_pkey", nil)
+		}
+	}
+	if _, ok := m.db.users[userID]; !ok {
+		return newConstraintError(ErrForeignKeyViolation, "users_permissions_user_id_fkey", nil)
+	}
+
+	if granted == nil {
+		granted = make(map[string]bool)
+		m.db.usersPermissions[userID] = granted
+	}
+	for _, code := range codes {
+		if m.db.permissions[code] {
+			granted[code] = true
+		}
+	}
+
+	return nil
+}
+
+// memoryRoleModel is the memory version of RoleModel.
+type memoryRoleModel struct {
+	db *memoryDB
+}
+
+// Insert adds a role. As with the SQL query, a parent which doesn't exist is
+// ignored.
+func (m memoryRoleModel) Insert(ctx context.Context, role *Role) error {
+	defer m.db.lock(ctx)()
+
+	if _, ok := m.db.roles[role.Name]; ok {
+		return ErrDuplicateRole
+	}
+
+	permissions, ok := m.db.knownPermissions(role.Permissions)
+	if !ok {
+		return ErrUnknownPermission
+	}
+
+	role.ID = m.db.next("roles")
+
+	stored := cloneRole(role)
+	stored.Permissions = permissions
+	if _, ok := m.db.roles[role.Parent]; !ok {
+		stored.Parent = ""
+	}
+	m.db.roles[role.Name] = stored
+
+	return nil
+}
+
+func (m memoryRoleModel) GetAll(ctx context.Context) ([]*Role, error) {
+	defer m.db.lock(ctx)()
+
+	roles := []*Role{}
+	for _, role := range m.db.roles {
+		roles = append(roles, cloneRole(role))
+	}
+	sort.Slice(roles, func(i, j int) bool {
+		return roles[i].ID < roles[j].ID
+	})
+
+	return roles, nil
+}
+
+func (m memoryRoleModel) Get(ctx context.Context, name string) (*Role, error) {
+	defer m.db.lock(ctx)()
+
+	role, ok := m.db.roles[name]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	return cloneRole(role), nil
+}
+
+// Update replaces the role's parent and permissions. As with Insert, a parent
+// which doesn't exist is ignored.
+func (m memoryRoleModel) Update(ctx context.Context, role *Role) error {
+	defer m.db.lock(ctx)()
+
+	var stored *Role
+	for _, r := range m.db.roles {
+		if r.ID == role.ID {
+			stored = r
+		}
+	}
+	if stored == nil {
+		return ErrRecordNotFound
+	}
+
+	parent := role.Parent
+	if _, ok := m.db.roles[parent]; !ok {
+		parent = ""
+	}
+	for name := parent; name != ""; name = m.db.roles[name].Parent {
+		if name == stored.Name {
+			return ErrRoleCycle
+		}
+	}
+
+	permissions, ok := m.db.knownPermissions(role.Permissions)
+	if !ok {
+		return ErrUnknownPermission
+	}
+
+	stored.Parent = parent
+	stored.Permissions = permissions
+	role.Name = stored.Name
+
+	return nil
+}
+
+func (m memoryRoleModel) Delete(ctx context.Context, name string) error {
+	defer m.db.lock(ctx)()
+
+	if _, ok := m.db.roles[name]; !ok {
+		return ErrRecordNotFound
+	}
+	for _, role := range m.db.roles {
+		if role.Parent == name {
+			return ErrRoleInUse
+		}
+	}
+
+	delete(m.db.roles, name)
+	for _, names := range m.db.usersRoles {
+		delete(names, name)
+	}
+
+	return nil
+}
+
+// AddForUser assigns the roles to the user. If any of the names doesn't
+// exist, nothing is assigned.
+func (m memoryRoleModel) AddForUser(ctx context.Context, userID int64, names ...string) error {
+	defer m.db.lock(ctx)()
+
+	if _, ok := m.db.users[userID]; !ok {
+		return ErrRecordNotFound
+	}
+	for _, name := range names {
+		if _, ok := m.db.roles[name]; !ok {
+			return ErrUnknownRole
+		}
+	}
+
+	assigned := m.db.usersRoles[userID]
+	if assigned == nil {
+		assigned = make(map[string]bool)
+		m.db.usersRoles[userID] = assigned
+	}
+	for _, name := range names {
+		assigned[name] = true
+	}
+
+	return nil
+}
+
+func (m memoryRoleModel) RemoveForUser(ctx context.Context, userID int64, names ...string) error {
+	defer m.db.lock(ctx)()
+
+	for _, name := range names {
+		delete(m.db.usersRoles[userID], name)
+	}
+
+	return nil
+}
+
+// memoryClientModel is the memory version of ClientModel.
+type memoryClientModel struct {
+	db *memoryDB
+}
+
+func (m memoryClientModel) Insert(ctx context.Context, client *ServiceClient) error {
+	defer m.db.lock(ctx)()
+
+	for _, c := range m.db.clients {
+		if c.Name == client.Name {
+			return ErrDuplicateClient
+		}
+	}
+
+	permissions, ok := m.db.knownPermissions(client.Permissions)
+	if !ok {
+		return ErrUnknownPermission
+	}
+
+	client.ID = m.db.next("service_clients")
+	client.CreatedAt = nowSeconds()
+
+	stored := cloneClient(client)
+	stored.Permissions = permissions
+	m.db.clients[client.ID] = stored
+
+	return nil
+}
+
+func (m memoryClientModel) Get(ctx context.Context, id int64) (*ServiceClient, error) {
+	defer m.db.lock(ctx)()
+
+	client, ok := m.db.clients[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	return cloneClient(client), nil
+}
+
+func (m memoryClientModel) NewKey(ctx context.Context, clientID int64) (*APIKey, error) {
+	key, err := generateAPIKey(clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	defer m.db.lock(ctx)()
+
+	if _, ok := m.db.clients[clientID]; !ok {
+		return nil, ErrRecordNotFound
+	}
+	if _, ok := m.db.apiKeys[key.Prefix]; ok {
+		return nil, newConstraintError(ErrUniqueViolation, "api_keys_prefix_key", nil)
+	}
+
+	key.ID = m.db.next("api_keys")
+	key.CreatedAt = nowSeconds()
+
+	stored := *key
+	stored.Plaintext = ""
+	m.db.apiKeys[key.Prefix] = &stored
+
+	return key, nil
+}
+
+func (m memoryClientModel) DeleteKey(ctx context.Context, clientID int64, prefix string) error {
+	defer m.db.lock(ctx)()
+
+	key, ok := m.db.apiKeys[prefix]
+	if !ok || key.ClientID != clientID {
+		return ErrRecordNotFound
+	}
+
+	delete(m.db.apiKeys, prefix)
+
+	return nil
+}
+
+func (m memoryClientModel) GetForKey(ctx context.Context, keyPlaintext string) (*ServiceClient, error) {
+	if len(keyPlaintext) < len(apiKeyPrefix)+8 {
+		return nil, ErrRecordNotFound
+	}
+
+	prefix := keyPlaintext[len(apiKeyPrefix) : len(apiKeyPrefix)+8]
+	keyHash := sha256.Sum256([]byte(keyPlaintext))
+
+	defer m.db.lock(ctx)()
+
+	key, ok := m.db.apiKeys[prefix]
+	if !ok || subtle.ConstantTimeCompare(key.Hash, keyHash[:]) != 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	client, ok := m.db.clients[key.ClientID]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	return cloneClient(client), nil
+}
+
+// memoryJobModel is the memory version of JobModel.
+type memoryJobModel struct {
+	db *memoryDB
+}
+
+func (m memoryJobModel) Enqueue(ctx context.Context, job *Job) error {
+	defer m.db.lock(ctx)()
+
+	job.ID = m.db.next("jobs")
+	job.CreatedAt = time.Now()
+
+	stored := &memoryJob{Job: *job, status: "pending"}
+	stored.Payload = append([]byte(nil), job.Payload...)
+	m.db.jobs[job.ID] = stored
+
+	return nil
+}
+
+// Claim takes the job which has been due the longest, like the SQL query.
+func (m memoryJobModel) Claim(ctx context.Context, lease time.Duration) (*Job, error) {
+	defer m.db.lock(ctx)()
+
+	t := time.Now()
+
+	var next *memoryJob
+	for _, job := range m.db.jobs {
+		due := (job.status == "pending" && !job.RunAt.After(t)) ||
+			(job.status == "running" && !job.lockedUntil.After(t))
+		if !due {
+			continue
+		}
+		if next == nil || job.RunAt.Before(next.RunAt) || (job.RunAt.Equal(next.RunAt) && job.ID < next.ID) {
+			next = job
+		}
+	}
+	if next == nil {
+		return nil, ErrRecordNotFound
+	}
+
+	next.status = "running"
+	next.Attempts++
+	next.lockedUntil = t.Add(lease)
+
+	job := next.Job
+	job.Payload = append([]byte(nil), next.Payload...)
+
+	return &job, nil
+}
+
+// claimed returns the stored job, if it's still running under the claim
+// that job came from.
+func (m memoryJobModel) claimed(job *Job) (*memoryJob, error) {
+	stored, ok := m.db.jobs[job.ID]
+	if !ok || stored.Attempts != job.Attempts || stored.status != "running" {
+		return nil, ErrEditConflict
+	}
+	return stored, nil
+}
+
+func (m memoryJobModel) Complete(ctx context.Context, job *Job) error {
+	defer m.db.lock(ctx)()
+
+	if _, err := m.claimed(job); err != nil {
+		return err
+	}
+
+	delete(m.db.jobs, job.ID)
+
+	return nil
+}
+
+func (m memoryJobModel) Retry(ctx context.Context, job *Job, runAt time.Time, lastError string) error {
+	defer m.db.lock(ctx)()
+
+	stored, err := m.claimed(job)
+	if err != nil {
+		return err
+	}
+
+	stored.status = "pending"
+	stored.RunAt = runAt
+	stored.lockedUntil = time.Time{}
+	stored.LastError = lastError
+
+	return nil
+}
+
+func (m memoryJobModel) Bury(ctx context.Context, job *Job, lastError string) error {
+	defer m.db.lock(ctx)()
+
+	stored, err := m.claimed(job)
+	if err != nil {
+		return err
+	}
+
+	stored.status = "dead"
+	stored.Payload = []byte(`{}`)
+	stored.lockedUntil = time.Time{}
+	stored.LastError = lastError
+
+	return nil
+}
@@ -1,6 +1,7 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"time"
@@ -19,40 +20,238 @@ type Models struct {
 	// Set the Movies field to be an interface containing the methods that both
 	// the 'real' model and mock model need to support.
 	Movies interface {
-		Insert(movie *Movie) error
-		Get(id int64) (*Movie, error)
-		Update(movie *Movie) error
-		Delete(id int64) error
-		GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error)
+		Insert(ctx context.Context, movie *Movie) error
+		Get(ctx context.Context, id int64) (*Movie, error)
+		Update(ctx context.Context, movie *Movie) error
+		Delete(ctx context.Context, id int64) error
+		GetAll(ctx context.Context, title string, genres []string, filters Filters) ([]*Movie, Metadata, error)
 	}
 	Users interface {
-		Insert(user *User) error
-		GetByEmail(email string) (*User, error)
-		Update(user *User) error
-		GetForToken(tokenScope, tokenPlaintext string) (*User, error)
+		Insert(ctx context.Context, user *User) error
+		GetByEmail(ctx context.Context, email string) (*User, error)
+		Update(ctx context.Context, user *User) error
+		GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, time.Time, error)
 	}
 	Tokens interface {
-		New(userID int64, ttl time.Duration, scope string) (*Token, error)
-		Insert(token *Token) error
-		DeleteAllForUser(scope string, userID int64) error
+		New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error)
+		Insert(ctx context.Context, token *Token) error
+		DeleteAllForUser(ctx context.Context, scope string, userID int64) error
+		DeleteExpired(ctx context.Context, limit int) (int64, error)
 	}
 	Permissions interface {
-		GetAllForUser(userID int64) (Permissions, error)
-		AddForUser(userID int64, codes ...string) error
+		GetAllForUser(ctx context.Context, userID int64) (Permissions, error)
+		AddForUser(ctx context.Context, userID int64, codes ...string) error
 	}
+	Roles interface {
+		Insert(ctx context.Context, role *Role) error
+		GetAll(ctx context.Context) ([]*Role, error)
+		Get(ctx context.Context, name string) (*Role, error)
+		Update(ctx context.Context, role *Role) error
+		Delete(ctx context.Context, name string) error
+		AddForUser(ctx context.Context, userID int64, names ...string) error
+		RemoveForUser(ctx context.Context, userID int64, names ...string) error
+	}
+	Clients interface {
+		Insert(ctx context.Context, client *ServiceClient) error
+		Get(ctx context.Context, id int64) (*ServiceClient, error)
+		NewKey(ctx context.Context, clientID int64) (*APIKey, error)
+		DeleteKey(ctx context.Context, clientID int64, prefix string) error
+		GetForKey(ctx context.Context, keyPlaintext string) (*ServiceClient, error)
+	}
+	Jobs interface {
+		Enqueue(ctx context.Context, job *Job) error
+		Claim(ctx context.Context, lease time.Duration) (*Job, error)
+		Complete(ctx context.Context, job *Job) error
+		Retry(ctx context.Context, job *Job, runAt time.Time, lastError string) error
+		Bury(ctx context.Context, job *Job, lastError string) error
+	}
+	Health interface {
+		Ping(ctx context.Context) error
+		SchemaVersion(ctx context.Context) (version int64, dirty bool, err error)
+	}
+
+	// db is the connection pool that Transaction() starts transactions on.
+	// It's nil for the mock models, and for models which are already part
+	// of a transaction.
+	db *sql.DB
+	// memory is the store of the memory models, which has a Transaction() of
+	// its own. It's nil for every other kind of models.
+	memory *memoryDB
+	// timeout is the query timeout given to the models, and ins measures
+	// their queries. Both are passed on to the models made for a
+	// transaction.
+	timeout time.Duration
+	ins     *Instrumentation
+}
+
+// DefaultTimeout is how long a model waits for a query before giving up,
+// unless it's given a timeout of its own.
+const DefaultTimeout = 3 * time.Second
+
+// withTimeout returns a copy of ctx which is cancelled after timeout, or after
+// DefaultTimeout if timeout is zero. Every model method runs its queries with
+// one of these, so that a query is abandoned either when it takes too long or
+// when the request it's for is cancelled (because the client went away, say),
+// whichever comes first.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	return context.WithTimeout(ctx, timeout)
+}
+
+// DBTX is the set of methods which *sql.DB and *sql.Tx have in common. The
+// models hold a DBTX rather than a *sql.DB, so that the same model code can
+// run either straight on the connection pool or inside a transaction.
+type DBTX interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
 }
 
 // For ease of use, we also add a New() method which returns a Models struct
-// containing the initialized MovieModel and initialized UserModel.
-func NewModels(db *sql.DB) Models {
+// containing the initialized MovieModel and initialized UserModel. Each model
+// gives up on a query after timeout (or DefaultTimeout, if it's zero). Movie
+// reads go to replicas, if it isn't nil. Queries are measured by ins, if it
+// isn't nil.
+func NewModels(db *sql.DB, timeout time.Duration, replicas *ReplicaSet, ins *Instrumentation) Models {
+	m := newModels(db, timeout, ins)
+	m.Movies = MovieModel{DB: ins.Wrap(db), Replicas: replicas, Timeout: timeout}
+	m.Health = HealthModel{DB: db}
+	m.db = db
+
+	return m
+}
+
+// newModels returns the models which read and write through db, measured by
+// ins.
+func newModels(db DBTX, timeout time.Duration, ins *Instrumentation) Models {
+	db = ins.Wrap(db)
+
 	return Models{
-		Movies:      MovieModel{DB: db},
-		Users:       UserModel{DB: db},
-		Tokens:      TokenModel{DB: db},
-		Permissions: PermissionModel{DB: db},
+		Movies:      MovieModel{DB: db, Timeout: timeout},
+		Users:       UserModel{DB: db, Timeout: timeout},
+		Tokens:      TokenModel{DB: db, Timeout: timeout},
+		Permissions: PermissionModel{DB: db, Timeout: timeout},
+		Roles:       RoleModel{DB: db, Timeout: timeout},
+		Clients:     ClientModel{DB: db, Timeout: timeout},
+		Jobs:        JobModel{DB: db, Timeout: timeout},
+		timeout:     timeout,
+		ins:         ins,
+	}
+}
+
+// NewModelsTx returns models which all work inside tx, for code which
+// manages a transaction itself. Committing or rolling it back is up to the
+// caller.
+func NewModelsTx(tx *sql.Tx, timeout time.Duration) Models {
+	return newModels(tx, timeout, nil)
+}
+
+type txContextKey struct{}
+
+// ContextWithTx returns a copy of ctx which carries tx, so that WithTx() and
+// Transaction() can find it.
+func ContextWithTx(ctx context.Context, tx *sql.Tx) context.Context {
+	return context.WithValue(ctx, txContextKey{}, tx)
+}
+
+// WithTx returns models which work inside the transaction carried by ctx, or
+// m itself if ctx doesn't carry one. It lets code which only has the
+// application's models and a context, like a helper which queues a job, take
+// part in whatever transaction its caller is in.
+func (m Models) WithTx(ctx context.Context) Models {
+	tx, ok := ctx.Value(txContextKey{}).(*sql.Tx)
+	if !ok {
+		return m
+	}
+
+	txModels := newModels(tx, m.timeout, m.ins)
+	txModels.Health = m.Health
+
+	return txModels
+}
+
+// Transaction is our unit of work: it calls fn with a copy of the models
+// which all work inside a single database transaction, along with a context
+// which carries the transaction (see WithTx()). The transaction is committed
+// if fn returns nil, and rolled back if it returns an error (which
+// Transaction returns) or panics. This lets a handler make several changes
+// which must happen together, like creating a user, their activation token
+// and the job which emails it to them.
+//
+// If ctx already carries a transaction, or the models are already inside
+// one, Transaction just calls fn, so the changes become part of the outer
+// transaction. The same goes for the mock models, which have no database at
+// all. The memory models roll back in their own way (see NewMemoryModels()).
+func (m Models) Transaction(ctx context.Context, fn func(ctx context.Context, tx Models) error) error {
+	if _, ok := ctx.Value(txContextKey{}).(*sql.Tx); ok {
+		return fn(ctx, m.WithTx(ctx))
 	}
+	if m.memory != nil {
+		return m.memory.transaction(ctx, m, fn)
+	}
+	if m.db == nil {
+		return fn(ctx, m)
+	}
+
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// Calling Rollback() after a successful Commit() is a no-op, and it
+	// also covers fn panicking.
+	defer tx.Rollback()
+
+	ctx = ContextWithTx(ctx, tx)
+
+	err = fn(ctx, m.WithTx(ctx))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
+// txn is a transaction started by beginTx().
+type txn interface {
+	DBTX
+	Commit() error
+	Rollback() error
+}
+
+// beginTx starts a transaction for a model method which needs several
+// statements to succeed or fail together. If db is already a transaction
+// (because the model came from Models.Transaction()), the statements just
+// become part of it, and committing or rolling back is left to whoever
+// started it.
+func beginTx(ctx context.Context, db DBTX) (txn, error) {
+	if idb, ok := db.(instrumentedDB); ok {
+		return idb.begin(ctx)
+	}
+
+	pool, ok := db.(*sql.DB)
+	if !ok {
+		return nestedTx{db}, nil
+	}
+
+	tx, err := pool.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return tx, nil
+}
+
+// nestedTx is a transaction inside a transaction started elsewhere.
+type nestedTx struct {
+	DBTX
+}
+
+func (nestedTx) Commit() error   { return nil }
+func (nestedTx) Rollback() error { return nil }
+
 // Create a helper function which returns a Models instance containing the mock
 // models only.
 func NewMockModels() Models {
@@ -61,5 +260,9 @@ func NewMockModels() Models {
 		Users:       MockUserModel{},
 		Tokens:      MockTokenModel{},
 		Permissions: MockPermissionModel{},
+		Roles:       MockRoleModel{},
+		Clients:     MockClientModel{},
+		Jobs:        MockJobModel{},
+		Health:      MockHealthModel{Version: SchemaVersion},
 	}
 }
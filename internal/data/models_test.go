@@ -0,0 +1,147 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cedrickchee/skel/internal/testdb"
+)
+
+func TestTransactionMock(t *testing.T) {
+	m := NewMockModels()
+
+	// The mock models have no database, so fn gets the same models, and its
+	// error is passed straight back.
+	errBoom := errors.New("boom")
+
+	err := m.Transaction(context.Background(), func(ctx context.Context, tx Models) error {
+		if _, ok := tx.Users.(MockUserModel); !ok {
+			t.Errorf("want mock models; got %T", tx.Users)
+		}
+		return errBoom
+	})
+	if !errors.Is(err, errBoom) {
+		t.Errorf("want %v; got %v", errBoom, err)
+	}
+}
+
+func TestTransactionFromContext(t *testing.T) {
+	// A transaction which was never begun is enough to check which models
+	// are used, as long as nothing runs a query on it.
+	tx := new(sql.Tx)
+	ctx := ContextWithTx(context.Background(), tx)
+
+	m := NewMockModels()
+
+	if _, ok := m.WithTx(context.Background()).Users.(MockUserModel); !ok {
+		t.Error("want WithTx() to return the same models when ctx carries no transaction")
+	}
+
+	users, ok := m.WithTx(ctx).Users.(UserModel)
+	if !ok || users.DB != tx {
+		t.Errorf("want models inside the transaction; got %#v", m.WithTx(ctx).Users)
+	}
+
+	// Transaction() joins the transaction carried by the context rather than
+	// starting a new one.
+	called := false
+	err := m.Transaction(ctx, func(ctx context.Context, inner Models) error {
+		called = true
+		if jobs, ok := inner.Jobs.(JobModel); !ok || jobs.DB != tx {
+			t.Errorf("want models inside the outer transaction; got %#v", inner.Jobs)
+		}
+		return nil
+	})
+	if err != nil || !called {
+		t.Errorf("want fn to be called without error; got called=%v, err=%v", called, err)
+	}
+}
+
+// TestTransaction checks the unit of work against a real database: the
+// changes made inside Transaction() are all saved if fn succeeds, and none of
+// them are if it fails.
+func TestTransaction(t *testing.T) {
+	t.Parallel()
+
+	db := testdb.New(t)
+	m := NewModels(db, 0, nil, nil)
+
+	errBoom := errors.New("boom")
+
+	tests := []struct {
+		name    string
+		email   string
+		err     error
+		wantRow bool
+	}{
+		{"Commit", "commit@example.com", nil, true},
+		{"Rollback", "rollback@example.com", errBoom, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var user *User
+			var token *Token
+			var job *Job
+
+			// Register a user the way the handler does: the user, their
+			// activation token and the job which emails it to them.
+			err := m.Transaction(context.Background(), func(ctx context.Context, tx Models) error {
+				user = &User{Name: "Test", Email: tt.email, Password: password{hash: []byte("not a real hash")}}
+				err := tx.Users.Insert(ctx, user)
+				if err != nil {
+					return err
+				}
+
+				token, err = tx.Tokens.New(ctx, user.ID, time.Hour, ScopeActivation)
+				if err != nil {
+					return err
+				}
+
+				job, err = NewJob("send_email", map[string]string{"recipient": tt.email})
+				if err != nil {
+					return err
+				}
+				err = tx.Jobs.Enqueue(ctx, job)
+				if err != nil {
+					return err
+				}
+
+				return tt.err
+			})
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("want %v; got %v", tt.err, err)
+			}
+
+			counts := map[string]string{
+				"user":  "SELECT count(*) FROM users WHERE id = $1",
+				"token": "SELECT count(*) FROM tokens WHERE hash = $1",
+				"job":   "SELECT count(*) FROM jobs WHERE id = $1",
+			}
+			args := map[string]interface{}{
+				"user":  user.ID,
+				"token": token.Hash,
+				"job":   job.ID,
+			}
+
+			want := 0
+			if tt.wantRow {
+				want = 1
+			}
+
+			for _, row := range []string{"user", "token", "job"} {
+				var n int
+				err := db.QueryRow(counts[row], args[row]).Scan(&n)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if n != want {
+					t.Errorf("want %d %s rows; got %d", want, row, n)
+				}
+			}
+		})
+	}
+}
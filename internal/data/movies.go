@@ -25,6 +25,9 @@ type Movie struct {
 	Runtime Runtime  `json:"runtime,omitempty"` // Movie runtime (in minutes)
 	Genres  []string `json:"genres,omitempty"`  // Slice of genres for the movie (romance, comedy, etc.)
 	Version int32    `json:"version"`           // The version number starts at 1 and will be incremented each time the movie information is updated
+	// The ID of the user who created the movie, or 0 if it isn't known (for
+	// example because the user has since been deleted).
+	CreatedBy int64 `json:"-"`
 }
 
 func ValidateMovie(v *validator.Validator, movie *Movie) {
@@ -54,38 +57,68 @@ func ValidateMovie(v *validator.Validator, movie *Movie) {
 
 // Define a MovieModel struct type which wraps a sql.DB connection pool.
 type MovieModel struct {
-	DB *sql.DB
+	DB DBTX
+	// Replicas, if set, serves Get() and GetAll(), which take most of the
+	// traffic. Writes always go to DB.
+	Replicas *ReplicaSet
+	Timeout  time.Duration
+}
+
+// reader returns the database which Get() and GetAll() read from.
+func (m MovieModel) reader(ctx context.Context) DBTX {
+	db := m.Replicas.Reader(ctx, m.DB)
+
+	// Measure the queries on a replica in the same way as those on the
+	// primary.
+	if idb, ok := m.DB.(instrumentedDB); ok {
+		return idb.ins.Wrap(db)
+	}
+	return db
 }
 
 // The Insert() method accepts a pointer to a movie struct, which should contain
 // the data for the new record.
-func (m MovieModel) Insert(movie *Movie) error {
+func (m MovieModel) Insert(ctx context.Context, movie *Movie) error {
 	// Define the SQL query for inserting a new record in the movies table and
 	// returning the system-generated data.
 	query := `
-		INSERT INTO movies (title, year, runtime, genres)
-		VALUES ($1, $2, $3, $4)
+		-- name: movies.insert
+		INSERT INTO movies (title, year, runtime, genres, created_by)
+		VALUES ($1, $2, $3, $4, NULLIF($5, 0))
 		RETURNING id, created_at, version`
 
 	// Create an args slice containing the values for the placeholder parameters
 	// from the movie struct. Declaring this slice immediately next to our SQL
 	// query helps to make it nice and clear *what values are being used where*
 	// in the query.
-	args := []interface{}{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres)}
+	args := []interface{}{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres), movie.CreatedBy}
 
-	// Create a context with a 3-second timeout.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	// Create a context with the model's timeout.
+	ctx, cancel := withTimeout(ctx, m.Timeout)
 	defer cancel()
 
 	// Use the QueryRow() method to execute the SQL query on our connection
 	// pool, passing in the args slice as a variadic parameter and scanning the
 	// system-generated id, created_at and version values into the movie
 	// struct.
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
+	//
+	// The table's CHECK constraints, like movies_year_check, back up
+	// ValidateMovie(). If one of them is violated anyway, translateError()
+	// returns a ConstraintError which says which field was wrong.
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
+	if err != nil {
+		return translateError(err)
+	}
+
+	// Send the user's reads to the primary for a little while, so that they
+	// can see the movie straight away.
+	m.Replicas.Wrote(ctx)
+
+	return nil
 }
 
 // Get fetches a specific record from the movies table.
-func (m MovieModel) Get(id int64) (*Movie, error) {
+func (m MovieModel) Get(ctx context.Context, id int64) (*Movie, error) {
 	// The PostgreSQL bigserial type that we're using for the movie ID starts
 	// auto-incrementing at 1 by default, so we know that no movies will have ID
 	// values less than that. To avoid making an unnecessary database call, we
@@ -96,17 +129,19 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 
 	// Define the SQL query for retrieving the movie data.
 	query := `
-		SELECT id, created_at, title, year, runtime, genres, version
+		-- name: movies.get
+		SELECT id, created_at, title, year, runtime, genres, version, COALESCE(created_by, 0)
 		FROM movies
 		WHERE id = $1`
 
 	// Declare a Movie struct to hold the data returned by the query.
 	var movie Movie
 
-	// Use the context.WithTimeout() function to create a context.Context which
-	// carries a 3-second timeout deadline. Note that we're using the empty
-	// context.Background() as the 'parent' context.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	// Use the withTimeout() helper to create a context.Context which carries
+	// the model's timeout deadline (3 seconds by default). Note that we're
+	// using the request's context as the 'parent' context, so the query is
+	// also cancelled if the client goes away.
+	ctx, cancel := withTimeout(ctx, m.Timeout)
 
 	// Importantly, use defer to make sure that we cancel the context before the
 	// Get() method returns.
@@ -118,7 +153,7 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 	// Then scan the response data into the fields of the Movie struct.
 	// Importantly, notice that we need to convert the scan target for the
 	// genres column using the pq.Array() adapter function again.
-	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+	err := m.reader(ctx).QueryRowContext(ctx, query, id).Scan(
 		&movie.ID,
 		&movie.CreatedAt,
 		&movie.Title,
@@ -126,6 +161,7 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 		&movie.Runtime,
 		pq.Array(&movie.Genres),
 		&movie.Version,
+		&movie.CreatedBy,
 	)
 
 	// Handle any errors. If there was no matching movie found, Scan() will
@@ -145,10 +181,11 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 }
 
 // Update updates a specific record in the movies table.
-func (m MovieModel) Update(movie *Movie) error {
+func (m MovieModel) Update(ctx context.Context, movie *Movie) error {
 	// Declare the SQL query for updating the record and returning the new
 	// version number.
 	query := `
+        -- name: movies.update
         UPDATE movies
         SET title = $1, year = $2, runtime = $3, genres = $4, version = version + 1
         WHERE id = $5 AND version = $6
@@ -165,8 +202,8 @@ func (m MovieModel) Update(movie *Movie) error {
 		movie.Version,
 	}
 
-	// Create a context with a 3-second timeout.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	// Create a context with the model's timeout.
+	ctx, cancel := withTimeout(ctx, m.Timeout)
 	defer cancel()
 
 	// Execute the SQL query. If no matching row could be found, we know the
@@ -178,15 +215,17 @@ func (m MovieModel) Update(movie *Movie) error {
 		case errors.Is(err, sql.ErrNoRows):
 			return ErrEditConflict
 		default:
-			return err
+			return translateError(err)
 		}
 	}
 
+	m.Replicas.Wrote(ctx)
+
 	return nil
 }
 
 // Delete deletes a specific record from the movies table.
-func (m MovieModel) Delete(id int64) error {
+func (m MovieModel) Delete(ctx context.Context, id int64) error {
 	// Return an ErrRecordNotFound error if the movie ID is less than 1.
 	if id < 1 {
 		return ErrRecordNotFound
@@ -194,11 +233,12 @@ func (m MovieModel) Delete(id int64) error {
 
 	// Construct the SQL query to delete the record.
 	query := `
+		-- name: movies.delete
 		DELETE FROM movies
 		WHERE id = $1`
 
-	// Create a context with a 3-second timeout.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	// Create a context with the model's timeout.
+	ctx, cancel := withTimeout(ctx, m.Timeout)
 	defer cancel()
 
 	// Execute the SQL query using the Exec() method, passing in the id variable
@@ -223,12 +263,14 @@ func (m MovieModel) Delete(id int64) error {
 		return ErrRecordNotFound
 	}
 
+	m.Replicas.Wrote(ctx)
+
 	return nil
 }
 
 // GetAll method returns a slice of movies and pagination metadata. We've set
 // this up to accept the various filter parameters as arguments.
-func (m MovieModel) GetAll(title string, genres []string,
+func (m MovieModel) GetAll(ctx context.Context, title string, genres []string,
 	filters Filters) ([]*Movie, Metadata, error) {
 	// Construct the SQL query to retrieve all movie records.
 	// Use full-text search for the title filter.
@@ -236,15 +278,16 @@ func (m MovieModel) GetAll(title string, genres []string,
 	// Notice that we also include a secondary sort on the movie ID to ensure a
 	// consistent ordering.
 	query := fmt.Sprintf(`
-		SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version
+		-- name: movies.get_all
+		SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version, COALESCE(created_by, 0)
 		FROM movies
         WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
 		AND (genres @> $2 OR $2 = '{}')
 		ORDER BY %s %s, id ASC
 		LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
 
-	// Create a context with a 3-second timeout.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	// Create a context with the model's timeout.
+	ctx, cancel := withTimeout(ctx, m.Timeout)
 	defer cancel()
 
 	// As our SQL query now has quite a few placeholder parameters, let's
@@ -256,7 +299,7 @@ func (m MovieModel) GetAll(title string, genres []string,
 
 	// Use QueryContext() to execute the query. This returns a sql.Rows
 	// resultset containing the result.
-	rows, err := m.DB.QueryContext(ctx, query, args...)
+	rows, err := m.reader(ctx).QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, Metadata{}, err
 	}
@@ -286,6 +329,7 @@ func (m MovieModel) GetAll(title string, genres []string,
 			&movie.Runtime,
 			pq.Array(&movie.Genres),
 			&movie.Version,
+			&movie.CreatedBy,
 		)
 		if err != nil {
 			return nil, Metadata{}, err
@@ -320,13 +364,14 @@ var mockMovie = &Movie{
 	Genres:    []string{"drama", "documentary"},
 	CreatedAt: time.Now(),
 	Version:   1,
+	CreatedBy: mockUser.ID,
 }
 
 type MockMovieModel struct{}
 
 // Insert inserts a new movie record. Note that this movie must not be the same
 // as the mocMovie.
-func (m MockMovieModel) Insert(movie *Movie) error {
+func (m MockMovieModel) Insert(ctx context.Context, movie *Movie) error {
 	movie.ID = 2
 	movie.CreatedAt = time.Now()
 	movie.Version = 1
@@ -334,25 +379,27 @@ func (m MockMovieModel) Insert(movie *Movie) error {
 	return nil
 }
 
-// Get gets the mockMovie.
-func (m MockMovieModel) Get(id int64) (*Movie, error) {
+// Get gets a copy of the mockMovie, so that handlers which modify the movie
+// don't affect other tests.
+func (m MockMovieModel) Get(ctx context.Context, id int64) (*Movie, error) {
 	switch id {
 	case 1:
-		return mockMovie, nil
+		movie := *mockMovie
+		return &movie, nil
 	default:
 		return nil, ErrRecordNotFound
 	}
 }
 
 // Update updates the mockMovie.
-func (m MockMovieModel) Update(movie *Movie) error {
+func (m MockMovieModel) Update(ctx context.Context, movie *Movie) error {
 	movie.Version = movie.Version + 1
 
 	return nil
 }
 
 // Delete deletes the existing mockMovie.
-func (m MockMovieModel) Delete(id int64) error {
+func (m MockMovieModel) Delete(ctx context.Context, id int64) error {
 	if id < 1 {
 		return ErrRecordNotFound
 	}
@@ -366,7 +413,7 @@ func (m MockMovieModel) Delete(id int64) error {
 }
 
 // GetAll filters and returns a slice of movies and pagination metadata.
-func (m MockMovieModel) GetAll(title string, genres []string,
+func (m MockMovieModel) GetAll(ctx context.Context, title string, genres []string,
 	filters Filters) ([]*Movie, Metadata, error) {
 	if title != mockMovie.Title {
 		return nil, Metadata{}, sql.ErrNoRows
@@ -0,0 +1,240 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/cedrickchee/skel/internal/testdb"
+)
+
+func TestMovieModelInsert(t *testing.T) {
+	t.Parallel()
+
+	m := MovieModel{DB: testdb.New(t, "testdata/fixtures.sql")}
+	ctx := context.Background()
+
+	movie := &Movie{
+		Title:     "Casablanca",
+		Year:      1942,
+		Runtime:   102,
+		Genres:    []string{"drama", "romance"},
+		CreatedBy: 2,
+	}
+
+	err := m.Insert(ctx, movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The fixtures have three movies, so this one is the fourth.
+	if movie.ID != 4 || movie.Version != 1 || movie.CreatedAt.IsZero() {
+		t.Errorf("want ID 4, version 1 and a creation time; got %+v", movie)
+	}
+
+	got, err := m.Get(ctx, movie.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Title != movie.Title || !reflect.DeepEqual(got.Genres, movie.Genres) || got.CreatedBy != 2 {
+		t.Errorf("want %+v; got %+v", movie, got)
+	}
+
+	// The database checks the movie, as well as ValidateMovie().
+	err = m.Insert(ctx, &Movie{Title: "Too Early", Year: 1800, Runtime: 1, Genres: []string{"drama"}})
+	if err == nil {
+		t.Error("want an error for a movie older than 1888")
+	}
+}
+
+func TestMovieModelGet(t *testing.T) {
+	t.Parallel()
+
+	m := MovieModel{DB: testdb.New(t, "testdata/fixtures.sql")}
+
+	tests := []struct {
+		name      string
+		id        int64
+		wantTitle string
+		wantError error
+	}{
+		{name: "Valid ID", id: 1, wantTitle: "Moana"},
+		{name: "Zero ID", id: 0, wantError: ErrRecordNotFound},
+		{name: "Non-existent ID", id: 99, wantError: ErrRecordNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			movie, err := m.Get(context.Background(), tt.id)
+			if !errors.Is(err, tt.wantError) {
+				t.Fatalf("want %v; got %v", tt.wantError, err)
+			}
+			if err != nil {
+				return
+			}
+
+			want := &Movie{
+				ID:        1,
+				CreatedAt: movie.CreatedAt,
+				Title:     "Moana",
+				Year:      2016,
+				Runtime:   107,
+				Genres:    []string{"animation", "adventure"},
+				Version:   1,
+				CreatedBy: 1,
+			}
+			if !reflect.DeepEqual(movie, want) {
+				t.Errorf("want %+v; got %+v", want, movie)
+			}
+		})
+	}
+}
+
+func TestMovieModelUpdate(t *testing.T) {
+	t.Parallel()
+
+	m := MovieModel{DB: testdb.New(t, "testdata/fixtures.sql")}
+	ctx := context.Background()
+
+	movie, err := m.Get(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keep a copy from before the update, to try updating it again later.
+	stale := *movie
+
+	movie.Runtime = 135
+	movie.Genres = []string{"action", "adventure", "sci-fi"}
+
+	err = m.Update(ctx, movie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if movie.Version != 2 {
+		t.Errorf("want version 2; got %d", movie.Version)
+	}
+
+	got, err := m.Get(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Runtime != 135 || !reflect.DeepEqual(got.Genres, movie.Genres) || got.Version != 2 {
+		t.Errorf("want %+v; got %+v", movie, got)
+	}
+
+	// The stale copy has the old version number, so updating it would
+	// overwrite the change we just made.
+	err = m.Update(ctx, &stale)
+	if !errors.Is(err, ErrEditConflict) {
+		t.Errorf("want %v; got %v", ErrEditConflict, err)
+	}
+
+	// So does a movie which has been deleted.
+	err = m.Update(ctx, &Movie{ID: 99, Title: "Gone", Year: 2000, Runtime: 90, Genres: []string{"drama"}, Version: 1})
+	if !errors.Is(err, ErrEditConflict) {
+		t.Errorf("want %v; got %v", ErrEditConflict, err)
+	}
+}
+
+func TestMovieModelDelete(t *testing.T) {
+	t.Parallel()
+
+	m := MovieModel{DB: testdb.New(t, "testdata/fixtures.sql")}
+	ctx := context.Background()
+
+	err := m.Delete(ctx, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = m.Get(ctx, 3)
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("want %v after deleting; got %v", ErrRecordNotFound, err)
+	}
+
+	for _, id := range []int64{0, 3, 99} {
+		err = m.Delete(ctx, id)
+		if !errors.Is(err, ErrRecordNotFound) {
+			t.Errorf("Delete(%d): want %v; got %v", id, ErrRecordNotFound, err)
+		}
+	}
+}
+
+func TestMovieModelGetAll(t *testing.T) {
+	t.Parallel()
+
+	m := MovieModel{DB: testdb.New(t, "testdata/fixtures.sql")}
+
+	safelist := []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
+
+	tests := []struct {
+		name         string
+		title        string
+		genres       []string
+		filters      Filters
+		wantIDs      []int64
+		wantMetadata Metadata
+	}{
+		{
+			name:         "All",
+			filters:      Filters{Page: 1, PageSize: 20, Sort: "id", SortSafelist: safelist},
+			wantIDs:      []int64{1, 2, 3},
+			wantMetadata: Metadata{CurrentPage: 1, PageSize: 20, FirstPage: 1, LastPage: 1, TotalRecords: 3},
+		},
+		{
+			name:         "Title",
+			title:        "panther",
+			filters:      Filters{Page: 1, PageSize: 20, Sort: "id", SortSafelist: safelist},
+			wantIDs:      []int64{2},
+			wantMetadata: Metadata{CurrentPage: 1, PageSize: 20, FirstPage: 1, LastPage: 1, TotalRecords: 1},
+		},
+		{
+			name:         "Genres",
+			genres:       []string{"adventure"},
+			filters:      Filters{Page: 1, PageSize: 20, Sort: "-year", SortSafelist: safelist},
+			wantIDs:      []int64{2, 1},
+			wantMetadata: Metadata{CurrentPage: 1, PageSize: 20, FirstPage: 1, LastPage: 1, TotalRecords: 2},
+		},
+		{
+			name:         "Sort and page",
+			filters:      Filters{Page: 2, PageSize: 2, Sort: "runtime", SortSafelist: safelist},
+			wantIDs:      []int64{2},
+			wantMetadata: Metadata{CurrentPage: 2, PageSize: 2, FirstPage: 1, LastPage: 2, TotalRecords: 3},
+		},
+		{
+			name:         "No matches",
+			title:        "casablanca",
+			filters:      Filters{Page: 1, PageSize: 20, Sort: "id", SortSafelist: safelist},
+			wantIDs:      nil,
+			wantMetadata: Metadata{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			genres := tt.genres
+			if genres == nil {
+				genres = []string{}
+			}
+
+			movies, metadata, err := m.GetAll(context.Background(), tt.title, genres, tt.filters)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var ids []int64
+			for _, movie := range movies {
+				ids = append(ids, movie.ID)
+			}
+
+			if !reflect.DeepEqual(ids, tt.wantIDs) {
+				t.Errorf("want IDs %v; got %v", tt.wantIDs, ids)
+			}
+			if metadata != tt.wantMetadata {
+				t.Errorf("want metadata %+v; got %+v", tt.wantMetadata, metadata)
+			}
+		})
+	}
+}
@@ -2,7 +2,6 @@ package data
 
 import (
 	"context"
-	"database/sql"
 	"time"
 
 	"github.com/lib/pq"
@@ -25,20 +24,42 @@ func (p Permissions) Include(code string) bool {
 
 // PermissionModel struct type which wraps a sql.DB connection pool.
 type PermissionModel struct {
-	DB *sql.DB
+	DB      DBTX
+	Timeout time.Duration
 }
 
-// GetAllForUser method returns all permission codes for a specific user in a
-// Permissions slice.
-func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
+// GetAllForUser method returns the effective permission codes for a specific
+// user in a Permissions slice. This is the union of the permissions granted to
+// the user directly, and those granted by the user's roles and every role that
+// they inherit from.
+func (m PermissionModel) GetAllForUser(ctx context.Context, userID int64) (Permissions, error) {
+	// The recursive CTE walks up the role hierarchy, starting from the roles
+	// assigned to the user and following each parent_id until it reaches a
+	// role with no parent. Using UNION (rather than UNION ALL) removes any
+	// duplicate permission codes from the result.
 	query := `
+		-- name: permissions.get_all_for_user
+		WITH RECURSIVE user_roles AS (
+			SELECT roles.id, roles.parent_id
+			FROM roles
+			INNER JOIN users_roles ON users_roles.role_id = roles.id
+			WHERE users_roles.user_id = $1
+			UNION
+			SELECT roles.id, roles.parent_id
+			FROM roles
+			INNER JOIN user_roles ON user_roles.parent_id = roles.id
+		)
 		SELECT permissions.code
 		FROM permissions
 		INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
-		INNER JOIN users ON users_permissions.user_id = users.id
-		WHERE users.id = $1`
+		WHERE users_permissions.user_id = $1
+		UNION
+		SELECT permissions.code
+		FROM permissions
+		INNER JOIN roles_permissions ON roles_permissions.permission_id = permissions.id
+		INNER JOIN user_roles ON user_roles.id = roles_permissions.role_id`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := withTimeout(ctx, m.Timeout)
 	defer cancel()
 
 	rows, err := m.DB.QueryContext(ctx, query, userID)
@@ -69,16 +90,17 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 // AddForUser adds the provided permission codes for a specific user. Notice
 // that we're using a variadic parameter for the codes so that we can assign
 // multiple permissions in a single call.
-func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
+func (m PermissionModel) AddForUser(ctx context.Context, userID int64, codes ...string) error {
 	query := `
+        -- name: permissions.add_for_user
         INSERT INTO users_permissions
         SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := withTimeout(ctx, m.Timeout)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
-	return err
+	return translateError(err)
 }
 
 // Mock models
@@ -91,12 +113,14 @@ type userPermissions struct {
 var mockUserPermissions = []userPermissions{
 	{userID: mockUser.ID, permissions: []string{"movies:read", "movies:write"}},
 	{userID: 2, permissions: []string{"movies:read"}},
+	{userID: mockAdmin.ID, permissions: []string{"movies:read", "movies:write", "movies:write:any", "roles:read", "roles:write", "clients:write", "metrics:read"}},
+	{userID: mockEditor.ID, permissions: []string{"movies:read", "movies:write"}},
 }
 
 type MockPermissionModel struct{}
 
 // GetAllForUser returns all mock permission codes for a specific user.
-func (m MockPermissionModel) GetAllForUser(userID int64) (Permissions, error) {
+func (m MockPermissionModel) GetAllForUser(ctx context.Context, userID int64) (Permissions, error) {
 	var permissions Permissions
 
 	for i := range mockUserPermissions {
@@ -110,6 +134,6 @@ func (m MockPermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 }
 
 // AddForUser adds the provided permission codes for a specific user.
-func (m MockPermissionModel) AddForUser(userID int64, codes ...string) error {
+func (m MockPermissionModel) AddForUser(ctx context.Context, userID int64, codes ...string) error {
 	return nil
 }
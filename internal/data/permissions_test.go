@@ -0,0 +1,91 @@
+package data
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/cedrickchee/skel/internal/testdb"
+)
+
+func TestPermissionModelGetAllForUser(t *testing.T) {
+	t.Parallel()
+
+	m := PermissionModel{DB: testdb.New(t, "testdata/fixtures.sql")}
+
+	tests := []struct {
+		name   string
+		userID int64
+		want   Permissions
+	}{
+		// Bob is an editor, and editors inherit from viewers.
+		{name: "Inherited from roles", userID: 2, want: Permissions{"movies:read", "movies:write"}},
+		{name: "No roles", userID: 1, want: nil},
+		{name: "Non-existent user", userID: 99, want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := m.GetAllForUser(context.Background(), tt.userID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The query doesn't sort the codes.
+			sort.Strings(got)
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("want %v; got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestPermissionModelAddForUser(t *testing.T) {
+	t.Parallel()
+
+	m := PermissionModel{DB: testdb.New(t, "testdata/fixtures.sql")}
+	ctx := context.Background()
+
+	// Codes which don't exist are ignored.
+	err := m.AddForUser(ctx, 1, "movies:read", "roles:read", "no:such:permission")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := m.GetAllForUser(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+
+	want := Permissions{"movies:read", "roles:read"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want %v; got %v", want, got)
+	}
+
+	// Permissions granted directly are added to those from the user's roles,
+	// without duplicates.
+	err = m.AddForUser(ctx, 2, "movies:read", "clients:write")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err = m.GetAllForUser(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+
+	want = Permissions{"clients:write", "movies:read", "movies:write"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want %v; got %v", want, got)
+	}
+
+	// The user must exist.
+	err = m.AddForUser(ctx, 99, "movies:read")
+	if err == nil {
+		t.Error("want an error adding permissions for a user who doesn't exist")
+	}
+}
@@ -0,0 +1,247 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultStickiness is how long a principal's reads keep going to the primary
+// after they've written something, unless the ReplicaSet is told otherwise.
+// It only needs to be a little longer than the replicas usually lag behind.
+const DefaultStickiness = 5 * time.Second
+
+// replica is one read-only connection pool in a ReplicaSet.
+type replica struct {
+	// reads and ejections are counters, and come first so that they're
+	// 64-bit aligned for the atomic functions, even on 32-bit platforms.
+	reads     uint64
+	ejections uint64
+	// healthy is 1 while the replica is taking reads.
+	healthy int32
+
+	name string
+	db   *sql.DB
+}
+
+// ReplicaSet spreads reads across the read replicas of the primary database.
+// Models which can read from a replica ask it for a Reader(), which is one of
+// the healthy replicas in turn, or the primary if:
+//
+//   - none of the replicas are healthy;
+//   - the context carries a transaction, since the transaction is on the
+//     primary; or
+//   - the principal making the request wrote something within the last
+//     stickiness period (see Wrote()), so that they always see their own
+//     changes, even if the replicas haven't caught up yet.
+//
+// Replicas start out healthy. Check() pings them and ejects any which don't
+// answer until they do again.
+//
+// Note that the record of who has written recently is kept in memory, so
+// each instance of the API only knows about the writes it made itself.
+type ReplicaSet struct {
+	// next is the index of the replica to read from next.
+	next uint32
+
+	replicas   []*replica
+	stickiness time.Duration
+
+	mu     sync.Mutex
+	writes map[string]time.Time
+}
+
+// NewReplicaSet returns a ReplicaSet for the given connection pools. Reads
+// stick to the primary for stickiness after a write, or DefaultStickiness if
+// it's zero.
+func NewReplicaSet(dbs []*sql.DB, stickiness time.Duration) *ReplicaSet {
+	if stickiness <= 0 {
+		stickiness = DefaultStickiness
+	}
+
+	s := &ReplicaSet{
+		stickiness: stickiness,
+		writes:     make(map[string]time.Time),
+	}
+
+	for i, db := range dbs {
+		s.replicas = append(s.replicas, &replica{
+			name:    fmt.Sprintf("replica%d", i),
+			db:      db,
+			healthy: 1,
+		})
+	}
+
+	return s
+}
+
+// Reader returns the database to read from for ctx. It's safe to call on a
+// nil ReplicaSet, which always returns primary.
+func (s *ReplicaSet) Reader(ctx context.Context, primary DBTX) DBTX {
+	if s == nil || len(s.replicas) == 0 {
+		return primary
+	}
+	if _, ok := ctx.Value(txContextKey{}).(*sql.Tx); ok {
+		return primary
+	}
+	if s.sticky(ctx) {
+		return primary
+	}
+
+	// Start at the next replica in turn, and skip over any that have been
+	// ejected.
+	start := atomic.AddUint32(&s.next, 1)
+	for i := range s.replicas {
+		r := s.replicas[(int(start)+i)%len(s.replicas)]
+		if atomic.LoadInt32(&r.healthy) == 1 {
+			atomic.AddUint64(&r.reads, 1)
+			return r.db
+		}
+	}
+
+	return primary
+}
+
+// Wrote records that the principal carried by ctx (see ContextWithPrincipal())
+// has just written to the primary, so that their reads go to the primary for
+// a while. It's safe to call on a nil ReplicaSet, and does nothing for
+// anonymous requests.
+func (s *ReplicaSet) Wrote(ctx context.Context) {
+	if s == nil || len(s.replicas) == 0 {
+		return
+	}
+
+	id, ok := principalID(ctx)
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.writes[id] = now
+
+	// Forget about writes which no longer matter, now and again, so that the
+	// map doesn't keep growing.
+	if len(s.writes) > 1000 {
+		for id, at := range s.writes {
+			if now.Sub(at) > s.stickiness {
+				delete(s.writes, id)
+			}
+		}
+	}
+}
+
+// sticky reports whether the principal carried by ctx wrote something within
+// the last stickiness period.
+func (s *ReplicaSet) sticky(ctx context.Context) bool {
+	id, ok := principalID(ctx)
+	if !ok {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	at, ok := s.writes[id]
+	return ok && time.Since(at) < s.stickiness
+}
+
+// Check pings every replica, ejecting those which fail and bringing back
+// those which have recovered. The ping for each replica is given timeout to
+// answer.
+func (s *ReplicaSet) Check(ctx context.Context, timeout time.Duration) {
+	var wg sync.WaitGroup
+
+	for _, r := range s.replicas {
+		wg.Add(1)
+		go func(r *replica) {
+			defer wg.Done()
+
+			ctx, cancel := withTimeout(ctx, timeout)
+			defer cancel()
+
+			if r.db.PingContext(ctx) != nil {
+				if atomic.CompareAndSwapInt32(&r.healthy, 1, 0) {
+					atomic.AddUint64(&r.ejections, 1)
+				}
+				return
+			}
+			atomic.StoreInt32(&r.healthy, 1)
+		}(r)
+	}
+
+	wg.Wait()
+}
+
+// Healthy returns the number of replicas which are taking reads.
+func (s *ReplicaSet) Healthy() int {
+	n := 0
+	for _, r := range s.replicas {
+		if atomic.LoadInt32(&r.healthy) == 1 {
+			n++
+		}
+	}
+	return n
+}
+
+// Close closes the connection pools of all the replicas.
+func (s *ReplicaSet) Close() error {
+	var firstErr error
+	for _, r := range s.replicas {
+		if err := r.db.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// ReplicaStats describes one replica, for expvar.
+type ReplicaStats struct {
+	Healthy   bool
+	Reads     uint64
+	Ejections uint64
+	sql.DBStats
+}
+
+// Stats returns the statistics of each replica, keyed by name ("replica0",
+// "replica1" and so on, in the order the pools were given to
+// NewReplicaSet()).
+func (s *ReplicaSet) Stats() map[string]ReplicaStats {
+	stats := make(map[string]ReplicaStats, len(s.replicas))
+
+	for _, r := range s.replicas {
+		stats[r.name] = ReplicaStats{
+			Healthy:   atomic.LoadInt32(&r.healthy) == 1,
+			Reads:     atomic.LoadUint64(&r.reads),
+			Ejections: atomic.LoadUint64(&r.ejections),
+			DBStats:   r.db.Stats(),
+		}
+	}
+
+	return stats
+}
+
+type principalContextKey struct{}
+
+// ContextWithPrincipal returns a copy of ctx which carries the principal
+// making the request, so that a ReplicaSet can send their reads to the
+// primary just after they've written something.
+func ContextWithPrincipal(ctx context.Context, principal Principal) context.Context {
+	return context.WithValue(ctx, principalContextKey{}, principal)
+}
+
+// principalID returns the ID of the principal carried by ctx, unless there
+// isn't one or it's anonymous.
+func principalID(ctx context.Context) (string, bool) {
+	principal, ok := ctx.Value(principalContextKey{}).(Principal)
+	if !ok || principal.IsAnonymous() {
+		return "", false
+	}
+
+	return principal.PrincipalID(), true
+}
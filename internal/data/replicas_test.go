@@ -0,0 +1,167 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pingDriver is a database/sql driver which can only be pinged. Pings to a
+// database whose name is in pingDown fail.
+type pingDriver struct{}
+
+var pingDown sync.Map
+
+func (pingDriver) Open(name string) (driver.Conn, error) {
+	return pingConn{name}, nil
+}
+
+type pingConn struct {
+	name string
+}
+
+func (pingConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+func (pingConn) Close() error              { return nil }
+func (pingConn) Begin() (driver.Tx, error) { return nil, errors.New("not supported") }
+
+func (c pingConn) Ping(ctx context.Context) error {
+	if _, down := pingDown.Load(c.name); down {
+		return driver.ErrBadConn
+	}
+	return nil
+}
+
+func init() {
+	sql.Register("ping", pingDriver{})
+}
+
+func openPing(t *testing.T, name string) *sql.DB {
+	db, err := sql.Open("ping", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestReplicaSetReader(t *testing.T) {
+	primary := openPing(t, "primary")
+	r0 := openPing(t, "r0")
+	r1 := openPing(t, "r1")
+
+	s := NewReplicaSet([]*sql.DB{r0, r1}, time.Hour)
+
+	// Reads are shared between the replicas.
+	seen := map[DBTX]int{}
+	for i := 0; i < 4; i++ {
+		seen[s.Reader(context.Background(), primary)]++
+	}
+	if seen[r0] != 2 || seen[r1] != 2 {
+		t.Errorf("want reads shared between the replicas; got %v", seen)
+	}
+
+	// Reads inside a transaction go to the primary.
+	ctx := ContextWithTx(context.Background(), new(sql.Tx))
+	if s.Reader(ctx, primary) != primary {
+		t.Error("want reads inside a transaction to go to the primary")
+	}
+
+	// So do a user's reads after they write something, but not anyone
+	// else's.
+	alice := ContextWithPrincipal(context.Background(), &User{ID: 1})
+	bob := ContextWithPrincipal(context.Background(), &User{ID: 2})
+	anonymous := ContextWithPrincipal(context.Background(), AnonymousUser)
+
+	s.Wrote(alice)
+	s.Wrote(anonymous)
+
+	if s.Reader(alice, primary) != primary {
+		t.Error("want reads after a write to go to the primary")
+	}
+	if s.Reader(bob, primary) == primary {
+		t.Error("want another user's reads to go to a replica")
+	}
+	if s.Reader(anonymous, primary) == primary {
+		t.Error("want anonymous reads to go to a replica")
+	}
+
+	// A nil ReplicaSet always reads from the primary.
+	var none *ReplicaSet
+	none.Wrote(alice)
+	if none.Reader(bob, primary) != primary {
+		t.Error("want a nil ReplicaSet to read from the primary")
+	}
+}
+
+func TestReplicaSetStickiness(t *testing.T) {
+	primary := openPing(t, "primary")
+	r0 := openPing(t, "r0")
+
+	s := NewReplicaSet([]*sql.DB{r0}, 10*time.Millisecond)
+
+	ctx := ContextWithPrincipal(context.Background(), &User{ID: 1})
+	s.Wrote(ctx)
+
+	if s.Reader(ctx, primary) != primary {
+		t.Error("want reads after a write to go to the primary")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	if s.Reader(ctx, primary) != r0 {
+		t.Error("want reads to go back to the replica once the stickiness has passed")
+	}
+}
+
+func TestReplicaSetCheck(t *testing.T) {
+	primary := openPing(t, "primary")
+	r0 := openPing(t, "check0")
+	r1 := openPing(t, "check1")
+
+	s := NewReplicaSet([]*sql.DB{r0, r1}, time.Hour)
+
+	// A replica which stops answering is ejected...
+	pingDown.Store("check1", true)
+	s.Check(context.Background(), time.Second)
+
+	if n := s.Healthy(); n != 1 {
+		t.Errorf("want 1 healthy replica; got %d", n)
+	}
+	for i := 0; i < 4; i++ {
+		if db := s.Reader(context.Background(), primary); db != r0 {
+			t.Fatalf("want every read to go to the healthy replica; got %v", db)
+		}
+	}
+
+	// ...and reads go to the primary if they all are.
+	pingDown.Store("check0", true)
+	s.Check(context.Background(), time.Second)
+
+	if db := s.Reader(context.Background(), primary); db != primary {
+		t.Errorf("want reads to go to the primary with no healthy replicas; got %v", db)
+	}
+
+	// A replica which comes back takes reads again.
+	pingDown.Delete("check1")
+	s.Check(context.Background(), time.Second)
+
+	if db := s.Reader(context.Background(), primary); db != r1 {
+		t.Errorf("want reads to go to the recovered replica; got %v", db)
+	}
+
+	stats := s.Stats()
+	if !stats["replica1"].Healthy || stats["replica1"].Ejections != 1 || stats["replica1"].Reads != 1 {
+		t.Errorf("unexpected stats for replica1: %+v", stats["replica1"])
+	}
+	if stats["replica0"].Healthy || stats["replica0"].Reads != 4 {
+		t.Errorf("unexpected stats for replica0: %+v", stats["replica0"])
+	}
+
+	pingDown.Delete("check0")
+}
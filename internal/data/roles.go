@@ -0,0 +1,450 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/cedrickchee/skel/internal/validator"
+	"github.com/lib/pq"
+)
+
+var (
+	ErrDuplicateRole     = errors.New("duplicate role")
+	ErrRoleInUse         = errors.New("role in use")
+	ErrUnknownPermission = errors.New("unknown permission")
+	ErrUnknownRole       = errors.New("unknown role")
+	ErrRoleCycle         = errors.New("role cycle")
+)
+
+// RoleRX restricts role names to lowercase words, so that they are safe to use
+// in URLs and command-line flags.
+var RoleRX = regexp.MustCompile("^[a-z][a-z0-9_-]*$")
+
+// Role is a named bundle of permission codes. A role may have a parent role,
+// in which case it also inherits all the permissions of the parent (and of the
+// parent's parent, and so on).
+type Role struct {
+	ID          int64       `json:"id"`
+	Name        string      `json:"name"`
+	Parent      string      `json:"parent,omitempty"`
+	Permissions Permissions `json:"permissions"`
+}
+
+func ValidateRole(v *validator.Validator, role *Role) {
+	v.Check(role.Name != "", "name", "must be provided")
+	v.Check(len(role.Name) <= 100, "name", "must not be more than 100 bytes long")
+	v.Check(validator.Matches(role.Name, RoleRX), "name", "must only contain lowercase letters, digits, hyphens and underscores")
+
+	v.Check(role.Parent != role.Name, "parent", "must not be the role itself")
+
+	v.Check(role.Permissions != nil, "permissions", "must be provided")
+	v.Check(validator.Unique(role.Permissions), "permissions", "must not contain duplicate values")
+}
+
+// RoleModel struct type which wraps a sql.DB connection pool.
+type RoleModel struct {
+	DB      DBTX
+	Timeout time.Duration
+}
+
+// Insert adds a new role, along with the permission codes it grants. Both
+// statements are executed in a single transaction so that we never end up
+// with a role which is missing some of its permissions.
+func (m RoleModel) Insert(ctx context.Context, role *Role) error {
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	tx, err := beginTx(ctx, m.DB)
+	if err != nil {
+		return err
+	}
+	// Calling Rollback() after a successful Commit() is a no-op, so it's safe
+	// to defer it here.
+	defer tx.Rollback()
+
+	query := `
+		-- name: roles.insert
+		INSERT INTO roles (name, parent_id)
+		VALUES ($1, (SELECT id FROM roles WHERE name = $2))
+		RETURNING id`
+
+	err = tx.QueryRowContext(ctx, query, role.Name, role.Parent).Scan(&role.ID)
+	if err != nil {
+		switch {
+		case violates(err, "roles_name_key"):
+			return ErrDuplicateRole
+		default:
+			return translateError(err)
+		}
+	}
+
+	query = `
+		-- name: roles.insert_permissions
+		INSERT INTO roles_permissions
+		SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`
+
+	result, err := tx.ExecContext(ctx, query, role.ID, pq.Array(role.Permissions))
+	if err != nil {
+		return err
+	}
+
+	// If fewer rows were inserted than we have permission codes, then at least
+	// one of the codes doesn't exist in the permissions table.
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected != int64(len(role.Permissions)) {
+		return ErrUnknownPermission
+	}
+
+	return tx.Commit()
+}
+
+// GetAll returns all roles, ordered by ID, with the permission codes that each
+// one grants directly (not including those inherited from the parent).
+func (m RoleModel) GetAll(ctx context.Context) ([]*Role, error) {
+	query := `
+		-- name: roles.get_all
+		SELECT roles.id, roles.name, COALESCE(parents.name, ''),
+			COALESCE(array_agg(permissions.code ORDER BY permissions.code) FILTER (WHERE permissions.code IS NOT NULL), '{}')
+		FROM roles
+		LEFT JOIN roles AS parents ON parents.id = roles.parent_id
+		LEFT JOIN roles_permissions ON roles_permissions.role_id = roles.id
+		LEFT JOIN permissions ON permissions.id = roles_permissions.permission_id
+		GROUP BY roles.id, parents.name
+		ORDER BY roles.id`
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []*Role{}
+
+	for rows.Next() {
+		var role Role
+
+		err := rows.Scan(&role.ID, &role.Name, &role.Parent, pq.Array(&role.Permissions))
+		if err != nil {
+			return nil, err
+		}
+
+		roles = append(roles, &role)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+// Get returns a specific role by name.
+func (m RoleModel) Get(ctx context.Context, name string) (*Role, error) {
+	query := `
+		-- name: roles.get
+		SELECT roles.id, roles.name, COALESCE(parents.name, ''),
+			COALESCE(array_agg(permissions.code ORDER BY permissions.code) FILTER (WHERE permissions.code IS NOT NULL), '{}')
+		FROM roles
+		LEFT JOIN roles AS parents ON parents.id = roles.parent_id
+		LEFT JOIN roles_permissions ON roles_permissions.role_id = roles.id
+		LEFT JOIN permissions ON permissions.id = roles_permissions.permission_id
+		WHERE roles.name = $1
+		GROUP BY roles.id, parents.name`
+
+	var role Role
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, name).Scan(&role.ID, &role.Name, &role.Parent, pq.Array(&role.Permissions))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &role, nil
+}
+
+// Update replaces the parent and permission codes of an existing role, which
+// is found by its ID. The role can't be given a parent which already inherits
+// from it, since then neither would have an end to its permissions; in that
+// case we return ErrRoleCycle.
+func (m RoleModel) Update(ctx context.Context, role *Role) error {
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	tx, err := beginTx(ctx, m.DB)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// The recursive CTE walks up from the new parent, in the same way as
+	// PermissionModel.GetAllForUser(), and the update only goes ahead if
+	// the role isn't among the parent's ancestors.
+	query := `
+		-- name: roles.update
+		WITH RECURSIVE ancestors AS (
+			SELECT roles.id, roles.parent_id FROM roles WHERE roles.name = $2
+			UNION
+			SELECT roles.id, roles.parent_id
+			FROM roles
+			INNER JOIN ancestors ON ancestors.parent_id = roles.id
+		)
+		UPDATE roles
+		SET parent_id = (SELECT id FROM roles WHERE name = $2)
+		WHERE id = $1
+		AND NOT EXISTS (SELECT 1 FROM ancestors WHERE ancestors.id = $1)
+		RETURNING name`
+
+	err = tx.QueryRowContext(ctx, query, role.ID, role.Parent).Scan(&role.Name)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			// As in Delete(), find out whether the role has gone or the
+			// update was refused.
+			var exists bool
+			err := tx.QueryRowContext(ctx, "-- name: roles.exists\nSELECT EXISTS (SELECT 1 FROM roles WHERE id = $1)", role.ID).Scan(&exists)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				return ErrRecordNotFound
+			}
+			return ErrRoleCycle
+		default:
+			return translateError(err)
+		}
+	}
+
+	query = `
+		-- name: roles.delete_permissions
+		DELETE FROM roles_permissions WHERE role_id = $1`
+
+	_, err = tx.ExecContext(ctx, query, role.ID)
+	if err != nil {
+		return err
+	}
+
+	query = `
+		-- name: roles.insert_permissions
+		INSERT INTO roles_permissions
+		SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`
+
+	result, err := tx.ExecContext(ctx, query, role.ID, pq.Array(role.Permissions))
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected != int64(len(role.Permissions)) {
+		return ErrUnknownPermission
+	}
+
+	return tx.Commit()
+}
+
+// Delete removes a role. Roles which other roles inherit from can't be
+// deleted, because that would silently change the permissions granted by the
+// child roles; in that case we return ErrRoleInUse.
+func (m RoleModel) Delete(ctx context.Context, name string) error {
+	query := `
+		-- name: roles.delete
+		DELETE FROM roles
+		WHERE name = $1
+		AND NOT EXISTS (SELECT 1 FROM roles AS children WHERE children.parent_id = roles.id)
+		RETURNING id`
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	var id int64
+
+	err := m.DB.QueryRowContext(ctx, query, name).Scan(&id)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			// Nothing was deleted, so either the role doesn't exist or it has
+			// children. Check which one it was so we can return a useful
+			// error.
+			_, err := m.Get(ctx, name)
+			if err != nil {
+				return err
+			}
+			return ErrRoleInUse
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// AddForUser assigns the named roles to a specific user. Roles which the user
+// already has are ignored, but if any of the names isn't a role then nothing is
+// assigned and ErrUnknownRole is returned. Otherwise a typo, in -default-roles
+// say, would quietly leave users without the permissions they should have.
+func (m RoleModel) AddForUser(ctx context.Context, userID int64, names ...string) error {
+	// The INSERT runs whatever the outer SELECT returns, and we count the
+	// roles that were found rather than the rows inserted, which leaves out
+	// roles the user already had.
+	query := `
+		-- name: roles.add_for_user
+		WITH known AS (
+			SELECT roles.id FROM roles WHERE roles.name = ANY($2)
+		), inserted AS (
+			INSERT INTO users_roles
+			SELECT $1, known.id FROM known
+			ON CONFLICT DO NOTHING
+		)
+		SELECT count(*) FROM known`
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	tx, err := beginTx(ctx, m.DB)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var found int
+
+	err = tx.QueryRowContext(ctx, query, userID, pq.Array(names)).Scan(&found)
+	if err != nil {
+		switch {
+		case violates(err, "users_roles_user_id_fkey"):
+			return ErrRecordNotFound
+		default:
+			return translateError(err)
+		}
+	}
+	if found != countUnique(names) {
+		return ErrUnknownRole
+	}
+
+	return tx.Commit()
+}
+
+// RemoveForUser unassigns the named roles from a specific user.
+func (m RoleModel) RemoveForUser(ctx context.Context, userID int64, names ...string) error {
+	query := `
+		-- name: roles.remove_for_user
+		DELETE FROM users_roles
+		USING roles
+		WHERE users_roles.role_id = roles.id
+		AND users_roles.user_id = $1
+		AND roles.name = ANY($2)`
+
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(names))
+	return err
+}
+
+// countUnique returns the number of distinct values in values.
+func countUnique(values []string) int {
+	seen := make(map[string]bool, len(values))
+	for _, value := range values {
+		seen[value] = true
+	}
+	return len(seen)
+}
+
+// Mock models
+
+var mockRoles = []*Role{
+	{ID: 1, Name: "viewer", Permissions: Permissions{"movies:read"}},
+	{ID: 2, Name: "editor", Parent: "viewer", Permissions: Permissions{"movies:write"}},
+	{ID: 3, Name: "admin", Parent: "editor", Permissions: Permissions{"movies:write:any", "roles:read", "roles:write", "clients:write", "metrics:read"}},
+}
+
+type MockRoleModel struct{}
+
+// Insert inserts a new role. Note that the role must not have the same name as
+// one of the mockRoles.
+func (m MockRoleModel) Insert(ctx context.Context, role *Role) error {
+	for i := range mockRoles {
+		if mockRoles[i].Name == role.Name {
+			return ErrDuplicateRole
+		}
+	}
+
+	role.ID = int64(len(mockRoles) + 1)
+
+	return nil
+}
+
+// GetAll returns all the mockRoles.
+func (m MockRoleModel) GetAll(ctx context.Context) ([]*Role, error) {
+	return mockRoles, nil
+}
+
+// Get gets one of the mockRoles by name.
+func (m MockRoleModel) Get(ctx context.Context, name string) (*Role, error) {
+	for i := range mockRoles {
+		if mockRoles[i].Name == name {
+			return mockRoles[i], nil
+		}
+	}
+
+	return nil, ErrRecordNotFound
+}
+
+// Delete deletes one of the mockRoles, unless another role inherits from it.
+func (m MockRoleModel) Delete(ctx context.Context, name string) error {
+	if _, err := m.Get(ctx, name); err != nil {
+		return err
+	}
+
+	for i := range mockRoles {
+		if mockRoles[i].Parent == name {
+			return ErrRoleInUse
+		}
+	}
+
+	return nil
+}
+
+// Update updates one of the mockRoles. Nothing is actually changed.
+func (m MockRoleModel) Update(ctx context.Context, role *Role) error {
+	for i := range mockRoles {
+		if mockRoles[i].ID == role.ID {
+			return nil
+		}
+	}
+
+	return ErrRecordNotFound
+}
+
+// AddForUser assigns roles to a user, as long as they're all mockRoles.
+func (m MockRoleModel) AddForUser(ctx context.Context, userID int64, names ...string) error {
+	for _, name := range names {
+		if _, err := m.Get(ctx, name); err != nil {
+			return ErrUnknownRole
+		}
+	}
+
+	return nil
+}
+
+// RemoveForUser unassigns roles from one of the mock users.
+func (m MockRoleModel) RemoveForUser(ctx context.Context, userID int64, names ...string) error {
+	return nil
+}
@@ -0,0 +1,32 @@
+-- Fixtures for the integration tests, which are loaded once the migrations
+-- have been applied to the test's schema.
+
+-- users
+INSERT INTO users (name, email, password_hash, activated, version, created_at) VALUES (
+    'Alice Jones',
+    'alice@example.com',
+    '013d7d16d7ad4fefb61bd95b765c8ceb',
+    true,
+    1,
+    '2021-09-17 01:10:00+08'
+);
+
+INSERT INTO users (name, email, password_hash, activated) VALUES (
+    'Bob Smith',
+    'bob@example.com',
+    '5f4dcc3b5aa765d61d8327deb882cf99',
+    true
+);
+
+-- Bob is an editor, so he can read and write movies. Alice has no roles.
+INSERT INTO users_roles
+SELECT users.id, roles.id
+FROM users, roles
+WHERE users.email = 'bob@example.com' AND roles.name = 'editor';
+
+-- movies
+INSERT INTO movies (title, year, runtime, genres, created_by, created_at)
+VALUES
+    ('Moana', 2016, 107, '{animation,adventure}', 1, '2021-09-17 01:20:00+08'),
+    ('Black Panther', 2018, 134, '{action,adventure}', 1, '2021-09-17 01:30:00+08'),
+    ('The Breakfast Club', 1985, 97, '{comedy,drama}', 2, '2021-09-17 01:40:00+08');
@@ -1,15 +0,0 @@
--- movies schema
-DROP TABLE IF EXISTS movies;
-
-DROP INDEX IF EXISTS movies_title_idx;
-DROP INDEX IF EXISTS movies_genres_idx;
-
--- tokens schema
-DROP TABLE IF EXISTS tokens;
-
--- permissions schema
-DROP TABLE IF EXISTS users_permissions;
-DROP TABLE IF EXISTS permissions;
-
--- users schema
-DROP TABLE IF EXISTS users;
@@ -4,7 +4,6 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
-	"database/sql"
 	"encoding/base32"
 	"time"
 
@@ -83,61 +82,131 @@ func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
 
 // TokenModel struct wraps the connection pool.
 type TokenModel struct {
-	DB *sql.DB
+	DB      DBTX
+	Timeout time.Duration
 }
 
 // New is a shortcut method which creates a new token using the
 // `generateToken()` function and then calls `Insert()` to store the data.
-func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
+func (m TokenModel) New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error) {
 	token, err := generateToken(userID, ttl, scope)
 	if err != nil {
 		return nil, err
 	}
 
-	err = m.Insert(token)
+	err = m.Insert(ctx, token)
 	return token, err
 }
 
 // Insert adds the data for a specific token to the tokens table.
-func (m TokenModel) Insert(token *Token) error {
+func (m TokenModel) Insert(ctx context.Context, token *Token) error {
 	query := `
+		-- name: tokens.insert
 		INSERT INTO tokens (hash, user_id, expiry, scope)
 		VALUES ($1, $2, $3, $4)`
 
 	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := withTimeout(ctx, m.Timeout)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, args...)
-	return err
+	return translateError(err)
 }
 
 // DeleteAllForUser deletes all tokens with a specific scope for a specific
 // user.
-func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
+func (m TokenModel) DeleteAllForUser(ctx context.Context, scope string, userID int64) error {
 	query := `
+        -- name: tokens.delete_all_for_user
         DELETE FROM tokens
         WHERE scope = $1 AND user_id = $2`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := withTimeout(ctx, m.Timeout)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, scope, userID)
 	return err
 }
 
+// sweepLockID is the key of the advisory lock taken by DeleteExpired(). It's
+// an arbitrary number, which just needs to differ from any other advisory
+// locks taken on the same database.
+const sweepLockID int64 = 5829104637782201
+
+// DeleteExpired deletes up to limit tokens which have expired, and returns how
+// many it deleted.
+//
+// Every instance of the application runs a sweeper, so the delete takes a
+// transaction-level advisory lock first. If another instance holds it, we
+// leave the tokens to them: nothing is deleted and DeleteExpired returns 0.
+// The lock is released when the transaction ends, so sweeping in small
+// batches doesn't hold up anyone else for long.
+func (m TokenModel) DeleteExpired(ctx context.Context, limit int) (int64, error) {
+	ctx, cancel := withTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	tx, err := beginTx(ctx, m.DB)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var locked bool
+	err = tx.QueryRowContext(ctx, "-- name: tokens.sweep_lock\nSELECT pg_try_advisory_xact_lock($1)", sweepLockID).Scan(&locked)
+	if err != nil {
+		return 0, err
+	}
+	if !locked {
+		return 0, nil
+	}
+
+	query := `
+		-- name: tokens.delete_expired
+		DELETE FROM tokens
+		WHERE hash IN (
+			SELECT hash FROM tokens
+			WHERE expiry < NOW()
+			LIMIT $1
+		)`
+
+	result, err := tx.ExecContext(ctx, query, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return deleted, tx.Commit()
+}
+
 // Mocking models
 
 var ttl = 24 * time.Hour
-var plainText = "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU"
-var hash = sha256.Sum256([]byte(plainText))
-var mockToken = &Token{
-	UserID:    mockUser.ID,
-	Plaintext: plainText, // "pa55w0rd",
-	Hash:      hash[:],
-	Expiry:    time.Now().Add(ttl),
-	Scope:     ScopeAuthentication,
+
+// newMockToken returns an authentication token for one of the mock users,
+// built from a fixed plaintext so that tests can use it directly.
+func newMockToken(userID int64, plaintext string) *Token {
+	hash := sha256.Sum256([]byte(plaintext))
+
+	return &Token{
+		UserID:    userID,
+		Plaintext: plaintext,
+		Hash:      hash[:],
+		Expiry:    time.Now().Add(ttl),
+		Scope:     ScopeAuthentication,
+	}
+}
+
+var mockToken = newMockToken(mockUser.ID, "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU")
+
+var mockTokens = []*Token{
+	mockToken,
+	newMockToken(mockAdmin.ID, "GBQTA6P3BDRPZVQZAFR2NPMWLU"),
+	newMockToken(mockEditor.ID, "MFRGGZDFMZTWQ2LKNNWG23TPOA"),
 }
 
 // TODO(ced): Should write a unit test for generateToken().
@@ -145,24 +214,31 @@ var mockToken = &Token{
 
 type MockTokenModel struct{}
 
-// New is a shortcut method which creates a new token.
-func (m MockTokenModel) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
-	// token, err := generateToken(userID, ttl, scope)
-	// if err != nil {
-	// 	return nil, err
-	// }
+// New is a shortcut method which returns the mock token for a user.
+func (m MockTokenModel) New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error) {
 	token := mockToken
 
-	err := m.Insert(token)
+	for i := range mockTokens {
+		if mockTokens[i].UserID == userID {
+			token = mockTokens[i]
+		}
+	}
+
+	err := m.Insert(ctx, token)
 	return token, err
 }
 
 // Insert inserts the mock token data.
-func (m MockTokenModel) Insert(token *Token) error {
+func (m MockTokenModel) Insert(ctx context.Context, token *Token) error {
 	return nil
 }
 
 // DeleteAllForUser ...
-func (m MockTokenModel) DeleteAllForUser(scope string, userID int64) error {
+func (m MockTokenModel) DeleteAllForUser(ctx context.Context, scope string, userID int64) error {
 	return nil
 }
+
+// DeleteExpired deletes nothing, because none of the mock tokens have expired.
+func (m MockTokenModel) DeleteExpired(ctx context.Context, limit int) (int64, error) {
+	return 0, nil
+}
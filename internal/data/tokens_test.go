@@ -0,0 +1,205 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/cedrickchee/skel/internal/testdb"
+)
+
+// countTokens returns the number of tokens a user has with the given scope.
+func countTokens(t *testing.T, db *sql.DB, userID int64, scope string) int {
+	t.Helper()
+
+	var n int
+	err := db.QueryRow("SELECT count(*) FROM tokens WHERE user_id = $1 AND scope = $2", userID, scope).Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestTokenModelNew(t *testing.T) {
+	t.Parallel()
+
+	db := testdb.New(t, "testdata/fixtures.sql")
+	m := TokenModel{DB: db}
+
+	token, err := m.New(context.Background(), 1, time.Hour, ScopeActivation)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(token.Plaintext) != 26 || len(token.Hash) != 32 {
+		t.Errorf("want a 26 character plaintext and a 32 byte hash; got %q and %d bytes", token.Plaintext, len(token.Hash))
+	}
+
+	// The token is stored under its hash, which is how GetForToken() finds
+	// it, and never in plaintext.
+	var userID int64
+	var expiry time.Time
+	err = db.QueryRow("SELECT user_id, expiry FROM tokens WHERE hash = $1 AND scope = $2", token.Hash, ScopeActivation).Scan(&userID, &expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userID != 1 {
+		t.Errorf("want user 1; got %d", userID)
+	}
+	// The expiry column only stores whole seconds.
+	if d := expiry.Sub(token.Expiry); d < -time.Second || d > time.Second {
+		t.Errorf("want expiry %v; got %v", token.Expiry, expiry)
+	}
+
+	user, _, err := UserModel{DB: db}.GetForToken(context.Background(), ScopeActivation, token.Plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Email != "alice@example.com" {
+		t.Errorf("want the token to belong to alice@example.com; got %s", user.Email)
+	}
+}
+
+func TestTokenModelInsert(t *testing.T) {
+	t.Parallel()
+
+	db := testdb.New(t, "testdata/fixtures.sql")
+	m := TokenModel{DB: db}
+
+	token, err := generateToken(2, time.Hour, ScopePasswordReset)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.Insert(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := countTokens(t, db, 2, ScopePasswordReset); n != 1 {
+		t.Errorf("want 1 token; got %d", n)
+	}
+
+	// The hash is the primary key, so the same token can't be stored twice.
+	err = m.Insert(context.Background(), token)
+	if err == nil {
+		t.Error("want an error inserting the same token twice")
+	}
+
+	// And tokens must belong to a user.
+	orphan, err := generateToken(99, time.Hour, ScopePasswordReset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Insert(context.Background(), orphan)
+	if err == nil {
+		t.Error("want an error inserting a token for a user who doesn't exist")
+	}
+}
+
+func TestTokenModelDeleteAllForUser(t *testing.T) {
+	t.Parallel()
+
+	db := testdb.New(t, "testdata/fixtures.sql")
+	m := TokenModel{DB: db}
+	ctx := context.Background()
+
+	for _, tok := range []struct {
+		userID int64
+		scope  string
+	}{
+		{1, ScopeActivation},
+		{1, ScopeActivation},
+		{1, ScopeAuthentication},
+		{2, ScopeActivation},
+	} {
+		_, err := m.New(ctx, tok.userID, time.Hour, tok.scope)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := m.DeleteAllForUser(ctx, ScopeActivation, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the user's tokens with that scope are deleted.
+	want := []struct {
+		userID int64
+		scope  string
+		n      int
+	}{
+		{1, ScopeActivation, 0},
+		{1, ScopeAuthentication, 1},
+		{2, ScopeActivation, 1},
+	}
+	for _, w := range want {
+		if n := countTokens(t, db, w.userID, w.scope); n != w.n {
+			t.Errorf("want %d %s tokens for user %d; got %d", w.n, w.scope, w.userID, n)
+		}
+	}
+}
+
+func TestTokenModelDeleteExpired(t *testing.T) {
+	t.Parallel()
+
+	db := testdb.New(t, "testdata/fixtures.sql")
+	m := TokenModel{DB: db}
+	ctx := context.Background()
+
+	// Five tokens which have expired, and one which hasn't.
+	for i := 0; i < 5; i++ {
+		_, err := m.New(ctx, 1, -time.Hour, ScopeAuthentication)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := m.New(ctx, 2, time.Hour, ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Deleting happens in batches of at most limit tokens.
+	for _, want := range []int64{3, 2, 0} {
+		n, err := m.DeleteExpired(ctx, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Errorf("want %d deleted; got %d", want, n)
+		}
+	}
+
+	if n := countTokens(t, db, 1, ScopeAuthentication); n != 0 {
+		t.Errorf("want no expired tokens left; got %d", n)
+	}
+	if n := countTokens(t, db, 2, ScopeAuthentication); n != 1 {
+		t.Errorf("want the unexpired token to be kept; got %d", n)
+	}
+
+	// While another sweeper holds the lock, nothing is deleted.
+	_, err = m.New(ctx, 1, -time.Hour, ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("SELECT pg_advisory_xact_lock($1)", sweepLockID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := m.DeleteExpired(ctx, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("want nothing deleted while the lock is held; got %d", n)
+	}
+}
@@ -119,36 +119,38 @@ func ValidateUser(v *validator.Validator, user *User) {
 
 // UserModel struct wraps the connection pool.
 type UserModel struct {
-	DB *sql.DB
+	DB      DBTX
+	Timeout time.Duration
 }
 
 // Insert a new record in the database for the user. Note that the id,
 // created_at and version fields are all automatically generated by our
 // database, so we use the RETURNING clause to read them into the User struct
 // after the insert, in the same way that we did when creating a movie.
-func (m UserModel) Insert(user *User) error {
+func (m UserModel) Insert(ctx context.Context, user *User) error {
 	query := `
+		-- name: users.insert
 		INSERT INTO users (name, email, password_hash, activated)
 		VALUES ($1, $2, $3, $4)
 		RETURNING id, created_at, version`
 
 	args := []interface{}{user.Name, user.Email, user.Password.hash, user.Activated}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := withTimeout(ctx, m.Timeout)
 	defer cancel()
 
 	// If the table already contains a record with this email address, then when
 	// we try to perform the insert there will be a violation of the UNIQUE
 	// 'users_email_key' constraint that we set up in the previous chapter. We
-	// check for this error specifically, and return custom ErrDuplicateEmail
-	// error instead.
+	// check for this error specifically, by its constraint name, and return
+	// custom ErrDuplicateEmail error instead.
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
 	if err != nil {
 		switch {
-		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
+		case violates(err, "users_email_key"):
 			return ErrDuplicateEmail
 		default:
-			return err
+			return translateError(err)
 		}
 	}
 
@@ -159,15 +161,16 @@ func (m UserModel) Insert(user *User) error {
 // address. Because we have a UNIQUE constraint on the email column, this SQL
 // query will only return one record (or none at all, in which case we return a
 // ErrRecordNotFound error).
-func (m UserModel) GetByEmail(email string) (*User, error) {
+func (m UserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
 	query := `
+		-- name: users.get_by_email
 		SELECT id, created_at, name, email, password_hash, activated, version
 		FROM users
 		WHERE email = $1`
 
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := withTimeout(ctx, m.Timeout)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, email).Scan(
@@ -197,8 +200,9 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 // just like we did when updating a movie. And we also check for a violation of
 // the 'users_email_key' constraint when performing the update, just like we did
 // when inserting the user record originally.
-func (m UserModel) Update(user *User) error {
+func (m UserModel) Update(ctx context.Context, user *User) error {
 	query := `
+		-- name: users.update
 		UPDATE users
 		SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
 		WHERE id = $5 AND version = $6
@@ -213,18 +217,18 @@ func (m UserModel) Update(user *User) error {
 		user.Version,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := withTimeout(ctx, m.Timeout)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
 	if err != nil {
 		switch {
-		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
+		case violates(err, "users_email_key"):
 			return ErrDuplicateEmail
 		case errors.Is(err, sql.ErrNoRows):
 			return ErrEditConflict
 		default:
-			return err
+			return translateError(err)
 		}
 	}
 
@@ -232,15 +236,17 @@ func (m UserModel) Update(user *User) error {
 }
 
 // GetForToken method retrieves the details of the user associated with a
-// particular activation token. If there is no matching token found, or it has
-// expired, this returns a `ErrRecordNotFound` error instead.
-func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
+// particular activation token, along with the time the token expires. If there
+// is no matching token found, or it has expired, this returns a
+// `ErrRecordNotFound` error instead.
+func (m UserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, time.Time, error) {
 	// Calculate the SHA-256 hash of the plaintext token provided by the client.
 	// Remember that this returns a byte *array* with length 32, not a slice.
 	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
 
 	query := `
-		SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version
+		-- name: users.get_for_token
+		SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version, tokens.expiry
 		FROM users
 		INNER JOIN tokens
 		ON users.id = tokens.user_id
@@ -255,8 +261,9 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 	args := []interface{}{tokenHash[:], tokenScope, time.Now()}
 
 	var user User
+	var expiry time.Time
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := withTimeout(ctx, m.Timeout)
 	defer cancel()
 
 	// Execute the query, scanning the return values into a User struct. If no
@@ -269,18 +276,19 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 		&user.Password.hash,
 		&user.Activated,
 		&user.Version,
+		&expiry,
 	)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
-			return nil, ErrRecordNotFound
+			return nil, time.Time{}, ErrRecordNotFound
 		default:
-			return nil, err
+			return nil, time.Time{}, err
 		}
 	}
 
 	// Return the matching user.
-	return &user, nil
+	return &user, expiry, nil
 }
 
 // Mocking models
@@ -295,46 +303,59 @@ var mockUser = &User{
 	Version:   1,
 }
 
+var mockAdmin = &User{
+	ID:        3,
+	Name:      "Jane Admin",
+	Email:     "jane@example.com",
+	Password:  password{hash: []byte("xxxxxxxx")},
+	Activated: true,
+	CreatedAt: time.Now(),
+	Version:   1,
+}
+
+var mockEditor = &User{
+	ID:        4,
+	Name:      "Ed Editor",
+	Email:     "ed@example.com",
+	Password:  password{hash: []byte("xxxxxxxx")},
+	Activated: true,
+	CreatedAt: time.Now(),
+	Version:   1,
+}
+
+var mockUsers = []*User{mockUser, mockAdmin, mockEditor}
+
 type MockUserModel struct{}
 
 // Insert inserts a new user record. Note that this user must not be the same as
-// the mockUser.
-func (m MockUserModel) Insert(user *User) error {
-	switch user.Email {
-	case mockUser.Email:
-		return ErrDuplicateEmail
-	default:
-		user.ID = 2
-		user.CreatedAt = time.Now()
-		user.Version = 1
-
-		return nil
+// one of the mockUsers.
+func (m MockUserModel) Insert(ctx context.Context, user *User) error {
+	for i := range mockUsers {
+		if user.Email == mockUsers[i].Email {
+			return ErrDuplicateEmail
+		}
 	}
-}
 
-// GetByEmail gets the mockUser.
-func (m MockUserModel) GetByEmail(email string) (*User, error) {
-	// var user User
+	user.ID = 2
+	user.CreatedAt = time.Now()
+	user.Version = 1
+
+	return nil
+}
 
-	if email != mockUser.Email {
-		return nil, ErrRecordNotFound
+// GetByEmail gets one of the mockUsers.
+func (m MockUserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
+	for i := range mockUsers {
+		if email == mockUsers[i].Email {
+			return mockUsers[i], nil
+		}
 	}
 
-	// user = User{
-	// 	ID:        2,
-	// 	CreatedAt: time.Now(),
-	// 	Name:      "Alice",
-	// 	Email:     "alice@example.com",
-	// 	Password:  password{hash: []byte("xxxxxxxx")},
-	// 	Activated: true,
-	// 	Version:   1,
-	// }
-
-	return mockUser, nil
+	return nil, ErrRecordNotFound
 }
 
 // Update updates the mockUser.
-func (m MockUserModel) Update(user *User) error {
+func (m MockUserModel) Update(ctx context.Context, user *User) error {
 	switch user.Email {
 	case "dupe@example.com":
 		return ErrDuplicateEmail
@@ -345,22 +366,26 @@ func (m MockUserModel) Update(user *User) error {
 	}
 }
 
-// GetForToken retrieves the details of the mockUser associated with a
+// GetForToken retrieves the details of the mock user associated with a
 // particular activation token.
-func (m MockUserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
+func (m MockUserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, time.Time, error) {
 	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
 
-	if res := bytes.Compare(tokenHash[:], mockToken.Hash); res != 0 {
-		return nil, ErrRecordNotFound
-	}
+	for _, token := range mockTokens {
+		if res := bytes.Compare(tokenHash[:], token.Hash); res != 0 {
+			continue
+		}
 
-	if tokenScope != mockToken.Scope {
-		return nil, ErrRecordNotFound
-	}
+		if tokenScope != token.Scope {
+			return nil, time.Time{}, ErrRecordNotFound
+		}
 
-	if mockUser.ID != mockToken.UserID {
-		return nil, ErrRecordNotFound
+		for i := range mockUsers {
+			if mockUsers[i].ID == token.UserID {
+				return mockUsers[i], token.Expiry, nil
+			}
+		}
 	}
 
-	return mockUser, nil
+	return nil, time.Time{}, ErrRecordNotFound
 }
@@ -0,0 +1,276 @@
+// Package jobs runs background jobs from a queue kept in the database (see
+// data.JobModel). Because the queue outlives the process, jobs which haven't
+// run when the application stops, or crashes, are picked up again when it
+// starts, by this instance or any other sharing the database.
+//
+// Each kind of job has its own Handler. A job whose handler fails is retried
+// with exponential backoff until it has used up its attempts, after which it's
+// marked as dead and left in the table to be looked into.
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cedrickchee/skel/internal/data"
+	"github.com/cedrickchee/skel/internal/jsonlog"
+	"github.com/cedrickchee/skel/internal/tracing"
+)
+
+// Store is the part of data.JobModel which the workers use.
+type Store interface {
+	Claim(ctx context.Context, lease time.Duration) (*data.Job, error)
+	Complete(ctx context.Context, job *data.Job) error
+	Retry(ctx context.Context, job *data.Job, runAt time.Time, lastError string) error
+	Bury(ctx context.Context, job *data.Job, lastError string) error
+}
+
+// Handler runs a job of a particular kind. It should return an error if the
+// job needs to be tried again. The context is cancelled when the job's lease
+// runs out, or when the queue has to stop without waiting for it.
+type Handler func(ctx context.Context, job *data.Job) error
+
+// permanentError is an error which trying again won't fix.
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent wraps an error to tell the queue that the job can never succeed,
+// like when its payload is invalid, so it should be marked as dead straight
+// away rather than retried.
+func Permanent(err error) error {
+	return permanentError{err}
+}
+
+// IsPermanent reports whether err, or any error it wraps, was returned by
+// Permanent().
+func IsPermanent(err error) bool {
+	return errors.As(err, new(permanentError))
+}
+
+// Config holds the settings for a Queue. Any which are zero get a default.
+type Config struct {
+	// Workers is the number of jobs which can run at once. The default is 2.
+	Workers int
+	// PollInterval is how long an idle worker waits before checking for new
+	// jobs again. The default is one second.
+	PollInterval time.Duration
+	// Lease is how long a worker has to finish a job before another worker
+	// may claim it. The default is five minutes.
+	Lease time.Duration
+	// Backoff returns how long to wait before trying a job again, after the
+	// given number of attempts. The default is ExponentialBackoff.
+	Backoff func(attempts int) time.Duration
+}
+
+// ExponentialBackoff waits 10 seconds after the first attempt, and doubles the
+// wait after each attempt after that, up to an hour. A random jitter of up to
+// 20% is added, so that jobs which failed together (because the SMTP server
+// was down, say) don't all retry at once.
+func ExponentialBackoff(attempts int) time.Duration {
+	const (
+		base = 10 * time.Second
+		max  = time.Hour
+	)
+
+	d := max
+	if attempts < 20 {
+		d = base << uint(attempts-1)
+		if d > max {
+			d = max
+		}
+	}
+
+	return d + time.Duration(rand.Int63n(int64(d)/5+1))
+}
+
+// Queue runs jobs with a pool of workers.
+type Queue struct {
+	// running is the number of jobs being run. It's the first field so that
+	// it's 64-bit aligned for the atomic functions, even on 32-bit platforms.
+	running int64
+
+	store    Store
+	logger   *jsonlog.Logger
+	cfg      Config
+	handlers map[string]Handler
+
+	// quit is closed when Shutdown() is called. Workers keep going until the
+	// queue has been drained, and then stop.
+	quit     chan struct{}
+	quitOnce sync.Once
+	// ctx is cancelled if Shutdown() gives up waiting for the workers.
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// New returns a Queue which takes jobs from store. Register a handler for
+// each kind of job with Handle(), and then call Start().
+func New(store Store, logger *jsonlog.Logger, cfg Config) *Queue {
+	if cfg.Workers <= 0 {
+		cfg.Workers = 2
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = time.Second
+	}
+	if cfg.Lease <= 0 {
+		cfg.Lease = 5 * time.Minute
+	}
+	if cfg.Backoff == nil {
+		cfg.Backoff = ExponentialBackoff
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Queue{
+		store:    store,
+		logger:   logger,
+		cfg:      cfg,
+		handlers: make(map[string]Handler),
+		quit:     make(chan struct{}),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// Handle registers the handler for a kind of job. It must be called before
+// Start().
+func (q *Queue) Handle(kind string, h Handler) {
+	q.handlers[kind] = h
+}
+
+// Start starts the workers.
+func (q *Queue) Start() {
+	for i := 0; i < q.cfg.Workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+}
+
+// Running returns the number of jobs being run right now.
+func (q *Queue) Running() int64 {
+	return atomic.LoadInt64(&q.running)
+}
+
+// Shutdown drains the queue: the workers carry on running jobs until there
+// are none due, and then stop. If ctx is done first, the jobs which are still
+// running have their contexts cancelled, and Shutdown returns ctx.Err() once
+// they have returned. Jobs which haven't run stay in the queue for next time.
+func (q *Queue) Shutdown(ctx context.Context) error {
+	q.quitOnce.Do(func() { close(q.quit) })
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		q.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// work is the loop run by each worker.
+func (q *Queue) work() {
+	defer q.wg.Done()
+
+	for {
+		if q.ctx.Err() != nil {
+			return
+		}
+
+		if q.runNext() {
+			continue
+		}
+
+		// There was nothing to do, so if we're shutting down, we're done.
+		// Otherwise wait a while before looking again.
+		select {
+		case <-q.quit:
+			return
+		case <-time.After(q.cfg.PollInterval):
+		}
+	}
+}
+
+// runNext claims and runs one job. It reports whether there was one.
+func (q *Queue) runNext() bool {
+	job, err := q.store.Claim(q.ctx, q.cfg.Lease)
+	if err != nil {
+		if !errors.Is(err, data.ErrRecordNotFound) {
+			q.logger.PrintError(fmt.Errorf("claiming job: %w", err), nil)
+		}
+		return false
+	}
+
+	atomic.AddInt64(&q.running, 1)
+	defer atomic.AddInt64(&q.running, -1)
+
+	// Carry on the trace of the request which queued the job, so that its
+	// log entries can be tied back to it.
+	tc := tracing.New(job.RequestID, job.Traceparent)
+	props := tc.Properties()
+	props["job_id"] = fmt.Sprint(job.ID)
+	props["job_kind"] = job.Kind
+	props["attempt"] = fmt.Sprint(job.Attempts)
+	logger := q.logger.With(props)
+
+	ctx, cancel := context.WithTimeout(tracing.NewContext(q.ctx, tc), q.cfg.Lease)
+	defer cancel()
+
+	err = q.run(ctx, job)
+
+	// Record the outcome even if the job was interrupted by Shutdown(), so
+	// that it's retried rather than left running until its lease runs out.
+	finishCtx := tracing.NewContext(context.Background(), tc)
+
+	switch {
+	case err == nil:
+		err = q.store.Complete(finishCtx, job)
+	case IsPermanent(err) || job.Attempts >= job.MaxAttempts:
+		logger.PrintError(fmt.Errorf("job failed for good: %w", err), nil)
+		err = q.store.Bury(finishCtx, job, err.Error())
+	default:
+		logger.PrintError(fmt.Errorf("job failed, will retry: %w", err), nil)
+		err = q.store.Retry(finishCtx, job, time.Now().Add(q.cfg.Backoff(job.Attempts)), err.Error())
+	}
+
+	// If the lease ran out and another worker has claimed the job, it's
+	// theirs now, and there's nothing more for us to do.
+	if err != nil && !errors.Is(err, data.ErrEditConflict) {
+		logger.PrintError(fmt.Errorf("finishing job: %w", err), nil)
+	}
+
+	return true
+}
+
+// run calls the job's handler, turning a panic into an error so that one bad
+// job can't take down the application.
+func (q *Queue) run(ctx context.Context, job *data.Job) (err error) {
+	h, ok := q.handlers[job.Kind]
+	if !ok {
+		return Permanent(fmt.Errorf("no handler for jobs of kind %q", job.Kind))
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	return h(ctx, job)
+}
@@ -0,0 +1,211 @@
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cedrickchee/skel/internal/data"
+	"github.com/cedrickchee/skel/internal/jsonlog"
+)
+
+// memoryStore is a Store which keeps its jobs in a slice.
+type memoryStore struct {
+	mu   sync.Mutex
+	jobs []*data.Job
+	// done and dead hold the IDs of the jobs which were completed and
+	// buried.
+	done []int64
+	dead []int64
+}
+
+func (s *memoryStore) add(job *data.Job) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job.ID = int64(len(s.jobs) + len(s.done) + len(s.dead) + 1)
+	if job.MaxAttempts == 0 {
+		job.MaxAttempts = data.DefaultMaxAttempts
+	}
+	s.jobs = append(s.jobs, job)
+}
+
+func (s *memoryStore) Claim(ctx context.Context, lease time.Duration) (*data.Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, job := range s.jobs {
+		if !job.RunAt.After(time.Now()) {
+			s.jobs = append(s.jobs[:i], s.jobs[i+1:]...)
+			job.Attempts++
+			return job, nil
+		}
+	}
+
+	return nil, data.ErrRecordNotFound
+}
+
+func (s *memoryStore) Complete(ctx context.Context, job *data.Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.done = append(s.done, job.ID)
+	return nil
+}
+
+func (s *memoryStore) Retry(ctx context.Context, job *data.Job, runAt time.Time, lastError string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job.RunAt = runAt
+	job.LastError = lastError
+	s.jobs = append(s.jobs, job)
+	return nil
+}
+
+func (s *memoryStore) Bury(ctx context.Context, job *data.Job, lastError string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job.LastError = lastError
+	s.dead = append(s.dead, job.ID)
+	return nil
+}
+
+func TestQueue(t *testing.T) {
+	var logs bytes.Buffer
+
+	store := &memoryStore{}
+	q := New(store, jsonlog.New(&logs, jsonlog.LevelInfo), Config{
+		PollInterval: time.Millisecond,
+		// Retry straight away, so that the test doesn't have to wait.
+		Backoff: func(int) time.Duration { return 0 },
+	})
+
+	var mu sync.Mutex
+	calls := map[string]int{}
+
+	q.Handle("ok", func(ctx context.Context, job *data.Job) error {
+		mu.Lock()
+		defer mu.Unlock()
+		calls["ok"]++
+		return nil
+	})
+	q.Handle("flaky", func(ctx context.Context, job *data.Job) error {
+		mu.Lock()
+		defer mu.Unlock()
+		calls["flaky"]++
+		if job.Attempts < 3 {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+	q.Handle("broken", func(ctx context.Context, job *data.Job) error {
+		mu.Lock()
+		defer mu.Unlock()
+		calls["broken"]++
+		return errors.New("connection refused")
+	})
+	q.Handle("invalid", func(ctx context.Context, job *data.Job) error {
+		mu.Lock()
+		defer mu.Unlock()
+		calls["invalid"]++
+		return Permanent(errors.New("bad payload"))
+	})
+	q.Handle("panics", func(ctx context.Context, job *data.Job) error {
+		panic("oops")
+	})
+
+	for _, kind := range []string{"ok", "flaky", "broken", "invalid", "unknown"} {
+		store.add(&data.Job{Kind: kind, RequestID: "abc-123"})
+	}
+	store.add(&data.Job{Kind: "panics", MaxAttempts: 1})
+
+	q.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Shutdown() drains the queue, so every job has either finished or died
+	// by the time it returns.
+	err := q.Shutdown(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]int{"ok": 1, "flaky": 3, "broken": data.DefaultMaxAttempts, "invalid": 1}
+	for kind, n := range want {
+		if calls[kind] != n {
+			t.Errorf("want %d calls for %q; got %d", n, kind, calls[kind])
+		}
+	}
+
+	if len(store.done) != 2 {
+		t.Errorf("want 2 jobs done; got %v", store.done)
+	}
+	if len(store.dead) != 4 {
+		t.Errorf("want 4 dead jobs; got %v", store.dead)
+	}
+	if len(store.jobs) != 0 {
+		t.Errorf("want empty queue; got %d jobs", len(store.jobs))
+	}
+
+	for _, want := range []string{`"request_id":"abc-123"`, `"job_kind":"broken"`, `no handler for jobs of kind \"unknown\"`, "panic: oops"} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("want %s in logs:\n%s", want, logs.String())
+		}
+	}
+}
+
+func TestQueueShutdownTimeout(t *testing.T) {
+	store := &memoryStore{}
+	q := New(store, jsonlog.New(&bytes.Buffer{}, jsonlog.LevelInfo), Config{PollInterval: time.Millisecond})
+
+	started := make(chan struct{})
+	q.Handle("slow", func(ctx context.Context, job *data.Job) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	store.add(&data.Job{Kind: "slow"})
+	q.Start()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := q.Shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want %v; got %v", context.DeadlineExceeded, err)
+	}
+
+	// The job was interrupted, so it goes back in the queue.
+	if len(store.jobs) != 1 || store.jobs[0].Attempts != 1 {
+		t.Errorf("want the job back in the queue; got %v", store.jobs)
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		min      time.Duration
+	}{
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{3, 40 * time.Second},
+		{10, time.Hour},
+		{100, time.Hour},
+	}
+
+	for _, tt := range tests {
+		got := ExponentialBackoff(tt.attempts)
+		if got < tt.min || got > tt.min+tt.min/5 {
+			t.Errorf("ExponentialBackoff(%d) = %s; want between %s and %s", tt.attempts, got, tt.min, tt.min+tt.min/5)
+		}
+	}
+}
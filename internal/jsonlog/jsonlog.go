@@ -2,10 +2,13 @@ package jsonlog
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"os"
 	"runtime/debug"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -31,27 +34,89 @@ func (l Level) String() string {
 		return "ERROR"
 	case LevelFatal:
 		return "FATAL"
+	case LevelOff:
+		return "OFF"
 	default:
 		return ""
 	}
 }
 
+// ParseLevel returns the level with the given name, like "info" or "ERROR".
+func ParseLevel(s string) (Level, error) {
+	for l := LevelInfo; l <= LevelOff; l++ {
+		if strings.EqualFold(s, l.String()) {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("jsonlog: unknown level %q", s)
+}
+
 // Logger is a custom logger. This holds the output destination that the log
 // entries will be written to, the minimum severity level that log entries will
-// be written for, plus a mutex for coordinating the writes.
+// be written for, plus a mutex for coordinating the writes. The properties are
+// added to every entry written by the logger (see With()).
+//
+// The minimum level can be changed while the application is running, so it's
+// accessed atomically. Like the mutex, it's shared by every logger created by
+// With(), so changing the level of one changes them all.
 type Logger struct {
-	out      io.Writer
-	minLevel Level
-	mu       sync.Mutex
+	out        io.Writer
+	minLevel   *int32
+	mu         *sync.Mutex
+	properties map[string]string
 }
 
 // New returns a Logger instance which writes log entries at or above a minimum
 // severity level to a specific output destination.
 func New(out io.Writer, minLevel Level) *Logger {
+	level := int32(minLevel)
+
 	return &Logger{
 		out:      out,
-		minLevel: minLevel,
+		minLevel: &level,
+		mu:       &sync.Mutex{},
+	}
+}
+
+// Level returns the minimum severity level that the logger writes entries for.
+func (l *Logger) Level() Level {
+	return Level(atomic.LoadInt32(l.minLevel))
+}
+
+// SetLevel changes the minimum severity level that the logger writes entries
+// for.
+func (l *Logger) SetLevel(level Level) {
+	atomic.StoreInt32(l.minLevel, int32(level))
+}
+
+// With returns a new Logger which adds the given properties to every entry
+// that it writes, as well as any that l already adds. It writes to the same
+// output as l and shares its mutex, so entries from the two never get mixed
+// up.
+func (l *Logger) With(properties map[string]string) *Logger {
+	child := *l
+	child.properties = merge(l.properties, properties)
+	return &child
+}
+
+// merge returns a map holding the properties from both maps, with the ones
+// from b taking precedence. Neither map is modified.
+func merge(a, b map[string]string) map[string]string {
+	if len(a) == 0 {
+		return b
+	}
+	if len(b) == 0 {
+		return a
+	}
+
+	props := make(map[string]string, len(a)+len(b))
+	for k, v := range a {
+		props[k] = v
+	}
+	for k, v := range b {
+		props[k] = v
 	}
+	return props
 }
 
 // Helper methods for writing log entries at the different levels. Notice that
@@ -75,7 +140,7 @@ func (l *Logger) print(level Level, message string,
 	properties map[string]string) (int, error) {
 	// If the severity level of the log entry is below the minimum severity for
 	// the logger, then return with no further action.
-	if level < l.minLevel {
+	if level < l.Level() {
 		return 0, nil
 	}
 
@@ -90,7 +155,7 @@ func (l *Logger) print(level Level, message string,
 		Level:      level.String(),
 		Time:       time.Now().UTC().Format(time.RFC3339),
 		Message:    message,
-		Properties: properties,
+		Properties: merge(l.properties, properties),
 	}
 
 	// Include a stack trace for entries at the ERROR and FATAL levels.
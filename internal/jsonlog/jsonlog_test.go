@@ -0,0 +1,57 @@
+package jsonlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestWith(t *testing.T) {
+	var buf bytes.Buffer
+
+	logger := New(&buf, LevelInfo)
+	child := logger.With(map[string]string{"request_id": "abc-123", "user": "a"})
+
+	child.PrintInfo("hello", map[string]string{"user": "b"})
+
+	var entry struct {
+		Message    string            `json:"message"`
+		Properties map[string]string `json:"properties"`
+	}
+	err := json.Unmarshal(buf.Bytes(), &entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if entry.Properties["request_id"] != "abc-123" || entry.Properties["user"] != "b" {
+		t.Errorf("unexpected properties %v", entry.Properties)
+	}
+
+	// The parent logger doesn't pick up the child's properties, but the two
+	// share a level.
+	buf.Reset()
+	logger.PrintInfo("hello", nil)
+	if bytes.Contains(buf.Bytes(), []byte("abc-123")) {
+		t.Errorf("want no request_id in parent's entry; got %s", buf.Bytes())
+	}
+
+	buf.Reset()
+	logger.SetLevel(LevelError)
+	child.PrintInfo("dropped", nil)
+	if buf.Len() != 0 {
+		t.Errorf("want child logger to use the new level; got %s", buf.Bytes())
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for s, want := range map[string]Level{"info": LevelInfo, "ERROR": LevelError, "Fatal": LevelFatal, "off": LevelOff} {
+		got, err := ParseLevel(s)
+		if err != nil || got != want {
+			t.Errorf("%s: want %s; got %s (%v)", s, want, got, err)
+		}
+	}
+
+	if _, err := ParseLevel("debug"); err == nil {
+		t.Error("want error for unknown level")
+	}
+}
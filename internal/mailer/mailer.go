@@ -2,8 +2,11 @@ package mailer
 
 import (
 	"bytes"
+	"context"
 	"embed"
 	"html/template"
+	"net"
+	"strconv"
 	"time"
 
 	"github.com/go-mail/mail/v2"
@@ -41,6 +44,20 @@ func New(host string, port int, username, password, sender string) Mailer {
 	}
 }
 
+// Ping checks that a TCP connection can be made to the SMTP server. It doesn't
+// log in or send anything, so it's cheap enough to call from a readiness
+// check.
+func (m Mailer) Ping(ctx context.Context) error {
+	var d net.Dialer
+
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(m.dialer.Host, strconv.Itoa(m.dialer.Port)))
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
 // Send method on the Mailer type. This takes the recipient email address as the
 // first parameter, the name of the file containing the templates, and any
 // dynamic data for the templates as an interface{} parameter.
@@ -88,22 +105,11 @@ func (m Mailer) Send(recipient, templateFile string, data interface{}) error {
 	msg.SetBody("text/plain", plainBody.String())
 	msg.AddAlternative("text/html", htmlBody.String())
 
-	// Try sending the email up to three times before aborting and returning the
-	// final error. We sleep for 500 milliseconds between each attempt.
-	for i := 1; i <= 3; i++ {
-		// Call the DialAndSend() method on the dialer, passing in the message
-		// to send. This opens a connection to the SMTP server, sends the
-		// message, then closes the connection. If there is a timeout, it will
-		// return a 'dial tcp: i/o timeout' error.
-		err = m.dialer.DialAndSend(msg)
-		// If everything worked, return nil.
-		if nil == err {
-			return nil
-		}
-
-		// If it didn't work, sleep for a short time and retry.
-		time.Sleep(500 * time.Millisecond)
-	}
-
-	return err
+	// Call the DialAndSend() method on the dialer, passing in the message to
+	// send. This opens a connection to the SMTP server, sends the message, then
+	// closes the connection. If there is a timeout, it will return a 'dial tcp:
+	// i/o timeout' error. We don't retry here: emails are sent by background
+	// jobs, and the job queue tries again later, without tying up a worker
+	// in the meantime.
+	return m.dialer.DialAndSend(msg)
 }
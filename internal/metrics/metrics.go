@@ -0,0 +1,327 @@
+// Package metrics is a small registry of counters, gauges and histograms which
+// can be written out in the Prometheus text exposition format
+// (https://prometheus.io/docs/instrumenting/exposition_formats/). It covers
+// what we need without pulling in the official client library and its
+// dependencies.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets are the default histogram buckets, in seconds. They suit the
+// latencies of a typical web service, from 5ms to 10s.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metric is implemented by everything that can be registered.
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// Registry holds a set of metrics.
+type Registry struct {
+	mu      sync.Mutex
+	names   []string
+	metrics map[string]metric
+}
+
+// NewRegistry returns a new, empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]metric)}
+}
+
+// register adds a metric to the registry. It panics if the name is taken, in
+// the same way as http.Handle() does for a duplicate pattern, because that is
+// always a programming error.
+func (r *Registry) register(name string, m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.metrics[name]; exists {
+		panic("metrics: duplicate metric " + name)
+	}
+
+	r.names = append(r.names, name)
+	sort.Strings(r.names)
+	r.metrics[name] = m
+}
+
+// WriteTo writes every metric in the registry to w in the text exposition
+// format, sorted by name.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	names := append([]string(nil), r.names...)
+	r.mu.Unlock()
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+
+	for _, name := range names {
+		r.mu.Lock()
+		m := r.metrics[name]
+		r.mu.Unlock()
+
+		m.write(bw)
+	}
+
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// Handler returns a http.Handler which serves the metrics in the registry.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteTo(w)
+	})
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// CounterVec is a set of counters which share a name and are told apart by
+// the values of their labels.
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+}
+
+// NewCounterVec creates and registers a new CounterVec with the given label
+// names.
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, labels: labels, values: make(map[string]*series)}
+	r.register(name, c)
+	return c
+}
+
+// Add adds v, which must not be negative, to the counter with the given label
+// values. The values must be in the same order as the label names.
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic("metrics: counter " + c.name + " cannot decrease")
+	}
+	checkLabels(c.name, c.labels, labelValues)
+
+	key := strings.Join(labelValues, "\xff")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s, ok := c.values[key]
+	if !ok {
+		s = &series{labelValues: labelValues}
+		c.values[key] = s
+	}
+	s.value += v
+}
+
+// Inc adds one to the counter with the given label values.
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := c.values[key]
+		writeSample(w, c.name, c.labels, s.labelValues, "", "", s.value)
+	}
+}
+
+// HistogramVec is a set of histograms which share a name and buckets, and are
+// told apart by the values of their labels.
+type HistogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	values map[string]*histogram
+}
+
+type histogram struct {
+	labelValues []string
+	counts      []uint64 // counts[i] is the number of observations <= buckets[i]
+	count       uint64
+	sum         float64
+}
+
+// NewHistogramVec creates and registers a new HistogramVec. The buckets are
+// the upper bounds of each bucket, in increasing order; a +Inf bucket is
+// always added.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if !sort.Float64sAreSorted(buckets) {
+		panic("metrics: buckets for " + name + " are not sorted")
+	}
+
+	h := &HistogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogram)}
+	r.register(name, h)
+	return h
+}
+
+// Observe records a value in the histogram with the given label values.
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	checkLabels(h.name, h.labels, labelValues)
+
+	key := strings.Join(labelValues, "\xff")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.values[key]
+	if !ok {
+		s = &histogram{labelValues: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.values[key] = s
+	}
+
+	for i, upper := range h.buckets {
+		if v <= upper {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	writeHeader(w, h.name, h.help, "histogram")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := h.values[key]
+
+		for i, upper := range h.buckets {
+			writeSample(w, h.name+"_bucket", h.labels, s.labelValues, "le", formatFloat(upper), float64(s.counts[i]))
+		}
+		writeSample(w, h.name+"_bucket", h.labels, s.labelValues, "le", "+Inf", float64(s.count))
+		writeSample(w, h.name+"_sum", h.labels, s.labelValues, "", "", s.sum)
+		writeSample(w, h.name+"_count", h.labels, s.labelValues, "", "", float64(s.count))
+	}
+}
+
+// valueFunc is a metric whose value is read by calling a function each time
+// the metrics are written, which suits values that are already tracked
+// somewhere else, like the number of goroutines.
+type valueFunc struct {
+	name string
+	help string
+	typ  string
+	fn   func() float64
+}
+
+// NewGaugeFunc registers a gauge whose value is the result of calling fn.
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.register(name, &valueFunc{name: name, help: help, typ: "gauge", fn: fn})
+}
+
+// NewCounterFunc registers a counter whose value is the result of calling
+// fn, which must never decrease.
+func (r *Registry) NewCounterFunc(name, help string, fn func() float64) {
+	r.register(name, &valueFunc{name: name, help: help, typ: "counter", fn: fn})
+}
+
+func (f *valueFunc) write(w *bufio.Writer) {
+	writeHeader(w, f.name, f.help, f.typ)
+	writeSample(w, f.name, nil, nil, "", "", f.fn())
+}
+
+func checkLabels(name string, labels, values []string) {
+	if len(labels) != len(values) {
+		panic(fmt.Sprintf("metrics: %s has %d labels but got %d values", name, len(labels), len(values)))
+	}
+}
+
+func writeHeader(w *bufio.Writer, name, help, typ string) {
+	help = strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// writeSample writes a single line like `name{a="b",le="0.5"} 3`. The extra
+// label is used for the "le" label of histogram buckets.
+func writeSample(w *bufio.Writer, name string, labels, values []string, extraLabel, extraValue string, v float64) {
+	w.WriteString(name)
+
+	if len(labels) > 0 || extraLabel != "" {
+		w.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, `%s="%s"`, label, escapeLabel(values[i]))
+		}
+		if extraLabel != "" {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, `%s="%s"`, extraLabel, extraValue)
+		}
+		w.WriteByte('}')
+	}
+
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
@@ -0,0 +1,89 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWriteTo(t *testing.T) {
+	r := NewRegistry()
+
+	requests := r.NewCounterVec("http_requests_total", "Total number of HTTP requests.", "method", "route")
+	requests.Inc("GET", "/v1/movies/:id")
+	requests.Inc("GET", "/v1/movies/:id")
+	requests.Add(3, "POST", `/v1/"quoted"`)
+
+	duration := r.NewHistogramVec("http_request_duration_seconds", "HTTP request latency.", []float64{0.1, 1}, "method")
+	duration.Observe(0.05, "GET")
+	duration.Observe(0.5, "GET")
+	duration.Observe(2, "GET")
+
+	r.NewGaugeFunc("go_goroutines", "Number of goroutines.\nSecond line.", func() float64 { return 7 })
+
+	var buf bytes.Buffer
+	_, err := r.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `# HELP go_goroutines Number of goroutines.\nSecond line.
+# TYPE go_goroutines gauge
+go_goroutines 7
+# HELP http_request_duration_seconds HTTP request latency.
+# TYPE http_request_duration_seconds histogram
+http_request_duration_seconds_bucket{method="GET",le="0.1"} 1
+http_request_duration_seconds_bucket{method="GET",le="1"} 2
+http_request_duration_seconds_bucket{method="GET",le="+Inf"} 3
+http_request_duration_seconds_sum{method="GET"} 2.55
+http_request_duration_seconds_count{method="GET"} 3
+# HELP http_requests_total Total number of HTTP requests.
+# TYPE http_requests_total counter
+http_requests_total{method="GET",route="/v1/movies/:id"} 2
+http_requests_total{method="POST",route="/v1/\"quoted\""} 3
+`
+
+	if got := buf.String(); got != want {
+		t.Errorf("want:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounterFunc("jobs_total", "Total number of jobs.", func() float64 { return 1 })
+
+	rr := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if ct := rr.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("unexpected Content-Type %q", ct)
+	}
+	if !bytes.Contains(rr.Body.Bytes(), []byte("# TYPE jobs_total counter\njobs_total 1\n")) {
+		t.Errorf("unexpected body %q", rr.Body.String())
+	}
+}
+
+func TestPanics(t *testing.T) {
+	for name, fn := range map[string]func(r *Registry){
+		"Duplicate name": func(r *Registry) {
+			r.NewCounterVec("a", "")
+			r.NewCounterVec("a", "")
+		},
+		"Wrong number of labels": func(r *Registry) {
+			r.NewCounterVec("a", "", "method").Inc()
+		},
+		"Negative counter": func(r *Registry) {
+			r.NewCounterVec("a", "").Add(-1)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("want panic")
+				}
+			}()
+			fn(NewRegistry())
+		})
+	}
+}
@@ -0,0 +1,5 @@
+package migrate
+
+// LockID lets the tests in package migrate_test, which can use testdb without
+// an import cycle, take the migration lock themselves.
+const LockID = lockID
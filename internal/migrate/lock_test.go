@@ -0,0 +1,66 @@
+package migrate_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/cedrickchee/skel/internal/jsonlog"
+	"github.com/cedrickchee/skel/internal/migrate"
+	"github.com/cedrickchee/skel/internal/testdb"
+	"github.com/cedrickchee/skel/migrations"
+)
+
+// TestLockPerSchema checks that the migration lock only covers one schema, so
+// that migrators working on different schemas, like the integration tests
+// running in parallel, don't queue up behind each other.
+func TestLockPerSchema(t *testing.T) {
+	t.Parallel()
+
+	held := testdb.New(t)
+	other := testdb.New(t)
+
+	// Hold the lock for the first schema, as a migrator working on it would.
+	ctx := context.Background()
+	conn, err := held.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, "SELECT pg_advisory_lock($1, hashtext(current_schema()))", migrate.LockID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1, hashtext(current_schema()))", migrate.LockID)
+
+	logger := jsonlog.New(ioutil.Discard, jsonlog.LevelInfo)
+
+	otherCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	m, err := migrate.New(other, migrations.FS, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Up(otherCtx)
+	if err != nil {
+		t.Errorf("want the other schema to migrate while the lock is held; got %v", err)
+	}
+
+	// The driver reports the cancelled wait as a query error, so check the
+	// context to see why it gave up.
+	heldCtx, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer cancel()
+
+	m, err = migrate.New(held, migrations.FS, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Up(heldCtx)
+	if err == nil || !errors.Is(heldCtx.Err(), context.DeadlineExceeded) {
+		t.Errorf("want the locked schema to wait for the lock; got %v", err)
+	}
+}
@@ -0,0 +1,410 @@
+// Package migrate applies the SQL migrations in the migrations directory to a
+// PostgreSQL database.
+//
+// It keeps track of the schema version in the same way as golang-migrate: a
+// schema_migrations table with a single row holding the version of the last
+// migration applied, and whether it failed part way through (dirty). So a
+// database migrated with the migrate CLI can be taken over by this package,
+// and the other way round.
+//
+// Only one migrator runs at a time on each schema, even across machines,
+// because each takes a PostgreSQL advisory lock for as long as it's working.
+// That makes it safe for every instance of the API to migrate the database
+// when it starts. Migrators working on different schemas of the same database
+// (like the integration tests, which each have a schema of their own) don't
+// wait for each other.
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/cedrickchee/skel/internal/jsonlog"
+	"github.com/lib/pq"
+)
+
+// NilVersion is the version of a database which has had no migrations
+// applied, or has had them all rolled back.
+const NilVersion int64 = -1
+
+// lockID is the first key of the advisory lock which a Migrator holds while
+// it works, and the second is a hash of the schema it's migrating (see
+// withLock()). It's an arbitrary number, which just needs to differ from any
+// other advisory locks taken on the same database.
+const lockID int32 = 746832750
+
+var (
+	// ErrDirty is returned when the last migration failed part way through.
+	// Someone needs to look at the database, tidy up after the migration,
+	// and then use Force() to set the version it's really at.
+	ErrDirty = errors.New("migrate: database is dirty")
+	// ErrNoMigration is returned by Goto() and Force() for a version which
+	// has no migration.
+	ErrNoMigration = errors.New("migrate: no migration with that version")
+)
+
+// Migration is a single change to the database schema.
+type Migration struct {
+	Version int64
+	Name    string
+	// Up makes the change, and Down undoes it. Down may be empty, in which
+	// case the migration can't be rolled back.
+	Up   string
+	Down string
+}
+
+// fileRX matches migration file names, like "000001_create_movies_table.up.sql".
+var fileRX = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+// Load reads the migrations in the top directory of fsys, and returns them in
+// order of version. Files whose names don't look like migrations are ignored.
+func Load(fsys fs.FS) ([]*Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*Migration)
+
+	for _, entry := range entries {
+		match := fileRX.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || match == nil {
+			continue
+		}
+
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migrate: invalid version in %q: %w", entry.Name(), err)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("migrate: more than one migration with version %d", version)
+		}
+
+		body, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		switch match[3] {
+		case "up":
+			m.Up = string(body)
+		case "down":
+			m.Down = string(body)
+		}
+	}
+
+	migrations := make([]*Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migrate: migration %d has no up file", m.Version)
+		}
+		migrations = append(migrations, m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// step is one migration to run, in one direction. version is what the
+// database's version will be once it has run.
+type step struct {
+	migration *Migration
+	up        bool
+	version   int64
+}
+
+// plan returns the steps which take a database at version current to version
+// target.
+func plan(migrations []*Migration, current, target int64) ([]step, error) {
+	if target != NilVersion && find(migrations, target) < 0 {
+		return nil, fmt.Errorf("%w: %d", ErrNoMigration, target)
+	}
+	if current != NilVersion && find(migrations, current) < 0 {
+		return nil, fmt.Errorf("migrate: the database is at version %d, which has no migration", current)
+	}
+
+	var steps []step
+
+	switch {
+	case target > current:
+		for _, m := range migrations {
+			if m.Version > current && m.Version <= target {
+				steps = append(steps, step{migration: m, up: true, version: m.Version})
+			}
+		}
+	case target < current:
+		for i := len(migrations) - 1; i >= 0; i-- {
+			m := migrations[i]
+			if m.Version > target && m.Version <= current {
+				// Rolling back a migration leaves the database at the version
+				// of the one before it.
+				version := NilVersion
+				if i > 0 {
+					version = migrations[i-1].Version
+				}
+				steps = append(steps, step{migration: m, up: false, version: version})
+			}
+		}
+	}
+
+	return steps, nil
+}
+
+// find returns the index of the migration with the given version, or -1 if
+// there isn't one.
+func find(migrations []*Migration, version int64) int {
+	for i, m := range migrations {
+		if m.Version == version {
+			return i
+		}
+	}
+	return -1
+}
+
+// Migrator applies migrations to a database.
+type Migrator struct {
+	db         *sql.DB
+	migrations []*Migration
+	logger     *jsonlog.Logger
+}
+
+// New returns a Migrator for the migrations in fsys (see Load()). Each
+// migration that it runs is logged to logger, if it isn't nil.
+func New(db *sql.DB, fsys fs.FS, logger *jsonlog.Logger) (*Migrator, error) {
+	migrations, err := Load(fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{db: db, migrations: migrations, logger: logger}, nil
+}
+
+// Migrations returns the migrations, in order of version.
+func (m *Migrator) Migrations() []*Migration {
+	return m.migrations
+}
+
+// Latest returns the version of the newest migration, or NilVersion if there
+// aren't any.
+func (m *Migrator) Latest() int64 {
+	if len(m.migrations) == 0 {
+		return NilVersion
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// Version returns the database's current version, and whether it's dirty. It
+// doesn't take the lock, so it's a snapshot which may be out of date if
+// another migrator is running.
+func (m *Migrator) Version(ctx context.Context) (version int64, dirty bool, err error) {
+	return readVersion(ctx, m.db)
+}
+
+// Up applies all the migrations which haven't been applied yet.
+func (m *Migrator) Up(ctx context.Context) error {
+	return m.locked(ctx, func(current int64) int64 {
+		return m.Latest()
+	})
+}
+
+// Down rolls back the last n migrations, or all of them if there are fewer.
+func (m *Migrator) Down(ctx context.Context, n int) error {
+	return m.locked(ctx, func(current int64) int64 {
+		i := find(m.migrations, current) - n
+		if i < 0 {
+			return NilVersion
+		}
+		return m.migrations[i].Version
+	})
+}
+
+// Goto migrates up or down to the given version. NilVersion rolls back every
+// migration.
+func (m *Migrator) Goto(ctx context.Context, version int64) error {
+	return m.locked(ctx, func(current int64) int64 {
+		return version
+	})
+}
+
+// Force sets the database's version, and marks it as clean, without running
+// any migrations. It's for recovering from a failed migration, once the
+// database has been fixed by hand.
+func (m *Migrator) Force(ctx context.Context, version int64) error {
+	if version != NilVersion && find(m.migrations, version) < 0 {
+		return fmt.Errorf("%w: %d", ErrNoMigration, version)
+	}
+
+	return m.withLock(ctx, func(conn *sql.Conn) error {
+		return setVersion(ctx, conn, version, false)
+	})
+}
+
+// locked takes the lock, checks that the database isn't dirty, and then
+// migrates it to the version that target returns for its current version.
+func (m *Migrator) locked(ctx context.Context, target func(current int64) int64) error {
+	return m.withLock(ctx, func(conn *sql.Conn) error {
+		current, dirty, err := readVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if dirty {
+			return fmt.Errorf("%w at version %d", ErrDirty, current)
+		}
+
+		steps, err := plan(m.migrations, current, target(current))
+		if err != nil {
+			return err
+		}
+
+		for _, s := range steps {
+			err := m.run(ctx, conn, s)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// run runs a single step. Like golang-migrate, it marks the database as dirty
+// before running the step's SQL, and clean once it has succeeded, so that a
+// migration which fails part way through can't go unnoticed.
+//
+// The SQL is sent as a single multi-statement query, which PostgreSQL runs in
+// an implicit transaction, so a failed migration leaves no changes behind
+// (unless it commits part of the way through itself).
+func (m *Migrator) run(ctx context.Context, conn *sql.Conn, s step) error {
+	direction, body := "up", s.migration.Up
+	if !s.up {
+		direction, body = "down", s.migration.Down
+		if body == "" {
+			return fmt.Errorf("migrate: migration %d can't be rolled back, because it has no down file", s.migration.Version)
+		}
+	}
+
+	err := setVersion(ctx, conn, s.version, true)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.ExecContext(ctx, body)
+	if err != nil {
+		return fmt.Errorf("migrate: %d_%s.%s.sql: %w", s.migration.Version, s.migration.Name, direction, err)
+	}
+
+	err = setVersion(ctx, conn, s.version, false)
+	if err != nil {
+		return err
+	}
+
+	if m.logger != nil {
+		m.logger.PrintInfo("applied migration", map[string]string{
+			"version":   strconv.FormatInt(s.migration.Version, 10),
+			"name":      s.migration.Name,
+			"direction": direction,
+		})
+	}
+
+	return nil
+}
+
+// withLock calls fn with a connection which holds the advisory lock. The lock
+// is tied to the connection, so fn must do all its work through it.
+//
+// Advisory locks belong to the whole database, so the lock is keyed by the
+// schema too, which is the first one on the connection's search_path:
+// current_schema() is where the migrations create their tables.
+func (m *Migrator) withLock(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, "SELECT pg_advisory_lock($1, hashtext(current_schema()))", lockID)
+	if err != nil {
+		return err
+	}
+	// Unlock with a fresh context, so that the lock is released even if ctx
+	// has been cancelled. Closing the connection would release it too, but
+	// the pool would keep the connection open.
+	defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1, hashtext(current_schema()))", lockID)
+
+	_, err = conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version bigint NOT NULL PRIMARY KEY,
+			dirty boolean NOT NULL
+		)`)
+	if err != nil {
+		return err
+	}
+
+	return fn(conn)
+}
+
+// queryer is the part of *sql.DB and *sql.Conn which readVersion() needs.
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// readVersion returns the database's version, which is NilVersion if the
+// schema_migrations table is empty or doesn't exist.
+func readVersion(ctx context.Context, q queryer) (int64, bool, error) {
+	var version int64
+	var dirty bool
+
+	err := q.QueryRowContext(ctx, "SELECT version, dirty FROM schema_migrations LIMIT 1").Scan(&version, &dirty)
+	if err != nil {
+		var pqErr *pq.Error
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return NilVersion, false, nil
+		case errors.As(err, &pqErr) && pqErr.Code == "42P01": // undefined_table
+			return NilVersion, false, nil
+		default:
+			return 0, false, err
+		}
+	}
+
+	return version, dirty, nil
+}
+
+// setVersion records the database's version. The table only ever has one
+// row, and a clean database with no migrations applied has none.
+func setVersion(ctx context.Context, conn *sql.Conn, version int64, dirty bool) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "TRUNCATE schema_migrations")
+	if err != nil {
+		return err
+	}
+
+	if version != NilVersion || dirty {
+		_, err = tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, dirty) VALUES ($1, $2)", version, dirty)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
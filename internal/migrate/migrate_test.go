@@ -0,0 +1,135 @@
+package migrate
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"testing/fstest"
+
+	"github.com/cedrickchee/skel/migrations"
+)
+
+func TestLoad(t *testing.T) {
+	fsys := fstest.MapFS{
+		"000002_second.up.sql":   {Data: []byte("up 2")},
+		"000001_first.up.sql":    {Data: []byte("up 1")},
+		"000001_first.down.sql":  {Data: []byte("down 1")},
+		"migrations.go":          {Data: []byte("package migrations")},
+		"000003_third.down.sql~": {Data: []byte("backup")},
+	}
+
+	got, err := Load(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []*Migration{
+		{Version: 1, Name: "first", Up: "up 1", Down: "down 1"},
+		{Version: 2, Name: "second", Up: "up 2"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want %+v; got %+v", want, got)
+	}
+
+	tests := []struct {
+		name string
+		fsys fstest.MapFS
+	}{
+		{
+			name: "Duplicate version",
+			fsys: fstest.MapFS{
+				"000001_first.up.sql": {Data: []byte("up")},
+				"000001_other.up.sql": {Data: []byte("up")},
+			},
+		},
+		{
+			name: "Missing up",
+			fsys: fstest.MapFS{
+				"000001_first.down.sql": {Data: []byte("down")},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load(tt.fsys)
+			if err == nil {
+				t.Error("want an error")
+			}
+		})
+	}
+}
+
+// TestLoadEmbedded checks that the embedded migrations can be loaded, and
+// that every one of them can be rolled back.
+func TestLoadEmbedded(t *testing.T) {
+	loaded, err := Load(migrations.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) == 0 {
+		t.Fatal("want some migrations")
+	}
+
+	for i, m := range loaded {
+		if m.Version != int64(i+1) {
+			t.Errorf("want migration %d to have version %d; got %d", i, i+1, m.Version)
+		}
+		if m.Down == "" {
+			t.Errorf("migration %d_%s has no down file", m.Version, m.Name)
+		}
+	}
+}
+
+func TestPlan(t *testing.T) {
+	ms := []*Migration{{Version: 1}, {Version: 2}, {Version: 5}}
+
+	type want struct {
+		version int64
+		up      bool
+	}
+
+	tests := []struct {
+		name    string
+		current int64
+		target  int64
+		want    []want
+		err     bool
+	}{
+		{name: "Up from nothing", current: NilVersion, target: 5, want: []want{{1, true}, {2, true}, {5, true}}},
+		{name: "Up part way", current: 1, target: 2, want: []want{{2, true}}},
+		{name: "Nothing to do", current: 5, target: 5},
+		{name: "Down one", current: 5, target: 2, want: []want{{2, false}}},
+		{name: "Down to nothing", current: 2, target: NilVersion, want: []want{{1, false}, {NilVersion, false}}},
+		{name: "Unknown target", current: 1, target: 3, err: true},
+		{name: "Unknown current", current: 9, target: 5, err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			steps, err := plan(ms, tt.current, tt.target)
+			if tt.err {
+				if err == nil {
+					t.Error("want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []want
+			for _, s := range steps {
+				got = append(got, want{s.version, s.up})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("want steps %v; got %v", tt.want, got)
+			}
+		})
+	}
+
+	_, err := plan(ms, 1, 3)
+	if !errors.Is(err, ErrNoMigration) {
+		t.Errorf("want %v; got %v", ErrNoMigration, err)
+	}
+}
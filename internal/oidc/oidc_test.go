@@ -0,0 +1,340 @@
+package oidc_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/cedrickchee/skel/internal/oidc"
+	"github.com/cedrickchee/skel/internal/oidc/oidctest"
+)
+
+func newTestProvider(t *testing.T) (*oidctest.Server, *oidc.Provider) {
+	t.Helper()
+
+	idp := oidctest.NewServer("skel", "s3cret")
+	t.Cleanup(idp.Close)
+
+	provider := oidc.NewProvider(oidc.ProviderConfig{
+		Issuer:       idp.URL,
+		ClientID:     "skel",
+		ClientSecret: "s3cret",
+		RedirectURL:  "http://localhost:4000/v1/auth/oidc/test/callback",
+	}, idp.Client())
+
+	return idp, provider
+}
+
+// login runs the authorization code flow against the fake provider, and
+// returns the raw ID token.
+func login(t *testing.T, idp *oidctest.Server, provider *oidc.Provider, nonce, verifier string) (string, error) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	authURL, err := provider.AuthCodeURL(ctx, "state", nonce, oidc.Challenge(verifier))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := idp.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+
+	res, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	location, err := url.Parse(res.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return provider.Exchange(ctx, location.Query().Get("code"), verifier)
+}
+
+func TestProvider(t *testing.T) {
+	idp, provider := newTestProvider(t)
+
+	idp.SetClaims(map[string]interface{}{
+		"sub":            "1234",
+		"email":          "john@example.com",
+		"email_verified": "true",
+		"name":           "John",
+	})
+
+	t.Run("Valid", func(t *testing.T) {
+		rawIDToken, err := login(t, idp, provider, "n0nce", "verifier")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		claims, err := provider.Verify(context.Background(), rawIDToken, "n0nce")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if claims.Subject != "1234" || claims.Email != "john@example.com" || !bool(claims.EmailVerified) {
+			t.Errorf("unexpected claims %+v", claims)
+		}
+	})
+
+	t.Run("Wrong nonce", func(t *testing.T) {
+		rawIDToken, err := login(t, idp, provider, "n0nce", "verifier")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = provider.Verify(context.Background(), rawIDToken, "other")
+		if !errors.Is(err, oidc.ErrInvalidToken) {
+			t.Errorf("want ErrInvalidToken; got %v", err)
+		}
+	})
+
+	t.Run("Wrong verifier", func(t *testing.T) {
+		ctx := context.Background()
+
+		authURL, err := provider.AuthCodeURL(ctx, "state", "n0nce", oidc.Challenge("verifier"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		client := idp.Client()
+		client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+
+		res, err := client.Get(authURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		location, _ := url.Parse(res.Header.Get("Location"))
+
+		_, err = provider.Exchange(ctx, location.Query().Get("code"), "not-the-verifier")
+		if !errors.Is(err, oidc.ErrExchange) {
+			t.Errorf("want ErrExchange; got %v", err)
+		}
+	})
+}
+
+func TestVerify(t *testing.T) {
+	idp, provider := newTestProvider(t)
+
+	now := time.Now()
+
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss":   idp.URL,
+			"aud":   []string{"skel", "other"},
+			"azp":   "skel",
+			"sub":   "1234",
+			"iat":   now.Unix(),
+			"exp":   now.Add(time.Minute).Unix(),
+			"nonce": "n0nce",
+		}
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(claims map[string]interface{})
+		token   func(signed string) string
+		wantErr bool
+	}{
+		{
+			name:   "Valid",
+			modify: func(map[string]interface{}) {},
+		},
+		{
+			name:    "Wrong issuer",
+			modify:  func(c map[string]interface{}) { c["iss"] = "https://evil.example" },
+			wantErr: true,
+		},
+		{
+			name:    "Wrong audience",
+			modify:  func(c map[string]interface{}) { c["aud"] = "other" },
+			wantErr: true,
+		},
+		{
+			name:   "Single audience",
+			modify: func(c map[string]interface{}) { c["aud"] = "skel"; delete(c, "azp") },
+		},
+		{
+			name:    "Several audiences without azp",
+			modify:  func(c map[string]interface{}) { delete(c, "azp") },
+			wantErr: true,
+		},
+		{
+			name:    "Issued to another client",
+			modify:  func(c map[string]interface{}) { c["azp"] = "other" },
+			wantErr: true,
+		},
+		{
+			name:    "Expired",
+			modify:  func(c map[string]interface{}) { c["exp"] = now.Add(-time.Hour).Unix() },
+			wantErr: true,
+		},
+		{
+			name:    "Missing subject",
+			modify:  func(c map[string]interface{}) { delete(c, "sub") },
+			wantErr: true,
+		},
+		{
+			name:   "Tampered payload",
+			modify: func(map[string]interface{}) {},
+			token: func(signed string) string {
+				// Flip a character in the middle of the payload.
+				b := []byte(signed)
+				i := len(b) / 2
+				if b[i] == 'A' {
+					b[i] = 'B'
+				} else {
+					b[i] = 'A'
+				}
+				return string(b)
+			},
+			wantErr: true,
+		},
+		{
+			name:   "Unsigned",
+			modify: func(map[string]interface{}) {},
+			token: func(string) string {
+				// {"alg":"none"}.{"sub":"1234"}.
+				return "eyJhbGciOiJub25lIn0.eyJzdWIiOiIxMjM0In0."
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := valid()
+			tt.modify(claims)
+
+			token := idp.Sign(claims)
+			if tt.token != nil {
+				token = tt.token(token)
+			}
+
+			_, err := provider.Verify(context.Background(), token, "n0nce")
+			if tt.wantErr && !errors.Is(err, oidc.ErrInvalidToken) {
+				t.Errorf("want ErrInvalidToken; got %v", err)
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("want no error; got %v", err)
+			}
+		})
+	}
+}
+
+// blockingTransport holds up requests for the JWKS until release is closed.
+type blockingTransport struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (bt *blockingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.URL.Path == "/jwks" {
+		close(bt.started)
+		<-bt.release
+	}
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+// TestSlowProvider checks that a slow response from the provider only holds up
+// the requests which need it.
+func TestSlowProvider(t *testing.T) {
+	idp := oidctest.NewServer("skel", "s3cret")
+	t.Cleanup(idp.Close)
+
+	bt := &blockingTransport{started: make(chan struct{}), release: make(chan struct{})}
+
+	provider := oidc.NewProvider(oidc.ProviderConfig{
+		Issuer:       idp.URL,
+		ClientID:     "skel",
+		ClientSecret: "s3cret",
+		RedirectURL:  "http://localhost:4000/v1/auth/oidc/test/callback",
+	}, &http.Client{Transport: bt})
+
+	ctx := context.Background()
+
+	token := idp.Sign(map[string]interface{}{
+		"iss":   idp.URL,
+		"aud":   "skel",
+		"sub":   "1234",
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Minute).Unix(),
+		"nonce": "n0nce",
+	})
+
+	// Verifying a token fetches the keys, which takes until we say so.
+	verified := make(chan error, 1)
+	go func() {
+		_, err := provider.Verify(ctx, token, "n0nce")
+		verified <- err
+	}()
+	<-bt.started
+
+	// If anything below does wait for the keys, let it have them once the
+	// test has failed, so that it doesn't hang.
+	released := false
+	release := func() {
+		if !released {
+			close(bt.release)
+			released = true
+		}
+	}
+	defer release()
+
+	// wait returns the result of fn, or fails the test if it takes more than
+	// a second.
+	wait := func(fn func() error) (bool, error) {
+		done := make(chan error, 1)
+		go func() { done <- fn() }()
+
+		select {
+		case err := <-done:
+			return true, err
+		case <-time.After(time.Second):
+			return false, nil
+		}
+	}
+
+	// Meanwhile, another user can start logging in.
+	ok, err := wait(func() error {
+		_, err := provider.AuthCodeURL(ctx, "state", "nonce", oidc.Challenge("verifier"))
+		return err
+	})
+	if !ok || err != nil {
+		t.Errorf("want AuthCodeURL not to wait for the keys; got %v (finished: %v)", err, ok)
+	}
+
+	// And a third has to wait for the same keys, but gives up when their
+	// request does, rather than fetching them again.
+	ok, err = wait(func() error {
+		waitCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+
+		_, err := provider.Verify(waitCtx, token, "n0nce")
+		return err
+	})
+	if !ok || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("want %v waiting for the keys; got %v (finished: %v)", context.DeadlineExceeded, err, ok)
+	}
+
+	release()
+
+	err = <-verified
+	if err != nil {
+		t.Errorf("want the token to be verified once the keys arrive; got %v", err)
+	}
+}
+
+/*
+Run:
+
+$ go test -v github.com/cedrickchee/skel/internal/oidc
+*/
@@ -0,0 +1,215 @@
+// Package oidctest provides a fake OpenID Connect identity provider for use in
+// tests, in the same spirit as net/http/httptest.
+package oidctest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// KeyID is the key ID of the signing key published by the fake provider.
+const KeyID = "test-key"
+
+// Server is a fake identity provider. It "logs in" whoever is described by
+// Claims without asking any questions, and signs ID tokens with Key.
+type Server struct {
+	*httptest.Server
+
+	ClientID     string
+	ClientSecret string
+	Key          *rsa.PrivateKey
+
+	mu sync.Mutex
+	// Claims are added to every ID token issued from now on, on top of the
+	// standard iss, aud, exp, iat and nonce claims.
+	claims map[string]interface{}
+	codes  map[string]authRequest
+}
+
+type authRequest struct {
+	challenge   string
+	nonce       string
+	redirectURI string
+}
+
+// NewServer starts and returns a new fake identity provider. The caller should
+// call Close when finished, to shut it down.
+func NewServer(clientID, clientSecret string) *Server {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+
+	s := &Server{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Key:          key,
+		claims:       map[string]interface{}{},
+		codes:        map[string]authRequest{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", s.discovery)
+	mux.HandleFunc("/authorize", s.authorize)
+	mux.HandleFunc("/token", s.token)
+	mux.HandleFunc("/jwks", s.jwks)
+
+	s.Server = httptest.NewServer(mux)
+
+	return s
+}
+
+// SetClaims sets the claims describing the user who will log in next.
+func (s *Server) SetClaims(claims map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.claims = claims
+}
+
+func (s *Server) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                 s.URL,
+		"authorization_endpoint": s.URL + "/authorize",
+		"token_endpoint":         s.URL + "/token",
+		"jwks_uri":               s.URL + "/jwks",
+	})
+}
+
+// authorize immediately redirects back to the client with an authorization
+// code, as though the user had logged in and consented.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	if qs.Get("client_id") != s.ClientID || qs.Get("response_type") != "code" ||
+		qs.Get("code_challenge_method") != "S256" || qs.Get("code_challenge") == "" {
+		http.Error(w, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+
+	code := randomString()
+
+	s.mu.Lock()
+	s.codes[code] = authRequest{
+		challenge:   qs.Get("code_challenge"),
+		nonce:       qs.Get("nonce"),
+		redirectURI: qs.Get("redirect_uri"),
+	}
+	s.mu.Unlock()
+
+	redirect, err := url.Parse(qs.Get("redirect_uri"))
+	if err != nil {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	rq := redirect.Query()
+	rq.Set("code", code)
+	rq.Set("state", qs.Get("state"))
+	redirect.RawQuery = rq.Encode()
+
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id, secret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	} else {
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+	}
+
+	if id != s.ClientID || secret != s.ClientSecret {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	code := r.PostFormValue("code")
+
+	s.mu.Lock()
+	req, ok := s.codes[code]
+	delete(s.codes, code)
+	claims := make(map[string]interface{}, len(s.claims))
+	for k, v := range s.claims {
+		claims[k] = v
+	}
+	s.mu.Unlock()
+
+	hash := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	challenge := base64.RawURLEncoding.EncodeToString(hash[:])
+
+	if !ok || r.PostFormValue("grant_type") != "authorization_code" ||
+		r.PostFormValue("redirect_uri") != req.redirectURI || challenge != req.challenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	now := time.Now()
+	claims["iss"] = s.URL
+	claims["aud"] = s.ClientID
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(5 * time.Minute).Unix()
+	claims["nonce"] = req.nonce
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     s.Sign(claims),
+	})
+}
+
+func (s *Server) jwks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": KeyID,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(s.Key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(s.Key.E)).Bytes()),
+		}},
+	})
+}
+
+// Sign returns an RS256 JWT containing the given claims, signed with the
+// server's key.
+func (s *Server) Sign(claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": KeyID, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+
+	hash := sha256.Sum256([]byte(signingInput))
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.Key, crypto.SHA256, hash[:])
+	if err != nil {
+		panic(err)
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,281 @@
+package oidc
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// leeway is how far the provider's clock may be ahead of ours before we reject
+// a token as expired or not yet valid.
+const leeway = time.Minute
+
+// Claims holds the claims from a verified ID token that we care about.
+type Claims struct {
+	Issuer        string     `json:"iss"`
+	Subject       string     `json:"sub"`
+	Audience      audience   `json:"aud"`
+	Expiry        int64      `json:"exp"`
+	IssuedAt      int64      `json:"iat"`
+	Nonce         string     `json:"nonce"`
+	Email         string     `json:"email"`
+	EmailVerified stringBool `json:"email_verified"`
+	Name          string     `json:"name"`
+	// AuthorizedParty is the client the token was issued to. It only has to
+	// be present when there's more than one audience.
+	AuthorizedParty string `json:"azp"`
+}
+
+// audience is the "aud" claim, which may be either a single string or an array
+// of strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+
+	var ss []string
+	if err := json.Unmarshal(b, &ss); err != nil {
+		return err
+	}
+	*a = ss
+	return nil
+}
+
+func (a audience) contains(s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// stringBool is a boolean claim which some providers send as the string "true"
+// or "false" instead of a JSON boolean.
+type stringBool bool
+
+func (b *stringBool) UnmarshalJSON(data []byte) error {
+	switch string(bytes.Trim(data, `"`)) {
+	case "true":
+		*b = true
+	case "false", "null":
+		*b = false
+	default:
+		return fmt.Errorf("invalid boolean %s", data)
+	}
+	return nil
+}
+
+// keySet holds the RSA public keys from the provider's JWKS, keyed by key ID.
+type keySet struct {
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+}
+
+// key returns the public key with the given ID. If we don't have it, the key
+// set is fetched again in case the provider has rotated its keys, although not
+// more than once a minute so that tokens with made-up key IDs can't be used to
+// hammer the provider. Only one fetch runs at a time: anyone else who needs
+// the keys waits for it to finish.
+func (p *Provider) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		p.mu.Lock()
+		ks, fetch := p.keys, p.keysFetch
+
+		if ks != nil {
+			if key, ok := ks.keys[kid]; ok {
+				p.mu.Unlock()
+				return key, nil
+			}
+		}
+
+		if fetch == nil {
+			if ks != nil && time.Since(ks.fetched) < time.Minute {
+				p.mu.Unlock()
+				return nil, fmt.Errorf("%w: unknown key ID %q", ErrInvalidToken, kid)
+			}
+
+			// Nobody else is fetching the keys, so it's up to us.
+			fetch = make(chan struct{})
+			p.keysFetch = fetch
+			p.mu.Unlock()
+
+			ks, err := p.fetchKeys(ctx, d.JWKSURI)
+
+			p.mu.Lock()
+			if err == nil {
+				p.keys = ks
+			}
+			p.keysFetch = nil
+			close(fetch)
+			p.mu.Unlock()
+
+			if err != nil {
+				return nil, err
+			}
+
+			key, ok := ks.keys[kid]
+			if !ok {
+				return nil, fmt.Errorf("%w: unknown key ID %q", ErrInvalidToken, kid)
+			}
+			return key, nil
+		}
+		p.mu.Unlock()
+
+		// Somebody else is fetching the keys. Once they're done, look again:
+		// if their fetch failed, we'll try one of our own.
+		select {
+		case <-fetch:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// fetchKeys fetches the provider's JWKS.
+func (p *Provider) fetchKeys(ctx context.Context, jwksURI string) (*keySet, error) {
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+
+	err := p.getJSON(ctx, jwksURI, &jwks)
+	if err != nil {
+		return nil, err
+	}
+
+	ks := &keySet{
+		keys:    make(map[string]*rsa.PublicKey),
+		fetched: time.Now(),
+	}
+
+	for _, k := range jwks.Keys {
+		// Skip anything that isn't an RSA signing key, since RS256 is the
+		// only algorithm we support.
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) > 4 {
+			continue
+		}
+
+		ks.keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	return ks, nil
+}
+
+// Verify checks the signature and claims of a raw ID token, and returns the
+// claims if the token is valid. The nonce must be the one passed to
+// AuthCodeURL() for this login.
+func (p *Provider) Verify(ctx context.Context, rawIDToken, nonce string) (*Claims, error) {
+	parts := strings.Split(rawIDToken, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed token", ErrInvalidToken)
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed header", ErrInvalidToken)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+
+	err = json.Unmarshal(headerJSON, &header)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed header", ErrInvalidToken)
+	}
+
+	// Never let the token choose its own algorithm. In particular this rules
+	// out "none" and HMAC algorithms keyed with the public key.
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidToken, header.Alg)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed signature", ErrInvalidToken)
+	}
+
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+	err = rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad signature", ErrInvalidToken)
+	}
+
+	// Only look at the claims once we know they're genuine.
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed payload", ErrInvalidToken)
+	}
+
+	var claims Claims
+
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed payload", ErrInvalidToken)
+	}
+
+	now := time.Now()
+
+	switch {
+	case claims.Issuer != p.config.Issuer:
+		return nil, fmt.Errorf("%w: wrong issuer %q", ErrInvalidToken, claims.Issuer)
+	case !claims.Audience.contains(p.config.ClientID):
+		return nil, fmt.Errorf("%w: wrong audience", ErrInvalidToken)
+	case (len(claims.Audience) > 1 || claims.AuthorizedParty != "") && claims.AuthorizedParty != p.config.ClientID:
+		// A token for several audiences may have been issued to one of the
+		// others, and passed on to us. azp says which client asked for it.
+		return nil, fmt.Errorf("%w: wrong authorized party", ErrInvalidToken)
+	case claims.Subject == "":
+		return nil, fmt.Errorf("%w: missing subject", ErrInvalidToken)
+	case now.After(time.Unix(claims.Expiry, 0).Add(leeway)):
+		return nil, fmt.Errorf("%w: token expired", ErrInvalidToken)
+	case now.Add(leeway).Before(time.Unix(claims.IssuedAt, 0)):
+		return nil, fmt.Errorf("%w: token issued in the future", ErrInvalidToken)
+	case nonce == "" || claims.Nonce != nonce:
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrInvalidToken)
+	}
+
+	return &claims, nil
+}
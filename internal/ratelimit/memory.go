@@ -0,0 +1,80 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Memory is a Limiter which keeps its buckets in process memory. It's the
+// fastest backend, but if the application runs on more than one server then
+// each of them has its own buckets, and a client can make the limit's worth of
+// requests to every one of them.
+type Memory struct {
+	now func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+	// lastSweep is when we last removed the buckets which have refilled
+	// completely.
+	lastSweep time.Time
+}
+
+type memoryBucket struct {
+	bucket
+	fullAt time.Time
+}
+
+// NewMemory returns a new in-memory Limiter.
+func NewMemory() *Memory {
+	return &Memory{
+		now:     time.Now,
+		buckets: make(map[string]*memoryBucket),
+	}
+}
+
+// Allow implements the Limiter interface. It never returns an error.
+func (m *Memory) Allow(ctx context.Context, key string, limit Limit) (Result, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+
+	// Once a minute, forget about any buckets which have refilled. Otherwise
+	// the map would grow forever with clients which we've stopped seeing.
+	if now.Sub(m.lastSweep) > time.Minute {
+		for k, b := range m.buckets {
+			if now.After(b.fullAt) {
+				delete(m.buckets, k)
+			}
+		}
+		m.lastSweep = now
+	}
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &memoryBucket{bucket: newBucket(limit, now)}
+		m.buckets[key] = b
+	}
+
+	allowed := b.take(limit, now)
+	b.fullAt = b.bucket.fullAt(limit)
+
+	return b.result(limit, allowed), nil
+}
+
+// Peek implements the Limiter interface. It never returns an error.
+func (m *Memory) Peek(ctx context.Context, key string, limit Limit) (Result, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+
+	b := newBucket(limit, now)
+	if mb, ok := m.buckets[key]; ok {
+		b = mb.bucket
+	}
+	b.refill(limit, now)
+
+	return b.result(limit, b.tokens >= 1), nil
+}
@@ -0,0 +1,163 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/cedrickchee/skel/internal/route"
+)
+
+// The values for Policy.Key, which say what a policy's buckets are keyed by.
+// Requests which don't have the right kind of principal (for example,
+// anonymous requests to a route with a KeyUser policy) fall back to being
+// keyed by IP address.
+const (
+	KeyIP        = "ip"
+	KeyUser      = "user"
+	KeyAPIKey    = "apikey"
+	KeyPrincipal = "principal"
+)
+
+// Policy is a rate limit for the requests which match a method and route
+// pattern.
+type Policy struct {
+	// Name identifies the policy's buckets, so that two policies never share
+	// a bucket. It defaults to the method and pattern.
+	Name string `json:"name"`
+	// Method is the HTTP method to match, or empty to match every method.
+	Method string `json:"method"`
+	// Pattern is a route pattern in the same syntax as our router, like
+	// "/v1/movies/:id". See route.Match for the details.
+	Pattern string `json:"pattern"`
+	// Key is one of KeyIP, KeyUser, KeyAPIKey or KeyPrincipal.
+	Key string `json:"key"`
+	// Rate is the number of requests allowed per unit of time, like "5/m".
+	// The units are s, m and h.
+	Rate  string `json:"rate"`
+	Burst int    `json:"burst"`
+
+	// Limit is calculated from Rate and Burst when the policy is loaded.
+	Limit Limit `json:"-"`
+}
+
+// LoadPolicies reads rate limit policies from a JSON file in the format:
+//
+//	{
+//		"policies": [
+//			{"method": "POST", "pattern": "/v1/tokens/authentication", "key": "ip", "rate": "5/m", "burst": 5},
+//			{"pattern": "/v1/movies", "key": "user", "rate": "50/s", "burst": 100}
+//		]
+//	}
+//
+// The policies are returned in the same order as in the file, which is the
+// order in which they should be matched.
+func LoadPolicies(path string) ([]*Policy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var cfg struct {
+		Policies []*Policy `json:"policies"`
+	}
+
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+
+	err = dec.Decode(&cfg)
+	if err != nil {
+		return nil, fmt.Errorf("ratelimit: parsing %s: %w", path, err)
+	}
+
+	// Policies with the same name would share their buckets, so each name
+	// must only be used once.
+	names := make(map[string]bool)
+
+	for i, p := range cfg.Policies {
+		err := p.init()
+		if err != nil {
+			return nil, fmt.Errorf("ratelimit: policy %d in %s: %w", i+1, path, err)
+		}
+
+		if names[p.Name] {
+			return nil, fmt.Errorf("ratelimit: policy %d in %s: duplicate name %q", i+1, path, p.Name)
+		}
+		names[p.Name] = true
+	}
+
+	return cfg.Policies, nil
+}
+
+// init validates the policy, fills in its defaults and calculates its Limit.
+func (p *Policy) init() error {
+	if !strings.HasPrefix(p.Pattern, "/") {
+		return errors.New("pattern must start with /")
+	}
+
+	p.Method = strings.ToUpper(p.Method)
+
+	if p.Name == "" {
+		p.Name = strings.TrimSpace(p.Method + " " + p.Pattern)
+	}
+
+	switch p.Key {
+	case "":
+		p.Key = KeyIP
+	case KeyIP, KeyUser, KeyAPIKey, KeyPrincipal:
+	default:
+		return fmt.Errorf("unknown key %q", p.Key)
+	}
+
+	rate, err := ParseRate(p.Rate)
+	if err != nil {
+		return err
+	}
+
+	if p.Burst < 1 {
+		return errors.New("burst must be at least 1")
+	}
+
+	p.Limit = Limit{Rate: rate, Burst: p.Burst}
+
+	return nil
+}
+
+// ParseRate parses a rate like "5/m" or "0.5/s", and returns it in requests
+// per second.
+func ParseRate(s string) (float64, error) {
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid rate %q: must be like 5/s, 5/m or 5/h", s)
+	}
+
+	n, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid rate %q: must be a positive number of requests", s)
+	}
+
+	switch parts[1] {
+	case "s":
+		return n, nil
+	case "m":
+		return n / 60, nil
+	case "h":
+		return n / 3600, nil
+	default:
+		return 0, fmt.Errorf("invalid rate %q: unit must be s, m or h", s)
+	}
+}
+
+// Matches reports whether a request with the given method and URL path is
+// covered by the policy.
+func (p *Policy) Matches(method, path string) bool {
+	if p.Method != "" && p.Method != method {
+		return false
+	}
+
+	return route.Match(p.Pattern, path)
+}
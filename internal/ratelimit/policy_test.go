@@ -0,0 +1,133 @@
+package ratelimit
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		rate    string
+		want    float64
+		wantErr bool
+	}{
+		{rate: "50/s", want: 50},
+		{rate: "6/m", want: 0.1},
+		{rate: "0.5/s", want: 0.5},
+		{rate: "36/h", want: 0.01},
+		{rate: "5", wantErr: true},
+		{rate: "5/d", wantErr: true},
+		{rate: "-1/s", wantErr: true},
+		{rate: "x/s", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.rate, func(t *testing.T) {
+			got, err := ParseRate(tt.rate)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("want error; got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("want %v; got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestPolicyMatches(t *testing.T) {
+	tests := []struct {
+		method  string
+		pattern string
+		reqPath string
+		reqVerb string
+		want    bool
+	}{
+		{"POST", "/v1/tokens/authentication", "/v1/tokens/authentication", "POST", true},
+		{"POST", "/v1/tokens/authentication", "/v1/tokens/authentication", "GET", false},
+		{"", "/v1/movies", "/v1/movies", "GET", true},
+		{"", "/v1/movies", "/v1/movies/1", "GET", false},
+		{"", "/v1/movies/:id", "/v1/movies/1", "PATCH", true},
+		{"", "/v1/movies/:id", "/v1/movies", "GET", false},
+		{"", "/v1/roles/:name/users/:id", "/v1/roles/admin/users/3", "PUT", true},
+		{"", "/v1/*path", "/v1/movies/1", "GET", true},
+		{"", "/debug/*path", "/v1/movies", "GET", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.reqVerb+" "+tt.reqPath+" "+tt.pattern, func(t *testing.T) {
+			p := &Policy{Method: tt.method, Pattern: tt.pattern}
+
+			if got := p.Matches(tt.reqVerb, tt.reqPath); got != tt.want {
+				t.Errorf("want %v; got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestLoadPolicies(t *testing.T) {
+	write := func(t *testing.T, contents string) string {
+		t.Helper()
+
+		path := filepath.Join(t.TempDir(), "policies.json")
+		err := ioutil.WriteFile(path, []byte(contents), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	t.Run("Valid", func(t *testing.T) {
+		path := write(t, `{"policies": [
+			{"method": "post", "pattern": "/v1/tokens/authentication", "rate": "5/m", "burst": 5},
+			{"name": "movies", "pattern": "/v1/movies", "key": "user", "rate": "50/s", "burst": 100}
+		]}`)
+
+		policies, err := LoadPolicies(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(policies) != 2 {
+			t.Fatalf("want 2 policies; got %d", len(policies))
+		}
+
+		login := policies[0]
+		if login.Name != "POST /v1/tokens/authentication" || login.Key != KeyIP || login.Limit != (Limit{Rate: 5.0 / 60, Burst: 5}) {
+			t.Errorf("unexpected policy %+v", login)
+		}
+
+		movies := policies[1]
+		if movies.Name != "movies" || movies.Key != KeyUser || movies.Limit != (Limit{Rate: 50, Burst: 100}) {
+			t.Errorf("unexpected policy %+v", movies)
+		}
+	})
+
+	for name, contents := range map[string]string{
+		"Unknown key":   `{"policies": [{"pattern": "/", "key": "email", "rate": "1/s", "burst": 1}]}`,
+		"Missing burst": `{"policies": [{"pattern": "/", "rate": "1/s"}]}`,
+		"Bad rate":      `{"policies": [{"pattern": "/", "rate": "fast", "burst": 1}]}`,
+		"Bad pattern":   `{"policies": [{"pattern": "v1", "rate": "1/s", "burst": 1}]}`,
+		"Unknown field": `{"policies": [{"pattern": "/", "rate": "1/s", "burst": 1, "burts": 2}]}`,
+		"Duplicate name": `{"policies": [
+			{"name": "api", "pattern": "/v1/movies", "rate": "1/s", "burst": 1},
+			{"name": "api", "pattern": "/v1/roles", "rate": "1/s", "burst": 1}
+		]}`,
+		"Duplicate default name": `{"policies": [
+			{"method": "GET", "pattern": "/v1/movies", "rate": "1/s", "burst": 1},
+			{"method": "get", "pattern": "/v1/movies", "key": "user", "rate": "1/s", "burst": 1}
+		]}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := LoadPolicies(write(t, contents))
+			if err == nil {
+				t.Error("want error")
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package ratelimit
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Postgres is a Limiter which keeps its buckets in the rate_limit_buckets
+// table, so that every instance of the application sharing the database also
+// shares the same limits.
+//
+// Each call to Allow() runs a short transaction which locks the key's row with
+// SELECT ... FOR UPDATE. Concurrent requests for the same key therefore queue
+// up behind each other and can never take the same token twice, while
+// requests for different keys don't block each other at all. The current time
+// always comes from the database, so that servers with slightly different
+// clocks agree on how full each bucket is.
+//
+// Buckets which have refilled completely are no different from having no row
+// at all, so Start() runs a sweeper in the background which deletes them.
+type Postgres struct {
+	DB *sql.DB
+	// Timeout is the maximum time that a single call to Allow() may take.
+	Timeout time.Duration
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewPostgres returns a new Limiter backed by the given database.
+func NewPostgres(db *sql.DB) *Postgres {
+	return &Postgres{
+		DB:      db,
+		Timeout: time.Second,
+	}
+}
+
+// Allow implements the Limiter interface.
+func (p *Postgres) Allow(ctx context.Context, key string, limit Limit) (Result, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.Timeout)
+	defer cancel()
+
+	tx, err := p.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return Result{}, err
+	}
+	defer tx.Rollback()
+
+	// Create a full bucket if this is the first time we've seen the key. If
+	// another transaction gets there first, ON CONFLICT DO NOTHING makes this
+	// a no-op and we'll use their row instead.
+	query := `
+		INSERT INTO rate_limit_buckets (key, tokens, updated_at, full_at)
+		VALUES ($1, $2, clock_timestamp(), clock_timestamp())
+		ON CONFLICT DO NOTHING`
+
+	_, err = tx.ExecContext(ctx, query, key, limit.Burst)
+	if err != nil {
+		return Result{}, err
+	}
+
+	// Lock the row, and read the clock only once we hold the lock. Using
+	// clock_timestamp() rather than now() matters here, because now() is the
+	// time at which the transaction started, which may be long before we got
+	// the lock.
+	query = `
+		SELECT tokens, updated_at, clock_timestamp()
+		FROM rate_limit_buckets
+		WHERE key = $1
+		FOR UPDATE`
+
+	var b bucket
+	var now time.Time
+
+	err = tx.QueryRowContext(ctx, query, key).Scan(&b.tokens, &b.updated, &now)
+	if err != nil {
+		return Result{}, err
+	}
+
+	allowed := b.take(limit, now)
+
+	query = `
+		UPDATE rate_limit_buckets
+		SET tokens = $2, updated_at = $3, full_at = $4
+		WHERE key = $1`
+
+	_, err = tx.ExecContext(ctx, query, key, b.tokens, b.updated, b.fullAt(limit))
+	if err != nil {
+		return Result{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return Result{}, err
+	}
+
+	return b.result(limit, allowed), nil
+}
+
+// Peek implements the Limiter interface. It doesn't lock the key's row, so a
+// concurrent call to Allow() may take the last token straight afterwards.
+func (p *Postgres) Peek(ctx context.Context, key string, limit Limit) (Result, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.Timeout)
+	defer cancel()
+
+	query := `
+		SELECT tokens, updated_at, clock_timestamp()
+		FROM rate_limit_buckets
+		WHERE key = $1`
+
+	var b bucket
+	var now time.Time
+
+	err := p.DB.QueryRowContext(ctx, query, key).Scan(&b.tokens, &b.updated, &now)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		// A key without a row has a full bucket.
+		now = time.Now()
+		b = newBucket(limit, now)
+	case err != nil:
+		return Result{}, err
+	}
+	b.refill(limit, now)
+
+	return b.result(limit, b.tokens >= 1), nil
+}
+
+// Start deletes the buckets which have refilled completely every interval,
+// until Stop() is called. The sweeps are kept off the request path, so that a
+// slow one can't use up the time that Allow() has.
+func (p *Postgres) Start(interval time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+	p.done = make(chan struct{})
+
+	go func() {
+		defer close(p.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				// Errors are ignored, since the rows will just be deleted
+				// next time instead.
+				sweepCtx, cancel := context.WithTimeout(ctx, interval)
+				p.Sweep(sweepCtx)
+				cancel()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the sweeper, abandoning any sweep in progress, and waits for it
+// to finish or for ctx to be done. It's safe to call if Start() wasn't.
+func (p *Postgres) Stop(ctx context.Context) error {
+	if p.cancel == nil {
+		return nil
+	}
+
+	p.cancel()
+
+	select {
+	case <-p.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Sweep deletes the buckets which have refilled completely, and returns how
+// many there were.
+func (p *Postgres) Sweep(ctx context.Context) (int64, error) {
+	result, err := p.DB.ExecContext(ctx, `DELETE FROM rate_limit_buckets WHERE full_at < clock_timestamp()`)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
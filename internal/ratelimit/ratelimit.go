@@ -0,0 +1,119 @@
+// Package ratelimit provides token bucket rate limiters, with interchangeable
+// backends. The in-memory backend is fast but only limits requests to a single
+// process, while the Postgres backend shares its buckets between every
+// instance of the application that uses the same database.
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// Limit describes a token bucket. The bucket holds at most Burst tokens, and
+// refills at Rate tokens per second. Every request takes one token.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// Result describes the outcome of a call to Limiter.Allow(), along with the
+// state of the bucket afterwards, which clients can use to pace themselves.
+type Result struct {
+	// Allowed reports whether the request may go ahead.
+	Allowed bool
+	// Limit is the most requests that can be made in a burst.
+	Limit int
+	// Remaining is the number of requests that can be made right now.
+	Remaining int
+	// Reset is how long it will take the bucket to refill completely.
+	Reset time.Duration
+	// RetryAfter is how long the client must wait before the next request
+	// will be allowed. It's zero if Remaining is at least one.
+	RetryAfter time.Duration
+}
+
+// Limiter is implemented by each of the rate limiter backends.
+type Limiter interface {
+	// Allow reports whether a request identified by key is allowed under the
+	// given limit, and takes a token from the key's bucket if it is.
+	Allow(ctx context.Context, key string, limit Limit) (Result, error)
+	// Peek reports whether a request identified by key would be allowed, and
+	// the state of the bucket, without taking a token.
+	Peek(ctx context.Context, key string, limit Limit) (Result, error)
+}
+
+// bucket is the state of a single token bucket. A bucket which has never been
+// used is full.
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// newBucket returns a full bucket for the given limit.
+func newBucket(limit Limit, now time.Time) bucket {
+	return bucket{tokens: float64(limit.Burst), updated: now}
+}
+
+// refill adds the tokens for the time that has passed since the bucket was
+// last updated.
+func (b *bucket) refill(limit Limit, now time.Time) {
+	// Never go backwards if the clock does. This matters for the Postgres
+	// backend, where two transactions may read the clock in a different order
+	// from the one in which they lock the row.
+	if elapsed := now.Sub(b.updated); elapsed > 0 {
+		b.tokens = math.Min(float64(limit.Burst), b.tokens+elapsed.Seconds()*limit.Rate)
+		b.updated = now
+	}
+}
+
+// take refills the bucket, and then takes a token if there is one. It reports
+// whether a token was taken.
+func (b *bucket) take(limit Limit, now time.Time) bool {
+	b.refill(limit, now)
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// fullAt returns the time at which the bucket will be full again. After that,
+// the bucket is the same as one that has never been used, so it can be
+// forgotten.
+func (b *bucket) fullAt(limit Limit) time.Time {
+	missing := float64(limit.Burst) - b.tokens
+
+	switch {
+	case missing <= 0:
+		return b.updated
+	case limit.Rate <= 0:
+		// A bucket which never refills must never be forgotten either.
+		return time.Unix(math.MaxInt32, 0)
+	}
+
+	return b.updated.Add(time.Duration(missing / limit.Rate * float64(time.Second)))
+}
+
+// result returns the Result for a request which has just been checked against
+// the bucket.
+func (b *bucket) result(limit Limit, allowed bool) Result {
+	res := Result{
+		Allowed:   allowed,
+		Limit:     limit.Burst,
+		Remaining: int(math.Floor(b.tokens)),
+		Reset:     b.fullAt(limit).Sub(b.updated),
+	}
+
+	if b.tokens < 1 {
+		if limit.Rate > 0 {
+			res.RetryAfter = time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+		} else {
+			res.RetryAfter = res.Reset
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,253 @@
+package ratelimit
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+func TestBucket(t *testing.T) {
+	limit := Limit{Rate: 2, Burst: 3}
+	now := time.Now()
+
+	b := newBucket(limit, now)
+
+	// A new bucket allows a burst of requests, and then refuses the next one.
+	for i := 0; i < 3; i++ {
+		if !b.take(limit, now) {
+			t.Fatalf("want request %d to be allowed", i+1)
+		}
+	}
+	if b.take(limit, now) {
+		t.Fatal("want request to be refused once the bucket is empty")
+	}
+
+	// At 2 tokens per second, one more token is available after half a
+	// second.
+	now = now.Add(500 * time.Millisecond)
+	if !b.take(limit, now) {
+		t.Fatal("want request to be allowed after refilling")
+	}
+	if b.take(limit, now) {
+		t.Fatal("want request to be refused")
+	}
+
+	// The bucket is full again after 1.5 seconds, and never holds more than
+	// the burst.
+	if got, want := b.fullAt(limit), now.Add(1500*time.Millisecond); !got.Equal(want) {
+		t.Errorf("want bucket to be full at %v; got %v", want, got)
+	}
+
+	b.take(limit, now.Add(time.Hour))
+	if b.tokens != float64(limit.Burst-1) {
+		t.Errorf("want %d tokens; got %v", limit.Burst-1, b.tokens)
+	}
+
+	// A clock going backwards must not add or remove tokens.
+	before := b.tokens
+	b.take(limit, now)
+	if b.tokens != before-1 {
+		t.Errorf("want %v tokens; got %v", before-1, b.tokens)
+	}
+}
+
+func TestBucketResult(t *testing.T) {
+	limit := Limit{Rate: 2, Burst: 3}
+	now := time.Now()
+
+	b := newBucket(limit, now)
+
+	tests := []struct {
+		name string
+		want Result
+	}{
+		{"First", Result{Allowed: true, Limit: 3, Remaining: 2, Reset: 500 * time.Millisecond}},
+		{"Second", Result{Allowed: true, Limit: 3, Remaining: 1, Reset: time.Second}},
+		{"Last", Result{Allowed: true, Limit: 3, Remaining: 0, Reset: 1500 * time.Millisecond, RetryAfter: 500 * time.Millisecond}},
+		{"Refused", Result{Allowed: false, Limit: 3, Remaining: 0, Reset: 1500 * time.Millisecond, RetryAfter: 500 * time.Millisecond}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowed := b.take(limit, now)
+
+			if got := b.result(limit, allowed); got != tt.want {
+				t.Errorf("want %+v; got %+v", tt.want, got)
+			}
+		})
+	}
+
+	// A quarter of a second later, half a token has come back.
+	now = now.Add(250 * time.Millisecond)
+	allowed := b.take(limit, now)
+
+	want := Result{Allowed: false, Limit: 3, Remaining: 0, Reset: 1250 * time.Millisecond, RetryAfter: 250 * time.Millisecond}
+	if got := b.result(limit, allowed); got != want {
+		t.Errorf("want %+v; got %+v", want, got)
+	}
+}
+
+// testConcurrentCallers makes many concurrent requests against a single key,
+// with a limit which doesn't refill during the test, and checks that exactly
+// the burst is allowed through.
+func testConcurrentCallers(t *testing.T, limiter Limiter, key string) {
+	t.Helper()
+
+	limit := Limit{Rate: 0.001, Burst: 10}
+
+	var (
+		wg      sync.WaitGroup
+		allowed int64
+		errs    int64
+	)
+
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			res, err := limiter.Allow(context.Background(), key, limit)
+			if err != nil {
+				t.Log(err)
+				atomic.AddInt64(&errs, 1)
+				return
+			}
+			if res.Allowed {
+				atomic.AddInt64(&allowed, 1)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if errs != 0 {
+		t.Fatalf("want no errors; got %d", errs)
+	}
+	if allowed != int64(limit.Burst) {
+		t.Errorf("want %d requests allowed; got %d", limit.Burst, allowed)
+	}
+
+	// Peek() sees the empty bucket, and doesn't take from a full one.
+	res, err := limiter.Peek(context.Background(), key, limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Allowed || res.Remaining != 0 {
+		t.Errorf("want an empty bucket; got %+v", res)
+	}
+	for i := 0; i < 2; i++ {
+		res, err = limiter.Peek(context.Background(), key+"-peek", limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !res.Allowed || res.Remaining != limit.Burst {
+			t.Errorf("want a full bucket; got %+v", res)
+		}
+	}
+
+	// Other keys have buckets of their own.
+	res, err = limiter.Allow(context.Background(), key+"-other", limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Allowed {
+		t.Error("want request for a different key to be allowed")
+	}
+}
+
+func TestMemory(t *testing.T) {
+	t.Run("Concurrent callers", func(t *testing.T) {
+		testConcurrentCallers(t, NewMemory(), "127.0.0.1")
+	})
+
+	t.Run("Sweep", func(t *testing.T) {
+		now := time.Now()
+
+		m := NewMemory()
+		m.now = func() time.Time { return now }
+
+		limit := Limit{Rate: 1, Burst: 1}
+		m.Allow(context.Background(), "a", limit)
+
+		// After two minutes the bucket has refilled, so the next call sweeps
+		// it away, leaving only the bucket for the new key.
+		now = now.Add(2 * time.Minute)
+		m.Allow(context.Background(), "b", limit)
+
+		if _, ok := m.buckets["a"]; ok || len(m.buckets) != 1 {
+			t.Errorf("want only bucket b to remain; got %d buckets", len(m.buckets))
+		}
+	})
+}
+
+// TestPostgres runs against a real database. Set SKEL_TEST_DB_DSN to the DSN
+// of a database that the test may create tables in to run it.
+func TestPostgres(t *testing.T) {
+	dsn := os.Getenv("SKEL_TEST_DB_DSN")
+	if dsn == "" || testing.Short() {
+		t.Skip("postgresql: SKEL_TEST_DB_DSN not set, skipping integration test")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Create the table from the migration, so that the test always uses the
+	// same schema as the application.
+	script, err := ioutil.ReadFile("../../migrations/000010_create_rate_limit_buckets.up.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(string(script))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Exec(`DELETE FROM rate_limit_buckets WHERE key LIKE 'test:%'`)
+
+	limiter := NewPostgres(db)
+	limiter.Timeout = 10 * time.Second
+
+	key := "test:" + time.Now().Format(time.RFC3339Nano)
+	testConcurrentCallers(t, limiter, key)
+
+	// Sweep() deletes the buckets which have refilled, and only those.
+	_, err = db.Exec(`
+		INSERT INTO rate_limit_buckets (key, tokens, updated_at, full_at)
+		VALUES ($1, 1, clock_timestamp(), clock_timestamp() - interval '1 second')`, key+":full")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := limiter.Sweep(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n < 1 {
+		t.Errorf("want the full bucket to be deleted; got %d deleted", n)
+	}
+
+	var remaining int
+	err = db.QueryRow(`SELECT count(*) FROM rate_limit_buckets WHERE key IN ($1, $1 || ':full')`, key).Scan(&remaining)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remaining != 1 {
+		t.Errorf("want 1 bucket left; got %d", remaining)
+	}
+}
+
+/*
+Run:
+
+$ go test -v -race github.com/cedrickchee/skel/internal/ratelimit
+$ SKEL_TEST_DB_DSN=postgres://... go test -v -run TestPostgres github.com/cedrickchee/skel/internal/ratelimit
+*/
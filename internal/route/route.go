@@ -0,0 +1,35 @@
+// Package route matches request paths against route patterns written in the
+// same syntax as our router, so that per-route settings (like rate limit and
+// CORS policies) can be configured without access to the router itself.
+package route
+
+import "strings"
+
+// Match reports whether path matches the pattern, like "/v1/movies/:id". A
+// ":name" segment matches any single non-empty path segment, and a final
+// "*name" segment matches the rest of the path. Otherwise the path must match
+// exactly.
+func Match(pattern, path string) bool {
+	parts := strings.Split(strings.Trim(pattern, "/"), "/")
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+
+	for i, part := range parts {
+		if strings.HasPrefix(part, "*") {
+			return true
+		}
+		if i >= len(segments) {
+			return false
+		}
+		if strings.HasPrefix(part, ":") {
+			if segments[i] == "" {
+				return false
+			}
+			continue
+		}
+		if part != segments[i] {
+			return false
+		}
+	}
+
+	return len(parts) == len(segments)
+}
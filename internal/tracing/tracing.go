@@ -0,0 +1,177 @@
+// Package tracing carries the identifiers which tie together everything that
+// happens because of a single request: the request ID, which is ours, and the
+// W3C Trace Context (https://www.w3.org/TR/trace-context/) trace and span IDs,
+// which are shared with the other services taking part in the same trace.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+// Context holds the identifiers for a request.
+type Context struct {
+	// RequestID identifies the request. It comes from the client's
+	// X-Request-ID header if there was a valid one, or is generated.
+	RequestID string
+	// TraceID identifies the whole trace, across every service.
+	TraceID string
+	// SpanID identifies our part of the trace, and ParentID the span of the
+	// caller, if the request had a traceparent header.
+	SpanID   string
+	ParentID string
+	// Flags are the trace flags, as two hex digits. "01" means that the
+	// caller is recording the trace.
+	Flags string
+}
+
+// Traceparent returns the value of the traceparent header which tells the
+// next service in the trace that this span is its parent.
+func (c Context) Traceparent() string {
+	return "00-" + c.TraceID + "-" + c.SpanID + "-" + c.Flags
+}
+
+// Properties returns the identifiers as jsonlog properties.
+func (c Context) Properties() map[string]string {
+	props := map[string]string{
+		"request_id": c.RequestID,
+		"trace_id":   c.TraceID,
+		"span_id":    c.SpanID,
+	}
+	if c.ParentID != "" {
+		props["parent_span_id"] = c.ParentID
+	}
+
+	return props
+}
+
+// New returns the Context for a request with the given X-Request-ID and
+// traceparent header values, either of which may be empty or invalid. Invalid
+// values are ignored rather than rejected, so that a misbehaving client or
+// proxy can't stop requests from being served.
+func New(requestID, traceparent string) Context {
+	c := Context{RequestID: requestID}
+
+	if !ValidRequestID(c.RequestID) {
+		c.RequestID = randomHex(16)
+	}
+
+	var ok bool
+	c.TraceID, c.ParentID, c.Flags, ok = ParseTraceparent(traceparent)
+	if !ok {
+		// Start a new trace, with this request at its root.
+		c.TraceID, c.ParentID, c.Flags = randomHex(16), "", "00"
+	}
+	c.SpanID = randomHex(8)
+
+	return c
+}
+
+// ValidRequestID reports whether a client supplied request ID is safe to use.
+// It must be between 1 and 128 characters long, and only contain letters,
+// digits and the punctuation commonly found in generated IDs, so that it
+// can't be used to inject anything into the logs.
+func ValidRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("-_.:+/=", c):
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// ParseTraceparent parses a traceparent header value like
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" and returns its
+// trace ID, parent span ID and flags.
+func ParseTraceparent(s string) (traceID, parentID, flags string, ok bool) {
+	s = strings.TrimSpace(s)
+
+	// Later versions of the format may add fields on the end, but the first
+	// four are always the same. Version ff is never valid.
+	if len(s) < 55 || (len(s) > 55 && s[55] != '-') {
+		return "", "", "", false
+	}
+
+	version := s[0:2]
+	if !isHex(version) || version == "ff" || (version == "00" && len(s) != 55) {
+		return "", "", "", false
+	}
+
+	if s[2] != '-' || s[35] != '-' || s[52] != '-' {
+		return "", "", "", false
+	}
+
+	traceID, parentID, flags = s[3:35], s[36:52], s[53:55]
+	if !isHex(traceID) || !isHex(parentID) || !isHex(flags) {
+		return "", "", "", false
+	}
+
+	// All zero IDs are invalid.
+	if strings.Trim(traceID, "0") == "" || strings.Trim(parentID, "0") == "" {
+		return "", "", "", false
+	}
+
+	return traceID, parentID, flags, true
+}
+
+// isHex reports whether s is made up of lower case hex digits only.
+func isHex(s string) bool {
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// randomHex returns n random bytes, hex encoded.
+func randomHex(n int) string {
+	b := make([]byte, n)
+
+	// If crypto/rand fails, the system is in such a bad way that we have
+	// bigger problems than a predictable ID, so carry on regardless.
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx which carries the given identifiers.
+func NewContext(ctx context.Context, c Context) context.Context {
+	return context.WithValue(ctx, contextKey{}, c)
+}
+
+// FromContext returns the identifiers carried by ctx, if it has any.
+func FromContext(ctx context.Context) (Context, bool) {
+	c, ok := ctx.Value(contextKey{}).(Context)
+	return c, ok
+}
+
+// Detach returns a context which carries the same values as ctx, but is never
+// cancelled and has no deadline. It's for work which outlives the request
+// that started it, like sending an email after the response has gone, but
+// which should still be traced back to that request.
+func Detach(ctx context.Context) context.Context {
+	return detached{ctx}
+}
+
+type detached struct {
+	parent context.Context
+}
+
+func (detached) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detached) Done() <-chan struct{}               { return nil }
+func (detached) Err() error                          { return nil }
+func (d detached) Value(key interface{}) interface{} { return d.parent.Value(key) }
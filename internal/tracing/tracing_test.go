@@ -0,0 +1,106 @@
+package tracing
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		ok    bool
+	}{
+		{"Valid", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true},
+		{"Surrounding space", " 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00 ", true},
+		{"Future version", "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true},
+		{"Version 00 with extra fields", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false},
+		{"Version ff", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false},
+		{"Upper case", "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false},
+		{"Zero trace ID", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", false},
+		{"Zero parent ID", "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false},
+		{"Short", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-1", false},
+		{"Bad separator", "00_4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false},
+		{"Empty", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			traceID, parentID, flags, ok := ParseTraceparent(tt.value)
+			if ok != tt.ok {
+				t.Fatalf("want ok %v; got %v", tt.ok, ok)
+			}
+			if ok && (traceID != "4bf92f3577b34da6a3ce929d0e0e4736" || parentID != "00f067aa0ba902b7" || len(flags) != 2) {
+				t.Errorf("unexpected result %q %q %q", traceID, parentID, flags)
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	t.Run("From headers", func(t *testing.T) {
+		c := New("abc-123", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+		if c.RequestID != "abc-123" || c.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || c.ParentID != "00f067aa0ba902b7" || c.Flags != "01" {
+			t.Errorf("unexpected context %+v", c)
+		}
+
+		// We're a new span in the caller's trace.
+		if len(c.SpanID) != 16 || c.SpanID == c.ParentID {
+			t.Errorf("want a new span ID; got %q", c.SpanID)
+		}
+		if !strings.HasPrefix(c.Traceparent(), "00-4bf92f3577b34da6a3ce929d0e0e4736-"+c.SpanID) {
+			t.Errorf("unexpected traceparent %q", c.Traceparent())
+		}
+	})
+
+	t.Run("Generated", func(t *testing.T) {
+		c := New("bad id\n", "garbage")
+
+		if len(c.RequestID) != 32 || len(c.TraceID) != 32 || len(c.SpanID) != 16 || c.ParentID != "" {
+			t.Errorf("unexpected context %+v", c)
+		}
+		if _, _, _, ok := ParseTraceparent(c.Traceparent()); !ok {
+			t.Errorf("want a valid traceparent; got %q", c.Traceparent())
+		}
+	})
+}
+
+func TestValidRequestID(t *testing.T) {
+	for id, want := range map[string]bool{
+		"abc-123":                              true,
+		"f47ac10b-58cc-4372-a567-0e02b2c3d479": true,
+		"dGVzdA==":                             true,
+		"":                                     false,
+		"has space":                            false,
+		"new\nline":                            false,
+		`"quoted"`:                             false,
+		strings.Repeat("a", 129):               false,
+	} {
+		if got := ValidRequestID(id); got != want {
+			t.Errorf("%q: want %v; got %v", id, want, got)
+		}
+	}
+}
+
+func TestDetach(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	ctx = NewContext(ctx, Context{RequestID: "abc-123"})
+
+	detached := Detach(ctx)
+	cancel()
+
+	if detached.Err() != nil {
+		t.Errorf("want detached context not to be cancelled; got %v", detached.Err())
+	}
+	if _, ok := detached.Deadline(); ok {
+		t.Error("want detached context to have no deadline")
+	}
+
+	c, ok := FromContext(detached)
+	if !ok || c.RequestID != "abc-123" {
+		t.Errorf("want detached context to keep its values; got %+v", c)
+	}
+}
@@ -0,0 +1,37 @@
+CREATE TABLE IF NOT EXISTS roles (
+    id bigserial PRIMARY KEY,
+    name text UNIQUE NOT NULL,
+    parent_id bigint REFERENCES roles ON DELETE RESTRICT
+);
+
+CREATE TABLE IF NOT EXISTS roles_permissions (
+    role_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE,
+    permission_id bigint NOT NULL REFERENCES permissions ON DELETE CASCADE,
+    PRIMARY KEY (role_id, permission_id)
+);
+
+CREATE TABLE IF NOT EXISTS users_roles (
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    role_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE,
+    PRIMARY KEY (user_id, role_id)
+);
+
+-- Add the permissions needed to manage roles.
+INSERT INTO permissions (code)
+VALUES
+    ('roles:read'),
+    ('roles:write');
+
+-- Add the built-in roles. Each role inherits the permissions of its parent, so
+-- an admin can do everything an editor can, and an editor everything a viewer
+-- can.
+INSERT INTO roles (name) VALUES ('viewer');
+INSERT INTO roles (name, parent_id) SELECT 'editor', id FROM roles WHERE name = 'viewer';
+INSERT INTO roles (name, parent_id) SELECT 'admin', id FROM roles WHERE name = 'editor';
+
+INSERT INTO roles_permissions
+SELECT roles.id, permissions.id
+FROM roles, permissions
+WHERE (roles.name = 'viewer' AND permissions.code = 'movies:read')
+OR (roles.name = 'editor' AND permissions.code = 'movies:write')
+OR (roles.name = 'admin' AND permissions.code IN ('roles:read', 'roles:write'));
@@ -0,0 +1,12 @@
+-- Record the user who created each movie. Existing movies have no owner, so
+-- from now on only users with the movies:write:any permission can edit them.
+ALTER TABLE movies ADD COLUMN created_by bigint REFERENCES users ON DELETE SET NULL;
+
+INSERT INTO permissions (code)
+VALUES
+    ('movies:write:any');
+
+INSERT INTO roles_permissions
+SELECT roles.id, permissions.id
+FROM roles, permissions
+WHERE roles.name = 'admin' AND permissions.code = 'movies:write:any';
@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS service_clients_permissions;
+DROP TABLE IF EXISTS api_keys;
+DROP TABLE IF EXISTS service_clients;
+
+DELETE FROM permissions WHERE code = 'clients:write';
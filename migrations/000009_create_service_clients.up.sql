@@ -0,0 +1,33 @@
+CREATE TABLE IF NOT EXISTS service_clients (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    name text UNIQUE NOT NULL
+);
+
+-- The prefix is stored in plain text so that we can find a key without
+-- scanning the whole table, but the full key is only ever stored as a SHA-256
+-- hash.
+CREATE TABLE IF NOT EXISTS api_keys (
+    id bigserial PRIMARY KEY,
+    client_id bigint NOT NULL REFERENCES service_clients ON DELETE CASCADE,
+    prefix text UNIQUE NOT NULL,
+    hash bytea NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS api_keys_client_id_idx ON api_keys (client_id);
+
+CREATE TABLE IF NOT EXISTS service_clients_permissions (
+    client_id bigint NOT NULL REFERENCES service_clients ON DELETE CASCADE,
+    permission_id bigint NOT NULL REFERENCES permissions ON DELETE CASCADE,
+    PRIMARY KEY (client_id, permission_id)
+);
+
+-- Add the permission needed to manage service clients, and give it to admins.
+INSERT INTO permissions (code)
+VALUES ('clients:write');
+
+INSERT INTO roles_permissions
+SELECT roles.id, permissions.id
+FROM roles, permissions
+WHERE roles.name = 'admin' AND permissions.code = 'clients:write';
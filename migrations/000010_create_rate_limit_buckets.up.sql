@@ -0,0 +1,11 @@
+-- Token buckets for the Postgres rate limiter backend. full_at is the time at
+-- which the bucket will have refilled completely, after which the row holds no
+-- information and can be deleted.
+CREATE TABLE IF NOT EXISTS rate_limit_buckets (
+    key text PRIMARY KEY,
+    tokens double precision NOT NULL,
+    updated_at timestamp with time zone NOT NULL,
+    full_at timestamp with time zone NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS rate_limit_buckets_full_at_idx ON rate_limit_buckets (full_at);
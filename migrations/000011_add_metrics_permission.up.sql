@@ -0,0 +1,10 @@
+-- Add the permission needed to scrape /metrics, and give it to admins. The
+-- Prometheus server itself should use a service client with just this
+-- permission.
+INSERT INTO permissions (code)
+VALUES ('metrics:read');
+
+INSERT INTO roles_permissions
+SELECT roles.id, permissions.id
+FROM roles, permissions
+WHERE roles.name = 'admin' AND permissions.code = 'metrics:read';
@@ -0,0 +1,23 @@
+-- Background jobs, like sending emails. A job is 'pending' until a worker
+-- claims it, when it becomes 'running' until locked_until. If the worker
+-- doesn't finish it by then (because it crashed, say), another worker can
+-- claim it again. Finished jobs are deleted, and jobs which have failed too
+-- many times are kept as 'dead' so that they can be looked into.
+CREATE TABLE IF NOT EXISTS jobs (
+    id bigserial PRIMARY KEY,
+    kind text NOT NULL,
+    payload jsonb NOT NULL,
+    status text NOT NULL DEFAULT 'pending',
+    attempts integer NOT NULL DEFAULT 0,
+    max_attempts integer NOT NULL,
+    run_at timestamp with time zone NOT NULL DEFAULT NOW(),
+    locked_until timestamp with time zone,
+    last_error text NOT NULL DEFAULT '',
+    request_id text NOT NULL DEFAULT '',
+    traceparent text NOT NULL DEFAULT '',
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    CONSTRAINT jobs_status_check CHECK (status IN ('pending', 'running', 'dead'))
+);
+
+CREATE INDEX IF NOT EXISTS jobs_pending_idx ON jobs (run_at) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS jobs_running_idx ON jobs (locked_until) WHERE status = 'running';
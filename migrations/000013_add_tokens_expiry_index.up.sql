@@ -0,0 +1,2 @@
+-- Lets the token sweeper find expired tokens without scanning the table.
+CREATE INDEX IF NOT EXISTS tokens_expiry_idx ON tokens (expiry);
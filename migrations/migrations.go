@@ -0,0 +1,14 @@
+// Package migrations embeds the SQL migration files, so that the api binary
+// can migrate the database itself (see internal/migrate) without the files
+// having to be shipped alongside it.
+//
+// Files are named like golang-migrate expects, NNNNNN_title.up.sql and
+// NNNNNN_title.down.sql, so `make db/migrations/new` still works.
+package migrations
+
+import "embed"
+
+// FS holds the migration files.
+//
+//go:embed *.sql
+var FS embed.FS